@@ -2,8 +2,10 @@ package constants
 
 import (
 	"bytes"
+	"math"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -20,6 +22,10 @@ const (
 type Request struct {
 	Data      []byte
 	RequestId uuid.UUID
+	// Connection the request was received on
+	Conn net.Conn
+	// Set for data received on the replication link
+	FromMaster bool
 }
 
 type ExecuteCommandRequest struct {
@@ -27,6 +33,10 @@ type ExecuteCommandRequest struct {
 	RequestId      uuid.UUID
 	Args           []DataRepr
 	DecodedRequest DataRepr
+	// Connection the request was received on, nil for commands which weren't sent by a client
+	Conn net.Conn
+	// Commands from the master are applied even where other clients are restricted
+	FromMaster bool
 }
 
 // Parser constants
@@ -39,38 +49,128 @@ const (
 	ARRAY    = '*'
 	ERROR    = '-'
 	RDB_FILE = 'f'
+	// RESP3 types, which are downgraded to RESP2 ones for clients which didn't switch protocol with HELLO
+	NULL       = '_'
+	DOUBLE     = ','
+	BOOLEAN    = '#'
+	BLOB_ERROR = '!'
+	VERBATIM   = '='
+	BIG_NUMBER = '('
+	MAP        = '%'
+	SET        = '~'
+	ATTRIBUTE  = '|'
+	PUSH       = '>'
 )
 
+// DataRepr is a RESP value. Maps hold their keys and values alternately in Array, verbatim strings keep their
+// format as a prefix of Data, like txt:<text>, and Attributes holds the attribute sent before a value, if any
 type DataRepr struct {
-	Type  DataType
-	Data  []byte
-	Array []DataRepr
+	Type       DataType
+	Data       []byte
+	Array      []DataRepr
+	Attributes []DataRepr
 }
 
+// RESP protocol versions, set per connection with HELLO
+const (
+	RESP2_PROTOCOL = 2
+	RESP3_PROTOCOL = 3
+	// Verbatim strings start with their 3 characters format and a colon
+	VERBATIM_FORMAT_LENGTH = 3
+	VERBATIM_TEXT_FORMAT   = "txt"
+	BOOLEAN_TRUE           = "t"
+	BOOLEAN_FALSE          = "f"
+)
+
 const (
 	CRLF = "\r\n"
 )
 
 // Command Constants
 const (
-	PING_COMMAND     = "PING"
-	ECHO_COMMAND     = "ECHO"
-	GET_COMMAND      = "GET"
-	SET_COMMAND      = "SET"
-	INFO_COMMAND     = "INFO"
-	REPLCONF_COMMAND = "REPLCONF"
-	PSYNC_COMMAND    = "PSYNC"
-	WAIT_COMMAND     = "WAIT"
-	CONFIG_COMMAND   = "CONFIG"
-	KEYS_COMMAND     = "KEYS"
-	TYPE_COMMAND     = "TYPE"
-	XADD_COMMAND     = "XADD"
+	PING_COMMAND        = "PING"
+	ECHO_COMMAND        = "ECHO"
+	GET_COMMAND         = "GET"
+	SET_COMMAND         = "SET"
+	INFO_COMMAND        = "INFO"
+	REPLCONF_COMMAND    = "REPLCONF"
+	PSYNC_COMMAND       = "PSYNC"
+	WAIT_COMMAND        = "WAIT"
+	CONFIG_COMMAND      = "CONFIG"
+	KEYS_COMMAND        = "KEYS"
+	TYPE_COMMAND        = "TYPE"
+	XADD_COMMAND        = "XADD"
+	DEL_COMMAND         = "DEL"
+	REPLICAOF_COMMAND   = "REPLICAOF"
+	SLAVEOF_COMMAND     = "SLAVEOF"
+	FAILOVER_COMMAND    = "FAILOVER"
+	SUBSCRIBE_COMMAND   = "SUBSCRIBE"
+	UNSUBSCRIBE_COMMAND = "UNSUBSCRIBE"
+	PUBLISH_COMMAND     = "PUBLISH"
+	SENTINEL_COMMAND    = "SENTINEL"
+	CLUSTER_COMMAND     = "CLUSTER"
+	ASKING_COMMAND      = "ASKING"
+	DUMP_COMMAND        = "DUMP"
+	RESTORE_COMMAND     = "RESTORE"
+	MIGRATE_COMMAND     = "MIGRATE"
+	// RESTORE sent by MIGRATE to a cluster node, which serves it even for a slot it is only importing
+	RESTORE_ASKING_COMMAND = "RESTORE-ASKING"
+
+	BGREWRITEAOF_COMMAND = "BGREWRITEAOF"
+	HELLO_COMMAND        = "HELLO"
+)
+
+// Command flags, describing what a command does in the command table
+type CommandFlags uint
+
+const (
+	// Modifies the dataset, so it is propagated to replicas and the AOF
+	CMD_FLAG_WRITE CommandFlags = 1 << iota
+	// Only reads the dataset
+	CMD_FLAG_READONLY
+	// Administers the server rather than touching the dataset
+	CMD_FLAG_ADMIN
+	// Allowed on a replica whose master link is down, even when it does not serve stale data
+	CMD_FLAG_STALE
+	// Served by a cluster node importing the slot of its keys, as if the client had sent ASKING
+	CMD_FLAG_ASKING
 )
 
 const (
 	PONG_RESPONSE       = "PONG"
 	OK_RESPONSE         = "OK"
 	FULLRESYNC_RESPONSE = "FULLRESYNC"
+	CONTINUE_RESPONSE   = "CONTINUE"
+	NOKEY_RESPONSE      = "NOKEY"
+
+	ALREADY_CONNECTED_RESPONSE = "OK Already connected to specified master"
+	READONLY_ERROR             = "READONLY You can't write against a read only replica."
+	MASTERDOWN_ERROR           = "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."
+	NOREPLICAS_ERROR           = "NOREPLICAS Not enough good replicas to write."
+	NOMASTERLINK_ERROR         = "NOMASTERLINK Can't SYNC while not connected with my master"
+	CROSSSLOT_ERROR            = "CROSSSLOT Keys in request don't hash to the same slot"
+	CLUSTERDOWN_UNBOUND_ERROR  = "CLUSTERDOWN Hash slot not served"
+	CLUSTERDOWN_STATE_ERROR    = "CLUSTERDOWN The cluster is down"
+	TRYAGAIN_ERROR             = "TRYAGAIN Multiple keys request during rehashing of slot"
+	BUSYKEY_ERROR              = "BUSYKEY Target key name already exists."
+	IOERR_ERROR                = "IOERR error or timeout talking to target instance"
+	NOPROTO_ERROR              = "NOPROTO unsupported protocol version"
+	WRONGPASS_ERROR            = "WRONGPASS invalid username-password pair or user is disabled."
+	NOT_INTEGER_ERROR          = "value is not an integer or out of range"
+	INVALID_SET_EXPIRE_ERROR   = "invalid expire time in 'set' command"
+	// Protocol errors in client requests, after which the connection is closed
+	UNBALANCED_QUOTES_ERROR        = "Protocol error: unbalanced quotes in request"
+	TOO_BIG_INLINE_REQUEST_ERROR   = "Protocol error: too big inline request"
+	TOO_BIG_MULTIBULK_COUNT_ERROR  = "Protocol error: too big mbulk count string"
+	TOO_BIG_BULK_COUNT_ERROR       = "Protocol error: too big bulk count string"
+	INVALID_MULTIBULK_LENGTH_ERROR = "Protocol error: invalid multibulk length"
+	INVALID_BULK_LENGTH_ERROR      = "Protocol error: invalid bulk length"
+	EXPECTED_BULK_ERROR_FORMAT     = "Protocol error: expected '$', got '%c'"
+	// Redirections to the node serving a slot, as <slot> <ip>:<port>
+	MOVED_ERROR_FORMAT = "MOVED %d %s"
+	ASK_ERROR_FORMAT   = "ASK %d %s"
+
+	BGREWRITEAOF_STARTED_RESPONSE = "Background append only file rewriting started"
 )
 
 const (
@@ -85,7 +185,12 @@ const (
 )
 
 const (
-	SET_PX_COMMAND = "SET_PX"
+	SET_PX_COMMAND   = "SET_PX"
+	SET_EX_COMMAND   = "SET_EX"
+	SET_PXAT_COMMAND = "SET_PXAT"
+	SET_EXAT_COMMAND = "SET_EXAT"
+	SET_PXAT_PARAM   = "PXAT"
+	XADD_AUTO_ID     = "*"
 	// REPLCONF
 	REPLCONF_LISTENING_PORT_PARAM = "listening-port"
 	REPLCONF_CAPA_PARAM           = "capa"
@@ -97,12 +202,284 @@ const (
 	PSYNC_UNKNOWN_MASTER_OFFSET        = "-1"
 	// CONFIG
 	CONFIG_GET_COMMAND = "CONFIG_GET"
+	// REPLICAOF
+	REPLICAOF_NO_PARAM  = "NO"
+	REPLICAOF_ONE_PARAM = "ONE"
+	// FAILOVER
+	FAILOVER_TO_PARAM      = "TO"
+	FAILOVER_FORCE_PARAM   = "FORCE"
+	FAILOVER_TIMEOUT_PARAM = "TIMEOUT"
+	FAILOVER_ABORT_PARAM   = "ABORT"
+	// Sent by a master handing its role over, as PSYNC <replid> <offset> FAILOVER
+	PSYNC_FAILOVER_PARAM = "FAILOVER"
+	// Pub/sub messages, sent as arrays starting with their kind
+	PUBSUB_SUBSCRIBE_KIND   = "subscribe"
+	PUBSUB_UNSUBSCRIBE_KIND = "unsubscribe"
+	PUBSUB_MESSAGE_KIND     = "message"
+	// SENTINEL
+	SENTINEL_GET_MASTER_ADDR_PARAM = "GET-MASTER-ADDR-BY-NAME"
+	SENTINEL_MASTERS_PARAM         = "MASTERS"
+	SENTINEL_MASTER_PARAM          = "MASTER"
+	SENTINEL_REPLICAS_PARAM        = "REPLICAS"
+	SENTINEL_SLAVES_PARAM          = "SLAVES"
+	SENTINEL_SENTINELS_PARAM       = "SENTINELS"
+	SENTINEL_IS_MASTER_DOWN_PARAM  = "IS-MASTER-DOWN-BY-ADDR"
+	SENTINEL_MONITOR_PARAM         = "MONITOR"
+	SENTINEL_REMOVE_PARAM          = "REMOVE"
+	SENTINEL_MYID_PARAM            = "MYID"
+	SENTINEL_NO_VOTE_RUN_ID        = "*"
+	// CLUSTER
+	CLUSTER_SLOTS_PARAM           = "SLOTS"
+	CLUSTER_SHARDS_PARAM          = "SHARDS"
+	CLUSTER_NODES_PARAM           = "NODES"
+	CLUSTER_MYID_PARAM            = "MYID"
+	CLUSTER_KEYSLOT_PARAM         = "KEYSLOT"
+	CLUSTER_COUNTKEYSINSLOT_PARAM = "COUNTKEYSINSLOT"
+	CLUSTER_GETKEYSINSLOT_PARAM   = "GETKEYSINSLOT"
+	CLUSTER_MEET_PARAM            = "MEET"
+	CLUSTER_ADDSLOTS_PARAM        = "ADDSLOTS"
+	CLUSTER_ADDSLOTSRANGE_PARAM   = "ADDSLOTSRANGE"
+	CLUSTER_DELSLOTS_PARAM        = "DELSLOTS"
+	CLUSTER_SETSLOT_PARAM         = "SETSLOT"
+	CLUSTER_REPLICATE_PARAM       = "REPLICATE"
+	CLUSTER_INFO_PARAM            = "INFO"
+	CLUSTER_FORGET_PARAM          = "FORGET"
+	CLUSTER_SAVECONFIG_PARAM      = "SAVECONFIG"
+	// CLUSTER SETSLOT <slot> IMPORTING|MIGRATING|NODE <node id> and CLUSTER SETSLOT <slot> STABLE
+	SETSLOT_IMPORTING_PARAM = "IMPORTING"
+	SETSLOT_MIGRATING_PARAM = "MIGRATING"
+	SETSLOT_NODE_PARAM      = "NODE"
+	SETSLOT_STABLE_PARAM    = "STABLE"
+	// RESTORE key ttl payload [REPLACE] [ABSTTL] and MIGRATE host port key|"" db timeout [COPY] [REPLACE] [KEYS key...]
+	RESTORE_REPLACE_PARAM = "REPLACE"
+	RESTORE_ABSTTL_PARAM  = "ABSTTL"
+	MIGRATE_COPY_PARAM    = "COPY"
+	MIGRATE_REPLACE_PARAM = "REPLACE"
+	MIGRATE_KEYS_PARAM    = "KEYS"
+	// HELLO [protover [AUTH username password] [SETNAME clientname]]
+	HELLO_AUTH_PARAM    = "AUTH"
+	HELLO_SETNAME_PARAM = "SETNAME"
+)
+
+// Reported by HELLO. There is no ACL, every client is the default user, which needs no password
+const (
+	SERVER_NAME            = "redis"
+	SERVER_VERSION         = "7.2.0"
+	DEFAULT_USER           = "default"
+	SERVER_MODE_STANDALONE = "standalone"
+	SERVER_MODE_SENTINEL   = "sentinel"
+	SERVER_MODE_CLUSTER    = "cluster"
+	SERVER_ROLE_REPLICA    = "replica"
 )
 
 // Server config params
 const (
-	RDB_DIR       = "dir"
-	RDB_FILE_NAME = "dbfilename"
+	RDB_DIR            = "dir"
+	RDB_FILE_NAME      = "dbfilename"
+	APPEND_ONLY        = "appendonly"
+	APPEND_FSYNC       = "appendfsync"
+	APPEND_FILE_NAME   = "appendfilename"
+	APPEND_DIR_NAME    = "appenddirname"
+	AOF_LOAD_TRUNCATED = "aof-load-truncated"
+	REPL_BACKLOG_SIZE  = "repl-backlog-size"
+	REPL_DISKLESS_SYNC = "repl-diskless-sync"
+	// Seconds a diskless transfer waits for more replicas to join it
+	REPL_DISKLESS_SYNC_DELAY = "repl-diskless-sync-delay"
+	REPLICA_READ_ONLY        = "replica-read-only"
+	// Whether a replica keeps serving its possibly outdated dataset while it has no working link to its master
+	REPLICA_SERVE_STALE_DATA = "replica-serve-stale-data"
+	// Writes are refused unless this many replicas acknowledged within min-replicas-max-lag seconds
+	MIN_REPLICAS_TO_WRITE = "min-replicas-to-write"
+	MIN_REPLICAS_MAX_LAG  = "min-replicas-max-lag"
+	CLUSTER_ENABLED       = "cluster-enabled"
+	CLUSTER_CONFIG_FILE   = "cluster-config-file"
+	// Milliseconds a node may be unreachable before it is considered failing
+	CLUSTER_NODE_TIMEOUT = "cluster-node-timeout"
+	// Longest bulk string a client may send
+	PROTO_MAX_BULK_LEN = "proto-max-bulk-len"
+	// Output a replica may have pending before it is disconnected
+	CLIENT_OUTPUT_BUFFER_LIMIT = "client-output-buffer-limit"
+)
+
+// Limits of client requests
+const (
+	DEFAULT_PROTO_MAX_BULK_LEN = "512mb"
+	MIN_PROTO_MAX_BULK_LEN     = 1024 * 1024
+	// Bytes read from a connection at once, unless more are needed to complete a bulk string
+	PROTO_IOBUF_LEN = 16 * 1024
+	// Most bytes read from a connection at once while completing a bulk string
+	PROTO_MAX_READ_LEN = 1024 * 1024
+	// Longest inline request, or line holding the length of a multibulk request or of a bulk string
+	PROTO_INLINE_MAX_SIZE = 64 * 1024
+	// Most arguments of a multibulk request, of which no more than PROTO_MULTIBULK_PREALLOC are allocated upfront
+	PROTO_MAX_MULTIBULK_LEN  = math.MaxInt32
+	PROTO_MULTIBULK_PREALLOC = 1024
+)
+
+// AOF config values
+const (
+	DEFAULT_APPEND_FILE_NAME = "appendonly.aof"
+	DEFAULT_APPEND_DIR_NAME  = "appendonlydir"
+	APPENDFSYNC_ALWAYS       = "always"
+	APPENDFSYNC_EVERYSEC     = "everysec"
+	APPENDFSYNC_NO           = "no"
+	CONFIG_YES               = "yes"
+	CONFIG_NO                = "no"
+)
+
+// States of a replica attached to this master
+const (
+	// Waiting for the next snapshot transfer to start
+	REPLICA_STATE_WAIT_BGSAVE = "wait_bgsave"
+	// The snapshot is being sent, the replication stream is held back until it is done
+	REPLICA_STATE_SEND_BULK = "send_bulk"
+	REPLICA_STATE_ONLINE    = "online"
+)
+
+// States of a replica's link to its master
+const (
+	MASTER_LINK_STATE_CONNECT   = "connect"
+	MASTER_LINK_STATE_HANDSHAKE = "handshake"
+	// Receiving the snapshot sent for a full resync
+	MASTER_LINK_STATE_TRANSFER  = "transfer"
+	MASTER_LINK_STATE_CONNECTED = "connected"
+	MASTER_LINK_STATUS_UP       = "up"
+	MASTER_LINK_STATUS_DOWN     = "down"
+)
+
+// States of a FAILOVER, as shown in INFO
+const (
+	FAILOVER_STATE_NONE             = "no-failover"
+	FAILOVER_STATE_WAITING_FOR_SYNC = "waiting-for-sync"
+	FAILOVER_STATE_IN_PROGRESS      = "failover-in-progress"
+)
+
+// Sentinel values
+const (
+	DEFAULT_SENTINEL_PORT             = "26379"
+	DEFAULT_SENTINEL_DOWN_AFTER       = 30000
+	DEFAULT_SENTINEL_FAILOVER_TIMEOUT = 180000
+	// Channel of the monitored instances on which sentinels announce themselves and their configuration
+	SENTINEL_HELLO_CHANNEL = "__sentinel__:hello"
+	SENTINEL_TICK          = 100 * time.Millisecond
+	SENTINEL_PING_PERIOD   = time.Second
+	SENTINEL_INFO_PERIOD   = 10 * time.Second
+	// INFO is sent more often while the master is down, to follow a failover closely
+	SENTINEL_FAILOVER_INFO_PERIOD = time.Second
+	SENTINEL_HELLO_PERIOD         = 2 * time.Second
+	SENTINEL_ASK_PERIOD           = time.Second
+	// Replies from other sentinels about the master being down are trusted for this long
+	SENTINEL_MASTER_DOWN_REPLY_VALIDITY = 5 * SENTINEL_ASK_PERIOD
+	// Upper bound of the random delay before a failover attempt, so sentinels don't split their votes
+	SENTINEL_MAX_DESYNC       = time.Second
+	SENTINEL_ELECTION_TIMEOUT = 10 * time.Second
+	SENTINEL_RECONNECT_PERIOD = time.Second
+)
+
+// Instance roles and flags as shown by SENTINEL commands
+const (
+	SENTINEL_FLAG_MASTER               = "master"
+	SENTINEL_FLAG_SLAVE                = "slave"
+	SENTINEL_FLAG_SENTINEL             = "sentinel"
+	SENTINEL_FLAG_SDOWN                = "s_down"
+	SENTINEL_FLAG_ODOWN                = "o_down"
+	SENTINEL_FLAG_FAILOVER_IN_PROGRESS = "failover_in_progress"
+	SENTINEL_FLAG_PROMOTED             = "promoted"
+)
+
+// States of a sentinel failover
+const (
+	SENTINEL_FAILOVER_STATE_NONE               = "none"
+	SENTINEL_FAILOVER_STATE_WAIT_START         = "wait_start"
+	SENTINEL_FAILOVER_STATE_SELECT_SLAVE       = "select_slave"
+	SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE = "send_slaveof_noone"
+	SENTINEL_FAILOVER_STATE_WAIT_PROMOTION     = "wait_promotion"
+	SENTINEL_FAILOVER_STATE_RECONF_SLAVES      = "reconf_slaves"
+)
+
+// Cluster values
+const (
+	CLUSTER_SLOTS               = 16384
+	DEFAULT_CLUSTER_CONFIG_FILE = "nodes.conf"
+	// Nodes talk to each other on the bus port, which is the client port plus this offset unless announced otherwise
+	CLUSTER_BUS_PORT_OFFSET = 10000
+	// Fields of the node lines of CLUSTER NODES and nodes.conf
+	CLUSTER_FLAG_MYSELF = "myself"
+	CLUSTER_FLAG_MASTER = "master"
+	CLUSTER_FLAG_SLAVE  = "slave"
+	// Failing as seen by this node, and as agreed by a majority of masters
+	CLUSTER_FLAG_PFAIL = "fail?"
+	CLUSTER_FLAG_FAIL  = "fail"
+	// Met through CLUSTER MEET or gossip, its ID isn't known until it replies
+	CLUSTER_FLAG_HANDSHAKE          = "handshake"
+	CLUSTER_NO_MASTER               = "-"
+	CLUSTER_LINK_STATE_CONNECTED    = "connected"
+	CLUSTER_LINK_STATE_DISCONNECTED = "disconnected"
+	// Slots being moved are listed as [<slot>->-<target id>] on the source and [<slot>-<-<source id>] on the target
+	CLUSTER_MIGRATING_SLOT_SEPARATOR = "->-"
+	CLUSTER_IMPORTING_SLOT_SEPARATOR = "-<-"
+	// Health of a node in CLUSTER SHARDS
+	CLUSTER_HEALTH_ONLINE = "online"
+	CLUSTER_HEALTH_FAILED = "failed"
+	// Last line of nodes.conf, as vars currentEpoch <epoch> lastVoteEpoch <epoch>
+	CLUSTER_VARS_LINE_PREFIX     = "vars"
+	CLUSTER_CURRENT_EPOCH_VAR    = "currentEpoch"
+	CLUSTER_LAST_VOTE_EPOCH_VAR  = "lastVoteEpoch"
+	CLUSTER_STATE_OK             = "ok"
+	CLUSTER_STATE_FAIL           = "fail"
+	DEFAULT_CLUSTER_NODE_TIMEOUT = 15000
+	CLUSTER_TICK                 = 100 * time.Millisecond
+	CLUSTER_PING_PERIOD          = time.Second
+	// Failure reports and a FAIL flag are held for these multiples of the node timeout
+	CLUSTER_FAIL_REPORT_VALIDITY_MULT = 2
+	CLUSTER_FAIL_UNDO_TIME_MULT       = 2
+	CLUSTER_MIN_HANDSHAKE_TIMEOUT     = time.Second
+	// Forgotten nodes aren't added back from gossip for this long
+	CLUSTER_BLACKLIST_TTL = 60 * time.Second
+	// A replica waits this long, plus a random delay and a delay per better replica, before asking for votes
+	CLUSTER_FAILOVER_DELAY       = 500 * time.Millisecond
+	CLUSTER_FAILOVER_RANK_DELAY  = time.Second
+	CLUSTER_MIN_FAILOVER_TIMEOUT = 2 * time.Second
+)
+
+// Messages of the cluster bus, sent as arrays of bulk strings starting with their type
+const (
+	CLUSTER_MSG_PING = "PING"
+	CLUSTER_MSG_PONG = "PONG"
+	CLUSTER_MSG_MEET = "MEET"
+	// Announces a node flagged as failing
+	CLUSTER_MSG_FAIL = "FAIL"
+	// Tells a node with an outdated view the newer owner of its slots
+	CLUSTER_MSG_UPDATE            = "UPDATE"
+	CLUSTER_MSG_FAILOVER_AUTH_REQ = "FAILOVER_AUTH_REQUEST"
+	CLUSTER_MSG_FAILOVER_AUTH_ACK = "FAILOVER_AUTH_ACK"
+)
+
+// Replication values
+const (
+	REPLICATION_ID_LENGTH            = 40
+	EMPTY_REPLICATION_ID             = "0000000000000000000000000000000000000000"
+	DEFAULT_REPL_BACKLOG_SIZE        = "1mb"
+	MIN_REPL_BACKLOG_SIZE            = 16 * 1024
+	DEFAULT_REPL_DISKLESS_SYNC_DELAY = 5
+	DEFAULT_MIN_REPLICAS_MAX_LAG     = 10
+	// Limits of the output pending for a replica, the only client class with enforced limits
+	DEFAULT_REPLICA_OUTPUT_BUFFER_LIMIT = "replica 256mb 64mb 60"
+	CLIENT_CLASS_REPLICA                = "replica"
+	CLIENT_CLASS_SLAVE                  = "slave"
+	// A diskless transfer is sent as $EOF:<mark>\r\n<rdb><mark>, as its length isn't known upfront
+	RDB_EOF_MARK_PREFIX  = "$EOF:"
+	RDB_EOF_MARK_LENGTH  = 40
+	REPL_TEMP_RDB_PREFIX = "temp-repl-"
+	// Time allowed for each step of the link with the master before it is considered broken
+	REPL_TIMEOUT = 60 * time.Second
+	// Reconnection attempts to the master back off exponentially between these delays
+	MASTER_LINK_MIN_BACKOFF = 500 * time.Millisecond
+	MASTER_LINK_MAX_BACKOFF = 30 * time.Second
+	// How often a replica reports its offset to the master
+	REPLICA_ACK_INTERVAL = time.Second
+	// How often a failover checks whether its target caught up or took over
+	FAILOVER_CHECK_INTERVAL = 100 * time.Millisecond
 )
 
 // Data Types
@@ -110,6 +487,11 @@ const (
 	STREAM           = "stream"
 	NONE             = "none"
 	STRING_DATA_TYPE = "string"
+	LIST_DATA_TYPE   = "list"
+	SET_DATA_TYPE    = "set"
+	ZSET_DATA_TYPE   = "zset"
+	HASH_DATA_TYPE   = "hash"
+	MODULE_DATA_TYPE = "module"
 )
 
 // Notifications
@@ -128,6 +510,7 @@ type Notification interface {
 type CommandExecutedNotification struct {
 	Cmd                 string
 	RequestId           uuid.UUID
+	Conn                net.Conn
 	Args                []DataRepr
 	DecodedRequest      DataRepr
 	DecodedResponseList []DataRepr
@@ -160,10 +543,10 @@ func (actual DataRepr) IsEqual(expected DataRepr, onlyPrefix bool) bool {
 	}
 
 	switch actual.Type {
-	case INTEGER, STRING, BULK, ERROR:
+	case INTEGER, STRING, BULK, ERROR, NULL, DOUBLE, BOOLEAN, BLOB_ERROR, VERBATIM, BIG_NUMBER:
 		return (bytes.Equal(actual.Data, expected.Data) ||
 			(onlyPrefix && strings.HasPrefix(string(actual.Data), string(expected.Data))))
-	case ARRAY:
+	case ARRAY, MAP, SET, PUSH:
 		if len(actual.Array) != len(expected.Array) {
 			return false
 		}
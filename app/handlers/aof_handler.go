@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+)
+
+type AofHandler struct {
+	ctx               *context.Context
+	commandHandler    *CommandHandler
+	db                *persistence.PersiDb
+	appendFileName    string
+	dirPath           string
+	manifest          *persistence.AofManifest
+	aof               *persistence.AppendOnlyFile
+	rewriteInProgress bool
+	rewriteLock       sync.Mutex
+}
+
+func InitAofHandler(appContext *context.Context, commandHandler *CommandHandler, db *persistence.PersiDb) *AofHandler {
+	aofHandler := AofHandler{
+		ctx:            appContext,
+		commandHandler: commandHandler,
+		db:             db,
+		appendFileName: appContext.ServerInstance.GetAppendFileName(),
+		dirPath:        appContext.ServerInstance.GetAppendDirPath(),
+	}
+	commandHandler.aofHandler = &aofHandler
+	commandHandler.RegisterPropagator(aofHandler.feedCommand)
+	return &aofHandler
+}
+
+// StartAofHandler loads the dataset from the AOF files and opens the last incr file for appending.
+// With no manifest around yet the RDB is loaded instead and becomes the first base file
+func (h *AofHandler) StartAofHandler() {
+	if !h.ctx.ServerInstance.IsAppendOnlyEnabled() {
+		return
+	}
+	err := os.MkdirAll(h.dirPath, 0755)
+	if err != nil {
+		h.ctx.Logger.Fatalf("Error while trying to create AOF directory '%s': %v", h.dirPath, err.Error())
+	}
+	manifestPath := filepath.Join(h.dirPath, persistence.GetAofManifestFileName(h.appendFileName))
+	manifest, err := persistence.LoadAofManifest(manifestPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		h.ctx.Logger.Printf("No AOF manifest found at '%s', creating a new append only file", manifestPath)
+		h.db.Load()
+		err = h.createInitialAof()
+		if err != nil {
+			h.ctx.Logger.Fatalf("Error while trying to create the append only file: %v", err.Error())
+		}
+	case err != nil:
+		h.ctx.Logger.Fatalf("Error while trying to read AOF manifest '%s': %v", manifestPath, err.Error())
+	default:
+		h.manifest = manifest
+		err = h.loadAof()
+		if err != nil {
+			h.ctx.Logger.Fatalf("Error while trying to load the append only file: %v", err.Error())
+		}
+	}
+
+	lastIncrAof := h.manifest.LastIncrAof()
+	if lastIncrAof == nil {
+		lastIncrAof = h.manifest.NewIncrAof(h.appendFileName)
+		err = persistence.PersistAofManifest(h.dirPath, h.appendFileName, h.manifest)
+		if err != nil {
+			h.ctx.Logger.Fatalf("Error while trying to persist AOF manifest: %v", err.Error())
+		}
+	}
+	h.aof, err = persistence.OpenAppendOnlyFile(filepath.Join(h.dirPath, lastIncrAof.FileName), h.ctx.ServerInstance.GetAppendFsync())
+	if err != nil {
+		h.ctx.Logger.Fatalf("Error while trying to open append only file '%s': %v", lastIncrAof.FileName, err.Error())
+	}
+	h.aof.StartEverySecFsync(h.ctx.Logger)
+	h.ctx.Logger.Printf("Appending writes to '%s'", lastIncrAof.FileName)
+}
+
+// StartRewrite switches writes to a fresh incr file and writes a new base file from the dataset in the background
+func (h *AofHandler) StartRewrite() error {
+	h.rewriteLock.Lock()
+	if h.rewriteInProgress {
+		h.rewriteLock.Unlock()
+		return errors.New("background append only file rewriting already in progress")
+	}
+	h.rewriteInProgress = true
+	h.rewriteLock.Unlock()
+
+	snapshot, err := h.switchToNewIncrAof()
+	if err != nil {
+		h.finishRewrite()
+		return err
+	}
+	go h.rewriteBaseAof(snapshot)
+	return nil
+}
+
+func (h *AofHandler) createInitialAof() error {
+	h.manifest = persistence.NewAofManifest()
+	baseAof := h.manifest.NewBaseAof(h.appendFileName)
+	err := persistence.WriteRDBFile(filepath.Join(h.dirPath, baseAof.FileName), h.db.Snapshot(), aofBaseAuxFields())
+	if err != nil {
+		return err
+	}
+	h.manifest.NewIncrAof(h.appendFileName)
+	return persistence.PersistAofManifest(h.dirPath, h.appendFileName, h.manifest)
+}
+
+func (h *AofHandler) loadAof() error {
+	aofFiles := h.manifest.IncrAofList
+	if h.manifest.BaseAof != nil {
+		aofFiles = append([]*persistence.AofInfo{h.manifest.BaseAof}, aofFiles...)
+	}
+	for i, aofInfo := range aofFiles {
+		err := h.loadAofFile(aofInfo, i == len(aofFiles)-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAofFile replays a single AOF file. Only the last file can be cut off by a crash, so it is the
+// only one truncated to its last complete command when aof-load-truncated is enabled
+func (h *AofHandler) loadAofFile(aofInfo *persistence.AofInfo, isLastFile bool) error {
+	aofFilePath := filepath.Join(h.dirPath, aofInfo.FileName)
+	data, err := os.ReadFile(aofFilePath)
+	if err != nil {
+		return err
+	}
+	h.ctx.Logger.Printf("Loading AOF file '%s' (%d bytes)", aofInfo.FileName, len(data))
+	if len(data) == 0 {
+		return nil
+	}
+	// Base files are usually RDB snapshots, though they may hold plain commands as well
+	if bytes.HasPrefix(data, []byte(persistence.RDB_MAGIC_STRING)) {
+		return h.db.LoadRdbData(data)
+	}
+	requests, err := persistence.DecodeAofCommands(data)
+	if err != nil {
+		var formatErr *persistence.AofFormatError
+		if !errors.As(err, &formatErr) {
+			return err
+		}
+		if !persistence.IsAofTruncated(err) || !isLastFile || !h.ctx.ServerInstance.IsAofLoadTruncatedEnabled() {
+			return fmt.Errorf("bad file format reading the append only file '%s' at offset %d: %v, run 'gedis-check-aof --fix %s' to repair it",
+				aofInfo.FileName, formatErr.Offset, formatErr.Err, aofFilePath)
+		}
+		h.ctx.Logger.Printf("AOF file '%s' ends with an incomplete command, truncating it from %d to %d bytes", aofInfo.FileName, len(data), formatErr.Offset)
+		err = os.Truncate(aofFilePath, int64(formatErr.Offset))
+		if err != nil {
+			return err
+		}
+	}
+	for _, request := range requests {
+		err = h.commandHandler.ReplayCommand(request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// feedCommand runs under the command handler's write lock, which the rewrite takes as well before switching files
+func (h *AofHandler) feedCommand(request constants.DataRepr) {
+	if h.aof == nil {
+		return
+	}
+	err := h.aof.Write(parser.Encode(request))
+	if err != nil {
+		h.ctx.Logger.Printf("Error while trying to append command to the append only file: %v", err.Error())
+	}
+}
+
+func (h *AofHandler) switchToNewIncrAof() (map[string]persistence.Value, error) {
+	h.commandHandler.writeLock.Lock()
+	defer h.commandHandler.writeLock.Unlock()
+
+	newManifest := h.manifest.Copy()
+	incrAof := newManifest.NewIncrAof(h.appendFileName)
+	incrAofPath := filepath.Join(h.dirPath, incrAof.FileName)
+	aof, err := persistence.OpenAppendOnlyFile(incrAofPath, h.ctx.ServerInstance.GetAppendFsync())
+	if err != nil {
+		return nil, err
+	}
+	err = persistence.PersistAofManifest(h.dirPath, h.appendFileName, newManifest)
+	if err != nil {
+		aof.Close()
+		os.Remove(incrAofPath)
+		return nil, err
+	}
+	previousAof := h.aof
+	h.aof = aof
+	h.manifest = newManifest
+	aof.StartEverySecFsync(h.ctx.Logger)
+	if previousAof != nil {
+		err = previousAof.Close()
+		if err != nil {
+			h.ctx.Logger.Printf("Error while trying to close the previous append only file: %v", err.Error())
+		}
+	}
+	// No write can happen while the lock is held, so the snapshot matches the point where the new incr file starts
+	return h.db.Snapshot(), nil
+}
+
+func (h *AofHandler) rewriteBaseAof(snapshot map[string]persistence.Value) {
+	defer h.finishRewrite()
+
+	// Only a rewrite changes the manifest once the server is up, so it is safe to prepare it without the write lock
+	newManifest := h.manifest.Copy()
+	baseAof := newManifest.NewBaseAof(h.appendFileName)
+	newManifest.MoveIncrAofsToHistory()
+	err := persistence.WriteRDBFile(filepath.Join(h.dirPath, baseAof.FileName), snapshot, aofBaseAuxFields())
+	if err != nil {
+		h.ctx.Logger.Printf("Background AOF rewrite failed while writing base file '%s': %v", baseAof.FileName, err.Error())
+		return
+	}
+
+	h.commandHandler.writeLock.Lock()
+	err = persistence.PersistAofManifest(h.dirPath, h.appendFileName, newManifest)
+	if err == nil {
+		h.manifest = newManifest
+	}
+	h.commandHandler.writeLock.Unlock()
+	if err != nil {
+		h.ctx.Logger.Printf("Background AOF rewrite failed while persisting the manifest: %v", err.Error())
+		os.Remove(filepath.Join(h.dirPath, baseAof.FileName))
+		return
+	}
+	h.ctx.Logger.Printf("Background AOF rewrite finished successfully, new base file is '%s'", baseAof.FileName)
+	h.deleteHistoryAofs()
+}
+
+// deleteHistoryAofs drops the history files from the manifest, then deletes them. The manifest is persisted
+// first, so a crash never leaves it pointing at deleted files
+func (h *AofHandler) deleteHistoryAofs() {
+	h.commandHandler.writeLock.Lock()
+	defer h.commandHandler.writeLock.Unlock()
+	historyAofs := h.manifest.HistoryAofList
+	newManifest := h.manifest.Copy()
+	newManifest.HistoryAofList = make([]*persistence.AofInfo, 0)
+	err := persistence.PersistAofManifest(h.dirPath, h.appendFileName, newManifest)
+	if err != nil {
+		h.ctx.Logger.Printf("Error while trying to persist AOF manifest before deleting history files: %v", err.Error())
+		return
+	}
+	h.manifest = newManifest
+	for _, historyAof := range historyAofs {
+		err := os.Remove(filepath.Join(h.dirPath, historyAof.FileName))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			h.ctx.Logger.Printf("Error while trying to delete history AOF file '%s': %v", historyAof.FileName, err.Error())
+		}
+	}
+}
+
+func (h *AofHandler) finishRewrite() {
+	h.rewriteLock.Lock()
+	defer h.rewriteLock.Unlock()
+	h.rewriteInProgress = false
+}
+
+func aofBaseAuxFields() map[string]string {
+	return map[string]string{"aof-base": "1"}
+}
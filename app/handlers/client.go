@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// client is the state of a connection, which the connection sets for itself with HELLO
+type client struct {
+	id       int
+	protocol int
+	name     string
+	// Holds the data read from the connection until it completes a request
+	requestParser *parser.RequestParser
+}
+
+// registerClient gives a new connection its ID. Connections speak RESP2 until they switch with HELLO
+func (h *ConnectionHandler) registerClient(conn net.Conn) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	h.nextClientId++
+	h.clients[conn] = &client{
+		id:            h.nextClientId,
+		protocol:      constants.RESP2_PROTOCOL,
+		requestParser: parser.NewRequestParser(h.ctx.ServerInstance.GetProtoMaxBulkLen()),
+	}
+}
+
+func (h *ConnectionHandler) unregisterClient(conn net.Conn) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	delete(h.clients, conn)
+}
+
+// getClient returns a copy of the state of the connection
+func (h *ConnectionHandler) getClient(conn net.Conn) client {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	if connClient, exists := h.clients[conn]; exists {
+		return *connClient
+	}
+	return client{protocol: constants.RESP2_PROTOCOL}
+}
+
+func (h *ConnectionHandler) updateClient(conn net.Conn, update func(*client)) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	if connClient, exists := h.clients[conn]; exists {
+		update(connClient)
+	}
+}
+
+// validateClientName accepts names made of printable characters other than spaces, as CLIENT SETNAME does
+func validateClientName(name string) error {
+	for _, char := range name {
+		if char < '!' || char > '~' {
+			return errors.New("Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	return nil
+}
+
+// Command handlers
+
+// handleHelloCommand handles HELLO [protover [AUTH username password] [SETNAME clientname]], switching the
+// protocol of the connection before replying with a map describing the server in the new protocol
+func handleHelloCommand(h *CommandHandler, conn net.Conn, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	connClient := h.connHandler.getClient(conn)
+	if len(args) > 0 {
+		protocol, err := strconv.Atoi(string(args[0].Data))
+		if err != nil {
+			return make([]constants.DataRepr, 0), errors.New("Protocol version is not an integer or out of range")
+		}
+		if protocol != constants.RESP2_PROTOCOL && protocol != constants.RESP3_PROTOCOL {
+			return make([]constants.DataRepr, 0), errors.New(constants.NOPROTO_ERROR)
+		}
+		connClient.protocol = protocol
+	}
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i].Data))
+		switch {
+		case option == constants.HELLO_AUTH_PARAM && i+2 < len(args):
+			// Without ACL every client is the default user, whatever the password
+			if string(args[i+1].Data) != constants.DEFAULT_USER {
+				return make([]constants.DataRepr, 0), errors.New(constants.WRONGPASS_ERROR)
+			}
+			i += 2
+		case option == constants.HELLO_SETNAME_PARAM && i+1 < len(args):
+			connClient.name = string(args[i+1].Data)
+			if err := validateClientName(connClient.name); err != nil {
+				return make([]constants.DataRepr, 0), err
+			}
+			i++
+		default:
+			return make([]constants.DataRepr, 0), fmt.Errorf("Syntax error in HELLO option '%s'", args[i].Data)
+		}
+	}
+	h.connHandler.updateClient(conn, func(c *client) {
+		c.protocol, c.name = connClient.protocol, connClient.name
+	})
+	h.ctx.Logger.Printf("(%s) Client %d switched to RESP%d", conn.RemoteAddr(), connClient.id, connClient.protocol)
+
+	mode, role := constants.SERVER_MODE_STANDALONE, constants.MASTER_ROLE
+	if h.ctx.ServerInstance.IsSentinelEnabled() {
+		mode, role = constants.SERVER_MODE_SENTINEL, constants.SERVER_MODE_SENTINEL
+	} else if h.ctx.ServerInstance.GetReplicationRole() == constants.REPLICA_ROLE {
+		role = constants.SERVER_ROLE_REPLICA
+	}
+	if h.ctx.ServerInstance.IsClusterEnabled() {
+		mode = constants.SERVER_MODE_CLUSTER
+	}
+	return []constants.DataRepr{utils.CreateMapDataRepr([]constants.DataRepr{
+		utils.CreateBulkResponse("server"), utils.CreateBulkResponse(constants.SERVER_NAME),
+		utils.CreateBulkResponse("version"), utils.CreateBulkResponse(constants.SERVER_VERSION),
+		utils.CreateBulkResponse("proto"), utils.CreateIntegerResponse(connClient.protocol),
+		utils.CreateBulkResponse("id"), utils.CreateIntegerResponse(connClient.id),
+		utils.CreateBulkResponse("mode"), utils.CreateBulkResponse(mode),
+		utils.CreateBulkResponse("role"), utils.CreateBulkResponse(role),
+		utils.CreateBulkResponse("modules"), utils.CreateArrayDataRepr([]constants.DataRepr{}),
+	})}, nil
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+func TestHelloCommand(t *testing.T) {
+	handlers := newTestHandlers(t)
+	h := handlers.commandHandler
+	conn, peerConn := net.Pipe()
+	defer peerConn.Close()
+	handlers.connHandler.registerClient(conn)
+
+	result, err := handleHelloCommand(h, conn, createArgs("3", constants.HELLO_SETNAME_PARAM, "app"))
+	if err != nil || len(result) != 1 || result[0].Type != constants.MAP {
+		t.Fatalf("Expected HELLO 3 to reply with a map, Got: %q (%v)", result, err)
+	}
+	reply := map[string]string{}
+	for i := 0; i+1 < len(result[0].Array); i += 2 {
+		reply[string(result[0].Array[i].Data)] = string(result[0].Array[i+1].Data)
+	}
+	if reply["proto"] != "3" || reply["role"] != constants.MASTER_ROLE || reply["mode"] != constants.SERVER_MODE_STANDALONE {
+		t.Errorf("Expected HELLO to describe a standalone master speaking RESP3, Got: %v", reply)
+	}
+	if connClient := handlers.connHandler.getClient(conn); connClient.protocol != constants.RESP3_PROTOCOL || connClient.name != "app" {
+		t.Errorf("Expected the connection to switch to RESP3 named app, Got: RESP%d named %q", connClient.protocol, connClient.name)
+	}
+
+	testCases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"4"}, constants.NOPROTO_ERROR},
+		{[]string{"2", constants.HELLO_AUTH_PARAM, "someone", "password"}, constants.WRONGPASS_ERROR},
+	}
+	for _, testCase := range testCases {
+		if _, err := handleHelloCommand(h, conn, createArgs(testCase.args...)); err == nil || err.Error() != testCase.expected {
+			t.Errorf("Expected HELLO %v to fail with %q, Got: %v", testCase.args, testCase.expected, err)
+		}
+	}
+	if connClient := handlers.connHandler.getClient(conn); connClient.protocol != constants.RESP3_PROTOCOL {
+		t.Errorf("Expected a failed HELLO to leave the protocol as it was, Got: RESP%d", connClient.protocol)
+	}
+}
@@ -0,0 +1,619 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// clusterMessage is a message of the cluster bus, sent as <type> <current epoch> <replication offset>
+// <sender node line> <data> <gossip node line>... The sender line lists the slots it claims, gossip lines
+// tell the sender's view of the other nodes
+type clusterMessage struct {
+	kind         string
+	currentEpoch int
+	replOffset   int
+	sender       *clusterNode
+	senderSlots  [][2]int
+	data         string
+	gossip       []*clusterNode
+}
+
+func parseClusterMessage(message constants.DataRepr) (*clusterMessage, error) {
+	if message.Type != constants.ARRAY || len(message.Array) < 5 {
+		return nil, errors.New("invalid cluster bus message")
+	}
+	fields := make([]string, len(message.Array))
+	for i, field := range message.Array {
+		fields[i] = string(field.Data)
+	}
+	clusterMsg := &clusterMessage{kind: fields[0], data: fields[4]}
+	var err error
+	if clusterMsg.currentEpoch, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, fmt.Errorf("invalid current epoch '%s'", fields[1])
+	}
+	if clusterMsg.replOffset, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, fmt.Errorf("invalid replication offset '%s'", fields[2])
+	}
+	if clusterMsg.sender, clusterMsg.senderSlots, err = parseNodeLine(fields[3]); err != nil {
+		return nil, err
+	}
+	for _, line := range fields[5:] {
+		node, _, err := parseNodeLine(line)
+		if err != nil {
+			return nil, err
+		}
+		clusterMsg.gossip = append(clusterMsg.gossip, node)
+	}
+	return clusterMsg, nil
+}
+
+// parseNodeLine reads a node line sent over the bus, with the slots it lists. Its flags are the view of
+// the sending node, which flags its own line as myself
+func parseNodeLine(line string) (*clusterNode, [][2]int, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 {
+		return nil, nil, fmt.Errorf("unexpected node line '%s'", line)
+	}
+	node, err := parseClusterNode(fields)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unexpected node line '%s': %v", line, err.Error())
+	}
+	node.myself = false
+	slotRanges := [][2]int{}
+	for _, field := range fields[8:] {
+		slotRange, err := parseSlotRange(field)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unexpected slots '%s' of node %s: %v", field, node.id, err.Error())
+		}
+		slotRanges = append(slotRanges, slotRange)
+	}
+	return node, slotRanges, nil
+}
+
+// messageFields returns the fields of a message following its type. It is called with the lock held
+func (h *ClusterHandler) messageFields(data string) []string {
+	fields := []string{
+		strconv.Itoa(h.config.currentEpoch),
+		strconv.Itoa(h.ctx.ServerInstance.GetMasterReplOffset()),
+		h.config.describeNode(h.config.myself, true),
+		data,
+	}
+	for _, node := range h.config.sortedNodes() {
+		if !node.myself && !node.handshake {
+			fields = append(fields, h.config.describeNode(node, false))
+		}
+	}
+	return fields
+}
+
+// listenOnBus accepts the links of other nodes, each sending messages one at a time and reading the reply
+func (h *ClusterHandler) listenOnBus() {
+	busAddress := net.JoinHostPort(constants.DEFAULT_SERVER_ADDRESS, strconv.Itoa(h.config.myself.busPort))
+	listener, err := net.Listen("tcp", busAddress)
+	if err != nil {
+		h.ctx.Logger.Fatalf("Unable to listen on cluster bus address %s: %v", busAddress, err.Error())
+	}
+	h.ctx.Logger.Printf("Cluster bus listening on %s", busAddress)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				h.ctx.Logger.Printf("Error accepting cluster bus connection: %v", err.Error())
+				continue
+			}
+			go h.serveBusConn(conn)
+		}
+	}()
+}
+
+func (h *ClusterHandler) serveBusConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := parser.DecodeFrom(reader)
+		if err != nil {
+			return
+		}
+		reply := h.processBusRequest(request, conn)
+		if _, err := conn.Write(parser.Encode(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// processBusRequest handles a message received from another node, returning the reply: a PONG, or the vote
+// of this node for a failover
+func (h *ClusterHandler) processBusRequest(request constants.DataRepr, conn net.Conn) constants.DataRepr {
+	message, err := parseClusterMessage(request)
+	if err != nil {
+		return utils.CreateErrorResponse(err.Error())
+	}
+	localIp, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	remoteIp, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	myself := h.config.myself
+	if myself.ip == "" {
+		// A node learns its own address from the links of other nodes
+		myself.ip = localIp
+		h.dirty = true
+		h.ctx.Logger.Printf("Cluster node address set to %s", myself.address())
+	}
+	if message.sender.ip == "" {
+		message.sender.ip = remoteIp
+	}
+	sender := h.config.nodes[message.sender.id]
+	if sender == nil && message.kind == constants.CLUSTER_MSG_MEET && !h.isBlacklisted(message.sender.id) {
+		sender = h.addNode(message.sender)
+	}
+	// Messages of unknown nodes are only replied to, they are added once met or gossiped about
+	replyKind, replyData := constants.CLUSTER_MSG_PONG, ""
+	if sender != nil && !sender.myself && !sender.handshake {
+		replyKind, replyData = h.processMessage(sender, message)
+	}
+	return utils.CreateRequestForCommand(replyKind, h.messageFields(replyData)...)
+}
+
+// sendBusMessage sends a message to a node and processes its reply, which is how PONGs are received
+func (h *ClusterHandler) sendBusMessage(node *clusterNode, kind string, data string) {
+	h.lock.Lock()
+	fields := h.messageFields(data)
+	link := node.link
+	h.lock.Unlock()
+	reply, err := link.call(h.nodeTimeout, kind, fields...)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if kind == constants.CLUSTER_MSG_PING || kind == constants.CLUSTER_MSG_MEET {
+		node.pinging = false
+	}
+	if h.config.nodes[node.id] != node {
+		// Forgotten while the message was in flight
+		return
+	}
+	if err != nil {
+		node.linkState = constants.CLUSTER_LINK_STATE_DISCONNECTED
+		return
+	}
+	node.linkState = constants.CLUSTER_LINK_STATE_CONNECTED
+	message, err := parseClusterMessage(reply)
+	if err != nil {
+		h.ctx.Logger.Printf("Invalid reply from cluster node %s: %v", node.id, err.Error())
+		return
+	}
+	if node.handshake && !h.completeHandshake(node, message.sender.id) {
+		return
+	}
+	if message.sender.id != node.id {
+		// Another node took over the address
+		return
+	}
+	if message.sender.ip == "" {
+		message.sender.ip = node.ip
+	}
+	now := time.Now()
+	node.pongReceived, node.pingSent = now.UnixMilli(), 0
+	if node.pfail {
+		node.pfail = false
+		h.ctx.Logger.Printf("Cluster node %s is reachable again", node.id)
+	}
+	h.clearFailureIfNeeded(node, now)
+	h.processMessage(node, message)
+}
+
+// broadcastBusMessage sends a message to every other node, or to the masters only
+func (h *ClusterHandler) broadcastBusMessage(kind string, data string, mastersOnly bool) {
+	for _, node := range h.config.nodes {
+		if node.myself || node.handshake || (mastersOnly && node.role != constants.CLUSTER_FLAG_MASTER) {
+			continue
+		}
+		go h.sendBusMessage(node, kind, data)
+	}
+}
+
+// processMessage updates the view of the cluster with a message of a known node, returning the kind and
+// data of the reply. It is called with the lock held
+func (h *ClusterHandler) processMessage(sender *clusterNode, message *clusterMessage) (string, string) {
+	now := time.Now()
+	if message.currentEpoch > h.config.currentEpoch {
+		h.config.currentEpoch = message.currentEpoch
+		h.dirty = true
+	}
+	h.updateNode(sender, message.sender)
+	sender.replOffset = message.replOffset
+	if sender.role == constants.CLUSTER_FLAG_MASTER {
+		h.updateSlots(sender, message.senderSlots)
+		h.handleConfigEpochCollision(sender)
+	}
+	h.processGossip(sender, message.gossip, now)
+	switch message.kind {
+	case constants.CLUSTER_MSG_FAIL:
+		h.markFailed(message.data, now)
+	case constants.CLUSTER_MSG_UPDATE:
+		h.processUpdate(message.data)
+	case constants.CLUSTER_MSG_FAILOVER_AUTH_REQ:
+		if h.grantVote(sender, message, now) {
+			return constants.CLUSTER_MSG_FAILOVER_AUTH_ACK, strconv.Itoa(h.config.currentEpoch)
+		}
+	case constants.CLUSTER_MSG_FAILOVER_AUTH_ACK:
+		h.countVote(sender, message)
+	}
+	return constants.CLUSTER_MSG_PONG, ""
+}
+
+// updateNode applies the address, role and configuration epoch a node announces for itself
+func (h *ClusterHandler) updateNode(node *clusterNode, announced *clusterNode) {
+	myself := h.config.myself
+	if node.ip != announced.ip || node.port != announced.port || node.busPort != announced.busPort {
+		h.ctx.Logger.Printf("Cluster node %s moved from %s to %s", node.id, node.address(), announced.address())
+		node.ip, node.port, node.busPort = announced.ip, announced.port, announced.busPort
+		node.link.close()
+		node.link = newCommandLink(node.busAddress())
+		h.dirty = true
+		if myself.masterId == node.id {
+			go h.replicationHandler.ReplicaOf(node.address())
+		}
+	}
+	if announced.role == constants.CLUSTER_FLAG_MASTER && node.role == constants.CLUSTER_FLAG_SLAVE {
+		h.ctx.Logger.Printf("Cluster node %s is now a master", node.id)
+		node.role, node.masterId = constants.CLUSTER_FLAG_MASTER, ""
+		h.dirty = true
+	} else if announced.role == constants.CLUSTER_FLAG_SLAVE && (node.role != constants.CLUSTER_FLAG_SLAVE || node.masterId != announced.masterId) {
+		h.ctx.Logger.Printf("Cluster node %s is now a replica of %s", node.id, announced.masterId)
+		node.role, node.masterId = constants.CLUSTER_FLAG_SLAVE, announced.masterId
+		// Slots of a master turned replica are left to be claimed by their new owner
+		for slot, owner := range h.config.slots {
+			if owner == node {
+				h.config.slots[slot] = nil
+			}
+		}
+		h.dirty = true
+	}
+	if node.role == constants.CLUSTER_FLAG_MASTER && announced.configEpoch > node.configEpoch {
+		node.configEpoch = announced.configEpoch
+		h.dirty = true
+	}
+}
+
+// updateSlots gives a master the slots it claims, unless their owner has a newer configuration epoch. When
+// the master this node belongs to loses its last slot this way, this node follows the new owner
+func (h *ClusterHandler) updateSlots(sender *clusterNode, slotRanges [][2]int) {
+	myself := h.config.myself
+	currentMaster := myself
+	if myself.role == constants.CLUSTER_FLAG_SLAVE {
+		currentMaster = h.config.nodes[myself.masterId]
+	}
+	var newerOwner *clusterNode
+	lostSlots := false
+	for _, slotRange := range slotRanges {
+		for slot := slotRange[0]; slot <= slotRange[1]; slot++ {
+			owner := h.config.slots[slot]
+			if owner == sender {
+				continue
+			}
+			if _, importing := h.config.importingSlots[slot]; importing {
+				// Assigned by CLUSTER SETSLOT NODE once the keys are moved
+				continue
+			}
+			if owner != nil && owner.configEpoch >= sender.configEpoch {
+				if owner.configEpoch > sender.configEpoch {
+					newerOwner = owner
+				}
+				continue
+			}
+			if owner != nil && owner == currentMaster {
+				lostSlots = true
+			}
+			delete(h.config.migratingSlots, slot)
+			h.config.slots[slot] = sender
+			h.dirty = true
+		}
+	}
+	if lostSlots && h.config.countSlots(currentMaster) == 0 {
+		h.followMaster(sender)
+	}
+	if newerOwner != nil {
+		go h.sendBusMessage(sender, constants.CLUSTER_MSG_UPDATE, h.config.describeNode(newerOwner, true))
+	}
+}
+
+// followMaster makes this node a replica of master
+func (h *ClusterHandler) followMaster(master *clusterNode) {
+	myself := h.config.myself
+	h.ctx.Logger.Printf("Configuration change detected, replicating from new master %s", master.id)
+	myself.role, myself.masterId = constants.CLUSTER_FLAG_SLAVE, master.id
+	h.config.migratingSlots = make(map[int]*clusterNode)
+	h.config.importingSlots = make(map[int]*clusterNode)
+	h.dirty = true
+	go h.replicationHandler.ReplicaOf(master.address())
+}
+
+// handleConfigEpochCollision gives this master a new configuration epoch when another master has the same,
+// the node with the smaller ID taking the new one, so every master ends up with a unique epoch
+func (h *ClusterHandler) handleConfigEpochCollision(sender *clusterNode) {
+	myself := h.config.myself
+	if myself.role != constants.CLUSTER_FLAG_MASTER || sender.configEpoch != myself.configEpoch || myself.id > sender.id {
+		return
+	}
+	h.config.currentEpoch++
+	myself.configEpoch = h.config.currentEpoch
+	h.dirty = true
+	h.ctx.Logger.Printf("configEpoch collision with node %s, configEpoch set to %d", sender.id, myself.configEpoch)
+}
+
+// processGossip records the failure reports of a master, and starts a handshake with the nodes not known yet
+func (h *ClusterHandler) processGossip(sender *clusterNode, gossip []*clusterNode, now time.Time) {
+	for _, announced := range gossip {
+		node, known := h.config.nodes[announced.id]
+		if known {
+			if node.myself || sender.role != constants.CLUSTER_FLAG_MASTER {
+				continue
+			}
+			if announced.pfail || announced.fail {
+				node.failReports[sender.id] = now
+			} else {
+				delete(node.failReports, sender.id)
+			}
+			continue
+		}
+		if announced.handshake || announced.ip == "" || h.isBlacklisted(announced.id) {
+			continue
+		}
+		h.startHandshake(announced.ip, announced.port, announced.busPort, false)
+	}
+}
+
+// processUpdate applies the slots of a node whose configuration this node had missed
+func (h *ClusterHandler) processUpdate(data string) {
+	announced, slotRanges, err := parseNodeLine(data)
+	if err != nil {
+		return
+	}
+	node, known := h.config.nodes[announced.id]
+	if !known || node.myself || node.configEpoch >= announced.configEpoch {
+		return
+	}
+	node.configEpoch = announced.configEpoch
+	h.updateSlots(node, slotRanges)
+}
+
+// markFailed flags a node as failing on the FAIL message of another node
+func (h *ClusterHandler) markFailed(id string, now time.Time) {
+	node, known := h.config.nodes[id]
+	if !known || node.myself || node.fail {
+		return
+	}
+	node.pfail, node.fail, node.failTime = false, true, now
+	h.dirty = true
+	h.ctx.Logger.Printf("FAIL message received about %s", node.id)
+}
+
+// startHandshake adds a node by address, with a random ID until it replies. It does nothing if a node is
+// already known at that address
+func (h *ClusterHandler) startHandshake(ip string, port int, busPort int, meet bool) bool {
+	for _, node := range h.config.nodes {
+		if node.ip == ip && node.port == port {
+			return false
+		}
+	}
+	node := &clusterNode{
+		id:          server.NewReplicationId(),
+		ip:          ip,
+		port:        port,
+		busPort:     busPort,
+		role:        constants.CLUSTER_FLAG_MASTER,
+		linkState:   constants.CLUSTER_LINK_STATE_DISCONNECTED,
+		failReports: make(map[string]time.Time),
+		handshake:   true,
+		meet:        meet,
+		createdTime: time.Now(),
+	}
+	node.link = newCommandLink(node.busAddress())
+	h.config.nodes[node.id] = node
+	h.ctx.Logger.Printf("Starting handshake with cluster node at %s", node.address())
+	return true
+}
+
+// completeHandshake gives a node met by address its real ID, returning false if the node was known already
+func (h *ClusterHandler) completeHandshake(node *clusterNode, id string) bool {
+	if _, exists := h.config.nodes[id]; exists {
+		h.removeNode(node)
+		return false
+	}
+	delete(h.config.nodes, node.id)
+	node.id, node.handshake, node.meet = id, false, false
+	h.config.nodes[id] = node
+	h.dirty = true
+	h.ctx.Logger.Printf("Handshake with cluster node %s at %s completed", node.id, node.address())
+	return true
+}
+
+// addNode adds a node which met this one
+func (h *ClusterHandler) addNode(announced *clusterNode) *clusterNode {
+	node := announced
+	node.pingSent, node.pongReceived = 0, 0
+	node.pfail, node.fail = false, false
+	node.linkState = constants.CLUSTER_LINK_STATE_CONNECTED
+	node.createdTime = time.Now()
+	node.link = newCommandLink(node.busAddress())
+	h.config.nodes[node.id] = node
+	h.dirty = true
+	h.ctx.Logger.Printf("Cluster node %s at %s met this node", node.id, node.address())
+	return node
+}
+
+// removeNode drops a node along with its slots and the failure reports it sent
+func (h *ClusterHandler) removeNode(node *clusterNode) {
+	delete(h.config.nodes, node.id)
+	for slot, owner := range h.config.slots {
+		if owner == node {
+			h.config.slots[slot] = nil
+		}
+	}
+	for slot, other := range h.config.migratingSlots {
+		if other == node {
+			delete(h.config.migratingSlots, slot)
+		}
+	}
+	for slot, other := range h.config.importingSlots {
+		if other == node {
+			delete(h.config.importingSlots, slot)
+		}
+	}
+	for _, other := range h.config.nodes {
+		delete(other.failReports, node.id)
+	}
+	node.link.close()
+	h.dirty = true
+}
+
+func (h *ClusterHandler) isBlacklisted(id string) bool {
+	until, exists := h.blacklist[id]
+	if exists && time.Now().After(until) {
+		delete(h.blacklist, id)
+		return false
+	}
+	return exists
+}
+
+func (h *ClusterHandler) runTimer() {
+	ticker := time.NewTicker(constants.CLUSTER_TICK)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.lock.Lock()
+		h.tick(time.Now())
+		h.lock.Unlock()
+	}
+}
+
+// tick is called with the lock held. It pings the other nodes, flags the ones not replying in time as
+// failing, and saves the config once it changed
+func (h *ClusterHandler) tick(now time.Time) {
+	handshakeTimeout := max(h.nodeTimeout, constants.CLUSTER_MIN_HANDSHAKE_TIMEOUT)
+	for _, node := range h.config.nodes {
+		if node.myself {
+			continue
+		}
+		if node.handshake && now.Sub(node.createdTime) > handshakeTimeout {
+			h.ctx.Logger.Printf("Handshake with cluster node at %s timed out", node.address())
+			h.removeNode(node)
+			continue
+		}
+		if !node.pinging && now.Sub(node.lastPing) >= constants.CLUSTER_PING_PERIOD {
+			node.pinging, node.lastPing = true, now
+			if node.pingSent == 0 {
+				node.pingSent = now.UnixMilli()
+			}
+			kind := constants.CLUSTER_MSG_PING
+			if node.meet {
+				kind = constants.CLUSTER_MSG_MEET
+			}
+			go h.sendBusMessage(node, kind, "")
+		}
+		if !node.handshake && !node.pfail && !node.fail && node.pingSent != 0 &&
+			now.Sub(time.UnixMilli(node.pingSent)) > h.nodeTimeout {
+			node.pfail = true
+			h.ctx.Logger.Printf("Cluster node %s is possibly failing", node.id)
+		}
+	}
+	h.markFailingNodes(now)
+	h.updateState()
+	h.tickFailover(now)
+	if h.dirty {
+		h.saveConfig()
+	}
+}
+
+// markFailingNodes flags a node as failing once a majority of masters reports it, and tells every node
+func (h *ClusterHandler) markFailingNodes(now time.Time) {
+	validity := constants.CLUSTER_FAIL_REPORT_VALIDITY_MULT * h.nodeTimeout
+	quorum := h.config.size()/2 + 1
+	for _, node := range h.config.nodes {
+		for reporter, reportTime := range node.failReports {
+			if _, known := h.config.nodes[reporter]; !known || now.Sub(reportTime) > validity {
+				delete(node.failReports, reporter)
+			}
+		}
+		if !node.pfail || node.fail {
+			continue
+		}
+		reports := len(node.failReports)
+		if h.config.myself.role == constants.CLUSTER_FLAG_MASTER {
+			reports++
+		}
+		if reports < quorum {
+			continue
+		}
+		node.pfail, node.fail, node.failTime = false, true, now
+		h.dirty = true
+		h.ctx.Logger.Printf("Marking cluster node %s as failing (quorum reached)", node.id)
+		h.broadcastBusMessage(constants.CLUSTER_MSG_FAIL, node.id, false)
+	}
+}
+
+// clearFailureIfNeeded lifts the failing flag of a node replying again. A master still serving slots keeps
+// it for a while, giving its replicas the time to take over
+func (h *ClusterHandler) clearFailureIfNeeded(node *clusterNode, now time.Time) {
+	if !node.fail {
+		return
+	}
+	if node.role == constants.CLUSTER_FLAG_SLAVE || h.config.countSlots(node) == 0 ||
+		now.Sub(node.failTime) > constants.CLUSTER_FAIL_UNDO_TIME_MULT*h.nodeTimeout {
+		node.fail = false
+		h.dirty = true
+		h.ctx.Logger.Printf("Clear FAIL state for cluster node %s", node.id)
+	}
+}
+
+// updateState sets the cluster state, which is ok when every slot is served by a master which isn't failing
+// and a majority of the masters is reachable
+func (h *ClusterHandler) updateState() {
+	state := constants.CLUSTER_STATE_OK
+	masters := make(map[*clusterNode]bool)
+	for _, owner := range h.config.slots {
+		if owner == nil || owner.fail {
+			state = constants.CLUSTER_STATE_FAIL
+			break
+		}
+		masters[owner] = true
+	}
+	if state == constants.CLUSTER_STATE_OK {
+		reachableMasters := 0
+		for master := range masters {
+			if !master.pfail {
+				reachableMasters++
+			}
+		}
+		if reachableMasters < len(masters)/2+1 {
+			state = constants.CLUSTER_STATE_FAIL
+		}
+	}
+	if state != h.state {
+		h.ctx.Logger.Printf("Cluster state changed: %s", state)
+		h.state = state
+	}
+}
+
+// saveConfig writes the cluster config file through a temporary file, so a crash leaves either version.
+// It is called with the lock held
+func (h *ClusterHandler) saveConfig() error {
+	configPath := h.ctx.ServerInstance.GetClusterConfigPath()
+	err := persistence.WriteFileAtomically(configPath, configPath+".tmp", []byte(h.config.describeNodes()+h.config.describeVars()))
+	if err != nil {
+		h.ctx.Logger.Printf("Unable to save cluster config file %s: %v", configPath, err.Error())
+		return err
+	}
+	h.dirty = false
+	return nil
+}
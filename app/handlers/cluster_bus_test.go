@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+func nodeId(c string) string {
+	return strings.Repeat(c, 40)
+}
+
+// testNodesConf has three masters with slots and a replica of each of the first two. Bus ports are closed,
+// so messages sent to the other nodes fail right away
+var testNodesConf = "" +
+	nodeId("1") + " 127.0.0.1:7000@1 myself,master - 0 0 1 connected 0-99 300 [400-<-" + nodeId("2") + "]\n" +
+	nodeId("2") + " 127.0.0.1:7001@1 master - 0 0 2 connected 100-199\n" +
+	nodeId("3") + " 127.0.0.1:7002@1 master - 0 0 3 connected 200-210\n" +
+	nodeId("4") + " 127.0.0.1:7003@1 slave " + nodeId("2") + " 0 0 2 connected\n" +
+	nodeId("5") + " 127.0.0.1:7004@1 slave " + nodeId("3") + " 0 0 3 connected\n" +
+	"vars currentEpoch 5 lastVoteEpoch 4\n"
+
+// newTestClusterHandler serves a cluster described by nodesConf, without listening on the bus
+func newTestClusterHandler(t *testing.T, nodesConf string) *ClusterHandler {
+	handlers := newTestHandlers(t)
+	handlers.ctx.ServerInstance.ServerConfig.ClusterConfigFile = constants.DEFAULT_CLUSTER_CONFIG_FILE
+	config, err := parseClusterConfig(nodesConf)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the cluster config: %v", err)
+	}
+	for _, node := range config.nodes {
+		if !node.myself {
+			node.link = newCommandLink(node.busAddress())
+		}
+	}
+	return &ClusterHandler{
+		ctx:                handlers.ctx,
+		connHandler:        handlers.connHandler,
+		commandHandler:     handlers.commandHandler,
+		replicationHandler: handlers.replicationHandler,
+		config:             config,
+		askingConns:        make(map[net.Conn]bool),
+		nodeTimeout:        time.Second,
+		state:              constants.CLUSTER_STATE_FAIL,
+		blacklist:          make(map[string]time.Time),
+	}
+}
+
+func TestParseClusterMessage(t *testing.T) {
+	senderLine := nodeId("2") + " 127.0.0.1:7001@17001 myself,master - 0 0 2 connected 0-100 200"
+	gossipLine := nodeId("3") + " 127.0.0.1:7002@17002 slave,fail? " + nodeId("2") + " 0 1700000000000 2 connected"
+	message, err := parseClusterMessage(utils.CreateRequestForCommand(constants.CLUSTER_MSG_PING, "3", "100", senderLine, "data", gossipLine))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing a cluster message: %v", err)
+	}
+	if message.kind != constants.CLUSTER_MSG_PING || message.currentEpoch != 3 || message.replOffset != 100 || message.data != "data" {
+		t.Errorf("Unexpected message fields %+v", message)
+	}
+	if message.sender.id != nodeId("2") || message.sender.myself || message.sender.busPort != 17001 || message.sender.configEpoch != 2 {
+		t.Errorf("Expected the sender to be read from its line without the myself flag, Got: %+v", message.sender)
+	}
+	if len(message.senderSlots) != 2 || message.senderSlots[0] != [2]int{0, 100} || message.senderSlots[1] != [2]int{200, 200} {
+		t.Errorf("Expected the sender to claim slots 0-100 and 200, Got: %v", message.senderSlots)
+	}
+	if len(message.gossip) != 1 || message.gossip[0].masterId != nodeId("2") || !message.gossip[0].pfail || message.gossip[0].pongReceived != 1700000000000 {
+		t.Errorf("Expected the gossip about the replica, Got: %+v", message.gossip)
+	}
+
+	invalidMessages := [][]string{
+		{constants.CLUSTER_MSG_PING, "3", "100", senderLine},
+		{constants.CLUSTER_MSG_PING, "epoch", "100", senderLine, ""},
+		{constants.CLUSTER_MSG_PING, "3", "offset", senderLine, ""},
+		{constants.CLUSTER_MSG_PING, "3", "100", nodeId("2") + " 127.0.0.1:7001@17001 master - 0 0 2", ""},
+		{constants.CLUSTER_MSG_PING, "3", "100", nodeId("2") + " 127.0.0.1:7001@17001 handshake - 0 0 2 connected", ""},
+		{constants.CLUSTER_MSG_PING, "3", "100", senderLine + " 16384", ""},
+		{constants.CLUSTER_MSG_PING, "3", "100", senderLine, "", "gossip"},
+	}
+	for _, fields := range invalidMessages {
+		if _, err := parseClusterMessage(utils.CreateRequestForCommand(fields[0], fields[1:]...)); err == nil {
+			t.Errorf("Expected an error for message %q", fields)
+		}
+	}
+	if _, err := parseClusterMessage(utils.CreateBulkResponse("PING")); err == nil {
+		t.Errorf("Expected an error for a message which isn't an array")
+	}
+}
+
+func TestUpdateSlots_EpochPrecedence(t *testing.T) {
+	h := newTestClusterHandler(t, testNodesConf)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	myself, second, third := h.config.myself, h.config.nodes[nodeId("2")], h.config.nodes[nodeId("3")]
+
+	// The second node's epoch is newer than this node's, older than the third's, and slot 400 is being imported
+	h.updateSlots(second, [][2]int{{0, 99}, {200, 210}, {400, 400}, {500, 500}})
+	if h.config.slots[0] != second || h.config.slots[99] != second || h.config.slots[500] != second {
+		t.Errorf("Expected the claims with a newer epoch and on unassigned slots to be taken")
+	}
+	if h.config.slots[200] != third || h.config.slots[210] != third {
+		t.Errorf("Expected the slots of a newer epoch to be kept")
+	}
+	if h.config.slots[400] != nil {
+		t.Errorf("Expected a slot being imported to be left to CLUSTER SETSLOT")
+	}
+	if h.config.slots[300] != myself || myself.role != constants.CLUSTER_FLAG_MASTER || !h.dirty {
+		t.Errorf("Expected this node to stay master of its remaining slot and the config to be saved")
+	}
+
+	// Claims of the same epoch don't win
+	second.configEpoch = 1
+	h.updateSlots(second, [][2]int{{300, 300}})
+	if h.config.slots[300] != myself {
+		t.Errorf("Expected a claim with the same epoch to be ignored")
+	}
+}
+
+func TestMarkFailingNodes_Quorum(t *testing.T) {
+	h := newTestClusterHandler(t, testNodesConf)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	second, third := h.config.nodes[nodeId("2")], h.config.nodes[nodeId("3")]
+	third.pfail = true
+
+	// Three masters serve slots, so two of them have to see the node failing
+	h.markFailingNodes(now)
+	if third.fail {
+		t.Fatalf("Expected this node's view alone not to flag the node as failing")
+	}
+	third.failReports[second.id] = now.Add(-3 * h.nodeTimeout)
+	third.failReports[nodeId("9")] = now
+	h.markFailingNodes(now)
+	if third.fail || len(third.failReports) != 0 {
+		t.Fatalf("Expected outdated reports and reports of unknown nodes to be dropped, Got: %v", third.failReports)
+	}
+	third.failReports[second.id] = now
+	h.markFailingNodes(now)
+	if !third.fail || third.pfail || third.failTime != now {
+		t.Errorf("Expected the node to be failing once a majority of masters reports it")
+	}
+
+	// A replica doesn't count its own view
+	h.config.myself.role = constants.CLUSTER_FLAG_SLAVE
+	second.pfail = true
+	second.failReports[third.id] = now
+	h.markFailingNodes(now)
+	if second.fail {
+		t.Errorf("Expected a single report not to reach the quorum when this node is a replica")
+	}
+}
+
+func TestGrantVote(t *testing.T) {
+	h := newTestClusterHandler(t, testNodesConf)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	second, third := h.config.nodes[nodeId("2")], h.config.nodes[nodeId("3")]
+	requester, otherRequester := h.config.nodes[nodeId("4")], h.config.nodes[nodeId("5")]
+	request := &clusterMessage{kind: constants.CLUSTER_MSG_FAILOVER_AUTH_REQ, currentEpoch: 5}
+
+	if h.grantVote(requester, request, now) {
+		t.Fatalf("Expected no vote for a replica whose master is up")
+	}
+	second.fail = true
+	if h.grantVote(requester, &clusterMessage{currentEpoch: 4}, now) {
+		t.Fatalf("Expected no vote for a request of an older epoch")
+	}
+	if !h.grantVote(requester, request, now) {
+		t.Fatalf("Expected a vote for a replica of a failed master")
+	}
+	if h.config.lastVoteEpoch != 5 {
+		t.Errorf("Expected the vote to be recorded for epoch 5, Got: %d", h.config.lastVoteEpoch)
+	}
+	if data, err := os.ReadFile(h.ctx.ServerInstance.GetClusterConfigPath()); err != nil || !strings.Contains(string(data), "lastVoteEpoch 5") {
+		t.Errorf("Expected the vote to be saved before it is given, Got: %q (%v)", data, err)
+	}
+	if h.grantVote(requester, request, now) {
+		t.Errorf("Expected a single vote per epoch")
+	}
+
+	h.config.currentEpoch = 6
+	if h.grantVote(requester, &clusterMessage{currentEpoch: 6}, now.Add(h.nodeTimeout)) {
+		t.Errorf("Expected no second vote for a replica of the same master within twice the node timeout")
+	}
+	third.fail = true
+	if !h.grantVote(otherRequester, &clusterMessage{currentEpoch: 6}, now) {
+		t.Errorf("Expected a vote in the next epoch for a replica of another failed master")
+	}
+}
+
+func TestCountVote(t *testing.T) {
+	h := newTestClusterHandler(t, testNodesConf)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	second, third, replica := h.config.nodes[nodeId("2")], h.config.nodes[nodeId("3")], h.config.nodes[nodeId("4")]
+	ack := func(epoch int) *clusterMessage {
+		return &clusterMessage{kind: constants.CLUSTER_MSG_FAILOVER_AUTH_ACK, data: strconv.Itoa(epoch)}
+	}
+
+	h.countVote(second, ack(5))
+	if len(h.failover.voters) != 0 {
+		t.Fatalf("Expected votes to be ignored while no election is held")
+	}
+	h.failover = clusterFailover{authSent: true, authEpoch: 5, voters: make(map[string]bool)}
+	h.countVote(second, ack(5))
+	h.countVote(second, ack(5))
+	h.countVote(third, ack(4))
+	h.countVote(replica, ack(5))
+	if len(h.failover.voters) != 1 || !h.failover.voters[second.id] {
+		t.Errorf("Expected a single vote of a master for the election's epoch, Got: %v", h.failover.voters)
+	}
+}
+
+func TestParseMigrateOptions(t *testing.T) {
+	options, err := parseMigrateOptions(createArgs("127.0.0.1", "7001", "key", "0", "500", "copy", "REPLACE"))
+	if err != nil || options.address != "127.0.0.1:7001" || len(options.keys) != 1 || options.keys[0] != "key" ||
+		options.timeout != 500*time.Millisecond || !options.copy || !options.replace {
+		t.Errorf("Unexpected options %+v (%v)", options, err)
+	}
+	options, err = parseMigrateOptions(createArgs("127.0.0.1", "7001", "", "0", "0", "KEYS", "a", "b"))
+	if err != nil || len(options.keys) != 2 || options.keys[1] != "b" || options.copy || options.timeout != time.Millisecond {
+		t.Errorf("Expected the keys following KEYS and the shortest timeout, Got: %+v (%v)", options, err)
+	}
+	if keys := findMigrateKeys(createArgs("127.0.0.1", "7001", "", "0", "0", "KEYS", "a", "b")); len(keys) != 2 {
+		t.Errorf("Expected the keys following KEYS to be found, Got: %v", keys)
+	}
+
+	for _, invalidArgs := range [][]string{
+		{"127.0.0.1", "7001", "key", "0"},
+		{"127.0.0.1", "7001", "key", "1", "500"},
+		{"127.0.0.1", "7001", "key", "0", "-1"},
+		{"127.0.0.1", "7001", "key", "0", "500", "KEYS", "a"},
+		{"127.0.0.1", "7001", "key", "0", "500", "AUTH"},
+	} {
+		if _, err := parseMigrateOptions(createArgs(invalidArgs...)); err == nil {
+			t.Errorf("Expected an error for MIGRATE %v", invalidArgs)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+// clusterNode is a node of the cluster as known to this one
+type clusterNode struct {
+	id      string
+	ip      string
+	port    int
+	busPort int
+	myself  bool
+	role    string
+	// ID of the master of a replica, empty for masters
+	masterId string
+	// Unix times in milliseconds of the last PING sent to the node and PONG received from it
+	pingSent     int64
+	pongReceived int64
+	configEpoch  int
+	linkState    string
+	// Flagged as failing by this node alone, and as agreed by a majority of masters since failTime
+	pfail    bool
+	fail     bool
+	failTime time.Time
+	// Masters currently reporting the node as failing, by ID, with the time of their last report
+	failReports map[string]time.Time
+	// A node being met has a random ID until its first reply, meet telling it to add this node
+	handshake   bool
+	meet        bool
+	createdTime time.Time
+	// Bus link to the node, and whether a PING to it is in flight
+	link     *commandLink
+	pinging  bool
+	lastPing time.Time
+	// Replication offset announced by the node, which ranks replicas for a failover
+	replOffset int
+	// Last time this node voted for a replica of this master
+	votedTime time.Time
+}
+
+func (n *clusterNode) address() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.port))
+}
+
+func (n *clusterNode) busAddress() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.busPort))
+}
+
+func (n *clusterNode) flags() string {
+	flags := []string{}
+	if n.myself {
+		flags = append(flags, constants.CLUSTER_FLAG_MYSELF)
+	}
+	flags = append(flags, n.role)
+	if n.pfail {
+		flags = append(flags, constants.CLUSTER_FLAG_PFAIL)
+	}
+	if n.fail {
+		flags = append(flags, constants.CLUSTER_FLAG_FAIL)
+	}
+	if n.handshake {
+		flags = append(flags, constants.CLUSTER_FLAG_HANDSHAKE)
+	}
+	return strings.Join(flags, ",")
+}
+
+// clusterConfig is the cluster as listed by CLUSTER NODES, and as loaded from the cluster config file
+type clusterConfig struct {
+	nodes  map[string]*clusterNode
+	myself *clusterNode
+	// Owner of every slot, nil while the slot isn't assigned
+	slots [constants.CLUSTER_SLOTS]*clusterNode
+	// Slots of this node being moved to another node, and slots this node takes over from another one
+	migratingSlots map[int]*clusterNode
+	importingSlots map[int]*clusterNode
+	currentEpoch   int
+	lastVoteEpoch  int
+}
+
+func newClusterConfig() *clusterConfig {
+	return &clusterConfig{
+		nodes:          make(map[string]*clusterNode),
+		migratingSlots: make(map[int]*clusterNode),
+		importingSlots: make(map[int]*clusterNode),
+	}
+}
+
+// parseClusterConfig reads node lines in the format of CLUSTER NODES followed by a vars line:
+// <id> <ip>:<port>@<bus port> <flags> <master id|-> <ping sent> <pong received> <config epoch> <link state> <slot>...
+func parseClusterConfig(data string) (*clusterConfig, error) {
+	config := newClusterConfig()
+	// Slots are assigned once all nodes are known, as they may refer to nodes listed after them
+	slotFields := make(map[*clusterNode][]string)
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == constants.CLUSTER_VARS_LINE_PREFIX {
+			if err := config.parseVars(fields[1:]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("unexpected node line '%s'", line)
+		}
+		node, err := parseClusterNode(fields)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected node line '%s': %v", line, err.Error())
+		}
+		if node.handshake {
+			// Handshakes aren't resumed, the node is met again through gossip
+			continue
+		}
+		if node.myself {
+			if config.myself != nil {
+				return nil, errors.New("more than one node is flagged as myself")
+			}
+			config.myself = node
+		}
+		config.nodes[node.id] = node
+		slotFields[node] = fields[8:]
+	}
+	if config.myself == nil {
+		return nil, errors.New("no node is flagged as myself")
+	}
+	for node, fields := range slotFields {
+		for _, field := range fields {
+			if err := config.parseSlots(node, field); err != nil {
+				return nil, fmt.Errorf("unexpected slots '%s' of node %s: %v", field, node.id, err.Error())
+			}
+		}
+	}
+	return config, nil
+}
+
+func parseClusterNode(fields []string) (*clusterNode, error) {
+	node := &clusterNode{id: fields[0], linkState: fields[7], failReports: make(map[string]time.Time)}
+	// A hostname may follow the address after a comma
+	address, _, _ := strings.Cut(fields[1], ",")
+	address, busPort, hasBusPort := strings.Cut(address, "@")
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	node.ip = host
+	if node.port, err = strconv.Atoi(port); err != nil {
+		return nil, err
+	}
+	node.busPort = node.port + constants.CLUSTER_BUS_PORT_OFFSET
+	if hasBusPort {
+		if node.busPort, err = strconv.Atoi(busPort); err != nil {
+			return nil, err
+		}
+	}
+	for _, flag := range strings.Split(fields[2], ",") {
+		switch flag {
+		case constants.CLUSTER_FLAG_MYSELF:
+			node.myself = true
+		case constants.CLUSTER_FLAG_MASTER, constants.CLUSTER_FLAG_SLAVE:
+			node.role = flag
+		case constants.CLUSTER_FLAG_PFAIL:
+			node.pfail = true
+		case constants.CLUSTER_FLAG_FAIL:
+			node.fail, node.failTime = true, time.Now()
+		case constants.CLUSTER_FLAG_HANDSHAKE:
+			node.handshake = true
+		}
+	}
+	if node.role == "" {
+		return nil, errors.New("node is neither a master nor a slave")
+	}
+	if fields[3] != constants.CLUSTER_NO_MASTER {
+		node.masterId = fields[3]
+	}
+	if node.pingSent, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+		return nil, err
+	}
+	if node.pongReceived, err = strconv.ParseInt(fields[5], 10, 64); err != nil {
+		return nil, err
+	}
+	if node.configEpoch, err = strconv.Atoi(fields[6]); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// parseSlots reads a slot, a range of slots, or a slot being moved such as [<slot>->-<node id>]
+func (c *clusterConfig) parseSlots(node *clusterNode, field string) error {
+	if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+		field = strings.Trim(field, "[]")
+		slotsByNode, separator := c.migratingSlots, constants.CLUSTER_MIGRATING_SLOT_SEPARATOR
+		if strings.Contains(field, constants.CLUSTER_IMPORTING_SLOT_SEPARATOR) {
+			slotsByNode, separator = c.importingSlots, constants.CLUSTER_IMPORTING_SLOT_SEPARATOR
+		}
+		if !node.myself {
+			// Only a node's own slots being moved are saved
+			return nil
+		}
+		slotField, otherId, _ := strings.Cut(field, separator)
+		slot, err := parseSlot(slotField)
+		if err != nil {
+			return err
+		}
+		otherNode, exists := c.nodes[otherId]
+		if !exists {
+			return fmt.Errorf("unknown node %s", otherId)
+		}
+		slotsByNode[slot] = otherNode
+		return nil
+	}
+	slotRange, err := parseSlotRange(field)
+	if err != nil {
+		return err
+	}
+	for slot := slotRange[0]; slot <= slotRange[1]; slot++ {
+		c.slots[slot] = node
+	}
+	return nil
+}
+
+// parseSlotRange reads a slot or a range of slots such as <first>-<last>, as pairs of first and last slot
+func parseSlotRange(field string) ([2]int, error) {
+	startField, endField, isRange := strings.Cut(field, "-")
+	if !isRange {
+		endField = startField
+	}
+	startSlot, err := parseSlot(startField)
+	if err != nil {
+		return [2]int{}, err
+	}
+	endSlot, err := parseSlot(endField)
+	if err != nil || endSlot < startSlot {
+		return [2]int{}, errors.New("invalid slot range")
+	}
+	return [2]int{startSlot, endSlot}, nil
+}
+
+func (c *clusterConfig) parseVars(fields []string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		value, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' of %s", fields[i+1], fields[i])
+		}
+		switch fields[i] {
+		case constants.CLUSTER_CURRENT_EPOCH_VAR:
+			c.currentEpoch = value
+		case constants.CLUSTER_LAST_VOTE_EPOCH_VAR:
+			c.lastVoteEpoch = value
+		}
+	}
+	return nil
+}
+
+// parseSlot reads a slot number, as given in the config file or to CLUSTER commands
+func parseSlot(value string) (int, error) {
+	slot, err := strconv.Atoi(value)
+	if err != nil || slot < 0 || slot >= constants.CLUSTER_SLOTS {
+		return 0, errors.New("Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// slotRanges returns the ranges of consecutive slots served by the node, as pairs of first and last slot
+func (c *clusterConfig) slotRanges(node *clusterNode) [][2]int {
+	ranges := [][2]int{}
+	for slot := 0; slot < constants.CLUSTER_SLOTS; slot++ {
+		if c.slots[slot] != node {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == slot-1 {
+			ranges[len(ranges)-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+func (c *clusterConfig) countSlots(node *clusterNode) int {
+	slots := 0
+	for _, owner := range c.slots {
+		if owner == node {
+			slots++
+		}
+	}
+	return slots
+}
+
+// size is the number of masters serving slots, a majority of which is needed to flag a node as failing
+// or to elect a replica
+func (c *clusterConfig) size() int {
+	masters := make(map[*clusterNode]bool)
+	for _, owner := range c.slots {
+		if owner != nil {
+			masters[owner] = true
+		}
+	}
+	return len(masters)
+}
+
+// bumpConfigEpoch gives this node a new configuration epoch without the agreement of other masters, so
+// its claim on slots it took over wins over older ones. It does nothing if its epoch is already the only
+// greatest one
+func (c *clusterConfig) bumpConfigEpoch() bool {
+	maxEpoch, maxEpochCount := 0, 0
+	for _, node := range c.nodes {
+		if node.configEpoch > maxEpoch {
+			maxEpoch, maxEpochCount = node.configEpoch, 0
+		}
+		if node.configEpoch == maxEpoch {
+			maxEpochCount++
+		}
+	}
+	if c.myself.configEpoch != 0 && c.myself.configEpoch == maxEpoch && maxEpochCount == 1 {
+		return false
+	}
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+	return true
+}
+
+// sortedNodes lists the nodes by ID, so descriptions of the cluster are stable
+func (c *clusterConfig) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// replicasOf returns the replicas of a master, sorted by ID
+func (c *clusterConfig) replicasOf(master *clusterNode) []*clusterNode {
+	replicas := []*clusterNode{}
+	for _, node := range c.sortedNodes() {
+		if node.masterId == master.id {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+// describeNodes returns the node lines of CLUSTER NODES, which are also the ones saved in the config file
+func (c *clusterConfig) describeNodes() string {
+	var description strings.Builder
+	for _, node := range c.sortedNodes() {
+		description.WriteString(c.describeNode(node, true))
+		if node.myself {
+			description.WriteString(describeMovingSlots(c.migratingSlots, constants.CLUSTER_MIGRATING_SLOT_SEPARATOR))
+			description.WriteString(describeMovingSlots(c.importingSlots, constants.CLUSTER_IMPORTING_SLOT_SEPARATOR))
+		}
+		description.WriteString("\n")
+	}
+	return description.String()
+}
+
+// describeNode returns the node line of a node, listing its slots if withSlots is set
+func (c *clusterConfig) describeNode(node *clusterNode, withSlots bool) string {
+	masterId := constants.CLUSTER_NO_MASTER
+	if node.masterId != "" {
+		masterId = node.masterId
+	}
+	var description strings.Builder
+	fmt.Fprintf(&description, "%s %s@%d %s %s %d %d %d %s", node.id, node.address(), node.busPort, node.flags(),
+		masterId, node.pingSent, node.pongReceived, node.configEpoch, node.linkState)
+	if !withSlots {
+		return description.String()
+	}
+	for _, slotRange := range c.slotRanges(node) {
+		if slotRange[0] == slotRange[1] {
+			fmt.Fprintf(&description, " %d", slotRange[0])
+		} else {
+			fmt.Fprintf(&description, " %d-%d", slotRange[0], slotRange[1])
+		}
+	}
+	return description.String()
+}
+
+// describeVars returns the last line of the config file
+func (c *clusterConfig) describeVars() string {
+	return fmt.Sprintf("%s %s %d %s %d\n", constants.CLUSTER_VARS_LINE_PREFIX, constants.CLUSTER_CURRENT_EPOCH_VAR,
+		c.currentEpoch, constants.CLUSTER_LAST_VOTE_EPOCH_VAR, c.lastVoteEpoch)
+}
+
+func describeMovingSlots(slotsByNode map[int]*clusterNode, separator string) string {
+	slots := make([]int, 0, len(slotsByNode))
+	for slot := range slotsByNode {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	var description strings.Builder
+	for _, slot := range slots {
+		fmt.Fprintf(&description, " [%d%s%s]", slot, separator, slotsByNode[slot].id)
+	}
+	return description.String()
+}
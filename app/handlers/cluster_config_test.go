@@ -0,0 +1,38 @@
+package handlers
+
+import "testing"
+
+func TestParseClusterConfig(t *testing.T) {
+	nodesConf := "" +
+		"1111111111111111111111111111111111111111 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-5460 5462 [5461->-2222222222222222222222222222222222222222]\n" +
+		"2222222222222222222222222222222222222222 127.0.0.1:7001@17001 master - 0 1700000000000 2 connected 5461 5463-16383\n" +
+		"3333333333333333333333333333333333333333 127.0.0.1:7002@17002 slave 1111111111111111111111111111111111111111 0 1700000000000 1 connected\n"
+	config, err := parseClusterConfig(nodesConf + "vars currentEpoch 2 lastVoteEpoch 1\n")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the cluster config: %v", err)
+	}
+
+	myself, other := config.nodes["1111111111111111111111111111111111111111"], config.nodes["2222222222222222222222222222222222222222"]
+	if config.myself != myself || myself.address() != "127.0.0.1:7000" || myself.busPort != 17000 {
+		t.Fatalf("Expected myself to be the node at 127.0.0.1:7000@17000, Got: %+v", config.myself)
+	}
+	if config.slots[0] != myself || config.slots[5460] != myself || config.slots[5461] != other || config.slots[5462] != myself {
+		t.Errorf("Unexpected slot owners around the first range")
+	}
+	if config.migratingSlots[5461] != other || len(config.importingSlots) != 0 {
+		t.Errorf("Expected slot 5461 to be migrating to the second node, Got: %v %v", config.migratingSlots, config.importingSlots)
+	}
+	if replicas := config.replicasOf(myself); len(replicas) != 1 || replicas[0].role != "slave" {
+		t.Errorf("Expected one replica of myself, Got: %v", replicas)
+	}
+	if config.currentEpoch != 2 || config.lastVoteEpoch != 1 {
+		t.Errorf("Expected epochs 2 and 1, Got: %d and %d", config.currentEpoch, config.lastVoteEpoch)
+	}
+	if description := config.describeNodes(); description != nodesConf {
+		t.Errorf("Expected the nodes to be described as they were loaded, Got:\n%s", description)
+	}
+
+	if _, err := parseClusterConfig("1111111111111111111111111111111111111111 127.0.0.1:7000@17000 master - 0 0 1 connected\n"); err == nil {
+		t.Errorf("Expected an error for a config without myself")
+	}
+}
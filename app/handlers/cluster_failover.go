@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+// clusterFailover is the election a replica holds to take over its failed master
+type clusterFailover struct {
+	// When votes are asked for, once the delay of the attempt has passed
+	authTime  time.Time
+	authSent  bool
+	authEpoch int
+	// Masters which voted for this replica in authEpoch
+	voters map[string]bool
+}
+
+// tickFailover is called with the lock held. A replica whose master failed while serving slots asks the
+// other masters for their votes in a new epoch, and takes over the slots once a majority granted them.
+// Attempts are spaced by twice the auth timeout, and the replicas with the most data start first
+func (h *ClusterHandler) tickFailover(now time.Time) {
+	myself := h.config.myself
+	master, exists := h.config.nodes[myself.masterId]
+	if myself.role != constants.CLUSTER_FLAG_SLAVE || !exists || !master.fail || h.config.countSlots(master) == 0 {
+		return
+	}
+	authTimeout := max(2*h.nodeTimeout, constants.CLUSTER_MIN_FAILOVER_TIMEOUT)
+	failover := &h.failover
+	if now.Sub(failover.authTime) > 2*authTimeout {
+		rank := h.replicaRank(master)
+		delay := constants.CLUSTER_FAILOVER_DELAY + time.Duration(rand.Int63n(int64(constants.CLUSTER_FAILOVER_DELAY))) +
+			time.Duration(rank)*constants.CLUSTER_FAILOVER_RANK_DELAY
+		*failover = clusterFailover{authTime: now.Add(delay), voters: make(map[string]bool)}
+		h.ctx.Logger.Printf("Start of election delayed for %v (rank #%d, offset %d)", delay, rank,
+			h.ctx.ServerInstance.GetMasterReplOffset())
+		return
+	}
+	if now.Before(failover.authTime) || now.Sub(failover.authTime) > authTimeout {
+		return
+	}
+	if !failover.authSent {
+		h.config.currentEpoch++
+		failover.authEpoch, failover.authSent = h.config.currentEpoch, true
+		h.dirty = true
+		h.ctx.Logger.Printf("Starting a failover election for epoch %d", failover.authEpoch)
+		h.broadcastBusMessage(constants.CLUSTER_MSG_FAILOVER_AUTH_REQ, "", true)
+		return
+	}
+	if len(failover.voters) >= h.config.size()/2+1 {
+		h.promoteMyself(master, failover.authEpoch)
+	}
+}
+
+// replicaRank is the number of other replicas of master with a greater replication offset
+func (h *ClusterHandler) replicaRank(master *clusterNode) int {
+	offset := h.ctx.ServerInstance.GetMasterReplOffset()
+	rank := 0
+	for _, replica := range h.config.replicasOf(master) {
+		if !replica.myself && replica.replOffset > offset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// promoteMyself turns the replica which won the election into the master of the slots of its old master.
+// The new configuration epoch makes other nodes take its claim over the old master's
+func (h *ClusterHandler) promoteMyself(oldMaster *clusterNode, configEpoch int) {
+	myself := h.config.myself
+	myself.role, myself.masterId = constants.CLUSTER_FLAG_MASTER, ""
+	myself.configEpoch = configEpoch
+	for slot, owner := range h.config.slots {
+		if owner == oldMaster {
+			h.config.slots[slot] = myself
+		}
+	}
+	h.dirty = true
+	h.ctx.Logger.Printf("Failover election won, promoted to master of %d slots with configEpoch %d",
+		h.config.countSlots(myself), configEpoch)
+	go h.replicationHandler.PromoteToMaster()
+	// Other nodes learn about the new owner of the slots from the next pings, which are sent right away
+	for _, node := range h.config.nodes {
+		node.lastPing = time.Time{}
+	}
+}
+
+// grantVote tells whether this master votes for a replica asking to replace its failed master. A master
+// votes once per epoch, and once per failed master within twice the node timeout
+func (h *ClusterHandler) grantVote(requester *clusterNode, message *clusterMessage, now time.Time) bool {
+	myself := h.config.myself
+	if myself.role != constants.CLUSTER_FLAG_MASTER || h.config.countSlots(myself) == 0 {
+		return false
+	}
+	if message.currentEpoch < h.config.currentEpoch || h.config.lastVoteEpoch == h.config.currentEpoch {
+		h.ctx.Logger.Printf("Failover auth denied to %s: already voted for epoch %d", requester.id, h.config.currentEpoch)
+		return false
+	}
+	master, exists := h.config.nodes[requester.masterId]
+	if requester.role != constants.CLUSTER_FLAG_SLAVE || !exists {
+		return false
+	}
+	if !master.fail {
+		h.ctx.Logger.Printf("Failover auth denied to %s: its master is up", requester.id)
+		return false
+	}
+	if now.Sub(master.votedTime) < 2*h.nodeTimeout {
+		h.ctx.Logger.Printf("Failover auth denied to %s: already voted for a replica of %s", requester.id, master.id)
+		return false
+	}
+	h.config.lastVoteEpoch = h.config.currentEpoch
+	master.votedTime = now
+	// The vote is saved before it is sent, so it isn't given twice across a restart
+	h.saveConfig()
+	h.ctx.Logger.Printf("Failover auth granted to %s for epoch %d", requester.id, h.config.currentEpoch)
+	return true
+}
+
+// countVote records the vote of a master for the election this replica holds
+func (h *ClusterHandler) countVote(voter *clusterNode, message *clusterMessage) {
+	failover := &h.failover
+	if !failover.authSent || voter.role != constants.CLUSTER_FLAG_MASTER || h.config.countSlots(voter) == 0 ||
+		message.data != strconv.Itoa(failover.authEpoch) {
+		return
+	}
+	failover.voters[voter.id] = true
+	h.ctx.Logger.Printf("Failover auth granted by %s for epoch %d", voter.id, failover.authEpoch)
+}
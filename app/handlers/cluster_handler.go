@@ -0,0 +1,619 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// ClusterHandler runs a server as a cluster node. Keys are sharded over hash slots, each served by one
+// master, and commands on keys of slots served elsewhere are redirected with MOVED, or ASK while the slot
+// is being moved. Nodes ping each other over the cluster bus, agree on failing masters and elect one of
+// their replicas in their place
+type ClusterHandler struct {
+	ctx                *context.Context
+	connHandler        *ConnectionHandler
+	commandHandler     *CommandHandler
+	replicationHandler *ReplicationHandler
+	config             *clusterConfig
+	lock               sync.RWMutex
+	// Connections which sent ASKING, whose next command may use a slot being imported by this node
+	askingConns map[net.Conn]bool
+	askingLock  sync.Mutex
+	nodeTimeout time.Duration
+	state       string
+	// Set when the config changed since it was last saved
+	dirty bool
+	// Forgotten nodes, by ID, with the time until which gossip about them is ignored
+	blacklist map[string]time.Time
+	failover  clusterFailover
+}
+
+func InitClusterHandler(ctx *context.Context, connectionHandler *ConnectionHandler, notificationHandler *NotificationHandler,
+	commandHandler *CommandHandler, replicationHandler *ReplicationHandler) *ClusterHandler {
+	clusterHandler := &ClusterHandler{
+		ctx:                ctx,
+		connHandler:        connectionHandler,
+		commandHandler:     commandHandler,
+		replicationHandler: replicationHandler,
+		config:             loadClusterConfig(ctx),
+		askingConns:        make(map[net.Conn]bool),
+		nodeTimeout:        ctx.ServerInstance.GetClusterNodeTimeout(),
+		state:              constants.CLUSTER_STATE_FAIL,
+		blacklist:          make(map[string]time.Time),
+	}
+	for _, node := range clusterHandler.config.nodes {
+		if !node.myself {
+			node.link = newCommandLink(node.busAddress())
+		}
+	}
+	commandHandler.clusterHandler = clusterHandler
+	commandHandler.CommandRegistry[constants.CLUSTER_COMMAND] = Command{Handler: handleClusterCommand, Flags: constants.CMD_FLAG_STALE}
+	commandHandler.CommandRegistry[constants.ASKING_COMMAND] = Command{Handler: handleAskingCommand, Flags: constants.CMD_FLAG_STALE}
+	notificationHandler.SubscribeToConnClosedNotification(clusterHandler.processConnectionClosedNotification)
+
+	myself := clusterHandler.config.myself
+	ctx.Logger.Printf("Cluster node %s serving %d slots", myself.id, clusterHandler.countSlots(myself))
+	return clusterHandler
+}
+
+// StartClusterHandler saves the config, replicates from our master if the config has one, listens on the
+// cluster bus and starts pinging the other nodes
+func (h *ClusterHandler) StartClusterHandler() {
+	h.lock.Lock()
+	h.updateState()
+	if err := h.saveConfig(); err != nil {
+		h.ctx.Logger.Fatalf("Unable to save cluster config file: %v", err.Error())
+	}
+	masterAddress := ""
+	if master, exists := h.config.nodes[h.config.myself.masterId]; exists && h.config.myself.role == constants.CLUSTER_FLAG_SLAVE {
+		masterAddress = master.address()
+	}
+	h.lock.Unlock()
+	if masterAddress != "" {
+		h.replicationHandler.ReplicaOf(masterAddress)
+	}
+	h.listenOnBus()
+	go h.runTimer()
+}
+
+// loadClusterConfig reads the cluster config file, or starts a cluster of its own when there is none
+func loadClusterConfig(ctx *context.Context) *clusterConfig {
+	configPath := ctx.ServerInstance.GetClusterConfigPath()
+	port, _ := strconv.Atoi(ctx.ServerInstance.ListeningPort)
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		config := newClusterConfig()
+		// Node IDs have the format of replication IDs
+		config.myself = &clusterNode{
+			id:          server.NewReplicationId(),
+			port:        port,
+			busPort:     port + constants.CLUSTER_BUS_PORT_OFFSET,
+			myself:      true,
+			role:        constants.CLUSTER_FLAG_MASTER,
+			linkState:   constants.CLUSTER_LINK_STATE_CONNECTED,
+			failReports: make(map[string]time.Time),
+		}
+		config.nodes[config.myself.id] = config.myself
+		return config
+	}
+	if err != nil {
+		ctx.Logger.Fatalf("Unable to read cluster config file %s: %v", configPath, err.Error())
+	}
+	config, err := parseClusterConfig(string(data))
+	if err != nil {
+		ctx.Logger.Fatalf("Invalid cluster config file %s: %v", configPath, err.Error())
+	}
+	config.myself.port, config.myself.busPort = port, port+constants.CLUSTER_BUS_PORT_OFFSET
+	return config
+}
+
+// RouteCommand checks that the keys of a command belong to a single slot which this node serves, returning
+// the redirection to send to the client otherwise
+func (h *ClusterHandler) RouteCommand(commandName string, command Command, args []constants.DataRepr, conn net.Conn) error {
+	// ASKING only applies to the command right after it
+	h.askingLock.Lock()
+	asking := h.askingConns[conn] || command.HasFlag(constants.CMD_FLAG_ASKING)
+	delete(h.askingConns, conn)
+	if commandName == constants.ASKING_COMMAND && conn != nil {
+		h.askingConns[conn] = true
+	}
+	h.askingLock.Unlock()
+
+	keys := command.GetKeys(args)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := utils.KeyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if utils.KeyHashSlot(key) != slot {
+			return errors.New(constants.CROSSSLOT_ERROR)
+		}
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.state != constants.CLUSTER_STATE_OK {
+		return errors.New(constants.CLUSTERDOWN_STATE_ERROR)
+	}
+	owner := h.config.slots[slot]
+	migratingTo, migrating := h.config.migratingSlots[slot]
+	_, importing := h.config.importingSlots[slot]
+	if commandName == constants.MIGRATE_COMMAND && (migrating || importing) {
+		// MIGRATE moves whichever of its keys are still here
+		return nil
+	}
+	if owner == h.config.myself {
+		if !migrating {
+			return nil
+		}
+		// Keys already moved are served by the target, which only accepts them from clients sending ASKING
+		missingKeys := h.countMissingKeys(keys)
+		switch {
+		case missingKeys == 0:
+			return nil
+		case missingKeys < len(keys):
+			return errors.New(constants.TRYAGAIN_ERROR)
+		default:
+			return fmt.Errorf(constants.ASK_ERROR_FORMAT, slot, migratingTo.address())
+		}
+	}
+	if importing && asking {
+		if len(keys) > 1 && h.countMissingKeys(keys) > 0 {
+			return errors.New(constants.TRYAGAIN_ERROR)
+		}
+		return nil
+	}
+	if owner == nil {
+		return errors.New(constants.CLUSTERDOWN_UNBOUND_ERROR)
+	}
+	return fmt.Errorf(constants.MOVED_ERROR_FORMAT, slot, owner.address())
+}
+
+func (h *ClusterHandler) countMissingKeys(keys []string) int {
+	missingKeys := 0
+	for _, key := range keys {
+		if h.commandHandler.db.GetKeyType(key) == constants.NONE {
+			missingKeys++
+		}
+	}
+	return missingKeys
+}
+
+func (h *ClusterHandler) countSlots(node *clusterNode) int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config.countSlots(node)
+}
+
+func (h *ClusterHandler) processConnectionClosedNotification(notification constants.ConnectionClosedNotification) (bool, error) {
+	h.askingLock.Lock()
+	delete(h.askingConns, notification.Conn)
+	h.askingLock.Unlock()
+	return true, nil
+}
+
+// Cluster command space
+
+// handleAskingCommand lets the next command use a slot being imported. The flag is set by the cluster handler
+// when routing the command, as it knows the connection
+func handleAskingCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	return []constants.DataRepr{utils.CreateStringResponse(constants.OK_RESPONSE)}, nil
+}
+
+// handleClusterCommand handles the CLUSTER sub-commands describing the cluster and changing its configuration
+func handleClusterCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) < 1 {
+		return make([]constants.DataRepr, 0), errors.New("CLUSTER command expects a sub-command")
+	}
+	stringArgs := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		stringArgs[i] = string(arg.Data)
+	}
+	subCommand := strings.ToUpper(string(args[0].Data))
+	reply, err := h.clusterHandler.executeClusterCommand(subCommand, stringArgs)
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	return []constants.DataRepr{reply}, nil
+}
+
+func (h *ClusterHandler) executeClusterCommand(subCommand string, args []string) (constants.DataRepr, error) {
+	expectedArgs := map[string]int{
+		constants.CLUSTER_SLOTS_PARAM:           0,
+		constants.CLUSTER_SHARDS_PARAM:          0,
+		constants.CLUSTER_NODES_PARAM:           0,
+		constants.CLUSTER_MYID_PARAM:            0,
+		constants.CLUSTER_KEYSLOT_PARAM:         1,
+		constants.CLUSTER_COUNTKEYSINSLOT_PARAM: 1,
+		constants.CLUSTER_GETKEYSINSLOT_PARAM:   2,
+		constants.CLUSTER_INFO_PARAM:            0,
+		constants.CLUSTER_REPLICATE_PARAM:       1,
+		constants.CLUSTER_FORGET_PARAM:          1,
+		constants.CLUSTER_SAVECONFIG_PARAM:      0,
+	}
+	// Sub-commands taking a list of slots or options take at least this many arguments
+	minArgs := map[string]int{
+		constants.CLUSTER_MEET_PARAM:          2,
+		constants.CLUSTER_ADDSLOTS_PARAM:      1,
+		constants.CLUSTER_ADDSLOTSRANGE_PARAM: 2,
+		constants.CLUSTER_DELSLOTS_PARAM:      1,
+		constants.CLUSTER_SETSLOT_PARAM:       2,
+	}
+	if numArgs, variadic := minArgs[subCommand]; variadic {
+		if len(args) < numArgs {
+			return constants.DataRepr{}, fmt.Errorf("CLUSTER %s expects >%d variables but %d given", subCommand, numArgs-1, len(args))
+		}
+		return h.executeClusterConfigCommand(subCommand, args)
+	}
+	numArgs, known := expectedArgs[subCommand]
+	if !known {
+		return constants.DataRepr{}, fmt.Errorf("Unknown cluster subcommand '%s'", subCommand)
+	}
+	if len(args) != numArgs {
+		return constants.DataRepr{}, fmt.Errorf("CLUSTER %s expects %d variables but %d given", subCommand, numArgs, len(args))
+	}
+	switch subCommand {
+	case constants.CLUSTER_KEYSLOT_PARAM:
+		return utils.CreateIntegerResponse(utils.KeyHashSlot(args[0])), nil
+	case constants.CLUSTER_COUNTKEYSINSLOT_PARAM, constants.CLUSTER_GETKEYSINSLOT_PARAM:
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return constants.DataRepr{}, err
+		}
+		keys := h.commandHandler.db.GetKeysInSlot(slot)
+		if subCommand == constants.CLUSTER_COUNTKEYSINSLOT_PARAM {
+			return utils.CreateIntegerResponse(len(keys)), nil
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return constants.DataRepr{}, errors.New("Invalid number of keys")
+		}
+		keyList := []constants.DataRepr{}
+		for _, key := range keys[:min(count, len(keys))] {
+			keyList = append(keyList, utils.CreateBulkResponse(key))
+		}
+		return utils.CreateArrayDataRepr(keyList), nil
+	case constants.CLUSTER_REPLICATE_PARAM, constants.CLUSTER_FORGET_PARAM, constants.CLUSTER_SAVECONFIG_PARAM:
+		return h.executeClusterConfigCommand(subCommand, args)
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	switch subCommand {
+	case constants.CLUSTER_MYID_PARAM:
+		return utils.CreateBulkResponse(h.config.myself.id), nil
+	case constants.CLUSTER_NODES_PARAM:
+		return utils.CreateBulkResponse(h.config.describeNodes()), nil
+	case constants.CLUSTER_SLOTS_PARAM:
+		return h.describeSlots(), nil
+	case constants.CLUSTER_INFO_PARAM:
+		return utils.CreateBulkResponse(h.describeInfo()), nil
+	default:
+		return h.describeShards(), nil
+	}
+}
+
+// executeClusterConfigCommand runs the CLUSTER sub-commands changing the configuration, which is saved
+// right away
+func (h *ClusterHandler) executeClusterConfigCommand(subCommand string, args []string) (constants.DataRepr, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var err error
+	switch subCommand {
+	case constants.CLUSTER_MEET_PARAM:
+		err = h.meet(args)
+	case constants.CLUSTER_ADDSLOTS_PARAM, constants.CLUSTER_ADDSLOTSRANGE_PARAM, constants.CLUSTER_DELSLOTS_PARAM:
+		err = h.assignSlots(subCommand, args)
+	case constants.CLUSTER_SETSLOT_PARAM:
+		err = h.setSlot(args)
+	case constants.CLUSTER_REPLICATE_PARAM:
+		err = h.replicate(args[0])
+	case constants.CLUSTER_FORGET_PARAM:
+		err = h.forget(args[0])
+	}
+	if err != nil {
+		return constants.DataRepr{}, err
+	}
+	h.updateState()
+	if err := h.saveConfig(); err != nil {
+		return constants.DataRepr{}, fmt.Errorf("error saving the cluster node config: %v", err.Error())
+	}
+	return utils.CreateStringResponse(constants.OK_RESPONSE), nil
+}
+
+// meet handles CLUSTER MEET <ip> <port> [<bus port>], starting a handshake which adds the nodes to each other
+func (h *ClusterHandler) meet(args []string) error {
+	port, err := strconv.Atoi(args[1])
+	busPort := port + constants.CLUSTER_BUS_PORT_OFFSET
+	if err == nil && len(args) > 2 {
+		busPort, err = strconv.Atoi(args[2])
+	}
+	if err != nil || net.ParseIP(args[0]) == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return fmt.Errorf("Invalid node address specified: %s:%s", args[0], args[1])
+	}
+	h.startHandshake(args[0], port, busPort, true)
+	return nil
+}
+
+// assignSlots handles CLUSTER ADDSLOTS <slot>..., CLUSTER ADDSLOTSRANGE <first> <last>... and CLUSTER
+// DELSLOTS <slot>..., changing the slots of this node only. Other nodes learn about them through gossip
+func (h *ClusterHandler) assignSlots(subCommand string, args []string) error {
+	slots := []int{}
+	if subCommand == constants.CLUSTER_ADDSLOTSRANGE_PARAM {
+		if len(args)%2 != 0 {
+			return fmt.Errorf("CLUSTER %s expects pairs of first and last slot", subCommand)
+		}
+		for i := 0; i < len(args); i += 2 {
+			startSlot, err := parseSlot(args[i])
+			if err != nil {
+				return err
+			}
+			endSlot, err := parseSlot(args[i+1])
+			if err != nil {
+				return err
+			}
+			if startSlot > endSlot {
+				return fmt.Errorf("start slot number %d is greater than end slot number %d", startSlot, endSlot)
+			}
+			for slot := startSlot; slot <= endSlot; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+	} else {
+		for _, arg := range args {
+			slot, err := parseSlot(arg)
+			if err != nil {
+				return err
+			}
+			slots = append(slots, slot)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, slot := range slots {
+		if seen[slot] {
+			return fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+		if subCommand == constants.CLUSTER_DELSLOTS_PARAM && h.config.slots[slot] == nil {
+			return fmt.Errorf("Slot %d is already unassigned", slot)
+		}
+		if subCommand != constants.CLUSTER_DELSLOTS_PARAM && h.config.slots[slot] != nil {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+	}
+	owner := h.config.myself
+	if subCommand == constants.CLUSTER_DELSLOTS_PARAM {
+		owner = nil
+	}
+	for _, slot := range slots {
+		h.config.slots[slot] = owner
+		delete(h.config.importingSlots, slot)
+	}
+	h.dirty = true
+	return nil
+}
+
+// setSlot handles CLUSTER SETSLOT <slot> MIGRATING|IMPORTING|NODE <node id> and CLUSTER SETSLOT <slot> STABLE,
+// which move a slot between masters: the target imports it, the source migrates it while its keys are
+// moved with MIGRATE, and both are then told its new owner
+func (h *ClusterHandler) setSlot(args []string) error {
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return err
+	}
+	myself := h.config.myself
+	if myself.role != constants.CLUSTER_FLAG_MASTER {
+		return errors.New("Please use SETSLOT only with masters.")
+	}
+	action := strings.ToUpper(args[1])
+	if action == constants.SETSLOT_STABLE_PARAM && len(args) == 2 {
+		delete(h.config.migratingSlots, slot)
+		delete(h.config.importingSlots, slot)
+		h.dirty = true
+		return nil
+	}
+	if len(args) != 3 {
+		return errors.New("Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	node, known := h.config.nodes[args[2]]
+	if !known {
+		return fmt.Errorf("I don't know about node %s", args[2])
+	}
+	if node.role != constants.CLUSTER_FLAG_MASTER {
+		return errors.New("Target node is not a master")
+	}
+	switch action {
+	case constants.SETSLOT_MIGRATING_PARAM:
+		if h.config.slots[slot] != myself {
+			return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		h.config.migratingSlots[slot] = node
+	case constants.SETSLOT_IMPORTING_PARAM:
+		if h.config.slots[slot] == myself {
+			return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		h.config.importingSlots[slot] = node
+	case constants.SETSLOT_NODE_PARAM:
+		if h.config.slots[slot] == myself && node != myself && len(h.commandHandler.db.GetKeysInSlot(slot)) > 0 {
+			return fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		if node != myself {
+			delete(h.config.migratingSlots, slot)
+		}
+		if _, importing := h.config.importingSlots[slot]; importing && node == myself {
+			// Taking the slot over needs a new epoch, so the claim wins over the one of the old owner
+			delete(h.config.importingSlots, slot)
+			if h.config.bumpConfigEpoch() {
+				h.ctx.Logger.Printf("configEpoch updated after importing slot %d: %d", slot, myself.configEpoch)
+			}
+		}
+		h.config.slots[slot] = node
+	default:
+		return errors.New("Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	h.dirty = true
+	return nil
+}
+
+// replicate handles CLUSTER REPLICATE <node id>, making this node a replica of a master
+func (h *ClusterHandler) replicate(id string) error {
+	myself := h.config.myself
+	node, known := h.config.nodes[id]
+	if !known {
+		return fmt.Errorf("Unknown node %s", id)
+	}
+	if node == myself {
+		return errors.New("Can't replicate myself")
+	}
+	if node.role != constants.CLUSTER_FLAG_MASTER {
+		return errors.New("I can only replicate a master, not a replica.")
+	}
+	if myself.role == constants.CLUSTER_FLAG_MASTER &&
+		(h.config.countSlots(myself) > 0 || len(h.commandHandler.db.GetKeysWithPattern("*")) > 0) {
+		return errors.New("To set a master the node must be empty and without assigned slots.")
+	}
+	h.followMaster(node)
+	return nil
+}
+
+// forget handles CLUSTER FORGET <node id>, which is ignored in gossip for a while so the node isn't
+// added back before every node forgot it
+func (h *ClusterHandler) forget(id string) error {
+	myself := h.config.myself
+	node, known := h.config.nodes[id]
+	if !known {
+		return fmt.Errorf("Unknown node %s", id)
+	}
+	if node == myself {
+		return errors.New("I tried hard but I can't forget myself...")
+	}
+	if myself.role == constants.CLUSTER_FLAG_SLAVE && myself.masterId == id {
+		return errors.New("Can't forget my master!")
+	}
+	h.removeNode(node)
+	h.blacklist[id] = time.Now().Add(constants.CLUSTER_BLACKLIST_TTL)
+	return nil
+}
+
+// describeInfo returns the fields of CLUSTER INFO
+func (h *ClusterHandler) describeInfo() string {
+	assignedSlots, pfailSlots, failSlots := 0, 0, 0
+	for _, owner := range h.config.slots {
+		switch {
+		case owner == nil:
+			continue
+		case owner.fail:
+			failSlots++
+		case owner.pfail:
+			pfailSlots++
+		}
+		assignedSlots++
+	}
+	// A replica reports the epoch of its master
+	epochNode := h.config.myself
+	if master, exists := h.config.nodes[epochNode.masterId]; exists {
+		epochNode = master
+	}
+	info := []string{
+		fmt.Sprintf("cluster_state:%s", h.state),
+		fmt.Sprintf("cluster_slots_assigned:%d", assignedSlots),
+		fmt.Sprintf("cluster_slots_ok:%d", assignedSlots-pfailSlots-failSlots),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfailSlots),
+		fmt.Sprintf("cluster_slots_fail:%d", failSlots),
+		fmt.Sprintf("cluster_known_nodes:%d", len(h.config.nodes)),
+		fmt.Sprintf("cluster_size:%d", h.config.size()),
+		fmt.Sprintf("cluster_current_epoch:%d", h.config.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", epochNode.configEpoch),
+	}
+	return strings.Join(info, "\r\n") + "\r\n"
+}
+
+// describeSlots lists the slot ranges in order, each with its master followed by the master's replicas
+func (h *ClusterHandler) describeSlots() constants.DataRepr {
+	type slotRange struct {
+		start, end int
+		master     *clusterNode
+	}
+	ranges := []slotRange{}
+	for _, node := range h.config.nodes {
+		for _, nodeRange := range h.config.slotRanges(node) {
+			ranges = append(ranges, slotRange{nodeRange[0], nodeRange[1], node})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	slots := []constants.DataRepr{}
+	for _, slotRange := range ranges {
+		entry := []constants.DataRepr{
+			utils.CreateIntegerResponse(slotRange.start),
+			utils.CreateIntegerResponse(slotRange.end),
+		}
+		for _, node := range append([]*clusterNode{slotRange.master}, h.config.replicasOf(slotRange.master)...) {
+			entry = append(entry, utils.CreateArrayDataRepr([]constants.DataRepr{
+				utils.CreateBulkResponse(node.ip),
+				utils.CreateIntegerResponse(node.port),
+				utils.CreateBulkResponse(node.id),
+				// Metadata such as hostnames, none is announced
+				utils.CreateArrayDataRepr([]constants.DataRepr{}),
+			}))
+		}
+		slots = append(slots, utils.CreateArrayDataRepr(entry))
+	}
+	return utils.CreateArrayDataRepr(slots)
+}
+
+// describeShards lists every master with its slot ranges, as pairs of first and last slot, and its nodes
+func (h *ClusterHandler) describeShards() constants.DataRepr {
+	shards := []constants.DataRepr{}
+	for _, master := range h.config.sortedNodes() {
+		if master.role != constants.CLUSTER_FLAG_MASTER {
+			continue
+		}
+		slots := []constants.DataRepr{}
+		for _, slotRange := range h.config.slotRanges(master) {
+			slots = append(slots, utils.CreateIntegerResponse(slotRange[0]), utils.CreateIntegerResponse(slotRange[1]))
+		}
+		nodes := []constants.DataRepr{}
+		for _, node := range append([]*clusterNode{master}, h.config.replicasOf(master)...) {
+			nodes = append(nodes, h.describeShardNode(node))
+		}
+		shards = append(shards, utils.CreateMapDataRepr([]constants.DataRepr{
+			utils.CreateBulkResponse("slots"), utils.CreateArrayDataRepr(slots),
+			utils.CreateBulkResponse("nodes"), utils.CreateArrayDataRepr(nodes),
+		}))
+	}
+	return utils.CreateArrayDataRepr(shards)
+}
+
+func (h *ClusterHandler) describeShardNode(node *clusterNode) constants.DataRepr {
+	// Only this node's own offset is known
+	replicationOffset := 0
+	if node.myself {
+		replicationOffset = h.ctx.ServerInstance.GetMasterReplOffset()
+	}
+	health := constants.CLUSTER_HEALTH_ONLINE
+	if node.pfail || node.fail {
+		health = constants.CLUSTER_HEALTH_FAILED
+	}
+	return utils.CreateMapDataRepr([]constants.DataRepr{
+		utils.CreateBulkResponse("id"), utils.CreateBulkResponse(node.id),
+		utils.CreateBulkResponse("port"), utils.CreateIntegerResponse(node.port),
+		utils.CreateBulkResponse("ip"), utils.CreateBulkResponse(node.ip),
+		utils.CreateBulkResponse("endpoint"), utils.CreateBulkResponse(node.ip),
+		utils.CreateBulkResponse("role"), utils.CreateBulkResponse(node.role),
+		utils.CreateBulkResponse("replication-offset"), utils.CreateIntegerResponse(replicationOffset),
+		utils.CreateBulkResponse("health"), utils.CreateBulkResponse(health),
+	})
+}
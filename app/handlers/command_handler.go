@@ -3,13 +3,16 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
 	"github.com/codecrafters-io/redis-starter-go/app/context"
 	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
 	"github.com/codecrafters-io/redis-starter-go/app/utils"
 )
 
@@ -19,30 +22,118 @@ type CommandHandler struct {
 	connectedReplicaCount int
 	notificationHandler   *NotificationHandler
 	db                    *persistence.PersiDb
+	aofHandler            *AofHandler
+	replicationHandler    *ReplicationHandler
+	pubSubHandler         *PubSubHandler
+	sentinelHandler       *SentinelHandler
+	clusterHandler        *ClusterHandler
+	connHandler           *ConnectionHandler
+	// writeLock serializes write commands with their propagation, so propagators see writes in execution order
+	writeLock   sync.Mutex
+	propagators []CommandPropagatorFunc
+	// Closed when client writes paused by FAILOVER may go on, nil while they aren't paused
+	writesResumed chan struct{}
+	pauseLock     sync.Mutex
 }
 
 type CommandHandlerFunc func(*CommandHandler, []constants.DataRepr) ([]constants.DataRepr, error)
-type CommandRegistry map[string]CommandHandlerFunc
+
+// ConnCommandHandlerFunc handles a command acting on the connection which sent it
+type ConnCommandHandlerFunc func(*CommandHandler, net.Conn, []constants.DataRepr) ([]constants.DataRepr, error)
+
+// CommandRewriteFunc returns the deterministic form of a write command, which is propagated in place of
+// the request as sent. It gets the command's arguments and the reply it produced
+type CommandRewriteFunc func(*CommandHandler, []constants.DataRepr, []constants.DataRepr) constants.DataRepr
+
+type Command struct {
+	Handler CommandHandlerFunc
+	// Used in place of Handler by commands acting on their connection, such as HELLO
+	ConnHandler ConnCommandHandlerFunc
+	Flags       constants.CommandFlags
+	Rewrite     CommandRewriteFunc
+	Keys        KeySpec
+}
+
+// KeySpec tells which arguments of a command are keys, counting the command name as argument 0: every
+// KeyStep from FirstKey to LastKey, a negative LastKey counting from the end. Commands without keys leave it empty
+type KeySpec struct {
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	// Find replaces the positions for commands whose keys depend on their options
+	Find func([]constants.DataRepr) []string
+}
+
+var (
+	singleKeySpec = KeySpec{FirstKey: 1, LastKey: 1, KeyStep: 1}
+	allKeysSpec   = KeySpec{FirstKey: 1, LastKey: -1, KeyStep: 1}
+)
+
+func (c Command) HasFlag(flag constants.CommandFlags) bool {
+	return c.Flags&flag != 0
+}
+
+// GetKeys returns the keys among the arguments of the command, which follow the command name
+func (c Command) GetKeys(args []constants.DataRepr) []string {
+	if c.Keys.Find != nil {
+		return c.Keys.Find(args)
+	}
+	if c.Keys.FirstKey == 0 {
+		return nil
+	}
+	lastKey := c.Keys.LastKey
+	if lastKey < 0 {
+		lastKey += len(args) + 1
+	}
+	keys := []string{}
+	for i := c.Keys.FirstKey; i <= lastKey && i <= len(args); i += c.Keys.KeyStep {
+		keys = append(keys, string(args[i-1].Data))
+	}
+	return keys
+}
+
+type CommandRegistry map[string]Command
+
+// CommandPropagatorFunc receives every successfully executed write command
+type CommandPropagatorFunc func(request constants.DataRepr)
 
 func InitCommandHandler(ctx *context.Context, notificationHandler *NotificationHandler, db *persistence.PersiDb) *CommandHandler {
 	cmdRegistry := make(CommandRegistry)
-	cmdRegistry[constants.PING_COMMAND] = handlePingCommand
-	cmdRegistry[constants.ECHO_COMMAND] = handleEchoCommand
-	cmdRegistry[constants.GET_COMMAND] = handleGetCommand
-	cmdRegistry[constants.SET_COMMAND] = handleSetCommand
-	cmdRegistry[constants.INFO_COMMAND] = handleInfoCommand
-	cmdRegistry[constants.REPLCONF_COMMAND] = handleReplconfCommand
-	cmdRegistry[constants.PSYNC_COMMAND] = handlePsyncCommand
-	cmdRegistry[constants.WAIT_COMMAND] = handleWaitCommand
-	cmdRegistry[constants.CONFIG_COMMAND] = handleConfigCommand
-	cmdRegistry[constants.KEYS_COMMAND] = handleKeysCommand
-	cmdRegistry[constants.TYPE_COMMAND] = handleTypeCommand
-	cmdRegistry[constants.XADD_COMMAND] = handleXaddCommand
-
-	// Sub-commands
-	cmdRegistry[constants.SET_PX_COMMAND] = handleSetPxCommand
-	cmdRegistry[constants.REPLCONF_GETACK] = handleReplconfGetackCommand
-	cmdRegistry[constants.CONFIG_GET_COMMAND] = handleConfigGetCommand
+	cmdRegistry[constants.PING_COMMAND] = Command{Handler: handlePingCommand, Flags: constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.ECHO_COMMAND] = Command{Handler: handleEchoCommand, Flags: constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.GET_COMMAND] = Command{Handler: handleGetCommand, Flags: constants.CMD_FLAG_READONLY, Keys: singleKeySpec}
+	cmdRegistry[constants.SET_COMMAND] = Command{Handler: handleSetCommand, Flags: constants.CMD_FLAG_WRITE, Rewrite: rewriteSetCommand, Keys: singleKeySpec}
+	cmdRegistry[constants.DEL_COMMAND] = Command{Handler: handleDelCommand, Flags: constants.CMD_FLAG_WRITE, Keys: allKeysSpec}
+	cmdRegistry[constants.INFO_COMMAND] = Command{Handler: handleInfoCommand, Flags: constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.REPLCONF_COMMAND] = Command{Handler: handleReplconfCommand, Flags: constants.CMD_FLAG_ADMIN | constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.PSYNC_COMMAND] = Command{Handler: handlePsyncCommand, Flags: constants.CMD_FLAG_ADMIN}
+	cmdRegistry[constants.WAIT_COMMAND] = Command{Handler: handleWaitCommand}
+	cmdRegistry[constants.CONFIG_COMMAND] = Command{Handler: handleConfigCommand, Flags: constants.CMD_FLAG_ADMIN | constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.KEYS_COMMAND] = Command{Handler: handleKeysCommand, Flags: constants.CMD_FLAG_READONLY}
+	cmdRegistry[constants.TYPE_COMMAND] = Command{Handler: handleTypeCommand, Flags: constants.CMD_FLAG_READONLY, Keys: singleKeySpec}
+	cmdRegistry[constants.XADD_COMMAND] = Command{Handler: handleXaddCommand, Flags: constants.CMD_FLAG_WRITE, Rewrite: rewriteXaddCommand, Keys: singleKeySpec}
+	cmdRegistry[constants.BGREWRITEAOF_COMMAND] = Command{Handler: handleBgrewriteaofCommand, Flags: constants.CMD_FLAG_ADMIN}
+	cmdRegistry[constants.REPLICAOF_COMMAND] = Command{Handler: handleReplicaofCommand, Flags: constants.CMD_FLAG_ADMIN | constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.SLAVEOF_COMMAND] = cmdRegistry[constants.REPLICAOF_COMMAND]
+	cmdRegistry[constants.SUBSCRIBE_COMMAND] = Command{Handler: handleSubscribeCommand, Flags: constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.UNSUBSCRIBE_COMMAND] = Command{Handler: handleUnsubscribeCommand, Flags: constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.PUBLISH_COMMAND] = Command{Handler: handlePublishCommand, Flags: constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.FAILOVER_COMMAND] = Command{Handler: handleFailoverCommand, Flags: constants.CMD_FLAG_ADMIN | constants.CMD_FLAG_STALE}
+	cmdRegistry[constants.DUMP_COMMAND] = Command{Handler: handleDumpCommand, Flags: constants.CMD_FLAG_READONLY, Keys: singleKeySpec}
+	cmdRegistry[constants.RESTORE_COMMAND] = Command{Handler: handleRestoreCommand, Flags: constants.CMD_FLAG_WRITE, Rewrite: rewriteRestoreCommand, Keys: singleKeySpec}
+	cmdRegistry[constants.RESTORE_ASKING_COMMAND] = Command{Handler: handleRestoreCommand, Flags: constants.CMD_FLAG_WRITE | constants.CMD_FLAG_ASKING,
+		Rewrite: rewriteRestoreCommand, Keys: singleKeySpec}
+	cmdRegistry[constants.MIGRATE_COMMAND] = Command{Handler: handleMigrateCommand, Flags: constants.CMD_FLAG_WRITE, Rewrite: rewriteMigrateCommand,
+		Keys: KeySpec{Find: findMigrateKeys}}
+	cmdRegistry[constants.HELLO_COMMAND] = Command{ConnHandler: handleHelloCommand, Flags: constants.CMD_FLAG_STALE}
+
+	// Sub-commands, which take the flags of their parent command
+	cmdRegistry[constants.SET_PX_COMMAND] = Command{Handler: handleSetPxCommand}
+	cmdRegistry[constants.SET_EX_COMMAND] = Command{Handler: handleSetExCommand}
+	cmdRegistry[constants.SET_PXAT_COMMAND] = Command{Handler: handleSetPxatCommand}
+	cmdRegistry[constants.SET_EXAT_COMMAND] = Command{Handler: handleSetExatCommand}
+	cmdRegistry[constants.REPLCONF_GETACK] = Command{Handler: handleReplconfGetackCommand}
+	cmdRegistry[constants.CONFIG_GET_COMMAND] = Command{Handler: handleConfigGetCommand}
 
 	commandHandler := CommandHandler{
 		CommandRegistry:       cmdRegistry,
@@ -53,15 +144,20 @@ func InitCommandHandler(ctx *context.Context, notificationHandler *NotificationH
 	}
 
 	notificationHandler.SubscribeToConnectedReplicasHeartbeatNotification(commandHandler.processConnectedReplicasHeartbeatNotification)
+	// A sentinel has no dataset
+	if db != nil {
+		db.SetExpiryHandler(commandHandler.expireKey)
+	}
 	return &commandHandler
 }
 
 func (h *CommandHandler) ExecuteCommand(executeCommandRequest constants.ExecuteCommandRequest) []constants.DataRepr {
 	commandName := strings.ToUpper(executeCommandRequest.Cmd)
-	commandHandler, commandHandlerPresent := h.CommandRegistry[commandName]
+	command, commandHandlerPresent := h.CommandRegistry[commandName]
 	commandExecutedNotification := constants.CommandExecutedNotification{
 		Cmd:            commandName,
 		RequestId:      executeCommandRequest.RequestId,
+		Conn:           executeCommandRequest.Conn,
 		Args:           executeCommandRequest.Args,
 		DecodedRequest: executeCommandRequest.DecodedRequest,
 		Success:        true,
@@ -74,7 +170,25 @@ func (h *CommandHandler) ExecuteCommand(executeCommandRequest constants.ExecuteC
 		return []constants.DataRepr{utils.CreateErrorResponse(errMessage)}
 	}
 	h.ctx.Logger.Printf("Handling command: %s", commandName)
-	result, err := commandHandler(h, executeCommandRequest.Args)
+	if command.HasFlag(constants.CMD_FLAG_WRITE) && !executeCommandRequest.FromMaster {
+		h.waitForWritesResumed()
+	}
+	var err error
+	if h.clusterHandler != nil && !executeCommandRequest.FromMaster {
+		err = h.clusterHandler.RouteCommand(commandName, command, executeCommandRequest.Args, executeCommandRequest.Conn)
+	}
+	if err == nil {
+		err = h.checkReplicaRestrictions(command, executeCommandRequest.FromMaster)
+	}
+	if err == nil {
+		err = h.checkMinReplicas(command)
+	}
+	result := []constants.DataRepr{}
+	if err == nil && command.ConnHandler != nil {
+		result, err = h.executeConnCommand(command, executeCommandRequest.Args, executeCommandRequest.Conn)
+	} else if err == nil {
+		result, err = h.executeCommand(command, executeCommandRequest.Args, executeCommandRequest.DecodedRequest)
+	}
 	if err != nil {
 		h.ctx.Logger.Printf("Error while trying to execute command [%s]: %v", commandName, err.Error())
 		result = append(result, utils.CreateErrorResponse(err.Error()))
@@ -86,6 +200,156 @@ func (h *CommandHandler) ExecuteCommand(executeCommandRequest constants.ExecuteC
 	return result
 }
 
+// PauseWrites holds client write commands until UnpauseWrites is called
+func (h *CommandHandler) PauseWrites() {
+	h.pauseLock.Lock()
+	defer h.pauseLock.Unlock()
+	if h.writesResumed == nil {
+		h.writesResumed = make(chan struct{})
+	}
+}
+
+func (h *CommandHandler) UnpauseWrites() {
+	h.pauseLock.Lock()
+	defer h.pauseLock.Unlock()
+	if h.writesResumed != nil {
+		close(h.writesResumed)
+		h.writesResumed = nil
+	}
+}
+
+func (h *CommandHandler) waitForWritesResumed() {
+	h.pauseLock.Lock()
+	writesResumed := h.writesResumed
+	h.pauseLock.Unlock()
+	if writesResumed != nil {
+		<-writesResumed
+	}
+}
+
+// checkReplicaRestrictions keeps clients of a replica from writing to it, when replica-read-only is set, and
+// from reading stale data while it isn't linked with its master, unless replica-serve-stale-data is set
+func (h *CommandHandler) checkReplicaRestrictions(command Command, fromMaster bool) error {
+	replicationConfig := h.ctx.ServerInstance.GetReplicationConfig()
+	if replicationConfig.Role != constants.REPLICA_ROLE || fromMaster {
+		return nil
+	}
+	if command.HasFlag(constants.CMD_FLAG_WRITE) && h.ctx.ServerInstance.IsReplicaReadOnly() {
+		return errors.New(constants.READONLY_ERROR)
+	}
+	if replicationConfig.MasterLinkState != constants.MASTER_LINK_STATE_CONNECTED &&
+		!command.HasFlag(constants.CMD_FLAG_STALE) && !h.ctx.ServerInstance.IsReplicaServeStaleDataEnabled() {
+		return errors.New(constants.MASTERDOWN_ERROR)
+	}
+	return nil
+}
+
+// checkMinReplicas refuses writes on a master with fewer than min-replicas-to-write replicas which
+// acknowledged within min-replicas-max-lag, limiting the writes lost if the master is cut off from them.
+// Setting either to 0 disables the check
+func (h *CommandHandler) checkMinReplicas(command Command) error {
+	minReplicas := h.ctx.ServerInstance.GetMinReplicasToWrite()
+	if minReplicas == 0 || h.ctx.ServerInstance.GetMinReplicasMaxLag() == 0 || !command.HasFlag(constants.CMD_FLAG_WRITE) ||
+		h.ctx.ServerInstance.GetReplicationRole() != constants.MASTER_ROLE || h.replicationHandler == nil {
+		return nil
+	}
+	if h.replicationHandler.CountGoodReplicas() < minReplicas {
+		return errors.New(constants.NOREPLICAS_ERROR)
+	}
+	return nil
+}
+
+// RegisterPropagator adds a function called with every write command right after it is executed
+func (h *CommandHandler) RegisterPropagator(propagator CommandPropagatorFunc) {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+	h.propagators = append(h.propagators, propagator)
+}
+
+// executeConnCommand runs a command acting on the connection which sent it, before its reply is written
+func (h *CommandHandler) executeConnCommand(command Command, args []constants.DataRepr, conn net.Conn) ([]constants.DataRepr, error) {
+	if h.connHandler == nil || conn == nil {
+		return make([]constants.DataRepr, 0), errors.New("command not available without a client connection")
+	}
+	return command.ConnHandler(h, conn, args)
+}
+
+func (h *CommandHandler) executeCommand(command Command, args []constants.DataRepr, request constants.DataRepr) ([]constants.DataRepr, error) {
+	if !command.HasFlag(constants.CMD_FLAG_WRITE) {
+		return command.Handler(h, args)
+	}
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+	result, err := command.Handler(h, args)
+	if err != nil {
+		return result, err
+	}
+	if command.Rewrite != nil {
+		request = command.Rewrite(h, args, result)
+	}
+	if request.Type == constants.ARRAY && len(request.Array) == 0 {
+		// Rewritten to nothing, as the command didn't change the dataset
+		return result, nil
+	}
+	h.propagate(request)
+	return result, nil
+}
+
+// propagate is called with writeLock held
+func (h *CommandHandler) propagate(request constants.DataRepr) {
+	for _, propagator := range h.propagators {
+		propagator(request)
+	}
+}
+
+// expireKey deletes key if it has expired, propagating the deletion as DEL so replicas and the AOF drop it
+// at the same point. Replicas leave expired keys to their master. It must not be called with writeLock held
+func (h *CommandHandler) expireKey(key string) {
+	if h.ctx.ServerInstance.GetReplicationRole() != constants.MASTER_ROLE {
+		return
+	}
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+	if !h.db.DeleteIfExpired(key) {
+		return
+	}
+	h.ctx.Logger.Printf("Deleted expired key: %s", key)
+	h.propagate(utils.CreateRequestForCommand(constants.DEL_COMMAND, key))
+}
+
+// ReplaceDataset swaps the whole dataset for the one held in an RDB received from the master
+func (h *CommandHandler) ReplaceDataset(rdbData []byte) error {
+	h.writeLock.Lock()
+	err := h.db.ReplaceWithRdbData(rdbData)
+	h.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if h.aofHandler != nil && h.ctx.ServerInstance.IsAppendOnlyEnabled() {
+		// The AOF describes the dataset which was just dropped, so start it over from the new one
+		err = h.aofHandler.StartRewrite()
+		if err != nil {
+			h.ctx.Logger.Printf("Unable to rewrite the append only file after loading the RDB from master: %v", err.Error())
+		}
+	}
+	return nil
+}
+
+// ReplayCommand executes a previously persisted command without replying, notifying or propagating it
+func (h *CommandHandler) ReplayCommand(request constants.DataRepr) error {
+	if request.Type != constants.ARRAY || len(request.Array) == 0 {
+		return fmt.Errorf("unable to extract command from %q", request.Data)
+	}
+	commandName := strings.ToUpper(string(request.Array[0].Data))
+	command, commandHandlerPresent := h.CommandRegistry[commandName]
+	// Commands acting on a connection have none to act on here
+	if !commandHandlerPresent || command.Handler == nil {
+		return fmt.Errorf("unknown command '%s'", commandName)
+	}
+	_, err := command.Handler(h, request.Array[1:])
+	return err
+}
+
 func (h *CommandHandler) processConnectedReplicasHeartbeatNotification(notification constants.ConnectedReplicaHeartbeatNotification) (bool, error) {
 	connectedReplicaCount := notification.ConnectedReplicas
 	h.connectedReplicaCount = connectedReplicaCount
@@ -119,13 +383,14 @@ func handleGetCommand(h *CommandHandler, args []constants.DataRepr) ([]constants
 		return make([]constants.DataRepr, 0), errors.New(errMessage)
 	}
 	key := string(args[0].Data)
+	h.expireKey(key)
 	value, valueExists := h.db.Fetch(key)
 
 	if !valueExists {
 		h.ctx.Logger.Printf("Unable to GET value for key %s", key)
 		return []constants.DataRepr{utils.NilBulkStringResponse()}, nil
 	}
-	h.ctx.Logger.Printf("For key: %s, fetched value: %q", key, value)
+	h.ctx.Logger.Printf("For key: %s, fetched value: %q", key, value.Data)
 	return []constants.DataRepr{utils.CreateBulkResponse(string(value.Data))}, nil
 }
 
@@ -136,8 +401,11 @@ func handleSetCommand(h *CommandHandler, args []constants.DataRepr) ([]constants
 		return make([]constants.DataRepr, 0), errors.New(errMessage)
 	}
 	if len(args) > 2 {
-		sub_command := fmt.Sprintf(constants.SUB_COMMAND_FORMAT, constants.SET_COMMAND, string(args[2].Data))
-		return h.CommandRegistry[strings.ToUpper(sub_command)](h, args)
+		subCommand, subCommandPresent := h.CommandRegistry[setSubCommand(args)]
+		if !subCommandPresent {
+			return make([]constants.DataRepr, 0), fmt.Errorf("unsupported SET option '%s'", args[2].Data)
+		}
+		return subCommand.Handler(h, args)
 	}
 	key := string(args[0].Data)
 	value := args[1].Data
@@ -147,19 +415,69 @@ func handleSetCommand(h *CommandHandler, args []constants.DataRepr) ([]constants
 
 	if err != nil {
 		h.ctx.Logger.Printf("Error while handling SET command: %v", err.Error())
-		return []constants.DataRepr{utils.NilBulkStringResponse()}, nil
+		return make([]constants.DataRepr, 0), err
 	}
 	h.ctx.Logger.Printf("Successfully persisted data: '%s'  against key: %s", value, key)
 	return []constants.DataRepr{utils.CreateStringResponse("OK")}, nil
 }
 
+// setSubCommand names the sub-command handling the option of SET key value <option> ...
+func setSubCommand(args []constants.DataRepr) string {
+	return strings.ToUpper(fmt.Sprintf(constants.SUB_COMMAND_FORMAT, constants.SET_COMMAND, string(args[2].Data)))
+}
+
 func handleInfoCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
-	response := []byte(fmt.Sprintf("role:%s\nmaster_replid:%s\nmaster_repl_offset:%d",
-		h.ctx.ServerInstance.ReplicationConfig.Role,
-		h.ctx.ServerInstance.ReplicationConfig.MasterReplId,
-		h.ctx.ServerInstance.ReplicationConfig.MasterReplOffset,
+	replicationConfig := h.ctx.ServerInstance.GetReplicationConfig()
+	info := []string{fmt.Sprintf("role:%s", replicationConfig.Role)}
+	if replicationConfig.Role == constants.REPLICA_ROLE {
+		info = append(info, replicaLinkInfo(replicationConfig)...)
+	}
+	if h.replicationHandler != nil {
+		replicasInfo := h.replicationHandler.ReplicasInfo()
+		info = append(info, fmt.Sprintf("connected_slaves:%d", len(replicasInfo)))
+		info = append(info, replicasInfo...)
+		if replicationConfig.Role == constants.MASTER_ROLE && h.ctx.ServerInstance.GetMinReplicasToWrite() > 0 &&
+			h.ctx.ServerInstance.GetMinReplicasMaxLag() > 0 {
+			info = append(info, fmt.Sprintf("min_slaves_good_slaves:%d", h.replicationHandler.CountGoodReplicas()))
+		}
+		info = append(info, fmt.Sprintf("master_failover_state:%s", h.replicationHandler.FailoverState()))
+	}
+	info = append(info, fmt.Sprintf("master_replid:%s\nmaster_replid2:%s\nmaster_repl_offset:%d\nsecond_repl_offset:%d\n"+
+		"repl_backlog_active:%d\nrepl_backlog_size:%d\nrepl_backlog_first_byte_offset:%d\nrepl_backlog_histlen:%d",
+		replicationConfig.MasterReplId,
+		replicationConfig.MasterReplId2,
+		replicationConfig.MasterReplOffset,
+		replicationConfig.SecondReplOffeset,
+		replicationConfig.ReplBacklogActive,
+		replicationConfig.ReplBacklogSize,
+		replicationConfig.ReplBacklogFirstByteOffset,
+		replicationConfig.ReplBacklogHistlen,
 	))
-	return []constants.DataRepr{utils.CreateBulkResponse(string(response))}, nil
+	return []constants.DataRepr{utils.CreateVerbatimResponse(constants.VERBATIM_TEXT_FORMAT, strings.Join(info, "\n"))}, nil
+}
+
+// replicaLinkInfo describes a replica's link to its master, the last IO being -1 before any data was read
+func replicaLinkInfo(replicationConfig server.ServerReplicationConfig) []string {
+	masterHost, masterPort, _ := net.SplitHostPort(replicationConfig.MasterServerAddress)
+	linkStatus := constants.MASTER_LINK_STATUS_DOWN
+	if replicationConfig.MasterLinkState == constants.MASTER_LINK_STATE_CONNECTED {
+		linkStatus = constants.MASTER_LINK_STATUS_UP
+	}
+	lastIoSecondsAgo := -1
+	if !replicationConfig.MasterLastIoTime.IsZero() {
+		lastIoSecondsAgo = int(time.Since(replicationConfig.MasterLastIoTime).Seconds())
+	}
+	syncInProgress := 0
+	if replicationConfig.MasterLinkState == constants.MASTER_LINK_STATE_TRANSFER {
+		syncInProgress = 1
+	}
+	return []string{
+		fmt.Sprintf("master_host:%s", masterHost),
+		fmt.Sprintf("master_port:%s", masterPort),
+		fmt.Sprintf("master_link_status:%s", linkStatus),
+		fmt.Sprintf("master_last_io_seconds_ago:%d", lastIoSecondsAgo),
+		fmt.Sprintf("master_sync_in_progress:%d", syncInProgress),
+	}
 }
 
 func handleReplconfCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
@@ -168,7 +486,7 @@ func handleReplconfCommand(h *CommandHandler, args []constants.DataRepr) ([]cons
 	switch firstArg {
 	case constants.GETACK:
 		sub_command := fmt.Sprintf(constants.SUB_COMMAND_FORMAT, constants.REPLCONF_COMMAND, string(args[0].Data))
-		return h.CommandRegistry[strings.ToUpper(sub_command)](h, args[1:])
+		return h.CommandRegistry[strings.ToUpper(sub_command)].Handler(h, args[1:])
 	case constants.ACK:
 		return []constants.DataRepr{}, nil
 	default:
@@ -177,16 +495,59 @@ func handleReplconfCommand(h *CommandHandler, args []constants.DataRepr) ([]cons
 	}
 }
 
+// handleWaitCommand replies to WAIT <numreplicas> <timeout> with the number of replicas which acknowledged
+// the writes made so far, waiting for them to do so
 func handleWaitCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
-	return []constants.DataRepr{}, nil
+	if len(args) != 2 {
+		errMessage := fmt.Sprintf("WAIT command expects %d variables but %d given", 2, len(args))
+		h.ctx.Logger.Print(errMessage)
+		return make([]constants.DataRepr, 0), errors.New(errMessage)
+	}
+	if h.ctx.ServerInstance.GetReplicationRole() != constants.MASTER_ROLE {
+		return make([]constants.DataRepr, 0), errors.New("WAIT cannot be used with replica instances")
+	}
+	numReplicas, err := strconv.Atoi(string(args[0].Data))
+	if err != nil || numReplicas < 0 {
+		return make([]constants.DataRepr, 0), errors.New("numreplicas is not an integer or out of range")
+	}
+	timeout, err := strconv.Atoi(string(args[1].Data))
+	if err != nil || timeout < 0 {
+		return make([]constants.DataRepr, 0), errors.New("timeout is not an integer or out of range")
+	}
+	ackReplicaCount := 0
+	if h.replicationHandler != nil {
+		ackReplicaCount = h.replicationHandler.WaitForReplicas(numReplicas, time.Duration(timeout)*time.Millisecond)
+	}
+	return []constants.DataRepr{utils.CreateIntegerResponse(ackReplicaCount)}, nil
 }
 
+// handlePsyncCommand handles PSYNC <replid> <offset> [FAILOVER], the last argument being sent by a master
+// handing its role over to this replica
 func handlePsyncCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
-	// TODO: Parse arguments to fetch replId and offset
-	responseData := fmt.Sprintf("%s %s %d", constants.FULLRESYNC_RESPONSE,
-		h.ctx.ServerInstance.ReplicationConfig.MasterReplId, h.ctx.ServerInstance.ReplicationConfig.MasterReplOffset)
-	responseDataList := []constants.DataRepr{utils.CreateStringResponse(responseData)}
-	return responseDataList, nil
+	if len(args) != 2 && (len(args) != 3 || !strings.EqualFold(string(args[2].Data), constants.PSYNC_FAILOVER_PARAM)) {
+		errMessage := fmt.Sprintf("PSYNC command expects %d variables but %d given", 2, len(args))
+		h.ctx.Logger.Print(errMessage)
+		return make([]constants.DataRepr, 0), errors.New(errMessage)
+	}
+	replicationConfig := h.ctx.ServerInstance.GetReplicationConfig()
+	if len(args) == 3 {
+		if replicationConfig.Role != constants.REPLICA_ROLE {
+			return make([]constants.DataRepr, 0), errors.New("PSYNC FAILOVER can't be sent to a master")
+		}
+		if string(args[0].Data) != replicationConfig.MasterReplId {
+			return make([]constants.DataRepr, 0), errors.New("PSYNC FAILOVER replid must match my replid")
+		}
+		h.ctx.Logger.Printf("Taking over as master, as asked by PSYNC FAILOVER")
+		// The former master continues from our backlog, as its history is now our previous one
+		h.replicationHandler.PromoteToMaster()
+		return []constants.DataRepr{}, nil
+	}
+	if replicationConfig.Role == constants.REPLICA_ROLE && replicationConfig.MasterLinkState != constants.MASTER_LINK_STATE_CONNECTED {
+		return make([]constants.DataRepr, 0), errors.New(constants.NOMASTERLINK_ERROR)
+	}
+	// The replication handler replies with FULLRESYNC or CONTINUE, as the reply has to be
+	// written in order with the snapshot or backlog that follows it
+	return []constants.DataRepr{}, nil
 }
 
 func handleConfigCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
@@ -194,7 +555,7 @@ func handleConfigCommand(h *CommandHandler, args []constants.DataRepr) ([]consta
 
 	switch subCommand {
 	case constants.GET:
-		return h.CommandRegistry[constants.CONFIG_GET_COMMAND](h, args[1:])
+		return h.CommandRegistry[constants.CONFIG_GET_COMMAND].Handler(h, args[1:])
 	}
 	return []constants.DataRepr{}, nil
 }
@@ -211,6 +572,7 @@ func handleKeysCommand(h *CommandHandler, args []constants.DataRepr) ([]constant
 
 func handleTypeCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
 	key := string(args[0].Data)
+	h.expireKey(key)
 	keyType := h.db.GetKeyType(key)
 	return []constants.DataRepr{utils.CreateStringResponse(keyType)}, nil
 }
@@ -229,39 +591,219 @@ func handleXaddCommand(h *CommandHandler, args []constants.DataRepr) ([]constant
 	return []constants.DataRepr{utils.CreateBulkResponse(persistedId)}, nil
 }
 
+func handleDelCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) < 1 {
+		errMessage := fmt.Sprintf("DEL command expects >%d variables but %d given", 0, len(args))
+		h.ctx.Logger.Print(errMessage)
+		return make([]constants.DataRepr, 0), errors.New(errMessage)
+	}
+	deletedCount := 0
+	for _, arg := range args {
+		if h.db.DeleteKey(string(arg.Data)) {
+			deletedCount++
+		}
+	}
+	return []constants.DataRepr{utils.CreateIntegerResponse(deletedCount)}, nil
+}
+
+// handleReplicaofCommand handles REPLICAOF <host> <port>, following a new master, and REPLICAOF NO ONE,
+// which promotes this server to a master
+func handleReplicaofCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) != 2 {
+		errMessage := fmt.Sprintf("REPLICAOF command expects %d variables but %d given", 2, len(args))
+		h.ctx.Logger.Print(errMessage)
+		return make([]constants.DataRepr, 0), errors.New(errMessage)
+	}
+	if h.ctx.ServerInstance.IsClusterEnabled() {
+		return make([]constants.DataRepr, 0), errors.New("REPLICAOF not allowed in cluster mode.")
+	}
+	replicationConfig := h.ctx.ServerInstance.GetReplicationConfig()
+	host, port := string(args[0].Data), string(args[1].Data)
+	if strings.EqualFold(host, constants.REPLICAOF_NO_PARAM) && strings.EqualFold(port, constants.REPLICAOF_ONE_PARAM) {
+		if replicationConfig.Role == constants.REPLICA_ROLE {
+			h.replicationHandler.PromoteToMaster()
+		}
+		return []constants.DataRepr{utils.CreateStringResponse(constants.OK_RESPONSE)}, nil
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 0 || portNumber > 65535 {
+		return make([]constants.DataRepr, 0), errors.New("invalid master port")
+	}
+	masterAddress := net.JoinHostPort(host, port)
+	if replicationConfig.Role == constants.REPLICA_ROLE && replicationConfig.MasterServerAddress == masterAddress {
+		return []constants.DataRepr{utils.CreateStringResponse(constants.ALREADY_CONNECTED_RESPONSE)}, nil
+	}
+	h.replicationHandler.ReplicaOf(masterAddress)
+	return []constants.DataRepr{utils.CreateStringResponse(constants.OK_RESPONSE)}, nil
+}
+
+// handleFailoverCommand handles FAILOVER [TO <host> <port> [FORCE]] [TIMEOUT <ms>] and FAILOVER ABORT, replying
+// as soon as the failover starts
+func handleFailoverCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if h.ctx.ServerInstance.IsClusterEnabled() {
+		return make([]constants.DataRepr, 0), errors.New("FAILOVER not allowed in cluster mode.")
+	}
+	options, abort, err := parseFailoverOptions(args)
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	if abort {
+		err = h.replicationHandler.AbortFailover()
+	} else {
+		err = h.replicationHandler.StartFailover(options)
+	}
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	return []constants.DataRepr{utils.CreateStringResponse(constants.OK_RESPONSE)}, nil
+}
+
+func handleSubscribeCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) < 1 {
+		errMessage := fmt.Sprintf("SUBSCRIBE command expects >%d variables but %d given", 0, len(args))
+		h.ctx.Logger.Print(errMessage)
+		return make([]constants.DataRepr, 0), errors.New(errMessage)
+	}
+	// The pub/sub handler confirms each channel, as it knows the subscribing connection
+	return []constants.DataRepr{}, nil
+}
+
+func handleUnsubscribeCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	return []constants.DataRepr{}, nil
+}
+
+func handlePublishCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) != 2 {
+		errMessage := fmt.Sprintf("PUBLISH command expects %d variables but %d given", 2, len(args))
+		h.ctx.Logger.Print(errMessage)
+		return make([]constants.DataRepr, 0), errors.New(errMessage)
+	}
+	received := h.pubSubHandler.Publish(string(args[0].Data), string(args[1].Data))
+	return []constants.DataRepr{utils.CreateIntegerResponse(received)}, nil
+}
+
+func handleBgrewriteaofCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if h.aofHandler == nil || !h.ctx.ServerInstance.IsAppendOnlyEnabled() {
+		return []constants.DataRepr{}, errors.New("append only file is not enabled")
+	}
+	err := h.aofHandler.StartRewrite()
+	if err != nil {
+		return []constants.DataRepr{}, err
+	}
+	return []constants.DataRepr{utils.CreateStringResponse(constants.BGREWRITEAOF_STARTED_RESPONSE)}, nil
+}
+
 // Sub-command handler space
 
 func handleSetPxCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	return setWithExpiry(h, args, constants.SET_PX_COMMAND)
+}
+
+func handleSetExCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	return setWithExpiry(h, args, constants.SET_EX_COMMAND)
+}
+
+func handleSetPxatCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	return setWithExpiry(h, args, constants.SET_PXAT_COMMAND)
+}
+
+func handleSetExatCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	return setWithExpiry(h, args, constants.SET_EXAT_COMMAND)
+}
+
+// setExpirationTimes turn the expiry given to each SET option into the point in time the key expires
+var setExpirationTimes = map[string]func(int) time.Time{
+	constants.SET_PX_COMMAND: func(expiry int) time.Time {
+		return time.Now().Add(time.Duration(expiry) * time.Millisecond)
+	},
+	constants.SET_EX_COMMAND: func(expiry int) time.Time {
+		return time.Now().Add(time.Duration(expiry) * time.Second)
+	},
+	constants.SET_PXAT_COMMAND: func(expiry int) time.Time {
+		return time.UnixMilli(int64(expiry))
+	},
+	constants.SET_EXAT_COMMAND: func(expiry int) time.Time {
+		return time.Unix(int64(expiry), 0)
+	},
+}
+
+// parseSetExpiry returns when SET key value <option> <expiry> makes the key expire
+func parseSetExpiry(subCommand string, expiry []byte) (time.Time, error) {
+	expiryValue, err := strconv.Atoi(string(expiry))
+	if err != nil {
+		return time.Time{}, errors.New(constants.NOT_INTEGER_ERROR)
+	}
+	if expiryValue <= 0 {
+		return time.Time{}, errors.New(constants.INVALID_SET_EXPIRE_ERROR)
+	}
+	return setExpirationTimes[subCommand](expiryValue), nil
+}
+
+// setWithExpiry handles SET key value <option> <expiry>
+func setWithExpiry(h *CommandHandler, args []constants.DataRepr, subCommand string) ([]constants.DataRepr, error) {
 	if len(args) < 4 {
-		errMessage := fmt.Sprintf("SET_PX command expects %d variables but %d given", 4, len(args))
+		errMessage := fmt.Sprintf("%s command expects %d variables but %d given", subCommand, 4, len(args))
 		h.ctx.Logger.Print(errMessage)
 		return make([]constants.DataRepr, 0), errors.New(errMessage)
 	}
 
 	key := string(args[0].Data)
 	value := args[1].Data
-	expiryDurationInMilli, err := strconv.Atoi(string(args[3].Data))
-
+	expirationTime, err := parseSetExpiry(subCommand, args[3].Data)
 	if err != nil {
-		h.ctx.Logger.Printf("Error while handling SET_PX command: %v", err.Error())
-		return []constants.DataRepr{utils.NilBulkStringResponse()}, nil
+		h.ctx.Logger.Printf("Error while handling %s command: %v", subCommand, err.Error())
+		return make([]constants.DataRepr, 0), err
 	}
 	setOptions := persistence.SetOptions{
-		ExpiryDuration: time.Duration(expiryDurationInMilli) * time.Millisecond,
+		ExpirationTime: expirationTime,
 		ValueType:      constants.STRING_DATA_TYPE,
 	}
 	err = h.db.Persist(key, value, setOptions)
 
 	if err != nil {
-		h.ctx.Logger.Printf("Error while handling SET_PX command: %v", err.Error())
-		return []constants.DataRepr{utils.NilBulkStringResponse()}, nil
+		h.ctx.Logger.Printf("Error while handling %s command: %v", subCommand, err.Error())
+		return make([]constants.DataRepr, 0), err
 	}
-	h.ctx.Logger.Printf("Successfully persisted data: '%s'  against key: '%s' with millseconds expiry duration '%d'", value, key, expiryDurationInMilli)
+	h.ctx.Logger.Printf("Successfully persisted data: '%s'  against key: '%s' expiring at '%s'", value, key, setOptions.ExpirationTime)
 	return []constants.DataRepr{utils.CreateStringResponse("OK")}, nil
 }
 
+// Rewrites of non-deterministic write commands
+
+// rewriteSetCommand turns relative expiries into the absolute time the key was given, so replicas and the
+// AOF expire it at the same moment no matter when they apply it
+func rewriteSetCommand(h *CommandHandler, args []constants.DataRepr, result []constants.DataRepr) constants.DataRepr {
+	key := string(args[0].Data)
+	request := utils.CreateRequestForCommand(constants.SET_COMMAND, key, string(args[1].Data))
+	if len(args) <= 2 {
+		return request
+	}
+	expirationTime, _ := parseSetExpiry(setSubCommand(args), args[3].Data)
+	if value, valueExists := h.db.Fetch(key); valueExists && value.ExpirationTime != nil {
+		expirationTime = *value.ExpirationTime
+	} else if !expirationTime.After(time.Now()) {
+		// Set with an expiry already in the past, which removed the key
+		return utils.CreateRequestForCommand(constants.DEL_COMMAND, key)
+	}
+	return utils.CreateRequestForCommand(constants.SET_COMMAND, key, string(args[1].Data),
+		constants.SET_PXAT_PARAM, strconv.FormatInt(expirationTime.UnixMilli(), 10))
+}
+
+// rewriteXaddCommand replaces an ID generated by the server with the ID it produced
+func rewriteXaddCommand(h *CommandHandler, args []constants.DataRepr, result []constants.DataRepr) constants.DataRepr {
+	rewrittenArgs := []string{}
+	for _, arg := range args {
+		rewrittenArgs = append(rewrittenArgs, string(arg.Data))
+	}
+	if strings.Contains(rewrittenArgs[1], constants.XADD_AUTO_ID) {
+		rewrittenArgs[1] = string(result[0].Data)
+	}
+	return utils.CreateRequestForCommand(constants.XADD_COMMAND, rewrittenArgs...)
+}
+
 func handleReplconfGetackCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
-	return []constants.DataRepr{utils.CreateReplconfAck(args[0].Data, 0)}, nil
+	// The offset covers the stream up to, but not including, this GETACK
+	replicaOffset := h.ctx.ServerInstance.GetMasterReplOffset()
+	return []constants.DataRepr{utils.CreateReplconfAck(args[0].Data, replicaOffset)}, nil
 }
 
 func handleConfigGetCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
@@ -274,10 +816,71 @@ func handleConfigGetCommand(h *CommandHandler, args []constants.DataRepr) ([]con
 			response = append(response, utils.CreateBulkResponse(h.ctx.ServerInstance.GetRdbDir()))
 		case constants.RDB_FILE_NAME:
 			response = append(response, utils.CreateBulkResponse(h.ctx.ServerInstance.GetRdbFileName()))
+		case constants.APPEND_ONLY:
+			appendOnly := constants.CONFIG_NO
+			if h.ctx.ServerInstance.IsAppendOnlyEnabled() {
+				appendOnly = constants.CONFIG_YES
+			}
+			response = append(response, utils.CreateBulkResponse(appendOnly))
+		case constants.APPEND_FSYNC:
+			response = append(response, utils.CreateBulkResponse(h.ctx.ServerInstance.GetAppendFsync()))
+		case constants.APPEND_FILE_NAME:
+			response = append(response, utils.CreateBulkResponse(h.ctx.ServerInstance.GetAppendFileName()))
+		case constants.APPEND_DIR_NAME:
+			response = append(response, utils.CreateBulkResponse(h.ctx.ServerInstance.ServerConfig.AppendDirName))
+		case constants.AOF_LOAD_TRUNCATED:
+			aofLoadTruncated := constants.CONFIG_NO
+			if h.ctx.ServerInstance.IsAofLoadTruncatedEnabled() {
+				aofLoadTruncated = constants.CONFIG_YES
+			}
+			response = append(response, utils.CreateBulkResponse(aofLoadTruncated))
+		case constants.REPL_BACKLOG_SIZE:
+			response = append(response, utils.CreateBulkResponse(strconv.Itoa(h.ctx.ServerInstance.GetReplBacklogSize())))
+		case constants.REPL_DISKLESS_SYNC:
+			replDisklessSync := constants.CONFIG_NO
+			if h.ctx.ServerInstance.IsReplDisklessSyncEnabled() {
+				replDisklessSync = constants.CONFIG_YES
+			}
+			response = append(response, utils.CreateBulkResponse(replDisklessSync))
+		case constants.REPL_DISKLESS_SYNC_DELAY:
+			response = append(response, utils.CreateBulkResponse(strconv.Itoa(h.ctx.ServerInstance.ServerConfig.ReplDisklessSyncDelay)))
+		case constants.MIN_REPLICAS_TO_WRITE:
+			response = append(response, utils.CreateBulkResponse(strconv.Itoa(h.ctx.ServerInstance.GetMinReplicasToWrite())))
+		case constants.MIN_REPLICAS_MAX_LAG:
+			response = append(response, utils.CreateBulkResponse(strconv.Itoa(h.ctx.ServerInstance.ServerConfig.MinReplicasMaxLag)))
+		case constants.REPLICA_READ_ONLY:
+			replicaReadOnly := constants.CONFIG_NO
+			if h.ctx.ServerInstance.IsReplicaReadOnly() {
+				replicaReadOnly = constants.CONFIG_YES
+			}
+			response = append(response, utils.CreateBulkResponse(replicaReadOnly))
+		case constants.REPLICA_SERVE_STALE_DATA:
+			replicaServeStaleData := constants.CONFIG_NO
+			if h.ctx.ServerInstance.IsReplicaServeStaleDataEnabled() {
+				replicaServeStaleData = constants.CONFIG_YES
+			}
+			response = append(response, utils.CreateBulkResponse(replicaServeStaleData))
+		case constants.CLUSTER_ENABLED:
+			clusterEnabled := constants.CONFIG_NO
+			if h.ctx.ServerInstance.IsClusterEnabled() {
+				clusterEnabled = constants.CONFIG_YES
+			}
+			response = append(response, utils.CreateBulkResponse(clusterEnabled))
+		case constants.CLUSTER_CONFIG_FILE:
+			response = append(response, utils.CreateBulkResponse(h.ctx.ServerInstance.ServerConfig.ClusterConfigFile))
+		case constants.CLUSTER_NODE_TIMEOUT:
+			response = append(response, utils.CreateBulkResponse(strconv.Itoa(h.ctx.ServerInstance.ServerConfig.ClusterNodeTimeout)))
+		case constants.PROTO_MAX_BULK_LEN:
+			response = append(response, utils.CreateBulkResponse(strconv.Itoa(h.ctx.ServerInstance.GetProtoMaxBulkLen())))
+		case constants.CLIENT_OUTPUT_BUFFER_LIMIT:
+			serverConfig := h.ctx.ServerInstance.ServerConfig
+			response = append(response, utils.CreateBulkResponse(fmt.Sprintf("%s %d %d %d", constants.CLIENT_CLASS_REPLICA,
+				serverConfig.ReplicaOutputBufferHardLimit, serverConfig.ReplicaOutputBufferSoftLimit, serverConfig.ReplicaOutputBufferSoftSeconds)))
 		default:
-			continue
+			// Unknown parameters are left out, along with their name
+			response = response[:len(response)-1]
 		}
 	}
 
-	return []constants.DataRepr{utils.CreateArrayDataRepr(response)}, nil
+	return []constants.DataRepr{utils.CreateMapDataRepr(response)}, nil
 }
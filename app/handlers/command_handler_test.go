@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+func createArgs(args ...string) []constants.DataRepr {
+	dataArgs := make([]constants.DataRepr, 0, len(args))
+	for _, arg := range args {
+		dataArgs = append(dataArgs, utils.CreateBulkResponse(arg))
+	}
+	return dataArgs
+}
+
+func requestArgs(request constants.DataRepr) []string {
+	args := make([]string, 0, len(request.Array))
+	for _, arg := range request.Array {
+		args = append(args, string(arg.Data))
+	}
+	return args
+}
+
+func TestRewriteSetCommand(t *testing.T) {
+	h := newTestHandlers(t).commandHandler
+	now := time.Now()
+	futureMillis := strconv.FormatInt(now.Add(time.Hour).UnixMilli(), 10)
+	futureSeconds := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+	testCases := []struct {
+		args []string
+		// Expected rewrite. PXAT is expected at absoluteMillis, or within a second of fromNow when it's empty
+		expected       []string
+		fromNow        time.Duration
+		absoluteMillis string
+	}{
+		{[]string{"k", "v"}, []string{"SET", "k", "v"}, 0, ""},
+		{[]string{"k", "v", "EX", "100"}, []string{"SET", "k", "v", "PXAT"}, 100 * time.Second, ""},
+		{[]string{"k", "v", "px", "5000"}, []string{"SET", "k", "v", "PXAT"}, 5 * time.Second, ""},
+		{[]string{"k", "v", "EXAT", futureSeconds}, []string{"SET", "k", "v", "PXAT"}, 0, futureSeconds + "000"},
+		{[]string{"k", "v", "PXAT", futureMillis}, []string{"SET", "k", "v", "PXAT"}, 0, futureMillis},
+		{[]string{"k", "v", "PXAT", "1"}, []string{"DEL", "k"}, 0, ""},
+	}
+	for _, testCase := range testCases {
+		args := createArgs(testCase.args...)
+		result, err := handleSetCommand(h, args)
+		if err != nil {
+			t.Fatalf("Unexpected error for SET %v: %v", testCase.args, err)
+		}
+		rewritten := requestArgs(rewriteSetCommand(h, args, result))
+		if len(testCase.expected) == 4 {
+			if len(rewritten) != 5 || !slices.Equal(rewritten[:4], testCase.expected) {
+				t.Errorf("Expected SET %v to be rewritten as %v <time>, Got: %v", testCase.args, testCase.expected, rewritten)
+				continue
+			}
+			if len(testCase.absoluteMillis) > 0 {
+				if rewritten[4] != testCase.absoluteMillis {
+					t.Errorf("Expected SET %v to expire at %s, Got: %s", testCase.args, testCase.absoluteMillis, rewritten[4])
+				}
+				continue
+			}
+			expiresAt, _ := strconv.ParseInt(rewritten[4], 10, 64)
+			if expiresIn := time.UnixMilli(expiresAt).Sub(now); expiresIn < testCase.fromNow-time.Second || expiresIn > testCase.fromNow+time.Second {
+				t.Errorf("Expected SET %v to expire in %s, Got: %s", testCase.args, testCase.fromNow, expiresIn)
+			}
+		} else if !slices.Equal(rewritten, testCase.expected) {
+			t.Errorf("Expected SET %v to be rewritten as %v, Got: %v", testCase.args, testCase.expected, rewritten)
+		}
+	}
+
+	for _, invalidArgs := range [][]string{{"k2", "v", "PX", "abc"}, {"k2", "v", "EX", "0"}} {
+		if _, err := handleSetCommand(h, createArgs(invalidArgs...)); err == nil {
+			t.Errorf("Expected an error for SET %v", invalidArgs)
+		}
+	}
+	if _, exists := h.db.Fetch("k2"); exists {
+		t.Errorf("Expected SET with an invalid expiry to leave the key unset")
+	}
+}
+
+func TestRewriteXaddCommand(t *testing.T) {
+	h := newTestHandlers(t).commandHandler
+	args := createArgs("stream", "*", "field", "value")
+	result, err := handleXaddCommand(h, args)
+	if err != nil {
+		t.Fatalf("Unexpected error for XADD: %v", err)
+	}
+	expected := []string{"XADD", "stream", string(result[0].Data), "field", "value"}
+	if rewritten := requestArgs(rewriteXaddCommand(h, args, result)); !slices.Equal(rewritten, expected) {
+		t.Errorf("Expected the generated ID to be propagated as %v, Got: %v", expected, rewritten)
+	}
+
+	args = createArgs("stream", "9999999999999-1", "field", "value")
+	result, err = handleXaddCommand(h, args)
+	if err != nil {
+		t.Fatalf("Unexpected error for XADD with an explicit ID: %v", err)
+	}
+	expected = []string{"XADD", "stream", "9999999999999-1", "field", "value"}
+	if rewritten := requestArgs(rewriteXaddCommand(h, args, result)); !slices.Equal(rewritten, expected) {
+		t.Errorf("Expected an explicit ID to be propagated as given %v, Got: %v", expected, rewritten)
+	}
+}
+
+func TestCheckMinReplicas(t *testing.T) {
+	h := newTestHandlers(t).commandHandler
+	serverConfig := &h.ctx.ServerInstance.ServerConfig
+	setCommand := h.CommandRegistry[constants.SET_COMMAND]
+	testCases := []struct {
+		minReplicasToWrite int
+		minReplicasMaxLag  int
+		refused            bool
+	}{
+		{0, 10, false},
+		{1, 0, false},
+		{1, 10, true},
+	}
+	for _, testCase := range testCases {
+		serverConfig.MinReplicasToWrite, serverConfig.MinReplicasMaxLag = testCase.minReplicasToWrite, testCase.minReplicasMaxLag
+		if err := h.checkMinReplicas(setCommand); (err != nil) != testCase.refused {
+			t.Errorf("Expected writes without replicas to be refused=%v with min-replicas-to-write %d and min-replicas-max-lag %d, Got: %v",
+				testCase.refused, testCase.minReplicasToWrite, testCase.minReplicasMaxLag, err)
+		}
+	}
+}
+
+func TestCheckReplicaRestrictions(t *testing.T) {
+	handlers := newTestHandlers(t)
+	h := handlers.commandHandler
+	serverInstance := handlers.ctx.ServerInstance
+	testCases := []struct {
+		role           string
+		linkState      string
+		readOnly       bool
+		serveStaleData bool
+		command        string
+		fromMaster     bool
+		expected       string
+	}{
+		{constants.MASTER_ROLE, "", true, false, constants.SET_COMMAND, false, ""},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECTED, true, true, constants.SET_COMMAND, false, constants.READONLY_ERROR},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECTED, false, true, constants.SET_COMMAND, false, ""},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECTED, true, true, constants.SET_COMMAND, true, ""},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECT, true, false, constants.GET_COMMAND, false, constants.MASTERDOWN_ERROR},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECT, true, true, constants.GET_COMMAND, false, ""},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECT, true, false, constants.PING_COMMAND, false, ""},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECTED, true, false, constants.GET_COMMAND, false, ""},
+		{constants.REPLICA_ROLE, constants.MASTER_LINK_STATE_CONNECT, true, false, constants.SET_COMMAND, true, ""},
+	}
+	for _, testCase := range testCases {
+		serverInstance.ReplicationConfig.Role, serverInstance.ReplicationConfig.MasterLinkState = testCase.role, testCase.linkState
+		serverInstance.ServerConfig.ReplicaReadOnly, serverInstance.ServerConfig.ReplicaServeStaleData = testCase.readOnly, testCase.serveStaleData
+		err := h.checkReplicaRestrictions(h.CommandRegistry[testCase.command], testCase.fromMaster)
+		if (err == nil && testCase.expected != "") || (err != nil && err.Error() != testCase.expected) {
+			t.Errorf("Expected %s on a %s with link %q (read only %v, serve stale data %v, from master %v) to give %q, Got: %v",
+				testCase.command, testCase.role, testCase.linkState, testCase.readOnly, testCase.serveStaleData, testCase.fromMaster, testCase.expected, err)
+		}
+	}
+
+	// Writes from the master are applied while clients are refused
+	setRequest := utils.CreateRequestForCommand(constants.SET_COMMAND, "key", "value")
+	for _, fromMaster := range []bool{false, true} {
+		h.ExecuteCommand(constants.ExecuteCommandRequest{
+			Cmd:            constants.SET_COMMAND,
+			Args:           setRequest.Array[1:],
+			DecodedRequest: setRequest,
+			FromMaster:     fromMaster,
+		})
+		value, _ := handleGetCommand(h, createArgs("key"))
+		if applied := len(value) == 1 && string(value[0].Data) == "value"; applied != fromMaster {
+			t.Errorf("Expected a write from the master only to be applied, from master %v, Got: %q", fromMaster, value)
+		}
+	}
+}
+
+func TestConfigGet(t *testing.T) {
+	h := newTestHandlers(t).commandHandler
+	result, err := handleConfigGetCommand(h, createArgs(constants.RDB_FILE_NAME, "nosuch"))
+	if err != nil || len(result) != 1 {
+		t.Fatalf("Unexpected reply for CONFIG GET: %q (%v)", result, err)
+	}
+	expected := map[int]string{
+		constants.RESP2_PROTOCOL: "*2\r\n$10\r\ndbfilename\r\n$8\r\ndump.rdb\r\n",
+		constants.RESP3_PROTOCOL: "%1\r\n$10\r\ndbfilename\r\n$8\r\ndump.rdb\r\n",
+	}
+	for protocol, expectedReply := range expected {
+		if reply := string(parser.EncodeForProtocol(result[0], protocol)); reply != expectedReply {
+			t.Errorf("Expected CONFIG GET to leave out unknown parameters in RESP%d %q, Got: %q", protocol, expectedReply, reply)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// commandLink is a connection sending commands to another server, such as a sentinel's link to a monitored
+// instance or a cluster node's bus link to another node. Commands are sent one at a time, and the connection
+// is dropped and dialed again after any error
+type commandLink struct {
+	address string
+	conn    net.Conn
+	reader  *bufio.Reader
+	lock    sync.Mutex
+	closed  bool
+}
+
+func newCommandLink(address string) *commandLink {
+	return &commandLink{address: address}
+}
+
+// call sends a command and waits for its reply, giving up after timeout
+func (l *commandLink) call(timeout time.Duration, command string, args ...string) (constants.DataRepr, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return constants.DataRepr{}, errors.New("link closed")
+	}
+	if l.conn == nil {
+		conn, err := net.DialTimeout("tcp", l.address, timeout)
+		if err != nil {
+			return constants.DataRepr{}, err
+		}
+		l.conn, l.reader = conn, bufio.NewReader(conn)
+	}
+	l.conn.SetDeadline(time.Now().Add(timeout))
+	_, err := l.conn.Write(parser.Encode(utils.CreateRequestForCommand(command, args...)))
+	if err != nil {
+		l.dropConn()
+		return constants.DataRepr{}, err
+	}
+	reply, err := parser.DecodeFrom(l.reader)
+	if err != nil {
+		l.dropConn()
+		return constants.DataRepr{}, err
+	}
+	return reply, nil
+}
+
+// localIp is the address the other server sees this one connecting from, which sentinels announce in hellos
+func (l *commandLink) localIp() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.conn == nil {
+		return ""
+	}
+	localIp, _, _ := net.SplitHostPort(l.conn.LocalAddr().String())
+	return localIp
+}
+
+func (l *commandLink) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closed = true
+	l.dropConn()
+}
+
+func (l *commandLink) dropConn() {
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn, l.reader = nil, nil
+	}
+}
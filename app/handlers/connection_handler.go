@@ -1,19 +1,15 @@
 package handlers
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"io"
 	"net"
-	"os"
 	"sync"
 	"syscall"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
 	"github.com/codecrafters-io/redis-starter-go/app/context"
 	"github.com/codecrafters-io/redis-starter-go/app/parser"
-	"github.com/codecrafters-io/redis-starter-go/app/server"
 	"github.com/codecrafters-io/redis-starter-go/app/utils"
 	"github.com/google/uuid"
 )
@@ -31,14 +27,33 @@ type HandshakeStep struct {
 
 type ConnectionHandler struct {
 	connectionFileDescriptorBiMap *utils.BiMap[int, net.Conn]
-	requestIdToConnMap            map[uuid.UUID]net.Conn
 	epollFd                       int
 	ctx                           *context.Context
 	requestHandler                *RequestHandler
 	notificationHandler           *NotificationHandler
+	replicationHandler            *ReplicationHandler
 	masterConn                    *net.Conn
-	masterRequestBytesProcessed   int
-	requestsProcessedCounterLock  sync.Mutex
+	// Closed once the current master connection goes down
+	masterLinkClosed chan struct{}
+	// Connection to the master while the handshake is in progress
+	handshakeConn     net.Conn
+	masterLinkRunning bool
+	// Wakes up runMasterLink waiting to retry, when the master is changed
+	masterLinkReset chan struct{}
+	masterConnLock  sync.Mutex
+	// Data from the master is processed one read at a time, as the replication stream has to be applied in order
+	masterLinkLock sync.Mutex
+	terminateLock  sync.Mutex
+	// Start of a command from the master whose remaining bytes haven't arrived yet
+	pendingMasterData []byte
+	// Set after the first full resync, from then on reconnections ask the master to continue the stream
+	syncedWithMaster bool
+	// Set by FAILOVER, the next PSYNC asks the new master to take over from this server
+	failoverPsync bool
+	// State of the registered connections, by connection
+	clients      map[net.Conn]*client
+	nextClientId int
+	clientLock   sync.Mutex
 }
 
 func InitConnectionHandler(ctx *context.Context, requestHandler *RequestHandler, notificationHandler *NotificationHandler) *ConnectionHandler {
@@ -48,11 +63,11 @@ func InitConnectionHandler(ctx *context.Context, requestHandler *RequestHandler,
 		ctx:                           ctx,
 		requestHandler:                requestHandler,
 		notificationHandler:           notificationHandler,
-		requestIdToConnMap:            make(map[uuid.UUID]net.Conn),
 		masterConn:                    nil,
-		masterRequestBytesProcessed:   0,
+		masterLinkReset:               make(chan struct{}, 1),
+		clients:                       make(map[net.Conn]*client),
 	}
-	connectionHandler.notificationHandler.SubscribeToCmdExecutedNotification(connectionHandler.processCmdExecutedNotification)
+	requestHandler.commandHandler.connHandler = &connectionHandler
 	return &connectionHandler
 }
 
@@ -62,13 +77,18 @@ func (h *ConnectionHandler) StartEventLoop() {
 		h.ctx.Logger.Fatalf("Error creating epoll: %v", err.Error())
 	}
 	h.epollFd = epollFd
-	go h.handleMasterConnection()
+	if h.ctx.ServerInstance.GetReplicationRole() == constants.REPLICA_ROLE {
+		h.StartMasterLink()
+	}
 	go h.acceptConnections()
 
 	events := make([]syscall.EpollEvent, 100)
 
 	for {
 		n, err := syscall.EpollWait(h.epollFd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
 		if err != nil {
 			h.ctx.Logger.Fatalf("Error waiting for epoll events: %v", err.Error())
 		}
@@ -82,48 +102,98 @@ func (h *ConnectionHandler) StartEventLoop() {
 	}
 }
 
-func (h *ConnectionHandler) GetConnectionForRequest(requestId uuid.UUID) (*net.Conn, error) {
-	h.ctx.Logger.Printf("Fetching connection for requestId: %s", requestId.String())
-	conn, connExists := h.requestIdToConnMap[requestId]
-	if !connExists {
-		errMessage := fmt.Sprintf("Connection not present for requestId: %s", requestId.String())
-		h.ctx.Logger.Printf(errMessage)
-		return nil, errors.New(errMessage)
+// notificationConn returns the connection an executed command was received on
+func notificationConn(notification constants.CommandExecutedNotification) (net.Conn, error) {
+	if notification.Conn == nil {
+		return nil, fmt.Errorf("connection not present for requestId: %s", notification.RequestId.String())
 	}
-	h.ctx.Logger.Printf("Successfully fetched connection for requestId: %s", requestId.String())
-	return &conn, nil
+	return notification.Conn, nil
 }
 
 func (h *ConnectionHandler) processEventForConnection(connFd int) {
 	conn, isConnPresent := h.connectionFileDescriptorBiMap.Lookup(connFd)
 	if !isConnPresent {
-		h.ctx.Logger.Printf("Connection object not found for connection file descriptor: %d. Terminating the connection", connFd)
-		h.terminateConnection(conn)
+		h.ctx.Logger.Printf("Connection object not found for connection file descriptor: %d. Removing it from epoll", connFd)
+		h.closeConnectionPoll(connFd)
 		return
 	}
-	dataFromConn, err := h.fetchDataFromConnection(conn)
-	if err != nil {
+	isMasterConn := h.isMasterConn(conn)
+	if isMasterConn {
+		h.masterLinkLock.Lock()
+		defer h.masterLinkLock.Unlock()
+	}
+	if isMasterConn {
+		// The pending start of a command is decoded again with each read, growing reads keep that linear
+		dataFromConn, err := h.readFromConnection(conn, max(constants.PROTO_IOBUF_LEN, len(h.pendingMasterData)))
+		if err != nil {
+			h.terminateConnection(conn)
+			return
+		}
+		defer h.rearmConnectionPoll(connFd)
+		h.processMasterData(conn, dataFromConn)
+		return
+	}
+	requestParser := h.getClient(conn).requestParser
+	if requestParser == nil {
 		h.terminateConnection(conn)
 		return
 	}
-	if len(dataFromConn) == 0 {
+	// The parser reads into its own buffer, which is kept across reads
+	if _, err := requestParser.ReadFromConn(conn); err != nil {
+		h.terminateConnection(conn)
 		return
 	}
-	h.processRequest(conn, dataFromConn)
+	if h.processClientData(conn, requestParser) {
+		h.rearmConnectionPoll(connFd)
+	}
+}
+
+// processClientData executes the requests completed by the data read from a client, in order. The rest of the
+// data stays with the parser until more arrives. A protocol error is replied to before the connection is
+// closed, as what follows can't be parsed, in which case false is returned
+func (h *ConnectionHandler) processClientData(conn net.Conn, requestParser *parser.RequestParser) bool {
+	for {
+		request, err := requestParser.Next()
+		if errors.Is(err, parser.ErrNeedMoreData) {
+			return true
+		}
+		if err != nil {
+			h.ctx.Logger.Printf("(%s) Closing connection after protocol error: %v", conn.RemoteAddr(), err.Error())
+			h.writeDataToConnection(conn, []constants.DataRepr{utils.CreateErrorResponse(err.Error())})
+			h.terminateConnection(conn)
+			return false
+		}
+		h.processClientRequest(conn, request)
+	}
+}
+
+func (h *ConnectionHandler) processClientRequest(conn net.Conn, request constants.DataRepr) {
+	requestId := uuid.New()
+	h.ctx.Logger.Printf("From connection (%s) received request ID '%s': %q", conn.RemoteAddr(), requestId.String(), request.Array)
+	response := h.requestHandler.ProcessClientRequest(request, conn, requestId)
+	h.writeDataToConnection(conn, response)
+}
+
+// processMasterRequest applies a request from the replication stream, which took size bytes of it
+func (h *ConnectionHandler) processMasterRequest(conn net.Conn, request constants.DataRepr, size int) {
+	requestId := uuid.New()
+	h.ctx.Logger.Printf("From master (%s) received request ID '%s': %q", conn.RemoteAddr(), requestId.String(), request.Array)
+	if response := h.requestHandler.ProcessMasterRequest(request, size, conn, requestId); len(response) > 0 {
+		h.writeDataToConnection(conn, response)
+	}
 }
 
 func (h *ConnectionHandler) processRequest(conn net.Conn, dataToProcess []byte) {
 	requestId := uuid.New()
 	h.ctx.Logger.Printf("From connection (%s) received request ID '%s' with data: %q", conn.RemoteAddr(), requestId.String(), dataToProcess)
-	h.requestIdToConnMap[requestId] = conn
 	responseList := h.requestHandler.ProcessRequest(constants.Request{
-		Data:      dataToProcess,
-		RequestId: requestId,
+		Data:       dataToProcess,
+		RequestId:  requestId,
+		Conn:       conn,
+		FromMaster: h.isMasterConn(conn),
 	})
 	for _, response := range responseList {
-		if h.masterConn == nil || conn != *h.masterConn {
-			h.writeDataToConnection(conn, response)
-		}
+		h.writeDataToConnection(conn, response)
 	}
 }
 
@@ -135,14 +205,7 @@ func (h *ConnectionHandler) acceptConnections() {
 			continue
 		}
 
-		connFd := h.getConnectionFileDescriptor(conn)
-		h.ctx.Logger.Printf("For connection (%s) Got connection file descriptor: %d", conn.RemoteAddr(), connFd)
-
-		h.connectionFileDescriptorBiMap.Insert(connFd, conn)
-		err = syscall.EpollCtl(h.epollFd, syscall.EPOLL_CTL_ADD, connFd, &syscall.EpollEvent{
-			Events: syscall.EPOLLIN,
-			Fd:     int32(connFd),
-		})
+		err = h.registerConnection(conn)
 		if err != nil {
 			h.ctx.Logger.Printf("Error adding connection (%s) to epoll: %v", conn.RemoteAddr(), err.Error())
 			h.terminateConnection(conn)
@@ -153,181 +216,77 @@ func (h *ConnectionHandler) acceptConnections() {
 	}
 }
 
-func (h *ConnectionHandler) fetchDataFromConnection(conn net.Conn) ([]byte, error) {
-	// h.ctx.Logger.Printf("Started reading data from connection (%s)", conn.RemoteAddr())
-	reader := bufio.NewReader(conn)
-	data := make([]byte, 0, 1024)
-	for {
-		readBuf := make([]byte, 1024)
-		bytesRead, err := reader.Read(readBuf)
-		// h.ctx.Logger.Printf("From connection (%s) read %d bytes", conn.RemoteAddr(), bytesRead)
-		if err != nil {
-			// h.ctx.Logger.Printf("From connection (%s) error reading data from: %v", conn.RemoteAddr(), err.Error())
-			if err != io.EOF {
-				return nil, err
-			}
-			break
-		}
-		data = append(data, readBuf[:bytesRead]...)
-		if bytesRead < 1024 {
-			// If we don't have anymore data to read, we can safely quit the read loop
-			break
-		}
-	}
-	if len(data) < 1 {
-		// h.ctx.Logger.Printf("From connection (%s) no data received", conn.RemoteAddr())
-	}
-
-	return data, nil
+// registerConnection adds a connection to epoll, after which its requests are served by the event loop.
+// The fd is registered one-shot and rearmed once an event is handled, so a connection is served by one
+// goroutine at a time and its requests are processed in order
+func (h *ConnectionHandler) registerConnection(conn net.Conn) error {
+	connFd := h.getConnectionFileDescriptor(conn)
+	h.ctx.Logger.Printf("For connection (%s) Got connection file descriptor: %d", conn.RemoteAddr(), connFd)
+
+	h.connectionFileDescriptorBiMap.Insert(connFd, conn)
+	h.registerClient(conn)
+	return syscall.EpollCtl(h.epollFd, syscall.EPOLL_CTL_ADD, connFd, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLONESHOT,
+		Fd:     int32(connFd),
+	})
 }
 
-func (h *ConnectionHandler) handleMasterConnection() {
-	hostServer := h.ctx.ServerInstance
-	serverRole := hostServer.ReplicationConfig.Role
-	if serverRole == constants.MASTER_ROLE {
-		return
-	}
-	masterAddress := hostServer.ReplicationConfig.MasterServerAddress
-	masterConn, bufferedRequest, err := h.initiateHandShakeWithMaster(hostServer)
-	if err != nil {
-		h.ctx.Logger.Fatalf("Error while trying to initiate handshake with master (%s): %v", masterAddress, err.Error())
-	}
-	h.masterConn = &masterConn
-	h.handleInitialDataPostHandshake(masterConn, bufferedRequest)
-
-	h.ctx.Logger.Printf("Handshake completed with master at address: %s", masterAddress)
-	masterConnFd := h.getConnectionFileDescriptor(masterConn)
-	h.ctx.Logger.Printf("For master connection (%s) Got connection file descriptor: %d", masterAddress, masterConnFd)
-
-	h.connectionFileDescriptorBiMap.Insert(masterConnFd, masterConn)
-	err = syscall.EpollCtl(h.epollFd, syscall.EPOLL_CTL_ADD, masterConnFd, &syscall.EpollEvent{
-		Events: syscall.EPOLLIN,
-		Fd:     int32(masterConnFd),
+func (h *ConnectionHandler) rearmConnectionPoll(connFd int) {
+	err := syscall.EpollCtl(h.epollFd, syscall.EPOLL_CTL_MOD, connFd, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLONESHOT,
+		Fd:     int32(connFd),
 	})
 	if err != nil {
-		h.ctx.Logger.Fatalf("[FATAL] Error adding master connection (%s) to epoll: %v", masterAddress, err.Error())
-		h.terminateConnection(masterConn)
+		// The connection was terminated meanwhile
+		h.ctx.Logger.Printf("Failed to rearm fd %d in epoll: %v", connFd, err)
 	}
-
-	h.ctx.Logger.Printf("Connection with master (%s) successfully established", masterConn.RemoteAddr())
 }
 
-func (h *ConnectionHandler) initiateHandShakeWithMaster(serverInstance *server.Server) (net.Conn, []constants.DataRepr, error) {
-	masterServerAddress := (*serverInstance).ReplicationConfig.MasterServerAddress
-	conn, err := net.Dial("tcp", masterServerAddress)
-
+// readFromConnection reads what is available on a connection, up to readSize bytes. The fd is level
+// triggered, so any data left is read once it is rearmed
+func (h *ConnectionHandler) readFromConnection(conn net.Conn, readSize int) ([]byte, error) {
+	readBuf := make([]byte, readSize)
+	bytesRead, err := conn.Read(readBuf)
 	if err != nil {
-		h.ctx.Logger.Printf("Error while trying to establish connection with master (%s): %v", masterServerAddress, err.Error())
-		return nil, nil, err
+		return nil, err
 	}
-	var lastDecodedResponse []constants.DataRepr
-	handshakePipeline := h.createHandshakePipeline(serverInstance)
-	for _, handshakeStep := range handshakePipeline {
-		cmd := handshakeStep.CommandName
-		h.ctx.Logger.Printf("Beginning the handshake step with master (%s) using command (%s)", masterServerAddress, cmd)
-
-		_, err := h.writeDataToConnection(conn, []constants.DataRepr{handshakeStep.Request})
-		if err != nil {
-			h.ctx.Logger.Printf("Error while trying to send command (%s) master (%s): %v", cmd, masterServerAddress, err.Error())
-			return nil, nil, err
-		}
-
-		responseFromMaster, err := h.fetchDataFromConnection(conn)
-		if err != nil {
-			h.ctx.Logger.Printf("Error while waiting for response from master (%s) for command (%s): %v", masterServerAddress, cmd, err.Error())
-			return nil, nil, err
-		}
-		if len(responseFromMaster) == 0 {
-			errMessage := fmt.Sprintf("Empty response received from master (%s) for command (%s): %v", masterServerAddress, cmd, err.Error())
-			h.ctx.Logger.Printf(errMessage)
-			return nil, nil, errors.New(errMessage)
-		}
-		h.ctx.Logger.Printf("Received response from master (%s) for command (%s): %q", masterServerAddress, cmd, responseFromMaster)
-
-		decodedResponseFromMaster, err := parser.Decode(responseFromMaster)
-		if err != nil {
-			h.ctx.Logger.Printf("Error while decoding for response from master (%s) for command (%s): %v", masterServerAddress, cmd, err.Error())
-			return nil, nil, err
-		}
-		prefixOnlyCheck := false
-		if cmd == constants.PSYNC_COMMAND {
-			prefixOnlyCheck = true
-			lastDecodedResponse = append(lastDecodedResponse, decodedResponseFromMaster[1:]...)
-		}
-		if !decodedResponseFromMaster[0].IsEqual(handshakeStep.ExpectedResponse, prefixOnlyCheck) {
-			h.ctx.Logger.Printf("Unexpected response from master (%s) for command (%s): %+v", masterServerAddress, cmd, decodedResponseFromMaster)
-			return nil, nil, err
-		}
-	}
-	h.requestHandler.ctx.Logger.Printf("Last decoded response: %s", lastDecodedResponse)
-	return conn, lastDecodedResponse, nil
+	return readBuf[:bytesRead], nil
 }
 
-func (h *ConnectionHandler) handleInitialDataPostHandshake(conn net.Conn, requestList []constants.DataRepr) {
-	encodedRequests := []byte{}
-	for _, request := range requestList {
-		if len(request.Data) == 0 && request.Type != constants.ARRAY {
-			continue
-		}
-		h.requestHandler.ctx.Logger.Printf("Post handshake request data: %s", string(request.Data))
-		encodedRequest := parser.Encode(request)
-		encodedRequests = append(encodedRequests, encodedRequest...)
-	}
-	if len(encodedRequests) == 0 {
-		return
+// getConnectionFileDescriptor returns the connection's own fd rather than a duplicate from File(), which
+// would keep the socket open after the connection is closed
+func (h *ConnectionHandler) getConnectionFileDescriptor(conn net.Conn) int {
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		h.ctx.Logger.Fatalf("Error getting file descriptor: %v", err.Error())
 	}
-	h.processRequest(conn, encodedRequests)
-}
-
-func (h *ConnectionHandler) createHandshakePipeline(serverInstance *server.Server) []HandshakeStep {
-	handshakePipeline := []HandshakeStep{}
-	handshakePipeline = append(handshakePipeline, HandshakeStep{
-		CommandName:      constants.PING_COMMAND,
-		Request:          utils.CreateRequestForCommand(constants.PING_COMMAND),
-		ExpectedResponse: utils.CreateStringResponse(constants.PONG_RESPONSE),
-	})
-	ok_response := utils.CreateStringResponse(constants.OK_RESPONSE)
-	handshakePipeline = append(handshakePipeline, HandshakeStep{
-		CommandName:      constants.REPLCONF_COMMAND,
-		Request:          utils.CreateRequestForCommand(constants.REPLCONF_COMMAND, constants.REPLCONF_LISTENING_PORT_PARAM, (serverInstance).ListeningPort),
-		ExpectedResponse: ok_response,
-	})
-	handshakePipeline = append(handshakePipeline, HandshakeStep{
-		CommandName:      constants.REPLCONF_COMMAND,
-		Request:          utils.CreateRequestForCommand(constants.REPLCONF_COMMAND, constants.REPLCONF_CAPA_PARAM, constants.REPLCONF_PSYNC2_PARAM),
-		ExpectedResponse: ok_response,
-	})
-	handshakePipeline = append(handshakePipeline, HandshakeStep{
-		CommandName:      constants.PSYNC_COMMAND,
-		Request:          utils.CreateRequestForCommand(constants.PSYNC_COMMAND, constants.PSYNC_UNKNOWN_REPLICATION_ID_PARAM, constants.PSYNC_UNKNOWN_MASTER_OFFSET),
-		ExpectedResponse: utils.CreateStringResponse(constants.FULLRESYNC_RESPONSE),
+	connFd := -1
+	err = rawConn.Control(func(fd uintptr) {
+		connFd = int(fd)
 	})
-
-	return handshakePipeline
-}
-
-func (h *ConnectionHandler) getConnectionFileDescriptor(conn net.Conn) int {
-	tcpConn := conn.(*net.TCPConn)
-	file, err := tcpConn.File()
-
 	if err != nil {
 		h.ctx.Logger.Fatalf("Error getting file descriptor: %v", err.Error())
 	}
-	return int(file.Fd())
+	return connFd
 }
 
 func (h *ConnectionHandler) terminateConnection(conn net.Conn) {
-	h.closeConnection(conn)
-	h.ctx.ConnectionClosedNotificationChan <- constants.ConnectionClosedNotification{
-		Conn: conn,
-	}
+	// The fd leaves epoll before it is closed, as it may be reused by the next accepted connection
+	h.terminateLock.Lock()
 	connFd, connFdPresent := h.connectionFileDescriptorBiMap.ReverseLookup(conn)
-	if !connFdPresent {
-		h.ctx.Logger.Printf(" Connection (%s) file descriptor not found in connection file descriptor map while terminating connection", conn.RemoteAddr())
+	if connFdPresent {
+		h.closeConnectionPoll(connFd)
+	}
+	h.terminateLock.Unlock()
+	if !h.closeConnection(conn) {
+		// Already terminated, e.g. by another event for the same connection
 		return
 	}
-
-	h.closeConnectionPoll(connFd)
+	h.dropMasterConn(conn)
+	h.unregisterClient(conn)
+	h.ctx.ConnectionClosedNotificationChan <- constants.ConnectionClosedNotification{
+		Conn: conn,
+	}
 }
 
 func (h *ConnectionHandler) closeConnectionPoll(connFd int) {
@@ -339,20 +298,23 @@ func (h *ConnectionHandler) closeConnectionPoll(connFd int) {
 	h.ctx.Logger.Printf("[ConnFD-%d] Connection closed", connFd)
 }
 
-func (h *ConnectionHandler) closeConnection(conn net.Conn) {
+func (h *ConnectionHandler) closeConnection(conn net.Conn) bool {
 	err := conn.Close()
 	if err != nil {
 		h.ctx.Logger.Printf("(%s) Error closing connection: '%v'", conn.RemoteAddr(), err.Error())
-		os.Exit(1)
+		return false
 	}
 	h.connectionFileDescriptorBiMap.DeleteUsingReverseLookup(conn)
 	h.ctx.Logger.Printf("(%s) Connection closed", conn.RemoteAddr())
+	return true
 }
 
+// writeDataToConnection encodes data in the protocol the connection chose with HELLO
 func (h *ConnectionHandler) writeDataToConnection(conn net.Conn, dataList []constants.DataRepr) (int, error) {
 	dataWrittenToConn := 0
+	protocol := h.getClient(conn).protocol
 	for _, data := range dataList {
-		encodedData := parser.Encode(data)
+		encodedData := parser.EncodeForProtocol(data, protocol)
 		h.ctx.Logger.Printf("(%s) Begin writing data '%q' to connection", conn.RemoteAddr(), encodedData)
 		_, err := conn.Write(encodedData)
 		if err != nil {
@@ -365,47 +327,14 @@ func (h *ConnectionHandler) writeDataToConnection(conn net.Conn, dataList []cons
 	return dataWrittenToConn, nil
 }
 
-// Callback function that will be invoked by notification handler
-func (h *ConnectionHandler) processCmdExecutedNotification(notification constants.CommandExecutedNotification) (bool, error) {
-	h.ctx.Logger.Printf("Invoked processCmdExecutedNotification in connection handler with command [%s]", notification.Cmd)
-	if h.ctx.ServerInstance.ReplicationConfig.Role == constants.MASTER_ROLE {
-		return h.processCmdExecutedNotificationForAsMaster(notification)
-	}
-	conn, err := h.GetConnectionForRequest(notification.RequestId)
-	h.ctx.Logger.Printf("Got connection [%s] for notification cmd [%s]", (*conn).RemoteAddr(), notification.Cmd)
+// writeBytesToConnection writes data which is already RESP encoded, such as a slice of the replication stream
+func (h *ConnectionHandler) writeBytesToConnection(conn net.Conn, data []byte) (int, error) {
+	bytesWritten, err := conn.Write(data)
 	if err != nil {
-		h.ctx.Logger.Printf("Error while trying to fetch connection for executed command with requestId: %s", notification.RequestId.String())
-		return false, err
+		h.ctx.Logger.Printf("(%s) Error writing %d bytes to connection: %v", conn.RemoteAddr(), len(data), err.Error())
+		return bytesWritten, err
 	}
-	if h.masterConn != nil && *conn == *h.masterConn {
-		return h.handleCmdExecutedFromMaster(*conn, notification)
-	}
-	return true, nil
+	return bytesWritten, nil
 }
 
-func (h *ConnectionHandler) handleCmdExecutedFromMaster(masterConn net.Conn, notification constants.CommandExecutedNotification) (bool, error) {
-	// Handle more conversations with master
-	h.requestsProcessedCounterLock.Lock()
-	defer h.requestsProcessedCounterLock.Unlock()
-	masterRequestBytesProcessedTillNow := h.masterRequestBytesProcessed
-	encodedRequestBytes := parser.Encode(notification.DecodedRequest)
-	switch notification.Cmd {
-	case constants.REPLCONF_COMMAND:
-		if string(notification.Args[0].Data) != constants.GETACK {
-			return true, nil
-		}
-		h.masterRequestBytesProcessed += len(encodedRequestBytes)
-		responseToMaster := utils.CreateReplconfAck([]byte{}, masterRequestBytesProcessedTillNow)
-		h.writeDataToConnection(masterConn, []constants.DataRepr{responseToMaster})
-		return true, nil
-	default:
-		if masterRequestBytesProcessedTillNow != 0 {
-			h.masterRequestBytesProcessed += len(encodedRequestBytes)
-		}
-		return true, nil
-	}
-}
-
-func (h *ConnectionHandler) processCmdExecutedNotificationForAsMaster(notification constants.CommandExecutedNotification) (bool, error) {
-	return true, nil
-}
+// Callback function that will be invoked by notification handler
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+// FailoverOptions holds the arguments of FAILOVER [TO <host> <port>] [FORCE] [TIMEOUT <ms>]
+type FailoverOptions struct {
+	// Address of the replica to hand over to, any replica which caught up is picked when empty
+	TargetAddress string
+	// Hand over to the target when the timeout expires even if it didn't catch up
+	Force   bool
+	Timeout time.Duration
+	// IPs the target host resolves to and its port, set by StartFailover
+	targetIps  []string
+	targetPort string
+}
+
+// parseFailoverOptions parses FAILOVER [TO <host> <port> [FORCE]] [TIMEOUT <ms>] and FAILOVER ABORT, returning
+// whether the failover in progress is to be aborted instead
+func parseFailoverOptions(args []constants.DataRepr) (FailoverOptions, bool, error) {
+	options := FailoverOptions{}
+	abort := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i].Data)) {
+		case constants.FAILOVER_TO_PARAM:
+			if i+2 >= len(args) {
+				return FailoverOptions{}, false, errors.New("FAILOVER TO expects a host and a port")
+			}
+			host, port := string(args[i+1].Data), string(args[i+2].Data)
+			if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 0 || portNumber > 65535 {
+				return FailoverOptions{}, false, errors.New("invalid target port")
+			}
+			options.TargetAddress = net.JoinHostPort(host, port)
+			i += 2
+		case constants.FAILOVER_FORCE_PARAM:
+			options.Force = true
+		case constants.FAILOVER_TIMEOUT_PARAM:
+			if i+1 >= len(args) {
+				return FailoverOptions{}, false, errors.New("FAILOVER TIMEOUT expects a number of milliseconds")
+			}
+			timeout, err := strconv.Atoi(string(args[i+1].Data))
+			if err != nil || timeout <= 0 {
+				return FailoverOptions{}, false, errors.New("FAILOVER timeout must be greater than 0")
+			}
+			options.Timeout = time.Duration(timeout) * time.Millisecond
+			i++
+		case constants.FAILOVER_ABORT_PARAM:
+			abort = true
+		default:
+			return FailoverOptions{}, false, fmt.Errorf("unexpected FAILOVER argument '%s'", args[i].Data)
+		}
+	}
+	switch {
+	case abort && (options.TargetAddress != "" || options.Force || options.Timeout > 0):
+		return FailoverOptions{}, false, errors.New("FAILOVER ABORT can't be combined with other options")
+	case options.Force && (options.TargetAddress == "" || options.Timeout == 0):
+		return FailoverOptions{}, false, errors.New("FAILOVER with force option requires both a timeout and target HOST and IP")
+	}
+	return options, abort, nil
+}
+
+// StartFailover pauses client writes and hands the master role over to a replica once it has caught up with
+// them. The handover itself runs in the background, its progress is shown in INFO as master_failover_state
+func (h *ReplicationHandler) StartFailover(options FailoverOptions) error {
+	// The target host may be a name, which is resolved once before replicas are looked at
+	if options.TargetAddress != "" {
+		host, port, err := net.SplitHostPort(options.TargetAddress)
+		if err == nil {
+			options.targetIps, err = net.LookupHost(host)
+		}
+		if err != nil {
+			return errors.New("FAILOVER target HOST and PORT is not a replica")
+		}
+		options.targetPort = port
+	}
+	h.replicaMapLock.Lock()
+	defer h.replicaMapLock.Unlock()
+	if h.ctx.ServerInstance.GetReplicationRole() != constants.MASTER_ROLE {
+		return errors.New("FAILOVER is not valid when server is a replica")
+	}
+	if h.failoverState != constants.FAILOVER_STATE_NONE {
+		return errors.New("FAILOVER already in progress")
+	}
+	if options.TargetAddress != "" {
+		if h.findReplicaByAddress(options.targetIps, options.targetPort) == nil {
+			return errors.New("FAILOVER target HOST and PORT is not a replica")
+		}
+	} else if h.countOnlineReplicas() == 0 {
+		return errors.New("FAILOVER requires connected replicas")
+	}
+	h.failoverState = constants.FAILOVER_STATE_WAITING_FOR_SYNC
+	h.failoverAborted = make(chan struct{})
+	h.commandHandler.PauseWrites()
+	go h.runFailover(options, h.failoverAborted)
+	return nil
+}
+
+// AbortFailover stops a failover still waiting for its target to catch up, resuming writes
+func (h *ReplicationHandler) AbortFailover() error {
+	h.replicaMapLock.Lock()
+	defer h.replicaMapLock.Unlock()
+	switch {
+	case h.failoverState == constants.FAILOVER_STATE_NONE || h.failoverAborted == nil:
+		return errors.New("No failover in progress")
+	case h.failoverState == constants.FAILOVER_STATE_IN_PROGRESS:
+		return errors.New("FAILOVER can't be aborted once the target was asked to take over")
+	}
+	// The failover stays in its state until runFailover resumes writes
+	close(h.failoverAborted)
+	h.failoverAborted = nil
+	return nil
+}
+
+func (h *ReplicationHandler) FailoverState() string {
+	h.replicaMapLock.RLock()
+	defer h.replicaMapLock.RUnlock()
+	return h.failoverState
+}
+
+func (h *ReplicationHandler) runFailover(options FailoverOptions, aborted chan struct{}) {
+	var timeoutChan <-chan time.Time
+	if options.Timeout > 0 {
+		timeoutChan = time.After(options.Timeout)
+	}
+	ticker := time.NewTicker(constants.FAILOVER_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	// Replicas report their offset every second, so the target is seen catching up shortly after it does
+	targetAddress := ""
+	for targetAddress == "" {
+		select {
+		case <-aborted:
+			h.endFailover("aborted")
+			return
+		case <-timeoutChan:
+			if !options.Force {
+				h.endFailover("timed out waiting for a replica to catch up")
+				return
+			}
+			targetAddress = options.TargetAddress
+		case <-ticker.C:
+			targetAddress = h.findCaughtUpReplica(options)
+		}
+	}
+
+	h.replicaMapLock.Lock()
+	if h.failoverAborted == nil {
+		h.replicaMapLock.Unlock()
+		h.endFailover("aborted")
+		return
+	}
+	h.failoverState = constants.FAILOVER_STATE_IN_PROGRESS
+	h.replicaMapLock.Unlock()
+	h.ctx.Logger.Printf("Failing over to replica (%s)", targetAddress)
+	// The target takes over when it receives PSYNC FAILOVER from this server following it
+	h.connHandler.setFailoverPsync()
+	h.ReplicaOf(targetAddress)
+
+	linkDeadline := time.After(max(options.Timeout, constants.REPL_TIMEOUT))
+	for h.connHandler.getMasterLinkState() != constants.MASTER_LINK_STATE_CONNECTED {
+		select {
+		case <-linkDeadline:
+			h.ctx.Logger.Printf("Replica (%s) didn't take over, resuming as master", targetAddress)
+			h.PromoteToMaster()
+			h.endFailover("target didn't take over")
+			return
+		case <-ticker.C:
+		}
+	}
+	h.endFailover("")
+}
+
+func (h *ReplicationHandler) endFailover(abortReason string) {
+	h.replicaMapLock.Lock()
+	h.failoverState = constants.FAILOVER_STATE_NONE
+	h.failoverAborted = nil
+	masterAddress := h.ctx.ServerInstance.GetMasterServerAddress()
+	h.replicaMapLock.Unlock()
+	h.commandHandler.UnpauseWrites()
+	if abortReason != "" {
+		h.ctx.Logger.Printf("FAILOVER aborted: %s", abortReason)
+		return
+	}
+	h.ctx.Logger.Printf("FAILOVER completed, now replicating from (%s)", masterAddress)
+}
+
+// findCaughtUpReplica returns the address of the target, or of any replica when there is none, once it
+// acknowledged the whole replication stream
+func (h *ReplicationHandler) findCaughtUpReplica(options FailoverOptions) string {
+	h.replicaMapLock.RLock()
+	defer h.replicaMapLock.RUnlock()
+	masterOffset := h.ctx.ServerInstance.GetMasterReplOffset()
+	for conn, replica := range h.replicas {
+		if !replica.isActive || replica.state != constants.REPLICA_STATE_ONLINE || replica.ackOffset < masterOffset {
+			continue
+		}
+		replicaAddress := replicaAddress(conn, replica)
+		if options.TargetAddress == "" || h.findReplicaByAddress(options.targetIps, options.targetPort) == replica {
+			return replicaAddress
+		}
+	}
+	return ""
+}
+
+// findReplicaByAddress is called with replicaMapLock held. It finds the replica connected from one of
+// hostIps which serves clients on port
+func (h *ReplicationHandler) findReplicaByAddress(hostIps []string, port string) *Replica {
+	for conn, replica := range h.replicas {
+		if !replica.isActive || replica.state != constants.REPLICA_STATE_ONLINE || replica.listeningPort != port {
+			continue
+		}
+		replicaIp, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if slices.Contains(hostIps, replicaIp) {
+			return replica
+		}
+	}
+	return nil
+}
+
+// countOnlineReplicas is called with replicaMapLock held
+func (h *ReplicationHandler) countOnlineReplicas() int {
+	onlineReplicas := 0
+	for _, replica := range h.replicas {
+		if replica.isActive && replica.state == constants.REPLICA_STATE_ONLINE {
+			onlineReplicas++
+		}
+	}
+	return onlineReplicas
+}
+
+// replicaAddress is the address the replica serves clients on
+func replicaAddress(conn net.Conn, replica *Replica) string {
+	replicaIp, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return net.JoinHostPort(replicaIp, replica.listeningPort)
+}
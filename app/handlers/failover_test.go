@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+func TestParseFailoverOptions(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected FailoverOptions
+		abort    bool
+		invalid  bool
+	}{
+		{[]string{}, FailoverOptions{}, false, false},
+		{[]string{"to", "127.0.0.1", "6380"}, FailoverOptions{TargetAddress: "127.0.0.1:6380"}, false, false},
+		{[]string{"TIMEOUT", "500"}, FailoverOptions{Timeout: 500 * time.Millisecond}, false, false},
+		{[]string{"TO", "localhost", "6380", "FORCE", "TIMEOUT", "100"},
+			FailoverOptions{TargetAddress: "localhost:6380", Force: true, Timeout: 100 * time.Millisecond}, false, false},
+		{[]string{"ABORT"}, FailoverOptions{}, true, false},
+		{[]string{"ABORT", "TIMEOUT", "100"}, FailoverOptions{}, false, true},
+		{[]string{"TO", "127.0.0.1", "6380", "FORCE"}, FailoverOptions{}, false, true},
+		{[]string{"FORCE", "TIMEOUT", "100"}, FailoverOptions{}, false, true},
+		{[]string{"TO", "127.0.0.1"}, FailoverOptions{}, false, true},
+		{[]string{"TO", "127.0.0.1", "port"}, FailoverOptions{}, false, true},
+		{[]string{"TIMEOUT", "0"}, FailoverOptions{}, false, true},
+		{[]string{"TIMEOUT"}, FailoverOptions{}, false, true},
+		{[]string{"NOW"}, FailoverOptions{}, false, true},
+	}
+	for _, testCase := range testCases {
+		options, abort, err := parseFailoverOptions(createArgs(testCase.args...))
+		if testCase.invalid {
+			if err == nil {
+				t.Errorf("Expected an error for FAILOVER %v", testCase.args)
+			}
+			continue
+		}
+		if err != nil || abort != testCase.abort || options.TargetAddress != testCase.expected.TargetAddress ||
+			options.Force != testCase.expected.Force || options.Timeout != testCase.expected.Timeout {
+			t.Errorf("Expected FAILOVER %v to give %+v (abort %v), Got: %+v (abort %v, %v)",
+				testCase.args, testCase.expected, testCase.abort, options, abort, err)
+		}
+	}
+}
+
+func writesPaused(h *CommandHandler) bool {
+	h.pauseLock.Lock()
+	defer h.pauseLock.Unlock()
+	return h.writesResumed != nil
+}
+
+func waitForFailoverEnd(t *testing.T, replicationHandler *ReplicationHandler) {
+	deadline := time.Now().Add(5 * time.Second)
+	for replicationHandler.FailoverState() != constants.FAILOVER_STATE_NONE {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the failover to end, Got: %s", replicationHandler.FailoverState())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailover_AbortAndTimeout(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	if err := replicationHandler.StartFailover(FailoverOptions{}); err == nil {
+		t.Fatalf("Expected FAILOVER without replicas to be refused")
+	}
+
+	// The replica never acknowledges the offset, so the failover keeps waiting for it
+	handlers.ctx.ServerInstance.ReplicationConfig.MasterReplOffset = 100
+	_, replicaConn := attachOnlineReplica(replicationHandler)
+	defer replicaConn.Close()
+	if err := replicationHandler.StartFailover(FailoverOptions{TargetAddress: "127.0.0.1:1"}); err == nil {
+		t.Errorf("Expected FAILOVER to an address which isn't a replica to be refused")
+	}
+
+	if err := replicationHandler.StartFailover(FailoverOptions{}); err != nil {
+		t.Fatalf("Unexpected error starting a failover: %v", err)
+	}
+	if replicationHandler.FailoverState() != constants.FAILOVER_STATE_WAITING_FOR_SYNC || !writesPaused(handlers.commandHandler) {
+		t.Fatalf("Expected writes to be paused while waiting for sync, Got: %s", replicationHandler.FailoverState())
+	}
+	if err := replicationHandler.StartFailover(FailoverOptions{}); err == nil {
+		t.Errorf("Expected a second FAILOVER to be refused while one is in progress")
+	}
+	if err := replicationHandler.AbortFailover(); err != nil {
+		t.Fatalf("Unexpected error aborting the failover: %v", err)
+	}
+	waitForFailoverEnd(t, replicationHandler)
+	if writesPaused(handlers.commandHandler) {
+		t.Errorf("Expected writes to be resumed once the failover is aborted")
+	}
+	if err := replicationHandler.AbortFailover(); err == nil {
+		t.Errorf("Expected FAILOVER ABORT without a failover in progress to be refused")
+	}
+
+	if err := replicationHandler.StartFailover(FailoverOptions{Timeout: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("Unexpected error starting a failover: %v", err)
+	}
+	waitForFailoverEnd(t, replicationHandler)
+	if writesPaused(handlers.commandHandler) || handlers.ctx.ServerInstance.GetReplicationRole() != constants.MASTER_ROLE {
+		t.Errorf("Expected the server to resume as master with writes once the timeout expires")
+	}
+}
+
+func TestFailover_Handover(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	epollFd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		t.Fatalf("Unable to create epoll: %v", err)
+	}
+	defer syscall.Close(epollFd)
+	handlers.connHandler.epollFd = epollFd
+	replicationConfig := &handlers.ctx.ServerInstance.ReplicationConfig
+	replicationConfig.MasterReplOffset = 100
+
+	// The target serves clients on its own listener, where it expects this server to follow it
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for the target: %v", err)
+	}
+	defer targetListener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := targetListener.Accept()
+		if err != nil {
+			return
+		}
+		received <- <-runFakeMaster(t, conn, "+CONTINUE "+replicationConfig.MasterReplId+"\r\n", nil)
+	}()
+
+	replicaListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for the replica: %v", err)
+	}
+	defer replicaListener.Close()
+	replicaConn, err := net.Dial("tcp", replicaListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect the replica: %v", err)
+	}
+	defer replicaConn.Close()
+	masterConn, err := replicaListener.Accept()
+	if err != nil {
+		t.Fatalf("Unable to accept the replica: %v", err)
+	}
+	_, targetPort, _ := net.SplitHostPort(targetListener.Addr().String())
+	replicationHandler.replicaMapLock.Lock()
+	replicationHandler.backlog = NewReplicationBacklog(1024*1024, replicationConfig.MasterReplOffset)
+	replica := replicationHandler.addReplica(masterConn, constants.REPLICA_STATE_ONLINE)
+	replica.listeningPort = targetPort
+	replica.ackOffset = replicationConfig.MasterReplOffset
+	replicationHandler.replicaMapLock.Unlock()
+
+	if err := replicationHandler.StartFailover(FailoverOptions{TargetAddress: net.JoinHostPort("localhost", targetPort)}); err != nil {
+		t.Fatalf("Unexpected error starting a failover to the replica: %v", err)
+	}
+	select {
+	case commands := <-received:
+		if expected := "PSYNC " + replicationConfig.MasterReplId + " 101 FAILOVER"; commands[len(commands)-1] != expected {
+			t.Errorf("Expected the target to be asked to take over with %q, Got: %v", expected, commands)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the target to be asked to take over")
+	}
+	waitForFailoverEnd(t, replicationHandler)
+	if handlers.connHandler.getMasterLinkState() != constants.MASTER_LINK_STATE_CONNECTED || writesPaused(handlers.commandHandler) {
+		t.Errorf("Expected the server to follow the target with writes resumed, Got: %s", handlers.connHandler.getMasterLinkState())
+	}
+	if !strings.HasSuffix(handlers.ctx.ServerInstance.GetMasterServerAddress(), ":"+targetPort) {
+		t.Errorf("Expected the server to replicate from the target, Got: %s", handlers.ctx.ServerInstance.GetMasterServerAddress())
+	}
+	replicationHandler.PromoteToMaster()
+}
@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// StartMasterLink starts linking with the configured master, unless a link is already running
+func (h *ConnectionHandler) StartMasterLink() {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	if h.masterLinkRunning {
+		return
+	}
+	h.masterLinkRunning = true
+	go h.runMasterLink()
+}
+
+// DisconnectMaster drops the link with the master, along with a handshake in progress. runMasterLink
+// then connects to the configured master again, or stops if the server is no longer a replica
+func (h *ConnectionHandler) DisconnectMaster() {
+	h.masterConnLock.Lock()
+	masterConn, handshakeConn := h.masterConn, h.handshakeConn
+	h.masterConnLock.Unlock()
+	select {
+	case h.masterLinkReset <- struct{}{}:
+	default:
+	}
+	if handshakeConn != nil {
+		handshakeConn.Close()
+	}
+	if masterConn != nil {
+		h.terminateConnection(*masterConn)
+	}
+}
+
+// runMasterLink keeps a replica linked to its master. Each attempt goes through connect, handshake, transfer
+// and connected, and a failed attempt or a dropped link is retried with an exponential backoff
+func (h *ConnectionHandler) runMasterLink() {
+	backoff := constants.MASTER_LINK_MIN_BACKOFF
+	for h.isMasterLinkWanted() {
+		masterAddress := h.ctx.ServerInstance.GetMasterServerAddress()
+		linkClosed, err := h.connectToMaster(masterAddress)
+		if err != nil {
+			h.setMasterLinkState(constants.MASTER_LINK_STATE_CONNECT)
+			h.ctx.Logger.Printf("Unable to sync with master (%s), retrying in %v: %v", masterAddress, backoff, err.Error())
+			select {
+			case <-time.After(backoff):
+				backoff = min(backoff*2, constants.MASTER_LINK_MAX_BACKOFF)
+			case <-h.masterLinkReset:
+				// The master changed, no need to wait before trying it
+				backoff = constants.MASTER_LINK_MIN_BACKOFF
+			}
+			continue
+		}
+		backoff = constants.MASTER_LINK_MIN_BACKOFF
+		<-linkClosed
+		h.setMasterLinkState(constants.MASTER_LINK_STATE_CONNECT)
+		h.ctx.Logger.Printf("Connection with master (%s) lost", masterAddress)
+	}
+}
+
+// isMasterLinkWanted tells runMasterLink whether to go on, marking the link as stopped when it shouldn't
+func (h *ConnectionHandler) isMasterLinkWanted() bool {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	if h.ctx.ServerInstance.GetReplicationRole() != constants.REPLICA_ROLE {
+		h.masterLinkRunning = false
+		return false
+	}
+	return true
+}
+
+// connectToMaster runs one attempt at linking with the master. Once the link is up the master connection
+// is served by the event loop, and the returned channel is closed when it goes down
+func (h *ConnectionHandler) connectToMaster(masterAddress string) (chan struct{}, error) {
+	h.setMasterLinkState(constants.MASTER_LINK_STATE_CONNECT)
+	conn, err := net.DialTimeout("tcp", masterAddress, constants.REPL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	h.setMasterLinkState(constants.MASTER_LINK_STATE_HANDSHAKE)
+	h.setHandshakeConn(conn)
+	previousReplId := h.ctx.ServerInstance.GetReplicationConfig().MasterReplId
+	reader := bufio.NewReader(&idleTimeoutReader{conn: conn, timeout: constants.REPL_TIMEOUT})
+	rdbPayload, bufferedStream, err := h.syncWithMaster(conn, reader)
+	h.setHandshakeConn(nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	linkClosed := make(chan struct{})
+	h.masterLinkLock.Lock()
+	if !h.setMasterConn(conn, masterAddress, linkClosed) {
+		h.masterLinkLock.Unlock()
+		conn.Close()
+		return nil, errors.New("the master changed during the handshake")
+	}
+	if h.replicationHandler != nil && (rdbPayload != nil || h.ctx.ServerInstance.GetReplicationConfig().MasterReplId != previousReplId) {
+		h.replicationHandler.HandleMasterHistoryChange(rdbPayload != nil)
+	}
+	if rdbPayload != nil {
+		h.requestHandler.LoadRdbFromMaster(rdbPayload)
+	}
+	h.processMasterData(conn, bufferedStream)
+	h.masterLinkLock.Unlock()
+
+	err = h.registerConnection(conn)
+	if err != nil {
+		h.ctx.Logger.Printf("Error adding master connection (%s) to epoll: %v", masterAddress, err.Error())
+		h.terminateConnection(conn)
+		return linkClosed, nil
+	}
+	h.setMasterLinkState(constants.MASTER_LINK_STATE_CONNECTED)
+	h.ctx.Logger.Printf("Connection with master (%s) successfully established", masterAddress)
+	go h.sendAcksToMaster(conn, linkClosed)
+	return linkClosed, nil
+}
+
+// sendAcksToMaster reports the processed offset every second while the link is up, which lets the master
+// track the replica's lag without asking for it
+func (h *ConnectionHandler) sendAcksToMaster(conn net.Conn, linkClosed chan struct{}) {
+	ticker := time.NewTicker(constants.REPLICA_ACK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-linkClosed:
+			return
+		case <-ticker.C:
+		}
+		// Holding the link lock keeps the offset in step with the stream and the ACK apart from other replies
+		h.masterLinkLock.Lock()
+		replicaOffset := h.ctx.ServerInstance.GetMasterReplOffset()
+		_, err := h.writeDataToConnection(conn, []constants.DataRepr{utils.CreateReplconfAck(nil, replicaOffset)})
+		h.masterLinkLock.Unlock()
+		if err != nil {
+			h.ctx.Logger.Printf("Error while sending ACK to master (%s): %v", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+}
+
+// syncWithMaster runs the handshake and PSYNC on a new connection. It returns the RDB sent for a full resync,
+// which is nil when the master continues the stream instead, and the part of the stream read along with it
+func (h *ConnectionHandler) syncWithMaster(conn net.Conn, reader *bufio.Reader) ([]byte, []byte, error) {
+	masterAddress := conn.RemoteAddr().String()
+	for _, handshakeStep := range h.createHandshakePipeline(h.ctx.ServerInstance) {
+		cmd := handshakeStep.CommandName
+		h.ctx.Logger.Printf("Beginning the handshake step with master (%s) using command (%s)", masterAddress, cmd)
+		conn.SetWriteDeadline(time.Now().Add(constants.REPL_TIMEOUT))
+		_, err := h.writeDataToConnection(conn, []constants.DataRepr{handshakeStep.Request})
+		if err != nil {
+			return nil, nil, err
+		}
+		response, err := h.readReplyFromMaster(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cmd == constants.PSYNC_COMMAND {
+			return h.handlePsyncReply(conn, reader, response)
+		}
+		if !response.IsEqual(handshakeStep.ExpectedResponse, false) {
+			return nil, nil, fmt.Errorf("unexpected response to %s: %q", cmd, parser.Encode(response))
+		}
+	}
+	return nil, nil, errors.New("handshake ended without PSYNC")
+}
+
+// idleTimeoutReader gives each read from the master REPL_TIMEOUT, so a long RDB transfer only fails when the
+// master stops sending rather than when the whole of it takes longer than that
+type idleTimeoutReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(data []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(data)
+}
+
+// readReplyFromMaster reads a single line reply. A master waiting for more replicas before a diskless
+// transfer may keep the link alive with empty lines, which are skipped
+func (h *ConnectionHandler) readReplyFromMaster(reader *bufio.Reader) (constants.DataRepr, error) {
+	responseLine, err := reader.ReadBytes('\n')
+	for err == nil && len(bytes.TrimSpace(responseLine)) == 0 {
+		responseLine, err = reader.ReadBytes('\n')
+	}
+	if err != nil {
+		return constants.DataRepr{}, err
+	}
+	h.markMasterIo()
+	decodedResponse, err := parser.Decode(responseLine)
+	if err != nil {
+		return constants.DataRepr{}, err
+	}
+	return decodedResponse[0], nil
+}
+
+// handlePsyncReply handles +FULLRESYNC <replid> <offset>, reading the RDB following it, and
+// +CONTINUE [<replid>], where the master only sends what was missed since the last link
+func (h *ConnectionHandler) handlePsyncReply(conn net.Conn, reader *bufio.Reader, response constants.DataRepr) ([]byte, []byte, error) {
+	h.ctx.Logger.Printf("Received %q from master (%s)", response.Data, conn.RemoteAddr())
+	fields := strings.Fields(string(response.Data))
+	if response.Type != constants.STRING || len(fields) == 0 {
+		return nil, nil, fmt.Errorf("unexpected response to PSYNC: %q", parser.Encode(response))
+	}
+
+	switch fields[0] {
+	case constants.CONTINUE_RESPONSE:
+		// The master changed its replication ID since the last link, the old one stays valid up to here
+		h.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+			if len(fields) > 1 && fields[1] != replicationConfig.MasterReplId {
+				replicationConfig.MasterReplId2 = replicationConfig.MasterReplId
+				replicationConfig.SecondReplOffeset = replicationConfig.MasterReplOffset + 1
+				replicationConfig.MasterReplId = fields[1]
+			}
+		})
+		return nil, bufferedData(reader), nil
+	case constants.FULLRESYNC_RESPONSE:
+		// The stream following the RDB starts after offset
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("malformed response to PSYNC: %q", response.Data)
+		}
+		masterOffset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed offset in response to PSYNC: %q", response.Data)
+		}
+		h.setMasterLinkState(constants.MASTER_LINK_STATE_TRANSFER)
+		rdbPayload, err := parser.DecodeRdbPayload(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.ctx.Logger.Printf("Received RDB of %d bytes from master (%s)", len(rdbPayload), conn.RemoteAddr())
+		h.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+			replicationConfig.MasterReplId = fields[1]
+			replicationConfig.MasterReplOffset = masterOffset
+			replicationConfig.MasterReplId2 = constants.EMPTY_REPLICATION_ID
+			replicationConfig.SecondReplOffeset = -1
+			replicationConfig.MasterLastIoTime = time.Now()
+		})
+		h.syncedWithMaster = true
+		return rdbPayload, bufferedData(reader), nil
+	default:
+		return nil, nil, fmt.Errorf("unexpected response to PSYNC: %q", response.Data)
+	}
+}
+
+func bufferedData(reader *bufio.Reader) []byte {
+	data, _ := reader.Peek(reader.Buffered())
+	return data
+}
+
+// processMasterData applies the complete commands in data received from the master and forwards them to
+// this replica's own replicas, keeping an incomplete one at the end until the rest of it arrives. It is
+// called with masterLinkLock held
+func (h *ConnectionHandler) processMasterData(conn net.Conn, data []byte) {
+	h.markMasterIo()
+	data = append(h.pendingMasterData, data...)
+	h.pendingMasterData = nil
+	decodedRequests, endOffsets, err := parser.DecodePrefix(data)
+	processed := 0
+	if len(endOffsets) > 0 {
+		processed = endOffsets[len(endOffsets)-1]
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		// Anything past a malformed command can't be trusted, let the error reach the master's log
+		h.processRequest(conn, data)
+		return
+	}
+	start := 0
+	for i, decodedRequest := range decodedRequests {
+		h.processMasterRequest(conn, decodedRequest, endOffsets[i]-start)
+		start = endOffsets[i]
+	}
+	if processed > 0 {
+		if h.replicationHandler != nil {
+			h.replicationHandler.forwardMasterStream(data[:processed])
+		}
+	}
+	if processed < len(data) {
+		h.pendingMasterData = append([]byte{}, data[processed:]...)
+	}
+}
+
+// setMasterConn makes conn the master connection, unless the master was changed while it was set up
+func (h *ConnectionHandler) setMasterConn(conn net.Conn, masterAddress string, linkClosed chan struct{}) bool {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	replicationConfig := h.ctx.ServerInstance.GetReplicationConfig()
+	if replicationConfig.Role != constants.REPLICA_ROLE || replicationConfig.MasterServerAddress != masterAddress {
+		return false
+	}
+	h.masterConn = &conn
+	h.masterLinkClosed = linkClosed
+	h.pendingMasterData = nil
+	return true
+}
+
+func (h *ConnectionHandler) setHandshakeConn(conn net.Conn) {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	h.handshakeConn = conn
+}
+
+func (h *ConnectionHandler) isMasterConn(conn net.Conn) bool {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	return h.masterConn != nil && *h.masterConn == conn
+}
+
+// dropMasterConn forgets a closed master connection and wakes up runMasterLink to reconnect
+func (h *ConnectionHandler) dropMasterConn(conn net.Conn) {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	if h.masterConn == nil || *h.masterConn != conn {
+		return
+	}
+	h.masterConn = nil
+	close(h.masterLinkClosed)
+}
+
+func (h *ConnectionHandler) setMasterLinkState(state string) {
+	h.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+		replicationConfig.MasterLinkState = state
+	})
+}
+
+func (h *ConnectionHandler) getMasterLinkState() string {
+	return h.ctx.ServerInstance.GetReplicationConfig().MasterLinkState
+}
+
+// markMasterIo records that something was just read from the master
+func (h *ConnectionHandler) markMasterIo() {
+	h.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+		replicationConfig.MasterLastIoTime = time.Now()
+	})
+}
+
+// setFailoverPsync makes the next PSYNC ask the master to take over from this server
+func (h *ConnectionHandler) setFailoverPsync() {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	h.failoverPsync = true
+}
+
+// takeFailoverPsync tells whether this PSYNC asks the master to take over, which only the first one after
+// FAILOVER does
+func (h *ConnectionHandler) takeFailoverPsync() bool {
+	h.masterConnLock.Lock()
+	defer h.masterConnLock.Unlock()
+	failoverPsync := h.failoverPsync
+	h.failoverPsync = false
+	return failoverPsync
+}
+
+func (h *ConnectionHandler) createHandshakePipeline(serverInstance *server.Server) []HandshakeStep {
+	handshakePipeline := []HandshakeStep{}
+	handshakePipeline = append(handshakePipeline, HandshakeStep{
+		CommandName:      constants.PING_COMMAND,
+		Request:          utils.CreateRequestForCommand(constants.PING_COMMAND),
+		ExpectedResponse: utils.CreateStringResponse(constants.PONG_RESPONSE),
+	})
+	ok_response := utils.CreateStringResponse(constants.OK_RESPONSE)
+	handshakePipeline = append(handshakePipeline, HandshakeStep{
+		CommandName:      constants.REPLCONF_COMMAND,
+		Request:          utils.CreateRequestForCommand(constants.REPLCONF_COMMAND, constants.REPLCONF_LISTENING_PORT_PARAM, (serverInstance).ListeningPort),
+		ExpectedResponse: ok_response,
+	})
+	handshakePipeline = append(handshakePipeline, HandshakeStep{
+		CommandName:      constants.REPLCONF_COMMAND,
+		Request:          utils.CreateRequestForCommand(constants.REPLCONF_COMMAND, constants.REPLCONF_CAPA_PARAM, constants.REPLCONF_PSYNC2_PARAM),
+		ExpectedResponse: ok_response,
+	})
+	// After a first sync the replica asks to continue from the next byte it needs
+	replId, offset := constants.PSYNC_UNKNOWN_REPLICATION_ID_PARAM, constants.PSYNC_UNKNOWN_MASTER_OFFSET
+	if h.syncedWithMaster {
+		replicationConfig := serverInstance.GetReplicationConfig()
+		replId = replicationConfig.MasterReplId
+		offset = strconv.Itoa(replicationConfig.MasterReplOffset + 1)
+	}
+	psyncArgs := []string{replId, offset}
+	// A master handing its role over asks the target to take it, on the first attempt only
+	if h.takeFailoverPsync() {
+		psyncArgs = append(psyncArgs, constants.PSYNC_FAILOVER_PARAM)
+	}
+	handshakePipeline = append(handshakePipeline, HandshakeStep{
+		CommandName: constants.PSYNC_COMMAND,
+		Request:     utils.CreateRequestForCommand(constants.PSYNC_COMMAND, psyncArgs...),
+	})
+
+	return handshakePipeline
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// runFakeMaster answers a replica's handshake on conn, replying to PSYNC with psyncReply, and sends what follows
+// it. The commands it received are sent on the returned channel once the handshake is done
+func runFakeMaster(t *testing.T, conn net.Conn, psyncReply string, followingData []byte) chan []string {
+	received := make(chan []string, 1)
+	go func() {
+		reader := bufio.NewReader(conn)
+		commands := []string{}
+		for {
+			request, err := parser.DecodeFrom(reader)
+			if err != nil {
+				t.Errorf("Fake master failed reading the handshake: %v", err)
+				close(received)
+				return
+			}
+			command := strings.Join(requestArgs(request), " ")
+			commands = append(commands, command)
+			reply := "+" + constants.OK_RESPONSE + "\r\n"
+			if strings.HasPrefix(command, constants.PING_COMMAND) {
+				reply = "+" + constants.PONG_RESPONSE + "\r\n"
+			} else if strings.HasPrefix(command, constants.PSYNC_COMMAND) {
+				received <- commands
+				conn.Write(append([]byte(psyncReply), followingData...))
+				return
+			}
+			conn.Write([]byte(reply))
+		}
+	}()
+	return received
+}
+
+// encodeRdbTransfer returns an RDB holding values as a master sends it after +FULLRESYNC
+func encodeRdbTransfer(t *testing.T, values map[string]persistence.Value) []byte {
+	var rdb bytes.Buffer
+	if err := persistence.WriteRDB(&rdb, values, map[string]string{}); err != nil {
+		t.Fatalf("Unexpected error writing the RDB: %v", err)
+	}
+	return append([]byte("$"+strconv.Itoa(rdb.Len())+"\r\n"), rdb.Bytes()...)
+}
+
+func TestSyncWithMaster(t *testing.T) {
+	handlers := newTestHandlers(t)
+	connHandler := handlers.connHandler
+	replicationConfig := &handlers.ctx.ServerInstance.ReplicationConfig
+	replicationConfig.Role = constants.REPLICA_ROLE
+	masterReplId := strings.Repeat("a", constants.REPLICATION_ID_LENGTH)
+	setRequest := parser.Encode(utils.CreateRequestForCommand(constants.SET_COMMAND, "after", "sync"))
+
+	// A first sync asks for a full resync and receives the RDB, followed by the start of the stream
+	masterConn, replicaConn := net.Pipe()
+	rdbTransfer := encodeRdbTransfer(t, map[string]persistence.Value{"key": {Type: constants.STRING_DATA_TYPE, Data: []byte("value")}})
+	received := runFakeMaster(t, masterConn, "+FULLRESYNC "+masterReplId+" 100\r\n", append(rdbTransfer, setRequest...))
+	reader := bufio.NewReader(&idleTimeoutReader{conn: replicaConn, timeout: constants.REPL_TIMEOUT})
+	rdbPayload, bufferedStream, err := connHandler.syncWithMaster(replicaConn, reader)
+	if err != nil {
+		t.Fatalf("Unexpected error during a full resync: %v", err)
+	}
+	if commands := <-received; commands[len(commands)-1] != "PSYNC ? -1" {
+		t.Errorf("Expected a first sync to ask for a full resync, Got: %v", commands)
+	}
+	if replicationConfig.MasterLinkState != constants.MASTER_LINK_STATE_TRANSFER || !connHandler.syncedWithMaster {
+		t.Errorf("Expected the link to be in the transfer state after the RDB, Got: %s", replicationConfig.MasterLinkState)
+	}
+	if replicationConfig.MasterReplId != masterReplId || replicationConfig.MasterReplOffset != 100 {
+		t.Errorf("Expected the master's replication ID and offset 100, Got: %s and %d", replicationConfig.MasterReplId, replicationConfig.MasterReplOffset)
+	}
+	if len(rdbPayload) != len(rdbTransfer)-len("$"+strconv.Itoa(len(rdbPayload))+"\r\n") || !bytes.Equal(bufferedStream, setRequest) {
+		t.Errorf("Expected the RDB and the stream read along with it, Got: %d RDB bytes and %q", len(rdbPayload), bufferedStream)
+	}
+	masterConn.Close()
+	replicaConn.Close()
+
+	// Once synced, the replica asks to continue after its offset, and learns the master's new replication ID
+	newReplId := strings.Repeat("b", constants.REPLICATION_ID_LENGTH)
+	masterConn, replicaConn = net.Pipe()
+	received = runFakeMaster(t, masterConn, "+CONTINUE "+newReplId+"\r\n", nil)
+	rdbPayload, _, err = connHandler.syncWithMaster(replicaConn, bufio.NewReader(replicaConn))
+	if err != nil || rdbPayload != nil {
+		t.Fatalf("Expected a partial resync without an RDB, Got: %d RDB bytes (%v)", len(rdbPayload), err)
+	}
+	if commands := <-received; commands[len(commands)-1] != "PSYNC "+masterReplId+" 101" {
+		t.Errorf("Expected the replica to continue from offset 101, Got: %v", commands)
+	}
+	if replicationConfig.MasterReplId != newReplId || replicationConfig.MasterReplId2 != masterReplId || replicationConfig.SecondReplOffeset != 101 {
+		t.Errorf("Expected the previous replication ID to stay valid up to offset 101, Got: %s, %s up to %d",
+			replicationConfig.MasterReplId, replicationConfig.MasterReplId2, replicationConfig.SecondReplOffeset)
+	}
+	masterConn.Close()
+	replicaConn.Close()
+
+	masterConn, replicaConn = net.Pipe()
+	go func() {
+		bufio.NewReader(masterConn).ReadString('\n')
+		masterConn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+	}()
+	if _, _, err := connHandler.syncWithMaster(replicaConn, bufio.NewReader(replicaConn)); err == nil {
+		t.Errorf("Expected the handshake to fail on an unexpected reply to PING")
+	}
+	masterConn.Close()
+	replicaConn.Close()
+}
+
+func TestConnectToMaster(t *testing.T) {
+	handlers := newTestHandlers(t)
+	connHandler := handlers.connHandler
+	epollFd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		t.Fatalf("Unable to create epoll: %v", err)
+	}
+	defer syscall.Close(epollFd)
+	connHandler.epollFd = epollFd
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for the replica: %v", err)
+	}
+	defer listener.Close()
+	replicationConfig := &handlers.ctx.ServerInstance.ReplicationConfig
+	replicationConfig.Role = constants.REPLICA_ROLE
+	replicationConfig.MasterServerAddress = listener.Addr().String()
+	setRequest := parser.Encode(utils.CreateRequestForCommand(constants.SET_COMMAND, "after", "sync"))
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		runFakeMaster(t, conn, "+FULLRESYNC "+strings.Repeat("a", constants.REPLICATION_ID_LENGTH)+" 0\r\n",
+			append(encodeRdbTransfer(t, map[string]persistence.Value{}), setRequest...))
+	}()
+
+	linkClosed, err := connHandler.connectToMaster(replicationConfig.MasterServerAddress)
+	if err != nil {
+		t.Fatalf("Unexpected error linking with the master: %v", err)
+	}
+	if replicationConfig.MasterLinkState != constants.MASTER_LINK_STATE_CONNECTED {
+		t.Errorf("Expected the link to be connected, Got: %s", replicationConfig.MasterLinkState)
+	}
+	if value, exists := handlers.commandHandler.db.Fetch("after"); !exists || string(value.Data) != "sync" {
+		t.Errorf("Expected the stream sent along with the RDB to be applied")
+	}
+	if replicationConfig.MasterReplOffset != len(setRequest) {
+		t.Errorf("Expected the offset to cover the stream after the RDB, Got: %d", replicationConfig.MasterReplOffset)
+	}
+
+	connHandler.DisconnectMaster()
+	select {
+	case <-linkClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the link to be closed once the master is disconnected")
+	}
+}
+
+func TestProcessMasterData_PendingTail(t *testing.T) {
+	handlers := newTestHandlers(t)
+	connHandler := handlers.connHandler
+	replicationConfig := &handlers.ctx.ServerInstance.ReplicationConfig
+	replicationConfig.Role = constants.REPLICA_ROLE
+	masterConn, replicaConn := net.Pipe()
+	defer masterConn.Close()
+	defer replicaConn.Close()
+
+	stream := append(parser.Encode(utils.CreateRequestForCommand(constants.SET_COMMAND, "first", "1")),
+		parser.Encode(utils.CreateRequestForCommand(constants.SET_COMMAND, "second", "2"))...)
+	// Wherever the stream is cut, the start of a command waits for its end and the offset moves by whole commands
+	for cut := 0; cut <= len(stream); cut++ {
+		offset := replicationConfig.MasterReplOffset
+		connHandler.processMasterData(replicaConn, stream[:cut])
+		_, endOffsets, _ := parser.DecodePrefix(stream[:cut])
+		processed := 0
+		if len(endOffsets) > 0 {
+			processed = endOffsets[len(endOffsets)-1]
+		}
+		if replicationConfig.MasterReplOffset-offset != processed || !bytes.Equal(connHandler.pendingMasterData, stream[processed:cut]) {
+			t.Fatalf("Cut at %d: expected %d bytes applied and %q pending, Got: %d and %q",
+				cut, processed, stream[processed:cut], replicationConfig.MasterReplOffset-offset, connHandler.pendingMasterData)
+		}
+		connHandler.processMasterData(replicaConn, stream[cut:])
+		if replicationConfig.MasterReplOffset-offset != len(stream) || len(connHandler.pendingMasterData) != 0 {
+			t.Fatalf("Cut at %d: expected the whole stream applied, Got: %d bytes with %q pending",
+				cut, replicationConfig.MasterReplOffset-offset, connHandler.pendingMasterData)
+		}
+	}
+	for _, key := range []string{"first", "second"} {
+		if _, exists := handlers.commandHandler.db.Fetch(key); !exists {
+			t.Errorf("Expected key %s to be set by the stream", key)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// migrateOptions are the arguments of MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [KEYS key...]
+type migrateOptions struct {
+	address string
+	keys    []string
+	timeout time.Duration
+	copy    bool
+	replace bool
+}
+
+func parseMigrateOptions(args []constants.DataRepr) (migrateOptions, error) {
+	if len(args) < 5 {
+		return migrateOptions{}, fmt.Errorf("MIGRATE command expects >%d variables but %d given", 4, len(args))
+	}
+	options := migrateOptions{address: net.JoinHostPort(string(args[0].Data), string(args[1].Data))}
+	if string(args[3].Data) != "0" {
+		// gedis has a single database
+		return migrateOptions{}, errors.New("MIGRATE only supports destination db 0")
+	}
+	timeout, err := strconv.Atoi(string(args[4].Data))
+	if err != nil || timeout < 0 {
+		return migrateOptions{}, errors.New("timeout is not an integer or out of range")
+	}
+	options.timeout = time.Duration(max(timeout, 1)) * time.Millisecond
+	if key := string(args[2].Data); key != "" {
+		options.keys = []string{key}
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i].Data)) {
+		case constants.MIGRATE_COPY_PARAM:
+			options.copy = true
+		case constants.MIGRATE_REPLACE_PARAM:
+			options.replace = true
+		case constants.MIGRATE_KEYS_PARAM:
+			if len(options.keys) > 0 {
+				return migrateOptions{}, errors.New("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range args[i+1:] {
+				options.keys = append(options.keys, string(key.Data))
+			}
+			i = len(args)
+		default:
+			return migrateOptions{}, fmt.Errorf("unsupported MIGRATE option '%s'", args[i].Data)
+		}
+	}
+	return options, nil
+}
+
+// findMigrateKeys is the key finder of MIGRATE, whose keys are either its third argument or follow KEYS
+func findMigrateKeys(args []constants.DataRepr) []string {
+	options, err := parseMigrateOptions(args)
+	if err != nil {
+		return nil
+	}
+	return options.keys
+}
+
+// migrateKeys sends the keys which exist to the target with RESTORE, deleting them here once the target has
+// them all unless copying. It runs with writeLock held, so the keys can't change while they are in flight
+func (h *CommandHandler) migrateKeys(options migrateOptions) ([]string, error) {
+	restoreCommand := constants.RESTORE_COMMAND
+	if h.ctx.ServerInstance.IsClusterEnabled() {
+		// The target may only be importing the slot of the keys
+		restoreCommand = constants.RESTORE_ASKING_COMMAND
+	}
+	var requests []byte
+	movedKeys := []string{}
+	for _, key := range options.keys {
+		value, exists := h.db.GetValue(key)
+		if !exists {
+			continue
+		}
+		payload, err := persistence.EncodeDumpPayload(value)
+		if err != nil {
+			return nil, err
+		}
+		ttl := int64(0)
+		if value.ExpirationTime != nil {
+			ttl = max(time.Until(*value.ExpirationTime).Milliseconds(), 1)
+		}
+		restoreArgs := []string{key, strconv.FormatInt(ttl, 10), string(payload)}
+		if options.replace {
+			restoreArgs = append(restoreArgs, constants.RESTORE_REPLACE_PARAM)
+		}
+		requests = append(requests, parser.Encode(utils.CreateRequestForCommand(restoreCommand, restoreArgs...))...)
+		movedKeys = append(movedKeys, key)
+	}
+	if len(movedKeys) == 0 {
+		return movedKeys, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", options.address, options.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", constants.IOERR_ERROR, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(options.timeout))
+	if _, err := conn.Write(requests); err != nil {
+		return nil, fmt.Errorf("%s: %v", constants.IOERR_ERROR, err.Error())
+	}
+	reader := bufio.NewReader(conn)
+	var targetErr error
+	for range movedKeys {
+		reply, err := parser.DecodeFrom(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", constants.IOERR_ERROR, err.Error())
+		}
+		if reply.Type == constants.ERROR && targetErr == nil {
+			targetErr = fmt.Errorf("Target instance replied with error: %s", reply.Data)
+		}
+	}
+	// Keys are only deleted when all of them were restored, so a failed MIGRATE leaves the dataset as it was
+	if targetErr != nil {
+		return nil, targetErr
+	}
+	if !options.copy {
+		for _, key := range movedKeys {
+			h.db.DeleteKey(key)
+		}
+	}
+	return movedKeys, nil
+}
+
+// Command handlers
+
+// handleDumpCommand serializes the value of a key, which RESTORE turns back into a key
+func handleDumpCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) != 1 {
+		return make([]constants.DataRepr, 0), fmt.Errorf("DUMP command expects %d variables but %d given", 1, len(args))
+	}
+	key := string(args[0].Data)
+	h.expireKey(key)
+	value, exists := h.db.GetValue(key)
+	if !exists {
+		return []constants.DataRepr{utils.NilBulkStringResponse()}, nil
+	}
+	payload, err := persistence.EncodeDumpPayload(value)
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	return []constants.DataRepr{utils.CreateBulkResponse(string(payload))}, nil
+}
+
+// handleRestoreCommand handles RESTORE key ttl payload [REPLACE] [ABSTTL], the ttl being in milliseconds, or
+// a Unix time in milliseconds with ABSTTL, and 0 for keys which don't expire
+func handleRestoreCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) < 3 {
+		return make([]constants.DataRepr, 0), fmt.Errorf("RESTORE command expects >%d variables but %d given", 2, len(args))
+	}
+	replace, absTtl := false, false
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(string(arg.Data)) {
+		case constants.RESTORE_REPLACE_PARAM:
+			replace = true
+		case constants.RESTORE_ABSTTL_PARAM:
+			absTtl = true
+		default:
+			return make([]constants.DataRepr, 0), fmt.Errorf("unsupported RESTORE option '%s'", arg.Data)
+		}
+	}
+	key := string(args[0].Data)
+	ttl, err := strconv.ParseInt(string(args[1].Data), 10, 64)
+	if err != nil || ttl < 0 {
+		return make([]constants.DataRepr, 0), errors.New("Invalid TTL value, must be >= 0")
+	}
+	if !replace && h.db.GetKeyType(key) != constants.NONE {
+		return make([]constants.DataRepr, 0), errors.New(constants.BUSYKEY_ERROR)
+	}
+	value, err := persistence.DecodeDumpPayload(args[2].Data, h.ctx.Logger)
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	if ttl > 0 {
+		expirationTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		if absTtl {
+			expirationTime = time.UnixMilli(ttl)
+		}
+		if !expirationTime.After(time.Now()) {
+			// Restored already expired, which only drops the key being replaced
+			h.db.DeleteKey(key)
+			return []constants.DataRepr{utils.CreateStringResponse(constants.OK_RESPONSE)}, nil
+		}
+		value.ExpirationTime = &expirationTime
+	}
+	h.db.RestoreKey(key, *value)
+	return []constants.DataRepr{utils.CreateStringResponse(constants.OK_RESPONSE)}, nil
+}
+
+// handleMigrateCommand moves keys to another server, replying NOKEY when none of them exists
+func handleMigrateCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	options, err := parseMigrateOptions(args)
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	movedKeys, err := h.migrateKeys(options)
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	if len(movedKeys) == 0 {
+		return []constants.DataRepr{utils.CreateStringResponse(constants.NOKEY_RESPONSE)}, nil
+	}
+	return []constants.DataRepr{utils.CreateStringResponse(constants.OK_RESPONSE)}, nil
+}
+
+// Rewrites of non-deterministic write commands
+
+// rewriteRestoreCommand gives the key its absolute expiration time, and turns RESTORE-ASKING into RESTORE
+func rewriteRestoreCommand(h *CommandHandler, args []constants.DataRepr, result []constants.DataRepr) constants.DataRepr {
+	key := string(args[0].Data)
+	value, exists := h.db.GetValue(key)
+	if !exists {
+		return utils.CreateRequestForCommand(constants.DEL_COMMAND, key)
+	}
+	ttl := "0"
+	if value.ExpirationTime != nil {
+		ttl = strconv.FormatInt(value.ExpirationTime.UnixMilli(), 10)
+	}
+	return utils.CreateRequestForCommand(constants.RESTORE_COMMAND, key, ttl, string(args[2].Data),
+		constants.RESTORE_REPLACE_PARAM, constants.RESTORE_ABSTTL_PARAM)
+}
+
+// rewriteMigrateCommand propagates the deletion of the keys which were moved, if any
+func rewriteMigrateCommand(h *CommandHandler, args []constants.DataRepr, result []constants.DataRepr) constants.DataRepr {
+	options, _ := parseMigrateOptions(args)
+	deletedKeys := []string{}
+	if !options.copy && string(result[0].Data) == constants.OK_RESPONSE {
+		for _, key := range options.keys {
+			if h.db.GetKeyType(key) == constants.NONE {
+				deletedKeys = append(deletedKeys, key)
+			}
+		}
+	}
+	if len(deletedKeys) == 0 {
+		return utils.CreateArrayDataRepr([]constants.DataRepr{})
+	}
+	return utils.CreateRequestForCommand(constants.DEL_COMMAND, deletedKeys...)
+}
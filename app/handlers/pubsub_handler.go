@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// PubSubHandler delivers PUBLISH messages to the connections subscribed to their channel
+type PubSubHandler struct {
+	ctx         *context.Context
+	connHandler *ConnectionHandler
+	// Subscribed connections by channel, and channels by connection for the counts sent with replies
+	channelSubscribers map[string]map[net.Conn]bool
+	connChannels       map[net.Conn]map[string]bool
+	subscriptionLock   sync.RWMutex
+}
+
+func InitPubSubHandler(ctx *context.Context, connectionHandler *ConnectionHandler, notificationHandler *NotificationHandler,
+	commandHandler *CommandHandler) *PubSubHandler {
+	pubSubHandler := &PubSubHandler{
+		ctx:                ctx,
+		connHandler:        connectionHandler,
+		channelSubscribers: make(map[string]map[net.Conn]bool),
+		connChannels:       make(map[net.Conn]map[string]bool),
+	}
+	commandHandler.pubSubHandler = pubSubHandler
+	notificationHandler.SubscribeToCmdExecutedNotification(pubSubHandler.processCmdExecutedNotification)
+	notificationHandler.SubscribeToConnClosedNotification(pubSubHandler.processConnectionClosedNotification)
+	return pubSubHandler
+}
+
+// Publish sends the message to the subscribers of the channel, returning how many received it
+func (h *PubSubHandler) Publish(channel string, message string) int {
+	h.subscriptionLock.RLock()
+	subscriberConns := make([]net.Conn, 0, len(h.channelSubscribers[channel]))
+	for conn := range h.channelSubscribers[channel] {
+		subscriberConns = append(subscriberConns, conn)
+	}
+	h.subscriptionLock.RUnlock()
+
+	pubSubMessage := createPubSubMessage(constants.PUBSUB_MESSAGE_KIND, utils.CreateBulkResponse(channel), utils.CreateBulkResponse(message))
+	received := 0
+	for _, conn := range subscriberConns {
+		if _, err := h.connHandler.writeDataToConnection(conn, []constants.DataRepr{pubSubMessage}); err == nil {
+			received++
+		}
+	}
+	return received
+}
+
+// SUBSCRIBE and UNSUBSCRIBE are answered here, once per channel, as the command handler doesn't know the connection
+func (h *PubSubHandler) processCmdExecutedNotification(notification constants.CommandExecutedNotification) (bool, error) {
+	if !notification.Success || (notification.Cmd != constants.SUBSCRIBE_COMMAND && notification.Cmd != constants.UNSUBSCRIBE_COMMAND) {
+		return true, nil
+	}
+	conn, err := notificationConn(notification)
+	if err != nil {
+		return false, err
+	}
+	channels := make([]string, len(notification.Args))
+	for i, arg := range notification.Args {
+		channels[i] = string(arg.Data)
+	}
+	var replies []constants.DataRepr
+	if notification.Cmd == constants.SUBSCRIBE_COMMAND {
+		replies = h.subscribe(conn, channels)
+	} else {
+		replies = h.unsubscribe(conn, channels)
+	}
+	_, err = h.connHandler.writeDataToConnection(conn, replies)
+	return err == nil, err
+}
+
+func (h *PubSubHandler) processConnectionClosedNotification(notification constants.ConnectionClosedNotification) (bool, error) {
+	h.unsubscribe(notification.Conn, nil)
+	return true, nil
+}
+
+func (h *PubSubHandler) subscribe(conn net.Conn, channels []string) []constants.DataRepr {
+	h.subscriptionLock.Lock()
+	defer h.subscriptionLock.Unlock()
+	replies := make([]constants.DataRepr, 0, len(channels))
+	for _, channel := range channels {
+		if h.channelSubscribers[channel] == nil {
+			h.channelSubscribers[channel] = make(map[net.Conn]bool)
+		}
+		if h.connChannels[conn] == nil {
+			h.connChannels[conn] = make(map[string]bool)
+		}
+		h.channelSubscribers[channel][conn] = true
+		h.connChannels[conn][channel] = true
+		replies = append(replies, createPubSubMessage(constants.PUBSUB_SUBSCRIBE_KIND, utils.CreateBulkResponse(channel),
+			utils.CreateIntegerResponse(len(h.connChannels[conn]))))
+	}
+	return replies
+}
+
+// unsubscribe removes the connection from the given channels, or from all of them when none is given
+func (h *PubSubHandler) unsubscribe(conn net.Conn, channels []string) []constants.DataRepr {
+	h.subscriptionLock.Lock()
+	defer h.subscriptionLock.Unlock()
+	if len(channels) == 0 {
+		for channel := range h.connChannels[conn] {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+	}
+	if len(channels) == 0 {
+		return []constants.DataRepr{createPubSubMessage(constants.PUBSUB_UNSUBSCRIBE_KIND, utils.NilBulkStringResponse(), utils.CreateIntegerResponse(0))}
+	}
+	replies := make([]constants.DataRepr, 0, len(channels))
+	for _, channel := range channels {
+		delete(h.channelSubscribers[channel], conn)
+		if len(h.channelSubscribers[channel]) == 0 {
+			delete(h.channelSubscribers, channel)
+		}
+		delete(h.connChannels[conn], channel)
+		replies = append(replies, createPubSubMessage(constants.PUBSUB_UNSUBSCRIBE_KIND, utils.CreateBulkResponse(channel),
+			utils.CreateIntegerResponse(len(h.connChannels[conn]))))
+	}
+	if len(h.connChannels[conn]) == 0 {
+		delete(h.connChannels, conn)
+	}
+	return replies
+}
+
+func createPubSubMessage(kind string, channel constants.DataRepr, payload constants.DataRepr) constants.DataRepr {
+	// RESP3 clients get them out of band, as they may come between replies
+	return utils.CreatePushDataRepr([]constants.DataRepr{utils.CreateBulkResponse(kind), channel, payload})
+}
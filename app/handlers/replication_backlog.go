@@ -0,0 +1,77 @@
+package handlers
+
+import "sync"
+
+// ReplicationBacklog keeps the most recent bytes of the replication stream in a circular buffer,
+// so a replica which lost its connection can continue from its offset instead of resyncing fully.
+// Offsets are replication stream offsets: the first byte ever fed has offset 1
+type ReplicationBacklog struct {
+	buffer []byte
+	// Position in buffer the next byte is written to
+	writeIndex int
+	// Number of valid bytes in buffer
+	histlen int
+	// Replication offset of the last byte fed
+	endOffset int
+	lock      sync.RWMutex
+}
+
+// NewReplicationBacklog creates an empty backlog whose next fed byte will have offset startOffset+1
+func NewReplicationBacklog(size int, startOffset int) *ReplicationBacklog {
+	return &ReplicationBacklog{
+		buffer:    make([]byte, size),
+		endOffset: startOffset,
+	}
+}
+
+func (b *ReplicationBacklog) Feed(data []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.endOffset += len(data)
+	size := len(b.buffer)
+	if len(data) > size {
+		// Only the tail fits
+		data = data[len(data)-size:]
+	}
+	for len(data) > 0 {
+		copied := copy(b.buffer[b.writeIndex:], data)
+		data = data[copied:]
+		b.writeIndex = (b.writeIndex + copied) % size
+		b.histlen = min(b.histlen+copied, size)
+	}
+}
+
+// FirstByteOffset is the replication offset of the oldest byte still held
+func (b *ReplicationBacklog) FirstByteOffset() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.endOffset - b.histlen + 1
+}
+
+func (b *ReplicationBacklog) Histlen() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.histlen
+}
+
+func (b *ReplicationBacklog) Size() int {
+	return len(b.buffer)
+}
+
+// ReadFrom returns every byte from offset onwards. offset may be one past the last byte, giving
+// no data, as that is where a replica which received everything continues
+func (b *ReplicationBacklog) ReadFrom(offset int) ([]byte, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	firstByteOffset := b.endOffset - b.histlen + 1
+	if offset < firstByteOffset || offset > b.endOffset+1 {
+		return nil, false
+	}
+	length := b.endOffset + 1 - offset
+	data := make([]byte, length)
+	size := len(b.buffer)
+	start := (b.writeIndex - length + size) % size
+	copied := copy(data, b.buffer[start:min(start+length, size)])
+	copy(data[copied:], b.buffer[:length-copied])
+	return data, true
+}
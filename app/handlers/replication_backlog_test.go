@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReplicationBacklog_ReadFrom(t *testing.T) {
+	backlog := NewReplicationBacklog(8, 100)
+	backlog.Feed([]byte("abcde"))
+	backlog.Feed([]byte("fghij"))
+
+	if backlog.FirstByteOffset() != 103 || backlog.Histlen() != 8 {
+		t.Fatalf("Expected first byte offset 103 and histlen 8, Got: %d and %d", backlog.FirstByteOffset(), backlog.Histlen())
+	}
+	data, ok := backlog.ReadFrom(103)
+	if !ok || !bytes.Equal(data, []byte("cdefghij")) {
+		t.Errorf("Expected 'cdefghij' after wrapping around, Got: %q (%v)", data, ok)
+	}
+	data, ok = backlog.ReadFrom(111)
+	if !ok || len(data) != 0 {
+		t.Errorf("Expected no data for the offset after the last byte, Got: %q (%v)", data, ok)
+	}
+	for _, offset := range []int{102, 112} {
+		if _, ok := backlog.ReadFrom(offset); ok {
+			t.Errorf("Expected offset %d to be outside the backlog", offset)
+		}
+	}
+
+	backlog.Feed([]byte("0123456789"))
+	data, ok = backlog.ReadFrom(113)
+	if !ok || !bytes.Equal(data, []byte("23456789")) {
+		t.Errorf("Expected only the tail of a feed larger than the backlog, Got: %q (%v)", data, ok)
+	}
+}
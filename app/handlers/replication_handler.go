@@ -1,24 +1,44 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
 	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
 	"github.com/codecrafters-io/redis-starter-go/app/utils"
 )
 
 type Replica struct {
-	offset      int
+	// Replicas are listed in the order they attached
+	id int
+	// Port the replica serves clients on, as told with REPLCONF listening-port
+	listeningPort string
+	// Offset the replica last acknowledged having processed, and when
+	ackOffset   int
+	lastAckTime time.Time
 	isActive    bool
-	awaitingAck bool
+	state       string
+	// Replication stream waiting for the replica's writer. While the snapshot is being sent the writer
+	// isn't running yet, so the stream builds up here until the replica is online
+	outputBuffer []byte
+	outputReady  chan struct{}
+	// When the output buffer reached the soft limit, zero while it is below
+	softLimitReachedTime time.Time
 }
 
 type ReplicationHandler struct {
@@ -26,20 +46,58 @@ type ReplicationHandler struct {
 	replicas            map[net.Conn]*Replica
 	connHandler         *ConnectionHandler
 	notificationHandler *NotificationHandler
-	replicaMapLock      sync.RWMutex
+	commandHandler      *CommandHandler
+	db                  *persistence.PersiDb
+	// Created when the first replica attaches
+	backlog        *ReplicationBacklog
+	replicaMapLock sync.RWMutex
+	// A snapshot transfer is waiting to start, replicas needing a full resync join it
+	syncScheduled bool
+	// Serializes snapshot transfers
+	syncLock sync.Mutex
+	// REPLCONF listening-port values sent during handshakes, which come before PSYNC creates the replica
+	listeningPorts map[net.Conn]string
+	lastReplicaId  int
+	// WAIT calls blocked on replica acknowledgements
+	ackWaiters []*replicaAckWaiter
+	// Master offset right after the last write, which is what WAIT waits for. Unlike the master offset
+	// it doesn't cover REPLCONF GETACK, which replicas acknowledge only up to its start
+	writeOffset int
+	// writeOffset when REPLCONF GETACK was last sent
+	getackWriteOffset int
+	failoverState     string
+	// Closed by FAILOVER ABORT, nil once aborted or when no failover runs
+	failoverAborted chan struct{}
 }
 
-func InitReplicationHandler(appContext *context.Context, connectionHandler *ConnectionHandler, notificationHandler *NotificationHandler) *ReplicationHandler {
-	replicationHandler := ReplicationHandler{
+// replicaAckWaiter is a WAIT call waiting for numReplicas replicas to acknowledge targetOffset
+type replicaAckWaiter struct {
+	targetOffset int
+	numReplicas  int
+	done         chan struct{}
+}
+
+func InitReplicationHandler(appContext *context.Context, connectionHandler *ConnectionHandler, notificationHandler *NotificationHandler,
+	commandHandler *CommandHandler, db *persistence.PersiDb) *ReplicationHandler {
+	replicationHandler := &ReplicationHandler{
 		ctx:                 appContext,
 		replicas:            make(map[net.Conn]*Replica),
+		listeningPorts:      make(map[net.Conn]string),
 		connHandler:         connectionHandler,
 		notificationHandler: notificationHandler,
+		commandHandler:      commandHandler,
+		db:                  db,
 		replicaMapLock:      sync.RWMutex{},
+		failoverState:       constants.FAILOVER_STATE_NONE,
 	}
+	// Writes are fed to the replication stream while the write lock is held, so the stream follows
+	// execution order and a snapshot taken under the same lock matches an exact offset
+	commandHandler.RegisterPropagator(replicationHandler.propagateWriteCommand)
+	commandHandler.replicationHandler = replicationHandler
+	connectionHandler.replicationHandler = replicationHandler
 	notificationHandler.SubscribeToCmdExecutedNotification(replicationHandler.processCmdExecutedNotification)
 	notificationHandler.SubscribeToConnClosedNotification(replicationHandler.processConnectionClosedNotification)
-	return &replicationHandler
+	return replicationHandler
 }
 
 func (h *ReplicationHandler) StartReplicationHandler() {
@@ -48,10 +106,7 @@ func (h *ReplicationHandler) StartReplicationHandler() {
 
 func (h *ReplicationHandler) processCmdExecutedNotification(notification constants.CommandExecutedNotification) (bool, error) {
 	h.ctx.Logger.Printf("Invoked processCmdExecutedNotifications in replication handler")
-	if h.ctx.ServerInstance.ReplicationConfig.Role != constants.MASTER_ROLE {
-		// Only master should cater to these notifications, at least for now
-		return true, nil
-	}
+	// Replicas serve their own replicas as well, forwarding the stream they receive from their master
 	if !notification.Success {
 		h.ctx.Logger.Printf("Not handling command [%s] for replication as it wasn't successfully executed", notification.Cmd)
 		return true, nil
@@ -60,173 +115,663 @@ func (h *ReplicationHandler) processCmdExecutedNotification(notification constan
 	switch notification.Cmd {
 	case constants.PSYNC_COMMAND:
 		return h.handleHandshakeWithReplica(notification)
-	case constants.SET_COMMAND, constants.SET_PX_COMMAND:
-		return h.relayCommandToReplica(notification)
 	case constants.REPLCONF_COMMAND:
 		return h.processReplconf(notification)
-	case constants.WAIT_COMMAND:
-		return h.processWaitCommand(notification)
 	default:
 		return true, nil
 	}
 }
 
+// handleHandshakeWithReplica answers PSYNC <replid> <offset>, continuing from the backlog when the
+// replica's history is ours and the offset is still held, or sending a full snapshot otherwise
 func (h *ReplicationHandler) handleHandshakeWithReplica(cmdExecutedNotification constants.CommandExecutedNotification) (bool, error) {
-	h.ctx.Logger.Printf("Handshake completed with replica, adding a new replica")
-	conn, err := h.connHandler.GetConnectionForRequest(cmdExecutedNotification.RequestId)
+	args := cmdExecutedNotification.Args
+	requestedReplId := string(args[0].Data)
+	requestedOffset, err := strconv.Atoi(string(args[1].Data))
+	if err != nil {
+		requestedOffset = -1
+	}
+	conn, err := notificationConn(cmdExecutedNotification)
 	if err != nil {
 		h.ctx.Logger.Printf("Error while trying to fetch connection to requestId: %s", cmdExecutedNotification.RequestId.String())
 		return false, err
 	}
-	currDir, _ := os.Getwd()
-	rdbFilePath := filepath.Join(currDir, "app", "persistence", "storage", "empty_hex.rdb")
-	binaryDecodedDataFromFile, err := utils.ReadHexFileToBinary(rdbFilePath)
+	h.replicaMapLock.Lock()
+	continued := h.tryPartialResync(conn, requestedReplId, requestedOffset)
+	h.replicaMapLock.Unlock()
+	if !continued {
+		h.scheduleFullResync(conn)
+	}
+	h.replicaMapLock.RLock()
+	connectedReplicas := len(h.replicas)
+	h.replicaMapLock.RUnlock()
+	h.ctx.ConnectedReplicasHeartbeatNotificationChan <- constants.ConnectedReplicaHeartbeatNotification{
+		ConnectedReplicas: connectedReplicas,
+	}
+	return true, nil
+}
 
-	if err != nil {
-		h.ctx.Logger.Printf("Error while trying to decode data from rdb file at path '%s': %v", rdbFilePath, err.Error())
-		return false, err
+// tryPartialResync is called with replicaMapLock held. requestedOffset is the first byte the replica is missing
+func (h *ReplicationHandler) tryPartialResync(conn net.Conn, requestedReplId string, requestedOffset int) bool {
+	replicationConfig := h.ctx.ServerInstance.GetReplicationConfig()
+	if h.backlog == nil {
+		return false
+	}
+	// History under the previous replication ID is shared only up to the point it was replaced
+	if requestedReplId != replicationConfig.MasterReplId &&
+		(requestedReplId != replicationConfig.MasterReplId2 || requestedOffset > replicationConfig.SecondReplOffeset) {
+		h.ctx.Logger.Printf("Replica (%s) asked for replication ID '%s' which doesn't match ours, full resync needed", conn.RemoteAddr(), requestedReplId)
+		return false
+	}
+	missingData, inBacklog := h.backlog.ReadFrom(requestedOffset)
+	if !inBacklog {
+		h.ctx.Logger.Printf("Replica (%s) asked for offset %d which is outside the backlog (%d-%d), full resync needed",
+			conn.RemoteAddr(), requestedOffset, h.backlog.FirstByteOffset(), replicationConfig.MasterReplOffset)
+		return false
+	}
+	continueResponse := utils.CreateStringResponse(fmt.Sprintf("%s %s", constants.CONTINUE_RESPONSE, replicationConfig.MasterReplId))
+	replica := h.addReplica(conn, constants.REPLICA_STATE_ONLINE)
+	replica.ackOffset = requestedOffset - 1
+	replica.outputBuffer = append(parser.Encode(continueResponse), missingData...)
+	h.startReplicaWriter(conn, replica)
+	h.ctx.Logger.Printf("Partial resync with replica (%s) from offset %d, sent %d bytes of backlog. Total count of replicas added = %d",
+		conn.RemoteAddr(), requestedOffset, len(missingData), len(h.replicas))
+	return true
+}
+
+// addReplica is called with replicaMapLock held
+func (h *ReplicationHandler) addReplica(conn net.Conn, state string) *Replica {
+	h.lastReplicaId++
+	replica := &Replica{
+		id:            h.lastReplicaId,
+		listeningPort: h.listeningPorts[conn],
+		lastAckTime:   time.Now(),
+		isActive:      true,
+		state:         state,
+	}
+	h.replicas[conn] = replica
+	return replica
+}
+
+// scheduleFullResync queues the replica for the next snapshot transfer. Diskless transfers wait for
+// repl-diskless-sync-delay first, so replicas connecting close together share one
+func (h *ReplicationHandler) scheduleFullResync(conn net.Conn) {
+	h.replicaMapLock.Lock()
+	defer h.replicaMapLock.Unlock()
+	h.addReplica(conn, constants.REPLICA_STATE_WAIT_BGSAVE)
+	if h.syncScheduled {
+		h.ctx.Logger.Printf("Replica (%s) joins the snapshot transfer about to start", conn.RemoteAddr())
+		return
+	}
+	h.syncScheduled = true
+	delay := time.Duration(0)
+	if h.ctx.ServerInstance.IsReplDisklessSyncEnabled() {
+		delay = h.ctx.ServerInstance.GetReplDisklessSyncDelay()
+	}
+	h.ctx.Logger.Printf("Starting snapshot transfer for replica (%s) in %s", conn.RemoteAddr(), delay)
+	go h.runFullResync(delay)
+}
+
+// runFullResync sends a snapshot of the dataset taken at the current replication offset to every waiting
+// replica. Writes executed while it is being sent are held in each replica's output buffer and written
+// right after it
+func (h *ReplicationHandler) runFullResync(delay time.Duration) {
+	time.Sleep(delay)
+	h.syncLock.Lock()
+	defer h.syncLock.Unlock()
+
+	// On a replica the dataset, offset and forwarded stream move together while the master link lock is held
+	h.connHandler.masterLinkLock.Lock()
+	h.commandHandler.writeLock.Lock()
+	h.replicaMapLock.Lock()
+	replicationConfig := h.ctx.ServerInstance.GetReplicationConfig()
+	h.syncScheduled = false
+	conns := []net.Conn{}
+	for conn, replica := range h.replicas {
+		if replica.isActive && replica.state == constants.REPLICA_STATE_WAIT_BGSAVE {
+			conns = append(conns, conn)
+		}
+	}
+	if len(conns) == 0 {
+		h.replicaMapLock.Unlock()
+		h.commandHandler.writeLock.Unlock()
+		h.connHandler.masterLinkLock.Unlock()
+		return
+	}
+	if h.backlog == nil {
+		h.backlog = NewReplicationBacklog(h.ctx.ServerInstance.GetReplBacklogSize(), replicationConfig.MasterReplOffset)
+		h.updateBacklogStats()
+	}
+	replicationId := replicationConfig.MasterReplId
+	replicaOffset := replicationConfig.MasterReplOffset
+	for _, conn := range conns {
+		h.replicas[conn].ackOffset = replicaOffset
+		h.replicas[conn].state = constants.REPLICA_STATE_SEND_BULK
+	}
+	snapshot := h.db.Snapshot()
+	h.replicaMapLock.Unlock()
+	h.commandHandler.writeLock.Unlock()
+	h.connHandler.masterLinkLock.Unlock()
+
+	syncWriter := newReplicaSyncWriter(h, conns)
+	fullResyncResponse := utils.CreateStringResponse(fmt.Sprintf("%s %s %d", constants.FULLRESYNC_RESPONSE, replicationId, replicaOffset))
+	syncWriter.Write(parser.Encode(fullResyncResponse))
+	auxFields := map[string]string{
+		"repl-id":     replicationId,
+		"repl-offset": strconv.Itoa(replicaOffset),
+	}
+	var err error
+	if h.ctx.ServerInstance.IsReplDisklessSyncEnabled() {
+		err = h.sendSnapshotDiskless(syncWriter, snapshot, auxFields)
+	} else {
+		err = h.sendSnapshotFromDisk(syncWriter, snapshot, auxFields)
 	}
-	rdbDecodedData := utils.CreateRdbFileResponse(binaryDecodedDataFromFile)
-	_, err = h.connHandler.writeDataToConnection(*conn, []constants.DataRepr{rdbDecodedData})
 	if err != nil {
-		h.ctx.Logger.Printf("Error while tyring to send RDB file to replica: %v", err.Error())
-		return false, err
+		h.ctx.Logger.Printf("Snapshot transfer to %d replicas failed: %v", len(conns), err.Error())
 	}
+
 	h.replicaMapLock.Lock()
 	defer h.replicaMapLock.Unlock()
-	h.replicas[*conn] = &Replica{
-		isActive: true,
-		//TODO: Update offset based on data from replica
-		offset:      0,
-		awaitingAck: false,
+	for _, conn := range conns {
+		replica := h.replicas[conn]
+		// The replica may have been dropped for the output written during the transfer
+		if err != nil || syncWriter.failed[conn] != nil || !replica.isActive {
+			h.deactivateReplica(replica)
+			continue
+		}
+		h.ctx.Logger.Printf("Full resync with replica (%s) at offset %d done, %d bytes were written during the transfer",
+			conn.RemoteAddr(), replicaOffset, len(replica.outputBuffer))
+		replica.state = constants.REPLICA_STATE_ONLINE
+		h.startReplicaWriter(conn, replica)
 	}
-	h.ctx.Logger.Printf("Added replica for connection [%s]. Total count of replicas added = %d", (*conn).RemoteAddr(), len(h.replicas))
-	h.ctx.ConnectedReplicasHeartbeatNotificationChan <- constants.ConnectedReplicaHeartbeatNotification{
-		ConnectedReplicas: len(h.replicas),
+}
+
+// sendSnapshotDiskless streams the RDB to the replicas as it is encoded
+func (h *ReplicationHandler) sendSnapshotDiskless(syncWriter *replicaSyncWriter, snapshot map[string]persistence.Value, auxFields map[string]string) error {
+	eofMark, err := newRdbEofMark()
+	if err != nil {
+		return err
 	}
-	// TODO: Send all existing writes from offset to current time to newly added Replica
-	return true, nil
+	h.ctx.Logger.Printf("Streaming RDB of %d keys to %d replicas without touching the disk", len(snapshot), len(syncWriter.conns))
+	_, err = syncWriter.Write([]byte(constants.RDB_EOF_MARK_PREFIX + eofMark + "\r\n"))
+	if err != nil {
+		return err
+	}
+	err = persistence.WriteRDB(syncWriter, snapshot, auxFields)
+	if err != nil {
+		return err
+	}
+	_, err = syncWriter.Write([]byte(eofMark))
+	return err
 }
 
-func (h *ReplicationHandler) getUpToDateReplicasCount() int {
-	h.replicaMapLock.RLock()
-	defer h.replicaMapLock.RUnlock()
-	upToDateReplicaCount := 0
-	for _, replica := range h.replicas {
-		if !replica.awaitingAck {
-			upToDateReplicaCount++
+// sendSnapshotFromDisk writes the RDB to a temporary file in the RDB directory and sends it with its length
+func (h *ReplicationHandler) sendSnapshotFromDisk(syncWriter *replicaSyncWriter, snapshot map[string]persistence.Value, auxFields map[string]string) error {
+	rdbDir := h.ctx.ServerInstance.GetRdbDir()
+	if len(rdbDir) == 0 {
+		rdbDir = "."
+	}
+	rdbFilePath := filepath.Join(rdbDir, fmt.Sprintf("%s%d.rdb", constants.REPL_TEMP_RDB_PREFIX, os.Getpid()))
+	err := persistence.WriteRDBFile(rdbFilePath, snapshot, auxFields)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rdbFilePath)
+	rdbFile, err := os.Open(rdbFilePath)
+	if err != nil {
+		return err
+	}
+	defer rdbFile.Close()
+	rdbFileInfo, err := rdbFile.Stat()
+	if err != nil {
+		return err
+	}
+	h.ctx.Logger.Printf("Sending RDB of %d keys (%d bytes) to %d replicas", len(snapshot), rdbFileInfo.Size(), len(syncWriter.conns))
+	_, err = syncWriter.Write([]byte(fmt.Sprintf("$%d\r\n", rdbFileInfo.Size())))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(syncWriter, rdbFile)
+	return err
+}
+
+// replicaSyncWriter writes a snapshot transfer to several replicas at once, leaving out the ones whose
+// connection fails so the rest can carry on
+type replicaSyncWriter struct {
+	h      *ReplicationHandler
+	conns  []net.Conn
+	failed map[net.Conn]error
+}
+
+func newReplicaSyncWriter(h *ReplicationHandler, conns []net.Conn) *replicaSyncWriter {
+	return &replicaSyncWriter{h: h, conns: conns, failed: make(map[net.Conn]error)}
+}
+
+func (w *replicaSyncWriter) Write(data []byte) (int, error) {
+	for _, conn := range w.conns {
+		if w.failed[conn] != nil {
+			continue
+		}
+		_, err := w.h.connHandler.writeBytesToConnection(conn, data)
+		if err != nil {
+			w.failed[conn] = err
 		}
 	}
+	if len(w.failed) == len(w.conns) {
+		return 0, errors.New("connection to every replica failed")
+	}
+	return len(data), nil
+}
 
-	return upToDateReplicaCount
+func newRdbEofMark() (string, error) {
+	markBytes := make([]byte, constants.RDB_EOF_MARK_LENGTH/2)
+	_, err := rand.Read(markBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(markBytes), nil
 }
 
-func (h *ReplicationHandler) relayCommandToReplica(cmdExecutedNotification constants.CommandExecutedNotification) (bool, error) {
-	cmd := cmdExecutedNotification.Cmd
-	h.ctx.Logger.Printf("Relaying command [%s] to replicas", cmd)
+// startReplicaWriter is called with replicaMapLock held, once the replica is online
+func (h *ReplicationHandler) startReplicaWriter(conn net.Conn, replica *Replica) {
+	replica.outputReady = make(chan struct{}, 1)
+	go h.runReplicaWriter(conn, replica)
+	signalReplicaWriter(replica)
+}
 
-	h.replicaMapLock.Lock()
-	for conn, replica := range h.replicas {
+// runReplicaWriter is the only writer of the replication stream to a replica once it is online, so a
+// slow replica never holds up the writes being fed or the other replicas
+func (h *ReplicationHandler) runReplicaWriter(conn net.Conn, replica *Replica) {
+	for range replica.outputReady {
+		h.replicaMapLock.Lock()
 		if !replica.isActive {
-			h.ctx.Logger.Printf("Not relaying command [%s] to replica with address '%s' as connection is not active", cmd, conn.RemoteAddr())
+			h.replicaMapLock.Unlock()
+			return
+		}
+		output := replica.outputBuffer
+		replica.outputBuffer = nil
+		h.replicaMapLock.Unlock()
+		if len(output) == 0 {
 			continue
 		}
-		_, err := h.connHandler.writeDataToConnection(conn, []constants.DataRepr{cmdExecutedNotification.DecodedRequest})
+		_, err := h.connHandler.writeBytesToConnection(conn, output)
 		if err != nil {
-			h.ctx.Logger.Printf("Error while trying to relay command [%s] to replica with address '%s': %s", cmd, conn.RemoteAddr(), err.Error())
+			h.ctx.Logger.Printf("Error while trying to write replication stream to replica with address '%s': %s", conn.RemoteAddr(), err.Error())
+			h.replicaMapLock.Lock()
+			h.deactivateReplica(replica)
+			h.replicaMapLock.Unlock()
+			return
+		}
+	}
+}
+
+func signalReplicaWriter(replica *Replica) {
+	select {
+	case replica.outputReady <- struct{}{}:
+	default:
+		// The writer hasn't picked up the previous signal yet and will take this output along with it
+	}
+}
+
+// deactivateReplica is called with replicaMapLock held
+func (h *ReplicationHandler) deactivateReplica(replica *Replica) {
+	replica.isActive = false
+	replica.outputBuffer = nil
+	// Wakes the writer up so it can stop
+	signalReplicaWriter(replica)
+}
+
+// feedReplicationStream is called with replicaMapLock held, which keeps the stream in a single order.
+// It adds data to the backlog, moving the replication offset along, and queues it for every replica
+func (h *ReplicationHandler) feedReplicationStream(dataList []constants.DataRepr) {
+	encodedData := []byte{}
+	for _, data := range dataList {
+		encodedData = append(encodedData, parser.Encode(data)...)
+	}
+	if h.backlog != nil {
+		h.ctx.ServerInstance.AddMasterReplOffset(len(encodedData))
+	}
+	h.writeReplicationStream(encodedData)
+}
+
+// forwardMasterStream passes the stream a replica received from its master on to its own replicas as is,
+// so they share the upstream replication ID and offsets. It is called with the master link lock held,
+// once the data was applied and counted in the replication offset
+func (h *ReplicationHandler) forwardMasterStream(data []byte) {
+	h.replicaMapLock.Lock()
+	defer h.replicaMapLock.Unlock()
+	h.writeReplicationStream(data)
+}
+
+// writeReplicationStream adds data already counted in the replication offset to the backlog and queues it
+// for every replica. It is called with replicaMapLock held
+func (h *ReplicationHandler) writeReplicationStream(encodedData []byte) {
+	if h.backlog != nil {
+		h.backlog.Feed(encodedData)
+		h.updateBacklogStats()
+	}
+	for conn, replica := range h.replicas {
+		if !replica.isActive || replica.state == constants.REPLICA_STATE_WAIT_BGSAVE {
+			// The snapshot a waiting replica is going to receive already holds this data
+			continue
+		}
+		replica.outputBuffer = append(replica.outputBuffer, encodedData...)
+		if h.outputBufferLimitReached(replica) {
+			h.ctx.Logger.Printf("Disconnecting replica (%s) with %d bytes of pending output, over client-output-buffer-limit",
+				conn.RemoteAddr(), len(replica.outputBuffer))
+			h.deactivateReplica(replica)
+			// Closing the connection notifies the handlers, some of which take replicaMapLock
+			go h.connHandler.terminateConnection(conn)
 			continue
 		}
-		replica.awaitingAck = true
+		if replica.state == constants.REPLICA_STATE_ONLINE {
+			signalReplicaWriter(replica)
+		}
 	}
-	h.replicaMapLock.Unlock()
-	h.ctx.Logger.Printf("Successfully relayed command [%s] to all the replicas", cmd)
-	return true, nil
+}
+
+// outputBufferLimitReached is called with replicaMapLock held once output was queued for the replica. The output
+// is too much when it reaches the hard limit, or stays at or above the soft limit for longer than allowed
+func (h *ReplicationHandler) outputBufferLimitReached(replica *Replica) bool {
+	hardLimit, softLimit, softLimitDuration := h.ctx.ServerInstance.GetReplicaOutputBufferLimits()
+	outputLength := len(replica.outputBuffer)
+	if hardLimit > 0 && outputLength >= hardLimit {
+		return true
+	}
+	if softLimit == 0 || outputLength < softLimit {
+		replica.softLimitReachedTime = time.Time{}
+		return false
+	}
+	if replica.softLimitReachedTime.IsZero() {
+		replica.softLimitReachedTime = time.Now()
+	}
+	return time.Since(replica.softLimitReachedTime) >= softLimitDuration
+}
+
+func (h *ReplicationHandler) updateBacklogStats() {
+	h.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+		replicationConfig.ReplBacklogActive = 1
+		replicationConfig.ReplBacklogSize = h.backlog.Size()
+		replicationConfig.ReplBacklogFirstByteOffset = h.backlog.FirstByteOffset()
+		replicationConfig.ReplBacklogHistlen = h.backlog.Histlen()
+	})
+}
+
+// propagateWriteCommand is called by the command handler with its write lock held
+func (h *ReplicationHandler) propagateWriteCommand(request constants.DataRepr) {
+	if h.ctx.ServerInstance.GetReplicationRole() != constants.MASTER_ROLE {
+		return
+	}
+	h.replicaMapLock.Lock()
+	defer h.replicaMapLock.Unlock()
+	h.feedReplicationStream([]constants.DataRepr{request})
+	h.writeOffset = h.ctx.ServerInstance.GetMasterReplOffset()
 }
 
 func (h *ReplicationHandler) processReplconf(cmdExecutedNotification constants.CommandExecutedNotification) (bool, error) {
 	args := cmdExecutedNotification.Args
-
-	if string(args[0].Data) != constants.ACK {
+	if len(args) < 2 {
+		return true, nil
+	}
+	param := strings.ToLower(string(args[0].Data))
+	if param != strings.ToLower(constants.ACK) && param != constants.REPLCONF_LISTENING_PORT_PARAM {
 		return true, nil
 	}
-	bytesProcessedByReplica, _ := strconv.Atoi(string(args[1].Data))
 
-	conn, err := h.connHandler.GetConnectionForRequest(cmdExecutedNotification.RequestId)
+	conn, err := notificationConn(cmdExecutedNotification)
 	if err != nil {
-		h.ctx.Logger.Printf("Error while trying to fetch connection in REPLCONF ACK processing for requestId: %s", cmdExecutedNotification.RequestId.String())
+		h.ctx.Logger.Printf("Error while trying to fetch connection in REPLCONF processing for requestId: %s", cmdExecutedNotification.RequestId.String())
 		return false, err
 	}
 	h.replicaMapLock.Lock()
 	defer h.replicaMapLock.Unlock()
+	replica, isReplica := h.replicas[conn]
+	if param == constants.REPLCONF_LISTENING_PORT_PARAM {
+		h.listeningPorts[conn] = string(args[1].Data)
+		if isReplica {
+			replica.listeningPort = string(args[1].Data)
+		}
+		return true, nil
+	}
 
-	h.replicas[*conn].offset += int(bytesProcessedByReplica)
-	h.replicas[*conn].awaitingAck = false
+	ackOffset, err := strconv.Atoi(string(args[1].Data))
+	if err != nil {
+		h.ctx.Logger.Printf("Ignoring REPLCONF ACK with invalid offset: %q", args[1].Data)
+		return false, err
+	}
+	if !isReplica {
+		return true, nil
+	}
+	replica.lastAckTime = time.Now()
+	// ACKs may be handled out of order, an older one must not move the offset back
+	if ackOffset > replica.ackOffset {
+		replica.ackOffset = ackOffset
+	}
+	h.wakeAckWaiters()
 	return true, nil
 }
 
-func (h *ReplicationHandler) processWaitCommand(cmdExecutedNotification constants.CommandExecutedNotification) (bool, error) {
-	args := cmdExecutedNotification.Args
-	if len(args) < 2 {
-		errMessage := fmt.Sprintf("WAIT command expects %d variables but %d given", 2, len(args))
-		h.ctx.Logger.Print(errMessage)
-		return false, errors.New(errMessage)
+// WaitForReplicas returns the number of replicas which acknowledged the last write made before it was called,
+// once there are numReplicas of them or the timeout expires. A timeout of 0 waits for as long as it takes.
+// It blocks the caller, so the connection sending WAIT gets its reply before the ones of the commands after it
+func (h *ReplicationHandler) WaitForReplicas(numReplicas int, timeout time.Duration) int {
+	h.replicaMapLock.Lock()
+	targetOffset := h.writeOffset
+	ackReplicaCount := h.countAckedReplicas(targetOffset)
+	if ackReplicaCount >= numReplicas {
+		h.replicaMapLock.Unlock()
+		return ackReplicaCount
 	}
-	numReplicas, err := strconv.Atoi(string(args[0].Data))
-	if err != nil {
-		h.ctx.Logger.Printf("Error while trying to get numReplicas for WAIT command: %v", err.Error())
-		return false, nil
+	waiter := &replicaAckWaiter{
+		targetOffset: targetOffset,
+		numReplicas:  numReplicas,
+		done:         make(chan struct{}),
 	}
+	h.ackWaiters = append(h.ackWaiters, waiter)
+	h.requestAcks()
+	h.replicaMapLock.Unlock()
 
-	timeout, err := strconv.Atoi(string(args[1].Data))
-	if err != nil {
-		h.ctx.Logger.Printf("Error while trying to get timeout for WAIT command: %v", err.Error())
-		return false, nil
+	// A nil channel never fires, leaving only the acknowledgements to end the wait
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = time.After(timeout)
+	}
+	select {
+	case <-waiter.done:
+	case <-timeoutChan:
+		h.ctx.Logger.Printf("Timed out waiting for replicas to acknowledge offset %d", targetOffset)
 	}
 
-	awaitingAck := false
-	h.replicaMapLock.RLock()
-	for conn, replica := range h.replicas {
-		if !replica.isActive {
+	h.replicaMapLock.Lock()
+	h.removeAckWaiter(waiter)
+	ackReplicaCount = h.countAckedReplicas(targetOffset)
+	h.replicaMapLock.Unlock()
+	return ackReplicaCount
+}
+
+// countAckedReplicas is called with replicaMapLock held
+func (h *ReplicationHandler) countAckedReplicas(offset int) int {
+	ackReplicaCount := 0
+	for _, replica := range h.replicas {
+		if replica.isActive && replica.ackOffset >= offset {
+			ackReplicaCount++
+		}
+	}
+	return ackReplicaCount
+}
+
+// requestAcks asks replicas for their offset with REPLCONF GETACK, unless they were already asked since
+// the last write. It is called with replicaMapLock held
+func (h *ReplicationHandler) requestAcks() {
+	if h.backlog == nil || h.getackWriteOffset == h.writeOffset {
+		return
+	}
+	// GETACK goes through the replication stream, so it counts towards the offsets like any other command
+	h.feedReplicationStream([]constants.DataRepr{utils.CreateReplconfGetack(0)})
+	h.getackWriteOffset = h.writeOffset
+}
+
+// wakeAckWaiters releases the WAIT calls which have enough acknowledgements. It is called with replicaMapLock held
+func (h *ReplicationHandler) wakeAckWaiters() {
+	pendingWaiters := h.ackWaiters[:0]
+	for _, waiter := range h.ackWaiters {
+		if h.countAckedReplicas(waiter.targetOffset) >= waiter.numReplicas {
+			close(waiter.done)
 			continue
 		}
-		if replica.awaitingAck {
-			go h.sendHealthCheck(conn, replica)
+		pendingWaiters = append(pendingWaiters, waiter)
+	}
+	h.ackWaiters = pendingWaiters
+}
+
+// removeAckWaiter is called with replicaMapLock held
+func (h *ReplicationHandler) removeAckWaiter(waiter *replicaAckWaiter) {
+	for i, pendingWaiter := range h.ackWaiters {
+		if pendingWaiter == waiter {
+			h.ackWaiters = append(h.ackWaiters[:i], h.ackWaiters[i+1:]...)
+			return
 		}
-		awaitingAck = awaitingAck || replica.awaitingAck
 	}
-	h.replicaMapLock.RUnlock()
+}
+
+// PromoteToMaster turns a replica into a master. The new replication ID starts a new history, while the old
+// one stays valid as replid2 up to the current offset, so replicas of the old master can continue from us
+func (h *ReplicationHandler) PromoteToMaster() {
+	// Holding the master link lock lets data from the master already read finish applying as a replica
+	h.connHandler.masterLinkLock.Lock()
+	defer h.connHandler.masterLinkLock.Unlock()
+	h.commandHandler.writeLock.Lock()
+	h.replicaMapLock.Lock()
+	var replicationConfig server.ServerReplicationConfig
+	h.ctx.ServerInstance.UpdateReplicationConfig(func(config *server.ServerReplicationConfig) {
+		config.Role = constants.MASTER_ROLE
+		config.MasterServerAddress = ""
+		config.MasterReplId2 = config.MasterReplId
+		config.SecondReplOffeset = config.MasterReplOffset + 1
+		config.MasterReplId = server.NewReplicationId()
+		replicationConfig = *config
+	})
+	// The backlog of a replica serving replicas already holds the stream up to here
+	if h.backlog == nil {
+		h.backlog = NewReplicationBacklog(h.ctx.ServerInstance.GetReplBacklogSize(), replicationConfig.MasterReplOffset)
+		h.updateBacklogStats()
+	}
+	replicaConns := h.detachReplicas()
+	h.replicaMapLock.Unlock()
+	h.commandHandler.writeLock.Unlock()
 
-	timeoutChan := time.After(time.Duration(timeout) * time.Millisecond)
+	h.ctx.Logger.Printf("Promoted to master with replication ID %s, previous ID %s valid up to offset %d",
+		replicationConfig.MasterReplId, replicationConfig.MasterReplId2, replicationConfig.SecondReplOffeset)
+	h.connHandler.DisconnectMaster()
+	h.disconnectReplicas(replicaConns)
+}
 
-	conn, err := h.connHandler.GetConnectionForRequest(cmdExecutedNotification.RequestId)
-	if err != nil {
-		h.ctx.Logger.Printf("Error while trying to fetch connection in WAIT COMMAND processing for requestId: %s", cmdExecutedNotification.RequestId.String())
-		return false, err
+// ReplicaOf makes this server a replica of the master at masterAddress. The current replication ID and offset
+// are kept, so the new master can continue the stream if it shares our history
+func (h *ReplicationHandler) ReplicaOf(masterAddress string) {
+	h.commandHandler.writeLock.Lock()
+	h.replicaMapLock.Lock()
+	// The new master may send a different history, a backlog is created again once a replica needs one
+	h.backlog = nil
+	h.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+		replicationConfig.Role = constants.REPLICA_ROLE
+		replicationConfig.MasterServerAddress = masterAddress
+		replicationConfig.MasterLastIoTime = time.Time{}
+		replicationConfig.ReplBacklogActive = 0
+	})
+	replicaConns := h.detachReplicas()
+	h.replicaMapLock.Unlock()
+	h.commandHandler.writeLock.Unlock()
+
+	h.ctx.Logger.Printf("Replicating from master (%s)", masterAddress)
+	h.connHandler.syncedWithMaster = true
+	h.connHandler.DisconnectMaster()
+	h.connHandler.StartMasterLink()
+	h.disconnectReplicas(replicaConns)
+}
+
+// HandleMasterHistoryChange is called when a replica's link comes up with a history other than the one it
+// forwarded so far, through a full resync or a new replication ID. Its replicas are disconnected so they
+// sync again and learn about it, and after a full resync the backlog no longer matches the dataset
+func (h *ReplicationHandler) HandleMasterHistoryChange(fullResync bool) {
+	h.replicaMapLock.Lock()
+	if fullResync {
+		h.backlog = nil
+		h.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+			replicationConfig.ReplBacklogActive = 0
+		})
 	}
-	ackReplicaCount := h.getUpToDateReplicasCount()
-	hasTimedOut := false
-	for ackReplicaCount < numReplicas && !hasTimedOut && awaitingAck {
-		select {
-		case <-timeoutChan:
-			h.ctx.Logger.Printf("Timed out waiting for replicas to acknowledge")
-			hasTimedOut = true
-		default:
-			ackReplicaCount = h.getUpToDateReplicasCount()
+	replicaConns := h.detachReplicas()
+	h.replicaMapLock.Unlock()
+	h.disconnectReplicas(replicaConns)
+}
+
+// detachReplicas deactivates every replica after a role change, returning their connections to be closed
+// so they sync again and learn about the change. It is called with replicaMapLock held
+func (h *ReplicationHandler) detachReplicas() []net.Conn {
+	replicaConns := make([]net.Conn, 0, len(h.replicas))
+	for conn, replica := range h.replicas {
+		if replica.isActive {
+			h.deactivateReplica(replica)
+			replicaConns = append(replicaConns, conn)
 		}
 	}
+	return replicaConns
+}
 
-	h.connHandler.writeDataToConnection(*conn, []constants.DataRepr{utils.CreateIntegerResponse(ackReplicaCount)})
-	return true, nil
+func (h *ReplicationHandler) disconnectReplicas(replicaConns []net.Conn) {
+	for _, conn := range replicaConns {
+		h.connHandler.terminateConnection(conn)
+	}
 }
 
-func (h *ReplicationHandler) processConnectionClosedNotification(notification constants.ConnectionClosedNotification) (bool, error) {
-	if h.ctx.ServerInstance.ReplicationConfig.Role != constants.MASTER_ROLE {
-		// Only master should cater to these notifications, at least for now
-		return true, nil
+// CountGoodReplicas counts the online replicas which acknowledged within min-replicas-max-lag, or all of them
+// when it is 0
+func (h *ReplicationHandler) CountGoodReplicas() int {
+	h.replicaMapLock.RLock()
+	defer h.replicaMapLock.RUnlock()
+	maxLag := h.ctx.ServerInstance.GetMinReplicasMaxLag()
+	goodReplicas := 0
+	for _, replica := range h.replicas {
+		if replica.isActive && replica.state == constants.REPLICA_STATE_ONLINE && (maxLag == 0 || time.Since(replica.lastAckTime) <= maxLag) {
+			goodReplicas++
+		}
+	}
+	return goodReplicas
+}
+
+// ReplicasInfo lists the attached replicas for INFO replication, as slaveN:ip=,port=,state=,offset=,lag= lines
+func (h *ReplicationHandler) ReplicasInfo() []string {
+	h.replicaMapLock.RLock()
+	defer h.replicaMapLock.RUnlock()
+	replicaConns := make([]net.Conn, 0, len(h.replicas))
+	for conn, replica := range h.replicas {
+		if replica.isActive {
+			replicaConns = append(replicaConns, conn)
+		}
 	}
+	sort.Slice(replicaConns, func(i, j int) bool {
+		return h.replicas[replicaConns[i]].id < h.replicas[replicaConns[j]].id
+	})
+	replicasInfo := make([]string, 0, len(replicaConns))
+	for i, conn := range replicaConns {
+		replica := h.replicas[conn]
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		lag := int(time.Since(replica.lastAckTime).Seconds())
+		replicasInfo = append(replicasInfo, fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+			i, ip, replica.listeningPort, replica.state, replica.ackOffset, lag))
+	}
+	return replicasInfo
+}
+
+func (h *ReplicationHandler) processConnectionClosedNotification(notification constants.ConnectionClosedNotification) (bool, error) {
 	h.replicaMapLock.Lock()
-	replica := h.replicas[notification.Conn]
-	replica.isActive = false
+	delete(h.listeningPorts, notification.Conn)
+	h.replicaMapLock.Unlock()
+	h.replicaMapLock.Lock()
+	if replica, isReplica := h.replicas[notification.Conn]; isReplica {
+		h.deactivateReplica(replica)
+	}
 	h.replicaMapLock.Unlock()
 	return true, nil
 }
@@ -243,19 +788,3 @@ func (h *ReplicationHandler) cleanupInactiveConnections() {
 		time.Sleep(1 * time.Minute)
 	}
 }
-
-func (h *ReplicationHandler) sendHealthCheck(conn net.Conn, replica *Replica) (bool, error) {
-	h.ctx.Logger.Printf("Trying to send health check to conn: %s with Replica data: %+v", conn.RemoteAddr(), replica)
-	if !replica.isActive {
-		h.ctx.Logger.Printf("Not checking health of replica with address '%s' as connection is not active", conn.RemoteAddr())
-		return true, nil
-	}
-	h.ctx.Logger.Printf("Sending health check to replica at address: %s", conn.RemoteAddr())
-	_, err := h.connHandler.writeDataToConnection(conn, []constants.DataRepr{utils.CreateReplconfGetack(replica.offset)})
-	if err != nil {
-		h.ctx.Logger.Printf("Issue while sending REPLCONFG GETACK to replica at address: %s", conn.RemoteAddr().String())
-		return false, err
-	}
-	h.ctx.Logger.Printf("Done sending health check to replica")
-	return true, nil
-}
@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// testHandlers are the handlers of a master wired as main does, around a server that isn't listening
+type testHandlers struct {
+	ctx                *context.Context
+	commandHandler     *CommandHandler
+	connHandler        *ConnectionHandler
+	replicationHandler *ReplicationHandler
+}
+
+func newTestHandlers(t *testing.T) *testHandlers {
+	serverInstance := &server.Server{
+		ReplicationConfig: server.ServerReplicationConfig{
+			Role:              constants.MASTER_ROLE,
+			MasterReplId:      server.NewReplicationId(),
+			SecondReplOffeset: -1,
+		},
+		ServerConfig: server.ServerConfig{
+			RdbDir:          t.TempDir(),
+			DbFileName:      "dump.rdb",
+			ReplBacklogSize: 1024 * 1024,
+			ProtoMaxBulkLen: 512 * 1024 * 1024,
+		},
+	}
+	appContext := &context.Context{
+		ServerInstance:                   serverInstance,
+		Logger:                           log.New(io.Discard, "", 0),
+		CommandExecutedNotificationChan:  make(chan constants.CommandExecutedNotification),
+		ConnectionClosedNotificationChan: make(chan constants.ConnectionClosedNotification),
+		ConnectedReplicasHeartbeatNotificationChan: make(chan constants.ConnectedReplicaHeartbeatNotification),
+	}
+	utils.InitUtils(appContext)
+	parser.InitBaseParser(appContext)
+
+	persiDb := persistence.Init(appContext)
+	notificationHandler := NewNotificationHandler(appContext)
+	commandHandler := InitCommandHandler(appContext, notificationHandler, persiDb)
+	requestHandler := InitRequestHandler(appContext, commandHandler)
+	connectionHandler := InitConnectionHandler(appContext, requestHandler, notificationHandler)
+	replicationHandler := InitReplicationHandler(appContext, connectionHandler, notificationHandler, commandHandler, persiDb)
+	return &testHandlers{
+		ctx:                appContext,
+		commandHandler:     commandHandler,
+		connHandler:        connectionHandler,
+		replicationHandler: replicationHandler,
+	}
+}
+
+func TestPromoteToMaster_PartialResync(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	replicationConfig := &handlers.ctx.ServerInstance.ReplicationConfig
+	replicationConfig.Role = constants.REPLICA_ROLE
+	replicationConfig.MasterReplOffset = 100
+	oldReplId := replicationConfig.MasterReplId
+
+	replicationHandler.PromoteToMaster()
+	newReplId := replicationConfig.MasterReplId
+	if replicationConfig.Role != constants.MASTER_ROLE || newReplId == oldReplId {
+		t.Fatalf("Expected a master with a new replication ID, Got: %s with %s", replicationConfig.Role, newReplId)
+	}
+	if replicationConfig.MasterReplId2 != oldReplId || replicationConfig.SecondReplOffeset != 101 {
+		t.Fatalf("Expected the old replication ID to be valid up to offset 101, Got: %s up to %d",
+			replicationConfig.MasterReplId2, replicationConfig.SecondReplOffeset)
+	}
+
+	testCases := []struct {
+		replId    string
+		offset    int
+		continued bool
+	}{
+		{oldReplId, 101, true},
+		{oldReplId, 102, false},
+		{newReplId, 101, true},
+		{server.NewReplicationId(), 101, false},
+	}
+	for _, testCase := range testCases {
+		masterConn, replicaConn := net.Pipe()
+		replicationHandler.replicaMapLock.Lock()
+		continued := replicationHandler.tryPartialResync(masterConn, testCase.replId, testCase.offset)
+		replicationHandler.replicaMapLock.Unlock()
+		if continued != testCase.continued {
+			t.Errorf("Expected partial resync from %s at offset %d to be %v, Got: %v", testCase.replId, testCase.offset, testCase.continued, continued)
+		}
+		if continued {
+			line, err := bufio.NewReader(replicaConn).ReadString('\n')
+			if expected := "+" + constants.CONTINUE_RESPONSE + " " + newReplId + constants.CRLF; err != nil || line != expected {
+				t.Errorf("Expected %q, Got: %q (%v)", expected, line, err)
+			}
+		}
+		masterConn.Close()
+		replicaConn.Close()
+	}
+}
+
+// attachOnlineReplica adds a replica which is past its sync, whose stream can be read from the returned connection
+func attachOnlineReplica(replicationHandler *ReplicationHandler) (*Replica, net.Conn) {
+	masterConn, replicaConn := net.Pipe()
+	replicationHandler.replicaMapLock.Lock()
+	defer replicationHandler.replicaMapLock.Unlock()
+	if replicationHandler.backlog == nil {
+		replicationHandler.backlog = NewReplicationBacklog(1024*1024, replicationHandler.ctx.ServerInstance.GetMasterReplOffset())
+	}
+	replica := replicationHandler.addReplica(masterConn, constants.REPLICA_STATE_ONLINE)
+	replicationHandler.startReplicaWriter(masterConn, replica)
+	return replica, replicaConn
+}
+
+func TestReplicaWriter_StreamsInOrder(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	_, replicaConn := attachOnlineReplica(replicationHandler)
+	defer replicaConn.Close()
+
+	expected := []byte{}
+	for i := 0; i < 20; i++ {
+		request := utils.CreateRequestForCommand(constants.SET_COMMAND, "key", strconv.Itoa(i))
+		expected = append(expected, parser.Encode(request)...)
+		replicationHandler.propagateWriteCommand(request)
+	}
+	received := make([]byte, len(expected))
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(replicaConn, received); err != nil || !bytes.Equal(received, expected) {
+		t.Fatalf("Expected the commands in the order they were propagated %q, Got: %q (%v)", expected, received, err)
+	}
+	if offset := handlers.ctx.ServerInstance.ReplicationConfig.MasterReplOffset; offset != len(expected) {
+		t.Errorf("Expected the master offset to move to %d, Got: %d", len(expected), offset)
+	}
+}
+
+func TestReplicaWriter_OutputBufferLimit(t *testing.T) {
+	handlers := newTestHandlers(t)
+	handlers.ctx.ServerInstance.ServerConfig.ReplicaOutputBufferHardLimit = 256
+	replicationHandler := handlers.replicationHandler
+	replica, replicaConn := attachOnlineReplica(replicationHandler)
+	defer replicaConn.Close()
+
+	// Nothing reads from the replica, so its writer is stuck writing the first command while the rest builds up
+	for i := 0; i < 20; i++ {
+		replicationHandler.propagateWriteCommand(utils.CreateRequestForCommand(constants.SET_COMMAND, "key", strconv.Itoa(i)))
+	}
+	replicationHandler.replicaMapLock.RLock()
+	isActive := replica.isActive
+	replicationHandler.replicaMapLock.RUnlock()
+	if isActive {
+		t.Fatalf("Expected the replica to be dropped once its output reached the hard limit")
+	}
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, replicaConn); err != nil {
+		t.Errorf("Expected the connection to the replica to be closed, Got: %v", err)
+	}
+
+	handlers.ctx.ServerInstance.ServerConfig.ReplicaOutputBufferHardLimit = 0
+	handlers.ctx.ServerInstance.ServerConfig.ReplicaOutputBufferSoftLimit = 64
+	handlers.ctx.ServerInstance.ServerConfig.ReplicaOutputBufferSoftSeconds = 60
+	replicationHandler.replicaMapLock.Lock()
+	defer replicationHandler.replicaMapLock.Unlock()
+	softReplica := &Replica{isActive: true, outputBuffer: make([]byte, 64)}
+	if replicationHandler.outputBufferLimitReached(softReplica) || softReplica.softLimitReachedTime.IsZero() {
+		t.Errorf("Expected output at the soft limit to be allowed for the soft seconds, and the time it was reached recorded")
+	}
+	softReplica.softLimitReachedTime = time.Now().Add(-time.Minute)
+	if !replicationHandler.outputBufferLimitReached(softReplica) {
+		t.Errorf("Expected output over the soft limit for the soft seconds to be too much")
+	}
+	softReplica.outputBuffer = softReplica.outputBuffer[:10]
+	if replicationHandler.outputBufferLimitReached(softReplica) || !softReplica.softLimitReachedTime.IsZero() {
+		t.Errorf("Expected output back under the soft limit to reset the time it was reached")
+	}
+}
+
+func TestProcessMasterData_GetackOffsets(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationConfig := &handlers.ctx.ServerInstance.ReplicationConfig
+	replicationConfig.Role = constants.REPLICA_ROLE
+	replicationConfig.MasterReplOffset = 1000
+
+	setRequest := parser.Encode(utils.CreateRequestForCommand(constants.SET_COMMAND, "key", "value"))
+	pingRequest := parser.Encode(utils.CreateRequestForCommand(constants.PING_COMMAND))
+	getackRequest := parser.Encode(utils.CreateRequestForCommand(constants.REPLCONF_COMMAND, constants.GETACK, "*"))
+	stream := append(append(append(append([]byte{}, setRequest...), pingRequest...), getackRequest...), getackRequest...)
+
+	masterConn, replicaConn := net.Pipe()
+	defer replicaConn.Close()
+	go func() {
+		handlers.connHandler.processMasterData(replicaConn, stream)
+	}()
+	masterConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(masterConn)
+	// Each GETACK is acknowledged with the offset right before it, and PING isn't answered
+	firstAck := 1000 + len(setRequest) + len(pingRequest)
+	for _, expectedOffset := range []int{firstAck, firstAck + len(getackRequest)} {
+		ack, err := parser.DecodeFrom(reader)
+		if err != nil || len(ack.Array) != 3 || string(ack.Array[2].Data) != strconv.Itoa(expectedOffset) {
+			t.Fatalf("Expected an ACK for offset %d, Got: %q (%v)", expectedOffset, ack.Array, err)
+		}
+	}
+	masterConn.Close()
+	if replicationConfig.MasterReplOffset != 1000+len(stream) {
+		t.Errorf("Expected the offset to move by the %d bytes of the stream, Got: %d", len(stream), replicationConfig.MasterReplOffset-1000)
+	}
+}
+
+func TestFullResync_QueuesWritesDuringTransfer(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	if _, err := handleSetCommand(handlers.commandHandler, createArgs("before", "1")); err != nil {
+		t.Fatalf("Unexpected error setting a key: %v", err)
+	}
+	masterConn, replicaConn := net.Pipe()
+	defer replicaConn.Close()
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(replicaConn)
+	replicationHandler.scheduleFullResync(masterConn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "+"+constants.FULLRESYNC_RESPONSE) {
+		t.Fatalf("Expected the transfer to start with FULLRESYNC, Got: %q (%v)", line, err)
+	}
+	// Nothing reads the pipe while the write runs, so the transfer is still in progress
+	setRequest := utils.CreateRequestForCommand(constants.SET_COMMAND, "during", "2")
+	handlers.commandHandler.ExecuteCommand(constants.ExecuteCommandRequest{
+		Cmd:            constants.SET_COMMAND,
+		Args:           setRequest.Array[1:],
+		DecodedRequest: setRequest,
+	})
+
+	line, err = reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "$") {
+		t.Fatalf("Expected the length of the RDB, Got: %q (%v)", line, err)
+	}
+	rdbLength, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	rdb := make([]byte, rdbLength)
+	if _, err := io.ReadFull(reader, rdb); err != nil {
+		t.Fatalf("Unable to read the RDB: %v", err)
+	}
+	if !bytes.Contains(rdb, []byte("before")) || bytes.Contains(rdb, []byte("during")) {
+		t.Errorf("Expected the snapshot to hold the dataset from before the transfer only")
+	}
+	streamed, err := parser.DecodeFrom(reader)
+	if err != nil || !slices.Equal(requestArgs(streamed), []string{constants.SET_COMMAND, "during", "2"}) {
+		t.Errorf("Expected the write made during the transfer to follow the RDB, Got: %q (%v)", streamed.Array, err)
+	}
+}
+
+// sendReplconf processes REPLCONF <param> <value> as if the replica had sent it
+func sendReplconf(t *testing.T, replicationHandler *ReplicationHandler, replica *Replica, param string, value string) {
+	replicationHandler.replicaMapLock.RLock()
+	var conn net.Conn
+	for replicaConn, attachedReplica := range replicationHandler.replicas {
+		if attachedReplica == replica {
+			conn = replicaConn
+		}
+	}
+	replicationHandler.replicaMapLock.RUnlock()
+	if _, err := replicationHandler.processReplconf(constants.CommandExecutedNotification{
+		Cmd:  constants.REPLCONF_COMMAND,
+		Conn: conn,
+		Args: createArgs(param, value),
+	}); err != nil {
+		t.Fatalf("Unexpected error for REPLCONF %s %s: %v", param, value, err)
+	}
+}
+
+func sendReplconfAck(t *testing.T, replicationHandler *ReplicationHandler, replica *Replica, offset int) {
+	sendReplconf(t, replicationHandler, replica, constants.ACK, strconv.Itoa(offset))
+}
+
+func TestWaitForReplicas(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	result, err := handleWaitCommand(handlers.commandHandler, createArgs("0", "0"))
+	if err != nil || len(result) != 1 || string(result[0].Data) != "0" {
+		t.Fatalf("Expected WAIT 0 0 to return 0 right away, Got: %q (%v)", result, err)
+	}
+
+	replica, replicaConn := attachOnlineReplica(replicationHandler)
+	defer replicaConn.Close()
+	go io.Copy(io.Discard, replicaConn)
+	replicationHandler.propagateWriteCommand(utils.CreateRequestForCommand(constants.SET_COMMAND, "key", "value"))
+	targetOffset := handlers.ctx.ServerInstance.GetMasterReplOffset()
+
+	start := time.Now()
+	if count := replicationHandler.WaitForReplicas(1, 50*time.Millisecond); count != 0 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected WAIT to time out with no replica acknowledging, Got: %d after %s", count, time.Since(start))
+	}
+
+	waitResult := make(chan int)
+	go func() {
+		waitResult <- replicationHandler.WaitForReplicas(1, 0)
+	}()
+	// The waiter registers before the ACK, or it finds the offset already acknowledged. Either way it returns 1
+	time.Sleep(20 * time.Millisecond)
+	sendReplconfAck(t, replicationHandler, replica, targetOffset-1)
+	select {
+	case count := <-waitResult:
+		t.Fatalf("Expected WAIT to keep waiting for an ACK short of the target offset, Got: %d", count)
+	case <-time.After(20 * time.Millisecond):
+	}
+	sendReplconfAck(t, replicationHandler, replica, targetOffset)
+	select {
+	case count := <-waitResult:
+		if count != 1 {
+			t.Errorf("Expected WAIT to count the replica which acknowledged, Got: %d", count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an ACK reaching the target offset to wake WAIT")
+	}
+
+	// An ACK gives the replica's offset, a repeated one leaves it where it is and an older one doesn't move it back
+	for _, offset := range []int{targetOffset, targetOffset, targetOffset - 5} {
+		sendReplconfAck(t, replicationHandler, replica, offset)
+	}
+	replicationHandler.replicaMapLock.RLock()
+	ackOffset := replica.ackOffset
+	replicationHandler.replicaMapLock.RUnlock()
+	if ackOffset != targetOffset {
+		t.Errorf("Expected the ACK to set the replica offset to %d, Got: %d", targetOffset, ackOffset)
+	}
+}
+
+func TestReplicasInfo(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	replica, replicaConn := attachOnlineReplica(replicationHandler)
+	defer replicaConn.Close()
+	sendReplconf(t, replicationHandler, replica, constants.REPLCONF_LISTENING_PORT_PARAM, "6380")
+	replicationHandler.replicaMapLock.Lock()
+	replica.lastAckTime = time.Now().Add(-10 * time.Second)
+	replicationHandler.replicaMapLock.Unlock()
+
+	// net.Pipe has no IP address, so ip is left empty
+	expected := []string{"slave0:ip=,port=6380,state=" + constants.REPLICA_STATE_ONLINE + ",offset=0,lag=10"}
+	if replicasInfo := replicationHandler.ReplicasInfo(); !slices.Equal(replicasInfo, expected) {
+		t.Errorf("Expected the replica listed with its listening port and the time since its last ACK %v, Got: %v", expected, replicasInfo)
+	}
+	sendReplconfAck(t, replicationHandler, replica, 42)
+	expected = []string{"slave0:ip=,port=6380,state=" + constants.REPLICA_STATE_ONLINE + ",offset=42,lag=0"}
+	if replicasInfo := replicationHandler.ReplicasInfo(); !slices.Equal(replicasInfo, expected) {
+		t.Errorf("Expected an ACK to update the offset and reset the lag %v, Got: %v", expected, replicasInfo)
+	}
+}
+
+func TestProcessMasterData_ForwardsStream(t *testing.T) {
+	handlers := newTestHandlers(t)
+	replicationHandler := handlers.replicationHandler
+	upstreamReplId := server.NewReplicationId()
+	handlers.ctx.ServerInstance.UpdateReplicationConfig(func(replicationConfig *server.ServerReplicationConfig) {
+		replicationConfig.Role = constants.REPLICA_ROLE
+		replicationConfig.MasterReplId = upstreamReplId
+		replicationConfig.MasterReplOffset = 1000
+	})
+	_, subReplicaConn := attachOnlineReplica(replicationHandler)
+	defer subReplicaConn.Close()
+
+	setRequest := parser.Encode(utils.CreateRequestForCommand(constants.SET_COMMAND, "key", "value"))
+	getackRequest := parser.Encode(utils.CreateRequestForCommand(constants.REPLCONF_COMMAND, constants.GETACK, "*"))
+	stream := append(append([]byte{}, setRequest...), getackRequest...)
+	masterConn, replicaConn := net.Pipe()
+	defer replicaConn.Close()
+	go func() {
+		handlers.connHandler.processMasterData(replicaConn, stream)
+	}()
+	masterConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := parser.DecodeFrom(bufio.NewReader(masterConn)); err != nil {
+		t.Fatalf("Expected an ACK for the GETACK, Got: %v", err)
+	}
+	masterConn.Close()
+
+	// Sub-replicas get the bytes from the master as they were sent, GETACK included
+	forwarded := make([]byte, len(stream))
+	subReplicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(subReplicaConn, forwarded); err != nil || !bytes.Equal(forwarded, stream) {
+		t.Fatalf("Expected the stream from the master forwarded unchanged %q, Got: %q (%v)", stream, forwarded, err)
+	}
+	replicationConfig := handlers.ctx.ServerInstance.GetReplicationConfig()
+	if replicationConfig.MasterReplId != upstreamReplId || replicationConfig.MasterReplOffset != 1000+len(stream) {
+		t.Errorf("Expected the upstream replication ID %s at offset %d, Got: %s at %d",
+			upstreamReplId, 1000+len(stream), replicationConfig.MasterReplId, replicationConfig.MasterReplOffset)
+	}
+
+	// A sub-replica knowing the upstream history continues from its offset with the same bytes
+	nextConn, nextReplicaConn := net.Pipe()
+	defer nextReplicaConn.Close()
+	replicationHandler.replicaMapLock.Lock()
+	continued := replicationHandler.tryPartialResync(nextConn, upstreamReplId, 1001)
+	replicationHandler.replicaMapLock.Unlock()
+	if !continued {
+		t.Fatalf("Expected a partial resync with the upstream replication ID from offset 1001")
+	}
+	reader := bufio.NewReader(nextReplicaConn)
+	nextReplicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if expected := "+" + constants.CONTINUE_RESPONSE + " " + upstreamReplId + constants.CRLF; err != nil || line != expected {
+		t.Fatalf("Expected %q, Got: %q (%v)", expected, line, err)
+	}
+	if _, err := io.ReadFull(reader, forwarded); err != nil || !bytes.Equal(forwarded, stream) {
+		t.Errorf("Expected the backlog to hold the stream from the master %q, Got: %q (%v)", stream, forwarded, err)
+	}
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
 	"github.com/codecrafters-io/redis-starter-go/app/context"
@@ -36,7 +38,7 @@ func (h *RequestHandler) ProcessRequest(request constants.Request) [][]constants
 	}
 
 	for _, decodedRequest := range decodedRequestDataList {
-		response := processRequest(h, decodedRequest, requestId)
+		response := processRequest(h, decodedRequest, request.Conn, requestId, request.FromMaster)
 		if len(response) == 0 {
 			continue
 		}
@@ -45,11 +47,39 @@ func (h *RequestHandler) ProcessRequest(request constants.Request) [][]constants
 	return responseList
 }
 
-func processRequest(h *RequestHandler, decodedRequestData constants.DataRepr, requestId uuid.UUID) []constants.DataRepr {
-	if decodedRequestData.Type == constants.BULK {
-		h.ctx.Logger.Printf("Received RDB file from master with data %q", decodedRequestData.Data)
-		return []constants.DataRepr{}
+// ProcessClientRequest executes a request which the parser of the client's connection completed
+func (h *RequestHandler) ProcessClientRequest(decodedRequest constants.DataRepr, conn net.Conn, requestId uuid.UUID) []constants.DataRepr {
+	return processRequest(h, decodedRequest, conn, requestId, false)
+}
+
+// ProcessMasterRequest applies a request from the replication stream, which took size bytes of it. Everything
+// the master sends moves the offset along, but only REPLCONF GETACK is answered
+func (h *RequestHandler) ProcessMasterRequest(decodedRequest constants.DataRepr, size int, conn net.Conn, requestId uuid.UUID) []constants.DataRepr {
+	response := processRequest(h, decodedRequest, conn, requestId, true)
+	h.ctx.ServerInstance.AddMasterReplOffset(size)
+	if !isReplconfGetack(decodedRequest) {
+		return nil
 	}
+	return response
+}
+
+// LoadRdbFromMaster replaces the dataset with the RDB sent by the master at a full resync, which comes
+// before the commands streamed after it
+func (h *RequestHandler) LoadRdbFromMaster(rdbPayload []byte) {
+	h.ctx.Logger.Printf("Received RDB file of %d bytes from master", len(rdbPayload))
+	err := h.commandHandler.ReplaceDataset(rdbPayload)
+	if err != nil {
+		h.ctx.Logger.Printf("Error while trying to load RDB file received from master: %v", err.Error())
+	}
+}
+
+func isReplconfGetack(decodedRequestData constants.DataRepr) bool {
+	return decodedRequestData.Type == constants.ARRAY && len(decodedRequestData.Array) > 1 &&
+		strings.EqualFold(string(decodedRequestData.Array[0].Data), constants.REPLCONF_COMMAND) &&
+		strings.EqualFold(string(decodedRequestData.Array[1].Data), constants.GETACK)
+}
+
+func processRequest(h *RequestHandler, decodedRequestData constants.DataRepr, conn net.Conn, requestId uuid.UUID, fromMaster bool) []constants.DataRepr {
 	// Request is always going to be an ARRAY type and first element of array will be a command decoded as a bulk string
 	// For example: "PING" becomes *1\r\n$4\r\nPING\r\n
 	// "ECHO hey" becomes *2\r\n$4\r\nECHO\r\n$3\r\nhey\r\n
@@ -66,7 +96,9 @@ func processRequest(h *RequestHandler, decodedRequestData constants.DataRepr, re
 		Cmd:            command,
 		Args:           args,
 		RequestId:      requestId,
+		Conn:           conn,
 		DecodedRequest: decodedRequestData,
+		FromMaster:     fromMaster,
 	})
 	h.ctx.Logger.Printf("(%s) Response post processing request: %q", requestId.String(), response)
 	return response
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+// startFailoverIfNeeded starts a failover attempt of a master which is objectively down, in a new epoch. Attempts
+// are spaced by twice the failover timeout, and start after a random delay so sentinels rarely compete
+func (h *SentinelHandler) startFailoverIfNeeded(master *sentinelMaster, now time.Time) {
+	if master.odownSince.IsZero() || master.failoverState != constants.SENTINEL_FAILOVER_STATE_NONE ||
+		now.Sub(master.failoverStartTime) < 2*master.failoverTimeout {
+		return
+	}
+	h.currentEpoch++
+	master.failoverEpoch = h.currentEpoch
+	h.event(nil, nil, "+new-epoch", strconv.Itoa(h.currentEpoch))
+	h.event(master, master.instance, "+try-failover", "")
+	master.failoverStartTime = now.Add(time.Duration(rand.Int63n(int64(constants.SENTINEL_MAX_DESYNC))))
+	h.setFailoverState(master, constants.SENTINEL_FAILOVER_STATE_WAIT_START, now)
+}
+
+// stepFailover moves a failover along: get elected, select and promote a replica, then point the other
+// replicas at it and switch the monitored master
+func (h *SentinelHandler) stepFailover(master *sentinelMaster, now time.Time) {
+	switch master.failoverState {
+	case constants.SENTINEL_FAILOVER_STATE_WAIT_START:
+		if now.Before(master.failoverStartTime) {
+			return
+		}
+		if leader := h.electLeader(master, master.failoverEpoch); leader != h.runId {
+			if now.Sub(master.failoverStartTime) > min(constants.SENTINEL_ELECTION_TIMEOUT, master.failoverTimeout) {
+				h.abortFailover(master, "-failover-abort-not-elected")
+			}
+			return
+		}
+		h.event(master, master.instance, "+elected-leader", "")
+		h.setFailoverState(master, constants.SENTINEL_FAILOVER_STATE_SELECT_SLAVE, now)
+
+	case constants.SENTINEL_FAILOVER_STATE_SELECT_SLAVE:
+		replica := h.selectReplica(master, now)
+		if replica == nil {
+			h.abortFailover(master, "-failover-abort-no-good-slave")
+			return
+		}
+		master.promotedReplica = replica
+		h.event(master, replica, "+selected-slave", "")
+		h.setFailoverState(master, constants.SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE, now)
+
+	case constants.SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE:
+		if !master.promotedReplica.sdownSince.IsZero() {
+			if now.Sub(master.failoverStateTime) > master.failoverTimeout {
+				h.abortFailover(master, "-failover-abort-slave-timeout")
+			}
+			return
+		}
+		go h.sendReplicaof(master, master.promotedReplica, constants.REPLICAOF_NO_PARAM, constants.REPLICAOF_ONE_PARAM)
+		h.setFailoverState(master, constants.SENTINEL_FAILOVER_STATE_WAIT_PROMOTION, now)
+
+	case constants.SENTINEL_FAILOVER_STATE_WAIT_PROMOTION:
+		// The promotion is noticed by processInfo
+		if now.Sub(master.failoverStateTime) > master.failoverTimeout {
+			h.abortFailover(master, "-failover-abort-slave-timeout")
+		}
+
+	case constants.SENTINEL_FAILOVER_STATE_RECONF_SLAVES:
+		promotedHost, promotedPort, _ := net.SplitHostPort(master.promotedReplica.address)
+		for _, replica := range master.replicas {
+			if replica == master.promotedReplica || !replica.sdownSince.IsZero() {
+				continue
+			}
+			h.event(master, replica, "+slave-reconf-sent", "")
+			go h.sendReplicaof(master, replica, promotedHost, promotedPort)
+		}
+		h.event(master, master.instance, "+failover-end", "")
+		h.switchMaster(master, master.promotedReplica.address, master.promotedReplica.ips)
+	}
+}
+
+// setFailoverState moves to the next state, announced as e.g. +failover-state-select-slave
+func (h *SentinelHandler) setFailoverState(master *sentinelMaster, state string, now time.Time) {
+	master.failoverState, master.failoverStateTime = state, now
+	switch state {
+	case constants.SENTINEL_FAILOVER_STATE_NONE, constants.SENTINEL_FAILOVER_STATE_WAIT_START:
+	case constants.SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE, constants.SENTINEL_FAILOVER_STATE_WAIT_PROMOTION:
+		h.event(master, master.promotedReplica, "+failover-state-"+strings.ReplaceAll(state, "_", "-"), "")
+	default:
+		h.event(master, master.instance, "+failover-state-"+strings.ReplaceAll(state, "_", "-"), "")
+	}
+}
+
+func (h *SentinelHandler) abortFailover(master *sentinelMaster, reason string) {
+	h.event(master, master.instance, reason, "")
+	master.promotedReplica = nil
+	h.setFailoverState(master, constants.SENTINEL_FAILOVER_STATE_NONE, time.Now())
+}
+
+// electLeader counts the votes of the sentinels for the epoch, adding this sentinel's vote for the most voted
+// one, or for itself. The winner needs a majority of the sentinels and at least quorum votes
+func (h *SentinelHandler) electLeader(master *sentinelMaster, epoch int) string {
+	votes := make(map[string]int)
+	for _, sentinel := range master.sentinels {
+		if sentinel.leader != "" && sentinel.leaderEpoch == epoch {
+			votes[sentinel.leader]++
+		}
+	}
+	winner := mostVoted(votes)
+	if winner == "" {
+		winner = h.runId
+	}
+	if myVote, voteEpoch := h.voteLeader(master, epoch, winner); voteEpoch == epoch {
+		votes[myVote]++
+	}
+	winner = mostVoted(votes)
+	voters := len(master.sentinels) + 1
+	if votes[winner] < voters/2+1 || votes[winner] < master.quorum {
+		return ""
+	}
+	return winner
+}
+
+func mostVoted(votes map[string]int) string {
+	winner := ""
+	for candidate, count := range votes {
+		if count > votes[winner] || (count == votes[winner] && candidate < winner) {
+			winner = candidate
+		}
+	}
+	return winner
+}
+
+// voteLeader gives this sentinel's vote for the epoch to the first sentinel asking for it, returning who got
+// it. Voting for another sentinel holds back this one's own failover attempts
+func (h *SentinelHandler) voteLeader(master *sentinelMaster, epoch int, runId string) (string, int) {
+	if epoch > h.currentEpoch {
+		h.currentEpoch = epoch
+		h.event(nil, nil, "+new-epoch", strconv.Itoa(epoch))
+	}
+	if master.leaderEpoch < epoch && h.currentEpoch <= epoch {
+		master.leader, master.leaderEpoch = runId, h.currentEpoch
+		h.event(master, master.instance, "+vote-for-leader", fmt.Sprintf("%s %d", runId, master.leaderEpoch))
+		if runId != h.runId {
+			master.failoverStartTime = time.Now().Add(time.Duration(rand.Int63n(int64(constants.SENTINEL_MAX_DESYNC))))
+		}
+	}
+	return master.leader, master.leaderEpoch
+}
+
+// selectReplica picks the replica to promote among those up and recently heard from, preferring the one
+// which processed most of the replication stream
+func (h *SentinelHandler) selectReplica(master *sentinelMaster, now time.Time) *sentinelInstance {
+	candidates := []*sentinelInstance{}
+	for _, replica := range master.replicas {
+		if !replica.sdownSince.IsZero() || replica.reportedRole != constants.REPLICA_ROLE ||
+			now.Sub(replica.lastPongTime) > 5*constants.SENTINEL_PING_PERIOD ||
+			now.Sub(replica.infoRefreshTime) > 5*constants.SENTINEL_FAILOVER_INFO_PERIOD {
+			continue
+		}
+		candidates = append(candidates, replica)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].replOffset != candidates[j].replOffset {
+			return candidates[i].replOffset > candidates[j].replOffset
+		}
+		return candidates[i].address < candidates[j].address
+	})
+	return candidates[0]
+}
+
+// switchMaster starts monitoring the new master of a failover, either run by this sentinel or learned from
+// another's hello. The former master is kept as a replica, to be reconfigured once it is back
+func (h *SentinelHandler) switchMaster(master *sentinelMaster, newAddress string, newIps []string) {
+	oldMaster := master.instance
+	oldHost, oldPort, _ := net.SplitHostPort(oldMaster.address)
+	newHost, newPort, _ := net.SplitHostPort(newAddress)
+	h.event(nil, nil, "+switch-master", fmt.Sprintf("%s %s %s %s %s", master.name, oldHost, oldPort, newHost, newPort))
+
+	// Instances keep their links, so commands sent during the failover aren't cut short
+	var newMaster *sentinelInstance
+	for address, replica := range master.replicas {
+		if sameAddress(address, replica.ips, newAddress, newIps) {
+			newMaster = replica
+			delete(master.replicas, address)
+		}
+	}
+	if newMaster == nil {
+		newMaster = h.newMonitoredInstance(constants.SENTINEL_FLAG_MASTER, newAddress, newIps)
+	}
+	newMaster.role = constants.SENTINEL_FLAG_MASTER
+	oldMaster.role = constants.SENTINEL_FLAG_SLAVE
+	master.replicas[oldMaster.address] = oldMaster
+	master.instance = newMaster
+	for _, sentinel := range master.sentinels {
+		sentinel.masterDown = false
+	}
+	master.odownSince = time.Time{}
+	master.promotedReplica = nil
+	master.failoverState = constants.SENTINEL_FAILOVER_STATE_NONE
+}
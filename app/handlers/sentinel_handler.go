@@ -0,0 +1,821 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// sentinelInstance is a master, replica or other sentinel known to a sentinel, along with what it learned
+// about it from its replies
+type sentinelInstance struct {
+	role    string
+	address string
+	// IPs the host of address resolved to, resolved without the lock held
+	ips []string
+	// Sentinels are identified by their run ID
+	runId string
+	link  *commandLink
+	// Closed when the instance is dropped, ending its hello subscription
+	stop     chan struct{}
+	probing  bool
+	asking   bool
+	lastPing time.Time
+	lastInfo time.Time
+	// When a valid reply to PING was last received, which tells whether the instance is down
+	lastPongTime  time.Time
+	sdownSince    time.Time
+	lastHelloSent time.Time
+	lastAskTime   time.Time
+	// What the instance reported in INFO
+	infoRefreshTime       time.Time
+	reportedRole          string
+	roleReportedTime      time.Time
+	reportedMasterAddress string
+	reportedMasterIps     []string
+	masterLinkUp          bool
+	replOffset            int
+	lastReconfTime        time.Time
+	// What another sentinel replied to SENTINEL IS-MASTER-DOWN-BY-ADDR, including its vote
+	lastHelloSeen       time.Time
+	masterDown          bool
+	masterDownReplyTime time.Time
+	leader              string
+	leaderEpoch         int
+}
+
+// sentinelMaster is a monitored master with its replicas and the other sentinels monitoring it
+type sentinelMaster struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	instance        *sentinelInstance
+	// Replicas by address, sentinels by run ID
+	replicas  map[string]*sentinelInstance
+	sentinels map[string]*sentinelInstance
+	// Epoch of the failover which produced the current master, announced in hellos
+	configEpoch int
+	odownSince  time.Time
+	// Sentinel voted for as failover leader in leaderEpoch
+	leader      string
+	leaderEpoch int
+	// Failover state, with the start time also used to space out attempts
+	failoverState     string
+	failoverEpoch     int
+	failoverStartTime time.Time
+	failoverStateTime time.Time
+	promotedReplica   *sentinelInstance
+}
+
+// SentinelHandler runs a server in sentinel mode. It probes the monitored masters and their replicas, shares
+// its view with the other sentinels through hello messages, and fails a master over once enough sentinels
+// agree it is down
+type SentinelHandler struct {
+	ctx           *context.Context
+	pubSubHandler *PubSubHandler
+	runId         string
+	currentEpoch  int
+	masters       map[string]*sentinelMaster
+	lock          sync.Mutex
+	// Events raised with the lock held, published once it is released
+	pendingEvents []sentinelEvent
+}
+
+type sentinelEvent struct {
+	channel string
+	message string
+}
+
+func InitSentinelHandler(ctx *context.Context, commandHandler *CommandHandler, pubSubHandler *PubSubHandler) *SentinelHandler {
+	sentinelHandler := &SentinelHandler{
+		ctx:           ctx,
+		pubSubHandler: pubSubHandler,
+		// Run IDs have the format of replication IDs
+		runId:   server.NewReplicationId(),
+		masters: make(map[string]*sentinelMaster),
+	}
+	commandHandler.sentinelHandler = sentinelHandler
+	commandHandler.CommandRegistry = sentinelCommandRegistry(commandHandler.CommandRegistry)
+	if monitor := ctx.ServerInstance.ServerConfig.SentinelMonitor; monitor != "" {
+		fields := strings.Fields(monitor)
+		if len(fields) != 4 {
+			ctx.Logger.Fatalf("Invalid sentinel-monitor value '%s', expected '<name> <host> <port> <quorum>'", monitor)
+		}
+		if err := sentinelHandler.Monitor(fields[0], fields[1], fields[2], fields[3]); err != nil {
+			ctx.Logger.Fatalf("Invalid sentinel-monitor value '%s': %v", monitor, err.Error())
+		}
+	}
+	return sentinelHandler
+}
+
+func (h *SentinelHandler) StartSentinelHandler() {
+	go h.runTimer()
+}
+
+// sentinelCommandRegistry keeps the commands a sentinel serves out of the regular ones, and adds its own
+func sentinelCommandRegistry(cmdRegistry CommandRegistry) CommandRegistry {
+	sentinelRegistry := make(CommandRegistry)
+	for _, commandName := range []string{constants.PING_COMMAND, constants.HELLO_COMMAND, constants.SUBSCRIBE_COMMAND,
+		constants.UNSUBSCRIBE_COMMAND, constants.PUBLISH_COMMAND} {
+		sentinelRegistry[commandName] = cmdRegistry[commandName]
+	}
+	sentinelRegistry[constants.INFO_COMMAND] = Command{Handler: handleSentinelInfoCommand, Flags: constants.CMD_FLAG_STALE}
+	sentinelRegistry[constants.SENTINEL_COMMAND] = Command{Handler: handleSentinelCommand, Flags: constants.CMD_FLAG_ADMIN | constants.CMD_FLAG_STALE}
+	return sentinelRegistry
+}
+
+// Monitor starts monitoring a master, failing it over once quorum sentinels agree it is down
+func (h *SentinelHandler) Monitor(name string, host string, port string, quorum string) error {
+	quorumValue, err := strconv.Atoi(quorum)
+	if err != nil || quorumValue <= 0 {
+		return errors.New("Quorum must be 1 or greater")
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber <= 0 || portNumber > 65535 {
+		return errors.New("Invalid port number")
+	}
+	address := net.JoinHostPort(host, port)
+	ips := resolveHostIps(address)
+	h.lock.Lock()
+	defer h.unlock()
+	if _, exists := h.masters[name]; exists {
+		return errors.New("Duplicated master name")
+	}
+	master := &sentinelMaster{
+		name:            name,
+		quorum:          quorumValue,
+		downAfter:       h.ctx.ServerInstance.GetSentinelDownAfter(),
+		failoverTimeout: h.ctx.ServerInstance.GetSentinelFailoverTimeout(),
+		replicas:        make(map[string]*sentinelInstance),
+		sentinels:       make(map[string]*sentinelInstance),
+		failoverState:   constants.SENTINEL_FAILOVER_STATE_NONE,
+	}
+	master.instance = h.newMonitoredInstance(constants.SENTINEL_FLAG_MASTER, address, ips)
+	h.masters[name] = master
+	h.event(master, master.instance, "+monitor", fmt.Sprintf("quorum %d", quorumValue))
+	return nil
+}
+
+// newMonitoredInstance creates a master or replica, which is subscribed to for the hellos of other sentinels
+func (h *SentinelHandler) newMonitoredInstance(role string, address string, ips []string) *sentinelInstance {
+	instance := newSentinelInstance(role, address)
+	instance.ips = ips
+	instance.stop = make(chan struct{})
+	go subscribeToHellos(address, instance.stop, h.processHello)
+	return instance
+}
+
+func newSentinelInstance(role string, address string) *sentinelInstance {
+	return &sentinelInstance{
+		role:         role,
+		address:      address,
+		link:         newCommandLink(address),
+		lastPongTime: time.Now(),
+	}
+}
+
+func closeSentinelInstance(instance *sentinelInstance) {
+	if instance.stop != nil {
+		close(instance.stop)
+		instance.stop = nil
+	}
+	instance.link.close()
+}
+
+func (h *SentinelHandler) runTimer() {
+	ticker := time.NewTicker(constants.SENTINEL_TICK)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.lock.Lock()
+		for _, master := range h.masters {
+			h.tickMaster(master, time.Now())
+		}
+		h.unlock()
+	}
+}
+
+// tickMaster is called with the lock held. Network calls run in their own goroutines, updating the state
+// when their reply arrives
+func (h *SentinelHandler) tickMaster(master *sentinelMaster, now time.Time) {
+	for _, instance := range master.allInstances() {
+		if !instance.probing && now.Sub(instance.lastPing) >= constants.SENTINEL_PING_PERIOD {
+			instance.probing, instance.lastPing = true, now
+			sendInfo, sendHello := false, false
+			if instance.role != constants.SENTINEL_FLAG_SENTINEL {
+				sendInfo = now.Sub(instance.lastInfo) >= master.infoPeriod()
+				sendHello = now.Sub(instance.lastHelloSent) >= constants.SENTINEL_HELLO_PERIOD
+			}
+			if sendInfo {
+				instance.lastInfo = now
+			}
+			if sendHello {
+				instance.lastHelloSent = now
+			}
+			go h.probeInstance(master, instance, sendInfo, sendHello)
+		}
+		h.checkSubjectivelyDown(master, instance, now)
+	}
+	if !master.instance.sdownSince.IsZero() {
+		h.askOtherSentinels(master, now)
+	}
+	h.checkObjectivelyDown(master, now)
+	h.startFailoverIfNeeded(master, now)
+	h.stepFailover(master, now)
+}
+
+func (m *sentinelMaster) allInstances() []*sentinelInstance {
+	instances := []*sentinelInstance{m.instance}
+	for _, replica := range m.replicas {
+		instances = append(instances, replica)
+	}
+	for _, sentinel := range m.sentinels {
+		instances = append(instances, sentinel)
+	}
+	return instances
+}
+
+// infoPeriod is shortened while the master is down, to notice promotions quickly
+func (m *sentinelMaster) infoPeriod() time.Duration {
+	if m.failoverState != constants.SENTINEL_FAILOVER_STATE_NONE || !m.instance.sdownSince.IsZero() {
+		return constants.SENTINEL_FAILOVER_INFO_PERIOD
+	}
+	return constants.SENTINEL_INFO_PERIOD
+}
+
+// probeInstance sends PING, and INFO and a hello when they are due, to a master, replica or sentinel
+func (h *SentinelHandler) probeInstance(master *sentinelMaster, instance *sentinelInstance, sendInfo bool, sendHello bool) {
+	defer func() {
+		h.lock.Lock()
+		instance.probing = false
+		h.unlock()
+	}()
+	timeout := master.downAfter
+	reply, err := instance.link.call(timeout, constants.PING_COMMAND)
+	if err != nil {
+		return
+	}
+	// A busy or stale instance is still up
+	if string(reply.Data) == constants.PONG_RESPONSE || strings.HasPrefix(string(reply.Data), "LOADING") ||
+		strings.HasPrefix(string(reply.Data), "MASTERDOWN") {
+		h.lock.Lock()
+		instance.lastPongTime = time.Now()
+		h.unlock()
+	}
+	if sendInfo {
+		reply, err = instance.link.call(timeout, constants.INFO_COMMAND)
+		if err != nil {
+			return
+		}
+		if reply.Type == constants.BULK {
+			h.processInfo(master, instance, string(reply.Data))
+		}
+	}
+	if sendHello {
+		instance.link.call(timeout, constants.PUBLISH_COMMAND, constants.SENTINEL_HELLO_CHANNEL, h.createHello(master, instance.link.localIp()))
+	}
+}
+
+// createHello announces this sentinel and its view of the master as
+// <ip>,<port>,<run id>,<current epoch>,<master name>,<master ip>,<master port>,<master config epoch>
+func (h *SentinelHandler) createHello(master *sentinelMaster, sentinelIp string) string {
+	h.lock.Lock()
+	defer h.unlock()
+	masterHost, masterPort, _ := net.SplitHostPort(master.currentAddress())
+	return fmt.Sprintf("%s,%s,%s,%d,%s,%s,%s,%d", sentinelIp, h.ctx.ServerInstance.ListeningPort, h.runId, h.currentEpoch,
+		master.name, masterHost, masterPort, master.configEpoch)
+}
+
+// currentAddress is the address of the master, which is the promoted replica's as soon as the failover
+// promoted it, as that is when the config epoch announced along with it changes
+func (m *sentinelMaster) currentAddress() string {
+	if m.promotedReplica != nil && m.failoverState == constants.SENTINEL_FAILOVER_STATE_RECONF_SLAVES {
+		return m.promotedReplica.address
+	}
+	return m.instance.address
+}
+
+// processHello learns about other sentinels, newer epochs and masters switched by another sentinel's failover
+func (h *SentinelHandler) processHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	runId, masterName := fields[2], fields[4]
+	epoch, epochErr := strconv.Atoi(fields[3])
+	configEpoch, configEpochErr := strconv.Atoi(fields[7])
+	if epochErr != nil || configEpochErr != nil {
+		return
+	}
+	masterAddress := net.JoinHostPort(fields[5], fields[6])
+	masterIps := resolveHostIps(masterAddress)
+	h.lock.Lock()
+	defer h.unlock()
+	master, exists := h.masters[masterName]
+	if !exists || runId == h.runId {
+		return
+	}
+	address := net.JoinHostPort(fields[0], fields[1])
+	sentinel, known := master.sentinels[runId]
+	if !known || sentinel.address != address {
+		// A sentinel restarted on the same address comes back with a new run ID
+		for otherRunId, other := range master.sentinels {
+			if other.address == address || otherRunId == runId {
+				closeSentinelInstance(other)
+				delete(master.sentinels, otherRunId)
+			}
+		}
+		sentinel = newSentinelInstance(constants.SENTINEL_FLAG_SENTINEL, address)
+		sentinel.runId = runId
+		master.sentinels[runId] = sentinel
+		h.event(master, sentinel, "+sentinel", "")
+	}
+	sentinel.lastHelloSeen = time.Now()
+	if epoch > h.currentEpoch {
+		h.currentEpoch = epoch
+		h.event(nil, nil, "+new-epoch", strconv.Itoa(epoch))
+	}
+	if configEpoch > master.configEpoch {
+		master.configEpoch = configEpoch
+		if !sameAddress(masterAddress, masterIps, master.instance.address, master.instance.ips) {
+			h.event(master, sentinel, "+config-update-from", "")
+			h.switchMaster(master, masterAddress, masterIps)
+		}
+	}
+}
+
+// processInfo updates what a master or replica reported about its replication, discovering replicas from
+// the master and reconfiguring replicas which don't follow it
+func (h *SentinelHandler) processInfo(master *sentinelMaster, instance *sentinelInstance, info string) {
+	fields := make(map[string]string)
+	replicaIps := make(map[string][]string)
+	for _, line := range strings.Split(info, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		fields[key] = value
+		if strings.HasPrefix(key, "slave") && strings.Contains(value, "ip=") {
+			replicaFields := make(map[string]string)
+			for _, field := range strings.Split(value, ",") {
+				fieldKey, fieldValue, _ := strings.Cut(field, "=")
+				replicaFields[fieldKey] = fieldValue
+			}
+			replicaAddress := net.JoinHostPort(replicaFields["ip"], replicaFields["port"])
+			replicaIps[replicaAddress] = resolveHostIps(replicaAddress)
+		}
+	}
+	reportedMasterAddress, reportedMasterIps := "", []string(nil)
+	if fields["role"] == constants.REPLICA_ROLE {
+		reportedMasterAddress = net.JoinHostPort(fields["master_host"], fields["master_port"])
+		reportedMasterIps = resolveHostIps(reportedMasterAddress)
+	}
+
+	h.lock.Lock()
+	defer h.unlock()
+	now := time.Now()
+	instance.infoRefreshTime = now
+	if fields["role"] != instance.reportedRole {
+		instance.reportedRole, instance.roleReportedTime = fields["role"], now
+	}
+	if instance.reportedRole == constants.REPLICA_ROLE {
+		instance.reportedMasterAddress, instance.reportedMasterIps = reportedMasterAddress, reportedMasterIps
+		instance.masterLinkUp = fields["master_link_status"] == constants.MASTER_LINK_STATUS_UP
+		instance.replOffset, _ = strconv.Atoi(fields["master_repl_offset"])
+	}
+
+	if instance == master.instance {
+		if instance.reportedRole == constants.MASTER_ROLE {
+			for replicaAddress, ips := range replicaIps {
+				if _, known := master.replicas[replicaAddress]; !known {
+					replica := h.newMonitoredInstance(constants.SENTINEL_FLAG_SLAVE, replicaAddress, ips)
+					master.replicas[replicaAddress] = replica
+					h.event(master, replica, "+slave", "")
+				}
+			}
+		}
+		return
+	}
+	if master.replicas[instance.address] != instance {
+		return
+	}
+	if instance.reportedRole == constants.MASTER_ROLE && instance == master.promotedReplica &&
+		master.failoverState == constants.SENTINEL_FAILOVER_STATE_WAIT_PROMOTION {
+		master.configEpoch = master.failoverEpoch
+		h.event(master, instance, "+promoted-slave", "")
+		h.setFailoverState(master, constants.SENTINEL_FAILOVER_STATE_RECONF_SLAVES, now)
+		return
+	}
+	h.fixReplicaConfig(master, instance, now)
+}
+
+// fixReplicaConfig points a replica reporting another master, or itself as master, back at the monitored
+// master. Reports are only acted upon once they have lasted a while and no failover is running
+func (h *SentinelHandler) fixReplicaConfig(master *sentinelMaster, replica *sentinelInstance, now time.Time) {
+	if master.failoverState != constants.SENTINEL_FAILOVER_STATE_NONE || !master.instance.sdownSince.IsZero() ||
+		!replica.sdownSince.IsZero() || master.instance.reportedRole != constants.MASTER_ROLE {
+		return
+	}
+	if now.Sub(replica.roleReportedTime) < 4*constants.SENTINEL_HELLO_PERIOD || now.Sub(replica.lastReconfTime) < 4*constants.SENTINEL_HELLO_PERIOD {
+		return
+	}
+	switch {
+	case replica.reportedRole == constants.MASTER_ROLE:
+		h.event(master, replica, "+convert-to-slave", "")
+	case replica.reportedRole == constants.REPLICA_ROLE && !sameAddress(replica.reportedMasterAddress, replica.reportedMasterIps, master.instance.address, master.instance.ips):
+		h.event(master, replica, "+fix-slave-config", "")
+	default:
+		return
+	}
+	replica.lastReconfTime = now
+	masterHost, masterPort, _ := net.SplitHostPort(master.instance.address)
+	go h.sendReplicaof(master, replica, masterHost, masterPort)
+}
+
+func (h *SentinelHandler) sendReplicaof(master *sentinelMaster, instance *sentinelInstance, host string, port string) {
+	reply, err := instance.link.call(master.downAfter, constants.REPLICAOF_COMMAND, host, port)
+	if err != nil || reply.Type == constants.ERROR {
+		h.ctx.Logger.Printf("Failed to send REPLICAOF %s %s to (%s): %v %q", host, port, instance.address, err, reply.Data)
+	}
+}
+
+// checkSubjectivelyDown flags an instance which gave no valid reply for down-after-milliseconds
+func (h *SentinelHandler) checkSubjectivelyDown(master *sentinelMaster, instance *sentinelInstance, now time.Time) {
+	down := now.Sub(instance.lastPongTime) > master.downAfter
+	if down && instance.sdownSince.IsZero() {
+		instance.sdownSince = now
+		h.event(master, instance, "+sdown", "")
+	} else if !down && !instance.sdownSince.IsZero() {
+		instance.sdownSince = time.Time{}
+		h.event(master, instance, "-sdown", "")
+	}
+}
+
+// askOtherSentinels asks whether they see the master down too. While this sentinel is trying to fail the
+// master over, the question also asks for their vote
+func (h *SentinelHandler) askOtherSentinels(master *sentinelMaster, now time.Time) {
+	masterHost, masterPort, _ := net.SplitHostPort(master.instance.address)
+	candidateRunId := constants.SENTINEL_NO_VOTE_RUN_ID
+	if master.failoverState != constants.SENTINEL_FAILOVER_STATE_NONE {
+		candidateRunId = h.runId
+	}
+	epoch := strconv.Itoa(h.currentEpoch)
+	for _, sentinel := range master.sentinels {
+		if sentinel.asking || now.Sub(sentinel.lastAskTime) < constants.SENTINEL_ASK_PERIOD {
+			continue
+		}
+		sentinel.asking, sentinel.lastAskTime = true, now
+		go h.askMasterState(master, sentinel, masterHost, masterPort, epoch, candidateRunId)
+	}
+}
+
+func (h *SentinelHandler) askMasterState(master *sentinelMaster, sentinel *sentinelInstance, masterHost string, masterPort string,
+	epoch string, candidateRunId string) {
+	reply, err := sentinel.link.call(master.downAfter, constants.SENTINEL_COMMAND, constants.SENTINEL_IS_MASTER_DOWN_PARAM,
+		masterHost, masterPort, epoch, candidateRunId)
+	h.lock.Lock()
+	defer h.unlock()
+	sentinel.asking = false
+	if err != nil || reply.Type != constants.ARRAY || len(reply.Array) != 3 {
+		return
+	}
+	sentinel.masterDown = string(reply.Array[0].Data) == "1"
+	sentinel.masterDownReplyTime = time.Now()
+	if leader := string(reply.Array[1].Data); leader != constants.SENTINEL_NO_VOTE_RUN_ID {
+		sentinel.leader = leader
+		sentinel.leaderEpoch, _ = strconv.Atoi(string(reply.Array[2].Data))
+	}
+}
+
+// checkObjectivelyDown flags the master once quorum sentinels, this one included, see it down
+func (h *SentinelHandler) checkObjectivelyDown(master *sentinelMaster, now time.Time) {
+	votes := 0
+	if !master.instance.sdownSince.IsZero() {
+		votes++
+		for _, sentinel := range master.sentinels {
+			if sentinel.masterDown && now.Sub(sentinel.masterDownReplyTime) < constants.SENTINEL_MASTER_DOWN_REPLY_VALIDITY {
+				votes++
+			}
+		}
+	}
+	odown := votes >= master.quorum
+	if odown && master.odownSince.IsZero() {
+		master.odownSince = now
+		h.event(master, master.instance, "+odown", fmt.Sprintf("#quorum %d/%d", votes, master.quorum))
+	} else if !odown && !master.odownSince.IsZero() {
+		master.odownSince = time.Time{}
+		h.event(master, master.instance, "-odown", "")
+	}
+}
+
+// event logs a sentinel event, which is published to clients subscribed to the channel named after it once
+// the lock is released. It is called with the lock held
+func (h *SentinelHandler) event(master *sentinelMaster, instance *sentinelInstance, eventType string, details string) {
+	message := details
+	if instance != nil {
+		message = strings.TrimSpace(describeSentinelInstance(master, instance) + " " + details)
+	}
+	h.ctx.Logger.Printf("%s %s", eventType, message)
+	h.pendingEvents = append(h.pendingEvents, sentinelEvent{channel: eventType, message: message})
+}
+
+// unlock releases the lock, then publishes the events raised while it was held, as writing to subscribers
+// may block
+func (h *SentinelHandler) unlock() {
+	events := h.pendingEvents
+	h.pendingEvents = nil
+	h.lock.Unlock()
+	for _, event := range events {
+		h.pubSubHandler.Publish(event.channel, event.message)
+	}
+}
+
+// describeSentinelInstance names an instance the way events do, e.g. slave 127.0.0.1:6380 127.0.0.1 6380 @ mymaster 127.0.0.1 6379
+func describeSentinelInstance(master *sentinelMaster, instance *sentinelInstance) string {
+	host, port, _ := net.SplitHostPort(instance.address)
+	if instance == master.instance {
+		return fmt.Sprintf("%s %s %s %s", instance.role, master.name, host, port)
+	}
+	masterHost, masterPort, _ := net.SplitHostPort(master.instance.address)
+	return fmt.Sprintf("%s %s %s %s @ %s %s %s", instance.role, instance.name(), host, port, master.name, masterHost, masterPort)
+}
+
+func (i *sentinelInstance) name() string {
+	if i.role == constants.SENTINEL_FLAG_SENTINEL {
+		return i.runId
+	}
+	return i.address
+}
+
+// resolveHostIps resolves the host of a host:port address, which may be a name. It does network calls, so
+// it is called without the lock held
+func resolveHostIps(address string) []string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	hostIps, err := net.LookupHost(host)
+	if err != nil {
+		return nil
+	}
+	return hostIps
+}
+
+// sameAddress tells whether two host:port addresses point at the same instance, given the IPs their hosts
+// resolved to
+func sameAddress(address string, hostIps []string, otherAddress string, otherHostIps []string) bool {
+	host, port, err := net.SplitHostPort(address)
+	otherHost, otherPort, otherErr := net.SplitHostPort(otherAddress)
+	if err != nil || otherErr != nil || port != otherPort {
+		return false
+	}
+	if host == otherHost {
+		return true
+	}
+	for _, hostIp := range hostIps {
+		if slices.Contains(otherHostIps, hostIp) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sentinel command space
+
+func handleSentinelInfoCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	return []constants.DataRepr{utils.CreateVerbatimResponse(constants.VERBATIM_TEXT_FORMAT, h.sentinelHandler.Info())}, nil
+}
+
+func (h *SentinelHandler) Info() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	info := []string{"# Sentinel", fmt.Sprintf("sentinel_masters:%d", len(h.masters))}
+	for i, master := range h.sortedMasters() {
+		status := "ok"
+		if !master.odownSince.IsZero() {
+			status = "odown"
+		} else if !master.instance.sdownSince.IsZero() {
+			status = "sdown"
+		}
+		info = append(info, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, master.name, status, master.instance.address, len(master.replicas), len(master.sentinels)+1))
+	}
+	return strings.Join(info, "\n")
+}
+
+func (h *SentinelHandler) sortedMasters() []*sentinelMaster {
+	masters := make([]*sentinelMaster, 0, len(h.masters))
+	for _, master := range h.masters {
+		masters = append(masters, master)
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].name < masters[j].name })
+	return masters
+}
+
+// handleSentinelCommand handles the SENTINEL sub-commands used by clients and by other sentinels
+func handleSentinelCommand(h *CommandHandler, args []constants.DataRepr) ([]constants.DataRepr, error) {
+	if len(args) < 1 {
+		return make([]constants.DataRepr, 0), errors.New("SENTINEL command expects a sub-command")
+	}
+	stringArgs := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		stringArgs[i] = string(arg.Data)
+	}
+	subCommand := strings.ToUpper(string(args[0].Data))
+	reply, err := h.sentinelHandler.executeSentinelCommand(subCommand, stringArgs)
+	if err != nil {
+		return make([]constants.DataRepr, 0), err
+	}
+	return []constants.DataRepr{reply}, nil
+}
+
+func (h *SentinelHandler) executeSentinelCommand(subCommand string, args []string) (constants.DataRepr, error) {
+	expectedArgs := map[string]int{
+		constants.SENTINEL_GET_MASTER_ADDR_PARAM: 1,
+		constants.SENTINEL_MASTERS_PARAM:         0,
+		constants.SENTINEL_MASTER_PARAM:          1,
+		constants.SENTINEL_REPLICAS_PARAM:        1,
+		constants.SENTINEL_SLAVES_PARAM:          1,
+		constants.SENTINEL_SENTINELS_PARAM:       1,
+		constants.SENTINEL_IS_MASTER_DOWN_PARAM:  4,
+		constants.SENTINEL_MONITOR_PARAM:         4,
+		constants.SENTINEL_REMOVE_PARAM:          1,
+		constants.SENTINEL_MYID_PARAM:            0,
+	}
+	numArgs, known := expectedArgs[subCommand]
+	if !known {
+		return constants.DataRepr{}, fmt.Errorf("Unknown sentinel subcommand '%s'", subCommand)
+	}
+	if len(args) != numArgs {
+		return constants.DataRepr{}, fmt.Errorf("SENTINEL %s expects %d variables but %d given", subCommand, numArgs, len(args))
+	}
+	switch subCommand {
+	case constants.SENTINEL_MONITOR_PARAM:
+		if err := h.Monitor(args[0], args[1], args[2], args[3]); err != nil {
+			return constants.DataRepr{}, err
+		}
+		return utils.CreateStringResponse(constants.OK_RESPONSE), nil
+	case constants.SENTINEL_IS_MASTER_DOWN_PARAM:
+		return h.isMasterDownByAddr(args[0], args[1], args[2], args[3])
+	}
+
+	h.lock.Lock()
+	defer h.unlock()
+	if subCommand == constants.SENTINEL_MYID_PARAM {
+		return utils.CreateBulkResponse(h.runId), nil
+	}
+	if subCommand == constants.SENTINEL_MASTERS_PARAM {
+		masters := []constants.DataRepr{}
+		for _, master := range h.sortedMasters() {
+			masters = append(masters, h.describeMaster(master))
+		}
+		return utils.CreateArrayDataRepr(masters), nil
+	}
+	master, exists := h.masters[args[0]]
+	if !exists {
+		if subCommand == constants.SENTINEL_GET_MASTER_ADDR_PARAM {
+			return utils.NilBulkStringResponse(), nil
+		}
+		return constants.DataRepr{}, errors.New("No such master with that name")
+	}
+	switch subCommand {
+	case constants.SENTINEL_GET_MASTER_ADDR_PARAM:
+		host, port, _ := net.SplitHostPort(master.currentAddress())
+		return utils.CreateArrayDataRepr([]constants.DataRepr{utils.CreateBulkResponse(host), utils.CreateBulkResponse(port)}), nil
+	case constants.SENTINEL_MASTER_PARAM:
+		return h.describeMaster(master), nil
+	case constants.SENTINEL_REPLICAS_PARAM, constants.SENTINEL_SLAVES_PARAM:
+		return describeInstances(master, master.replicas), nil
+	case constants.SENTINEL_SENTINELS_PARAM:
+		return describeInstances(master, master.sentinels), nil
+	default:
+		closeSentinelInstance(master.instance)
+		for _, instance := range master.allInstances()[1:] {
+			closeSentinelInstance(instance)
+		}
+		delete(h.masters, master.name)
+		h.event(master, master.instance, "-monitor", "")
+		return utils.CreateStringResponse(constants.OK_RESPONSE), nil
+	}
+}
+
+// isMasterDownByAddr answers another sentinel asking whether this one sees the master at the address down,
+// voting for it as failover leader when it gives its run ID
+func (h *SentinelHandler) isMasterDownByAddr(host string, port string, epoch string, runId string) (constants.DataRepr, error) {
+	requestEpoch, err := strconv.Atoi(epoch)
+	if err != nil {
+		return constants.DataRepr{}, errors.New("invalid epoch")
+	}
+	address := net.JoinHostPort(host, port)
+	ips := resolveHostIps(address)
+	h.lock.Lock()
+	defer h.unlock()
+	masterDown := 0
+	leader, leaderEpoch := constants.SENTINEL_NO_VOTE_RUN_ID, 0
+	for _, master := range h.masters {
+		if !sameAddress(master.instance.address, master.instance.ips, address, ips) {
+			continue
+		}
+		if !master.instance.sdownSince.IsZero() {
+			masterDown = 1
+		}
+		if runId != constants.SENTINEL_NO_VOTE_RUN_ID {
+			leader, leaderEpoch = h.voteLeader(master, requestEpoch, runId)
+		}
+		break
+	}
+	return utils.CreateArrayDataRepr([]constants.DataRepr{
+		utils.CreateIntegerResponse(masterDown),
+		utils.CreateBulkResponse(leader),
+		utils.CreateIntegerResponse(leaderEpoch),
+	}), nil
+}
+
+func (h *SentinelHandler) describeMaster(master *sentinelMaster) constants.DataRepr {
+	fields := describeInstanceFields(master, master.instance)
+	fields = append(fields,
+		"num-slaves", strconv.Itoa(len(master.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(master.sentinels)),
+		"quorum", strconv.Itoa(master.quorum),
+		"down-after-milliseconds", strconv.FormatInt(master.downAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(master.failoverTimeout.Milliseconds(), 10),
+		"config-epoch", strconv.Itoa(master.configEpoch),
+		"failover-state", master.failoverState,
+	)
+	return createFieldList(fields)
+}
+
+func describeInstances(master *sentinelMaster, instances map[string]*sentinelInstance) constants.DataRepr {
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	descriptions := make([]constants.DataRepr, 0, len(names))
+	for _, name := range names {
+		instance := instances[name]
+		fields := describeInstanceFields(master, instance)
+		if instance.role == constants.SENTINEL_FLAG_SLAVE {
+			masterHost, masterPort, _ := net.SplitHostPort(instance.reportedMasterAddress)
+			linkStatus := constants.MASTER_LINK_STATUS_DOWN
+			if instance.masterLinkUp {
+				linkStatus = constants.MASTER_LINK_STATUS_UP
+			}
+			fields = append(fields, "master-host", masterHost, "master-port", masterPort, "master-link-status", linkStatus,
+				"slave-repl-offset", strconv.Itoa(instance.replOffset))
+		} else {
+			fields = append(fields, "last-hello-message", strconv.FormatInt(time.Since(instance.lastHelloSeen).Milliseconds(), 10),
+				"voted-leader", instance.leader, "voted-leader-epoch", strconv.Itoa(instance.leaderEpoch))
+		}
+		descriptions = append(descriptions, createFieldList(fields))
+	}
+	return utils.CreateArrayDataRepr(descriptions)
+}
+
+func describeInstanceFields(master *sentinelMaster, instance *sentinelInstance) []string {
+	host, port, _ := net.SplitHostPort(instance.address)
+	name := instance.name()
+	if instance == master.instance {
+		name = master.name
+	}
+	flags := []string{instance.role}
+	if !instance.sdownSince.IsZero() {
+		flags = append(flags, constants.SENTINEL_FLAG_SDOWN)
+	}
+	if instance == master.instance && !master.odownSince.IsZero() {
+		flags = append(flags, constants.SENTINEL_FLAG_ODOWN)
+	}
+	if instance == master.instance && master.failoverState != constants.SENTINEL_FAILOVER_STATE_NONE {
+		flags = append(flags, constants.SENTINEL_FLAG_FAILOVER_IN_PROGRESS)
+	}
+	if instance == master.promotedReplica {
+		flags = append(flags, constants.SENTINEL_FLAG_PROMOTED)
+	}
+	return []string{
+		"name", name,
+		"ip", host,
+		"port", port,
+		"runid", instance.runId,
+		"flags", strings.Join(flags, ","),
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(instance.lastPongTime).Milliseconds(), 10),
+		"role-reported", instance.reportedRole,
+	}
+}
+
+func createFieldList(fields []string) constants.DataRepr {
+	fieldList := make([]constants.DataRepr, len(fields))
+	for i, field := range fields {
+		fieldList[i] = utils.CreateBulkResponse(field)
+	}
+	return utils.CreateMapDataRepr(fieldList)
+}
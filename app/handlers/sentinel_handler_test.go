@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/server"
+)
+
+func newTestSentinelHandler(t *testing.T) *SentinelHandler {
+	handlers := newTestHandlers(t)
+	commandHandler := handlers.commandHandler
+	pubSubHandler := InitPubSubHandler(handlers.ctx, handlers.connHandler, commandHandler.notificationHandler, commandHandler)
+	return InitSentinelHandler(handlers.ctx, commandHandler, pubSubHandler)
+}
+
+// addTestMaster monitors a master without probing it or subscribing to its hellos
+func addTestMaster(h *SentinelHandler, name string, address string, quorum int) *sentinelMaster {
+	master := &sentinelMaster{
+		name:            name,
+		quorum:          quorum,
+		downAfter:       time.Second,
+		failoverTimeout: time.Minute,
+		replicas:        make(map[string]*sentinelInstance),
+		sentinels:       make(map[string]*sentinelInstance),
+		failoverState:   constants.SENTINEL_FAILOVER_STATE_NONE,
+	}
+	master.instance = newSentinelInstance(constants.SENTINEL_FLAG_MASTER, address)
+	master.instance.ips = resolveHostIps(address)
+	h.masters[name] = master
+	return master
+}
+
+func addTestSentinel(master *sentinelMaster, runId string, address string) *sentinelInstance {
+	sentinel := newSentinelInstance(constants.SENTINEL_FLAG_SENTINEL, address)
+	sentinel.runId = runId
+	master.sentinels[runId] = sentinel
+	return sentinel
+}
+
+func TestProcessHello(t *testing.T) {
+	h := newTestSentinelHandler(t)
+	master := addTestMaster(h, "mymaster", "127.0.0.1:6379", 2)
+	runId, otherRunId := server.NewReplicationId(), server.NewReplicationId()
+	hello := func(ip string, port string, runId string, epoch int, masterName string, masterHost string, masterPort string, configEpoch int) string {
+		return strings.Join([]string{ip, port, runId, strconv.Itoa(epoch), masterName, masterHost, masterPort, strconv.Itoa(configEpoch)}, ",")
+	}
+
+	for _, ignored := range []string{
+		"127.0.0.1,26380," + runId + ",1,mymaster,127.0.0.1,6379",
+		"127.0.0.1,26380," + runId + ",epoch,mymaster,127.0.0.1,6379,0",
+		hello("127.0.0.1", "26380", h.runId, 1, "mymaster", "127.0.0.1", "6379", 0),
+		hello("127.0.0.1", "26380", runId, 1, "othermaster", "127.0.0.1", "6379", 0),
+	} {
+		h.processHello(ignored)
+		if len(master.sentinels) != 0 || h.currentEpoch != 0 {
+			t.Fatalf("Expected hello %q to be ignored", ignored)
+		}
+	}
+
+	h.processHello(hello("127.0.0.1", "26380", runId, 3, "mymaster", "127.0.0.1", "6379", 0))
+	if sentinel, known := master.sentinels[runId]; !known || sentinel.address != "127.0.0.1:26380" || h.currentEpoch != 3 {
+		t.Fatalf("Expected the sentinel to be learned along with epoch 3, Got: %v sentinels in epoch %d", len(master.sentinels), h.currentEpoch)
+	}
+	// A sentinel restarted on the same address replaces the one it was
+	h.processHello(hello("127.0.0.1", "26380", otherRunId, 2, "mymaster", "127.0.0.1", "6379", 0))
+	if _, known := master.sentinels[otherRunId]; !known || len(master.sentinels) != 1 || h.currentEpoch != 3 {
+		t.Fatalf("Expected the restarted sentinel to replace the previous one and an older epoch to be ignored")
+	}
+	if len(h.pendingEvents) != 0 {
+		t.Errorf("Expected events to be published once the lock is released, Got: %d pending", len(h.pendingEvents))
+	}
+
+	// A newer config epoch announces the master another sentinel failed over to, here by host name
+	replica := newSentinelInstance(constants.SENTINEL_FLAG_SLAVE, "127.0.0.1:6380")
+	replica.ips = resolveHostIps(replica.address)
+	master.replicas[replica.address] = replica
+	oldMaster := master.instance
+	h.processHello(hello("127.0.0.1", "26380", otherRunId, 3, "mymaster", "localhost", "6380", 1))
+	if master.instance != replica || master.instance.role != constants.SENTINEL_FLAG_MASTER || master.configEpoch != 1 {
+		t.Fatalf("Expected the replica to become the monitored master, Got: %s", master.instance.address)
+	}
+	if master.replicas[oldMaster.address] != oldMaster || oldMaster.role != constants.SENTINEL_FLAG_SLAVE {
+		t.Errorf("Expected the former master to be kept as a replica")
+	}
+}
+
+func TestCheckObjectivelyDown(t *testing.T) {
+	h := newTestSentinelHandler(t)
+	master := addTestMaster(h, "mymaster", "127.0.0.1:6379", 2)
+	sentinel := addTestSentinel(master, server.NewReplicationId(), "127.0.0.1:26380")
+	addTestSentinel(master, server.NewReplicationId(), "127.0.0.1:26381")
+	now := time.Now()
+	h.lock.Lock()
+	defer h.unlock()
+
+	sentinel.masterDown, sentinel.masterDownReplyTime = true, now
+	h.checkObjectivelyDown(master, now)
+	if !master.odownSince.IsZero() {
+		t.Fatalf("Expected the master not to be down while this sentinel sees it up")
+	}
+	master.instance.sdownSince = now
+	h.checkObjectivelyDown(master, now)
+	if master.odownSince.IsZero() {
+		t.Fatalf("Expected the master to be down once quorum sentinels see it down")
+	}
+	// A reply to IS-MASTER-DOWN-BY-ADDR only counts for a while
+	later := now.Add(constants.SENTINEL_MASTER_DOWN_REPLY_VALIDITY)
+	h.checkObjectivelyDown(master, later)
+	if !master.odownSince.IsZero() {
+		t.Errorf("Expected the master to be back up once the other sentinel's reply is outdated")
+	}
+	master.quorum = 1
+	h.checkObjectivelyDown(master, later)
+	if master.odownSince.IsZero() {
+		t.Errorf("Expected the master to be down with a quorum of 1 once this sentinel sees it down")
+	}
+}
+
+func TestIsMasterDownByAddr(t *testing.T) {
+	h := newTestSentinelHandler(t)
+	master := addTestMaster(h, "mymaster", "127.0.0.1:6379", 2)
+	master.instance.sdownSince = time.Now()
+	candidate := server.NewReplicationId()
+
+	// The asking sentinel may name the master by host name
+	reply, err := h.isMasterDownByAddr("localhost", "6379", "1", candidate)
+	if err != nil || len(reply.Array) != 3 {
+		t.Fatalf("Unexpected reply %v (%v)", reply, err)
+	}
+	if string(reply.Array[0].Data) != "1" || string(reply.Array[1].Data) != candidate || string(reply.Array[2].Data) != "1" {
+		t.Errorf("Expected the master to be seen down and the vote given for epoch 1, Got: %q", reply.Array)
+	}
+	// The vote for the epoch is given once
+	reply, _ = h.isMasterDownByAddr("127.0.0.1", "6379", "1", server.NewReplicationId())
+	if string(reply.Array[1].Data) != candidate {
+		t.Errorf("Expected the vote for epoch 1 to stay with the first candidate, Got: %q", reply.Array[1].Data)
+	}
+	reply, _ = h.isMasterDownByAddr("127.0.0.1", "6380", "2", candidate)
+	if string(reply.Array[0].Data) != "0" || string(reply.Array[1].Data) != constants.SENTINEL_NO_VOTE_RUN_ID {
+		t.Errorf("Expected no vote for an unknown master, Got: %q", reply.Array)
+	}
+}
+
+func TestElectLeader(t *testing.T) {
+	h := newTestSentinelHandler(t)
+	candidate := server.NewReplicationId()
+	testCases := []struct {
+		name         string
+		sentinelVote []int
+		quorum       int
+		expected     string
+	}{
+		// Epochs the other sentinels voted for candidate in, 0 when they didn't vote
+		{"majority", []int{5, 5, 0}, 2, candidate},
+		{"no majority", []int{5, 0, 0}, 2, ""},
+		{"votes of another epoch", []int{5, 4, 4}, 2, ""},
+		{"under quorum", []int{5, 5, 0}, 4, ""},
+		{"alone", []int{}, 1, h.runId},
+	}
+	for i, testCase := range testCases {
+		master := addTestMaster(h, "master"+strconv.Itoa(i), "127.0.0.1:"+strconv.Itoa(7000+i), testCase.quorum)
+		for _, voteEpoch := range testCase.sentinelVote {
+			sentinel := addTestSentinel(master, server.NewReplicationId(), "127.0.0.1:26380")
+			if voteEpoch > 0 {
+				sentinel.leader, sentinel.leaderEpoch = candidate, voteEpoch
+			}
+		}
+		h.lock.Lock()
+		h.currentEpoch = 5
+		leader := h.electLeader(master, 5)
+		h.unlock()
+		if leader != testCase.expected {
+			t.Errorf("%s: expected leader %q, Got: %q", testCase.name, testCase.expected, leader)
+		}
+	}
+
+	// Votes are counted for the failover's epoch, even once a newer epoch was learned
+	master := addTestMaster(h, "newer", "127.0.0.1:7100", 2)
+	for i := 0; i < 2; i++ {
+		sentinel := addTestSentinel(master, server.NewReplicationId(), "127.0.0.1:26380")
+		sentinel.leader, sentinel.leaderEpoch = candidate, 5
+	}
+	master.leader, master.leaderEpoch = candidate, 5
+	h.lock.Lock()
+	h.currentEpoch = 6
+	leader := h.electLeader(master, 5)
+	h.unlock()
+	if leader != candidate {
+		t.Errorf("Expected the votes of epoch 5 to elect the candidate, Got: %q", leader)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// subscribeToHellos keeps a connection subscribed to the hello channel of a monitored instance until stop is
+// closed, handing every message to onHello
+func subscribeToHellos(address string, stop chan struct{}, onHello func(string)) {
+	for {
+		conn, err := net.DialTimeout("tcp", address, constants.SENTINEL_RECONNECT_PERIOD)
+		if err == nil {
+			connDone := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					conn.Close()
+				case <-connDone:
+				}
+			}()
+			readHellos(conn, onHello)
+			close(connDone)
+			conn.Close()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(constants.SENTINEL_RECONNECT_PERIOD):
+		}
+	}
+}
+
+func readHellos(conn net.Conn, onHello func(string)) {
+	_, err := conn.Write(parser.Encode(utils.CreateRequestForCommand(constants.SUBSCRIBE_COMMAND, constants.SENTINEL_HELLO_CHANNEL)))
+	if err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := parser.DecodeFrom(reader)
+		if err != nil {
+			return
+		}
+		if message.Type == constants.ARRAY && len(message.Array) == 3 &&
+			string(message.Array[0].Data) == constants.PUBSUB_MESSAGE_KIND {
+			onHello(string(message.Array[2].Data))
+		}
+	}
+}
@@ -16,22 +16,52 @@ func main() {
 	defer (*serverInstance).Listener.Close()
 
 	log.Printf("Listening on address: %s", (*serverInstance).ServerAddress)
-	log.Printf("Replication role: %s", (*serverInstance).ReplicationConfig.Role)
+	log.Printf("Replication role: %s", serverInstance.GetReplicationRole())
 
 	appContext := context.BuildContext(serverInstance)
+	if serverInstance.IsSentinelEnabled() {
+		runSentinel(appContext)
+		return
+	}
 	// Initialize persistence layer
 	persiDb := persistence.Init(appContext)
 
 	// Initialize components with context
 	notificationHandler := handlers.NewNotificationHandler(appContext)
 	commandHandler := handlers.InitCommandHandler(appContext, notificationHandler, persiDb)
+	aofHandler := handlers.InitAofHandler(appContext, commandHandler, persiDb)
 	requestHandler := handlers.InitRequestHandler(appContext, commandHandler)
 	connectionHandler := handlers.InitConnectionHandler(appContext, requestHandler, notificationHandler)
-	replicationHandler := handlers.InitReplicationHandler(appContext, connectionHandler, notificationHandler)
+	replicationHandler := handlers.InitReplicationHandler(appContext, connectionHandler, notificationHandler, commandHandler, persiDb)
+	handlers.InitPubSubHandler(appContext, connectionHandler, notificationHandler, commandHandler)
+	var clusterHandler *handlers.ClusterHandler
+	if serverInstance.IsClusterEnabled() {
+		clusterHandler = handlers.InitClusterHandler(appContext, connectionHandler, notificationHandler, commandHandler, replicationHandler)
+	}
 
 	utils.InitUtils(appContext)
 	parser.InitBaseParser(appContext)
 
+	aofHandler.StartAofHandler()
 	replicationHandler.StartReplicationHandler()
+	if clusterHandler != nil {
+		clusterHandler.StartClusterHandler()
+	}
+	connectionHandler.StartEventLoop()
+}
+
+// runSentinel serves clients and other sentinels. It has no dataset, as no data command is served
+func runSentinel(appContext *context.Context) {
+	notificationHandler := handlers.NewNotificationHandler(appContext)
+	commandHandler := handlers.InitCommandHandler(appContext, notificationHandler, nil)
+	requestHandler := handlers.InitRequestHandler(appContext, commandHandler)
+	connectionHandler := handlers.InitConnectionHandler(appContext, requestHandler, notificationHandler)
+	pubSubHandler := handlers.InitPubSubHandler(appContext, connectionHandler, notificationHandler, commandHandler)
+	sentinelHandler := handlers.InitSentinelHandler(appContext, commandHandler, pubSubHandler)
+
+	utils.InitUtils(appContext)
+	parser.InitBaseParser(appContext)
+
+	sentinelHandler.StartSentinelHandler()
 	connectionHandler.StartEventLoop()
 }
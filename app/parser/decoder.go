@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"strconv"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
@@ -23,29 +24,61 @@ func init() {
 	decoderRegistry[constants.BULK] = decodeBulkString
 	decoderRegistry[constants.ERROR] = decodeError
 	decoderRegistry[constants.ARRAY] = decodeArray
+	decoderRegistry[constants.NULL] = decodeNull
+	decoderRegistry[constants.DOUBLE] = decodeDouble
+	decoderRegistry[constants.BOOLEAN] = decodeBoolean
+	decoderRegistry[constants.BLOB_ERROR] = decodeBlobError
+	decoderRegistry[constants.VERBATIM] = decodeVerbatimString
+	decoderRegistry[constants.BIG_NUMBER] = decodeBigNumber
+	decoderRegistry[constants.MAP] = decodeMap
+	decoderRegistry[constants.SET] = decodeSet
+	decoderRegistry[constants.ATTRIBUTE] = decodeAttribute
+	decoderRegistry[constants.PUSH] = decodePush
 }
 
 func Decode(data []byte) ([]constants.DataRepr, error) {
 	if len(data) == 0 {
 		return nil, errors.New("no data provided")
 	}
-	reader := bufio.NewReader(bytes.NewReader(data))
+	decodedDataList, _, err := DecodePrefix(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodedDataList, nil
+}
+
+// DecodePrefix decodes values until the data runs out or an invalid value is found, returning the
+// offset each decoded value ends at. Data ending in the middle of a value gives io.ErrUnexpectedEOF
+func DecodePrefix(data []byte) ([]constants.DataRepr, []int, error) {
+	dataReader := bytes.NewReader(data)
+	reader := bufio.NewReader(dataReader)
 	decodedDataList := make([]constants.DataRepr, 0)
+	endOffsets := make([]int, 0)
 	for {
+		// The buffer only holds part of large inputs, so check the underlying data as well
+		if _, err := reader.Peek(1); err != nil {
+			break
+		}
 		decodedData, err := decode(reader)
 		if err != nil {
-			if err == io.EOF {
-				break
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return decodedDataList, endOffsets, io.ErrUnexpectedEOF
 			}
-			return nil, err
+			return decodedDataList, endOffsets, err
 		}
 		decodedDataList = append(decodedDataList, *decodedData)
+		endOffsets = append(endOffsets, len(data)-dataReader.Len()-reader.Buffered())
+	}
+	return decodedDataList, endOffsets, nil
+}
 
-		if reader.Buffered() == 0 {
-			break
-		}
+// DecodeFrom reads a single value from a stream, such as a reply to a command sent over a connection
+func DecodeFrom(reader *bufio.Reader) (constants.DataRepr, error) {
+	decodedData, err := decode(reader)
+	if err != nil {
+		return constants.DataRepr{}, err
 	}
-	return decodedDataList, nil
+	return *decodedData, nil
 }
 
 func decode(reader *bufio.Reader) (*constants.DataRepr, error) {
@@ -57,7 +90,7 @@ func decode(reader *bufio.Reader) (*constants.DataRepr, error) {
 
 	decoder, decoderExists := decoderRegistry[dataTypeByte[0]]
 	if !decoderExists {
-		errMessage := fmt.Sprintf("%q is not a valid start of a RESP2 value (expected +, -, :, $ or *) for decoder", dataTypeByte[0])
+		errMessage := fmt.Sprintf("%q is not a valid start of a RESP value for decoder", dataTypeByte[0])
 		ctx.Logger.Println(errMessage)
 		return nil, errors.New(errMessage)
 	}
@@ -92,35 +125,55 @@ func decodeSimpleString(reader *bufio.Reader) (*constants.DataRepr, error) {
 }
 
 func decodeBulkString(reader *bufio.Reader) (*constants.DataRepr, error) {
-	bulkStringLengthBytes, _, err := ReadUntilCRLF(reader)
+	bulkStringBytes, err := readBlob(reader)
 	if err != nil {
-		ctx.Logger.Printf("Error trying to read bulk string length bytes in decodeBulkString: %s", err)
+		ctx.Logger.Printf("Error trying to read bulk string in decodeBulkString: %s", err)
 		return nil, err
 	}
-	bulkStringLength, err := strconv.Atoi(string(bulkStringLengthBytes[1:]))
+	if bulkStringBytes == nil {
+		nilBulkStringResponse := utils.NilBulkStringResponse()
+		return &nilBulkStringResponse, nil
+	}
+	bulkStringDataRepr := utils.CreateBulkResponse(string(bulkStringBytes))
+	return &bulkStringDataRepr, nil
+}
+
+// readBlob reads the length prefixed data of bulk strings, blob errors and verbatim strings, which is nil
+// for the RESP2 null bulk string, $-1
+func readBlob(reader *bufio.Reader) ([]byte, error) {
+	blobLengthBytes, _, err := ReadUntilCRLF(reader)
 	if err != nil {
-		ctx.Logger.Printf("Error trying to parse bulk string length from bulk string length bytes: %s", err)
 		return nil, err
 	}
-	if bulkStringLength == -1 {
-		nilBulkStringResponse := utils.NilBulkStringResponse()
-		return &nilBulkStringResponse, nil
+	blobLength, err := strconv.Atoi(string(blobLengthBytes[1:]))
+	if err != nil {
+		return nil, err
+	}
+	if blobLength == -1 && blobLengthBytes[0] == constants.BULK {
+		return nil, nil
 	}
-	bulkStringBytes := make([]byte, bulkStringLength)
-	_, err = reader.Read(bulkStringBytes)
+	if blobLength < 0 {
+		return nil, fmt.Errorf("invalid bulk string length: %d", blobLength)
+	}
+	blobBytes := make([]byte, blobLength)
+	_, err = io.ReadFull(reader, blobBytes)
 	if err != nil {
-		ctx.Logger.Printf("Error trying to read bulk string bytes in decodeBulkString: %s", err)
 		return nil, err
 	}
 
-	crlfData, _ := reader.Peek(2)
-
-	if len(crlfData) == 2 && crlfData[0] == '\r' {
-		// Discard \r\n
-		reader.Discard(2)
+	// Data cut right after the blob is incomplete until its CRLF arrives
+	crlfData, err := reader.Peek(2)
+	if errors.Is(err, io.EOF) {
+		return nil, io.ErrUnexpectedEOF
 	}
-	bulkStringDataRepr := utils.CreateBulkResponse(string(bulkStringBytes))
-	return &bulkStringDataRepr, nil
+	if err != nil {
+		return nil, err
+	}
+	if crlfData[0] != '\r' || crlfData[1] != '\n' {
+		return nil, fmt.Errorf("expected CRLF after %d bytes of data, got %q", blobLength, crlfData)
+	}
+	reader.Discard(2)
+	return blobBytes, nil
 }
 
 func decodeError(reader *bufio.Reader) (*constants.DataRepr, error) {
@@ -135,27 +188,199 @@ func decodeError(reader *bufio.Reader) (*constants.DataRepr, error) {
 }
 
 func decodeArray(reader *bufio.Reader) (*constants.DataRepr, error) {
-	arrayLengthBytes, _, err := ReadUntilCRLF(reader)
+	array, err := decodeAggregate(reader, 1)
 	if err != nil {
-		ctx.Logger.Printf("Error trying to read array length bytes in decodeArray: %s", err)
+		ctx.Logger.Printf("Error trying to decode array in decodeArray: %s", err)
 		return nil, err
 	}
+	arrayDataRepr := utils.CreateArrayDataRepr(array)
+	return &arrayDataRepr, nil
+}
 
-	arrayLength, err := strconv.Atoi(string(arrayLengthBytes[1:]))
+// decodeAggregate reads the elements of an array, set, push, map or attribute, the last two having
+// elementsPerEntry 2 as their length counts pairs of key and value
+func decodeAggregate(reader *bufio.Reader, elementsPerEntry int) ([]constants.DataRepr, error) {
+	lengthBytes, _, err := ReadUntilCRLF(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.Atoi(string(lengthBytes[1:]))
 	if err != nil {
-		ctx.Logger.Printf("Error trying to parse array length from array length bytes: %s", err)
 		return nil, err
 	}
 
 	var array []constants.DataRepr
-	for i := 0; i < arrayLength; i++ {
+	for i := 0; i < length*elementsPerEntry; i++ {
 		element, err := decode(reader)
 		if err != nil {
-			ctx.Logger.Printf("Error trying to decode array element in decodeArray: %s", err)
 			return nil, err
 		}
 		array = append(array, *element)
 	}
-	arrayDataRepr := utils.CreateArrayDataRepr(array)
-	return &arrayDataRepr, nil
+	return array, nil
+}
+
+func decodeNull(reader *bufio.Reader) (*constants.DataRepr, error) {
+	nullData, _, err := ReadUntilCRLF(reader)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to read null in decodeNull: %s", err)
+		return nil, err
+	}
+	if len(nullData) != 1 {
+		return nil, fmt.Errorf("invalid null %q", nullData)
+	}
+	nullDataRepr := utils.NullResponse()
+	return &nullDataRepr, nil
+}
+
+func decodeDouble(reader *bufio.Reader) (*constants.DataRepr, error) {
+	doubleData, _, err := ReadUntilCRLF(reader)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to read double in decodeDouble: %s", err)
+		return nil, err
+	}
+	// Kept as sent, ParseFloat only checks it, as it accepts inf, -inf and nan like RESP3
+	if _, err := strconv.ParseFloat(string(doubleData[1:]), 64); err != nil {
+		return nil, fmt.Errorf("invalid double %q", doubleData[1:])
+	}
+	doubleDataRepr := utils.CreateAtomicDataReprFromString(string(doubleData[1:]), constants.DOUBLE)
+	return &doubleDataRepr, nil
+}
+
+func decodeBoolean(reader *bufio.Reader) (*constants.DataRepr, error) {
+	booleanData, _, err := ReadUntilCRLF(reader)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to read boolean in decodeBoolean: %s", err)
+		return nil, err
+	}
+	value := string(booleanData[1:])
+	if value != constants.BOOLEAN_TRUE && value != constants.BOOLEAN_FALSE {
+		return nil, fmt.Errorf("invalid boolean %q", value)
+	}
+	booleanDataRepr := utils.CreateBooleanResponse(value == constants.BOOLEAN_TRUE)
+	return &booleanDataRepr, nil
+}
+
+func decodeBlobError(reader *bufio.Reader) (*constants.DataRepr, error) {
+	errorBytes, err := readBlob(reader)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to read blob error in decodeBlobError: %s", err)
+		return nil, err
+	}
+	blobErrorDataRepr := utils.CreateBlobErrorResponse(string(errorBytes))
+	return &blobErrorDataRepr, nil
+}
+
+func decodeVerbatimString(reader *bufio.Reader) (*constants.DataRepr, error) {
+	verbatimBytes, err := readBlob(reader)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to read verbatim string in decodeVerbatimString: %s", err)
+		return nil, err
+	}
+	if len(verbatimBytes) <= constants.VERBATIM_FORMAT_LENGTH || verbatimBytes[constants.VERBATIM_FORMAT_LENGTH] != ':' {
+		return nil, fmt.Errorf("verbatim string %q doesn't start with its format", verbatimBytes)
+	}
+	verbatimDataRepr := utils.CreateAtomicDataReprFromByte(verbatimBytes, constants.VERBATIM)
+	return &verbatimDataRepr, nil
+}
+
+func decodeBigNumber(reader *bufio.Reader) (*constants.DataRepr, error) {
+	bigNumberData, _, err := ReadUntilCRLF(reader)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to read big number in decodeBigNumber: %s", err)
+		return nil, err
+	}
+	if _, valid := new(big.Int).SetString(string(bigNumberData[1:]), 10); !valid {
+		return nil, fmt.Errorf("invalid big number %q", bigNumberData[1:])
+	}
+	bigNumberDataRepr := utils.CreateBigNumberResponse(string(bigNumberData[1:]))
+	return &bigNumberDataRepr, nil
+}
+
+func decodeMap(reader *bufio.Reader) (*constants.DataRepr, error) {
+	keyValues, err := decodeAggregate(reader, 2)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to decode map in decodeMap: %s", err)
+		return nil, err
+	}
+	mapDataRepr := utils.CreateMapDataRepr(keyValues)
+	return &mapDataRepr, nil
+}
+
+func decodeSet(reader *bufio.Reader) (*constants.DataRepr, error) {
+	elements, err := decodeAggregate(reader, 1)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to decode set in decodeSet: %s", err)
+		return nil, err
+	}
+	setDataRepr := utils.CreateSetDataRepr(elements)
+	return &setDataRepr, nil
+}
+
+func decodePush(reader *bufio.Reader) (*constants.DataRepr, error) {
+	elements, err := decodeAggregate(reader, 1)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to decode push in decodePush: %s", err)
+		return nil, err
+	}
+	pushDataRepr := utils.CreatePushDataRepr(elements)
+	return &pushDataRepr, nil
+}
+
+// decodeAttribute reads an attribute along with the value it describes, which it is attached to
+func decodeAttribute(reader *bufio.Reader) (*constants.DataRepr, error) {
+	attributes, err := decodeAggregate(reader, 2)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to decode attribute in decodeAttribute: %s", err)
+		return nil, err
+	}
+	value, err := decode(reader)
+	if err != nil {
+		return nil, err
+	}
+	value.Attributes = attributes
+	return value, nil
+}
+
+// DecodeRdbPayload reads the RDB a master sends after +FULLRESYNC. It is framed either like a bulk string
+// without the trailing CRLF, $<length>\r\n<rdb>, or, when streamed without knowing its length upfront,
+// as $EOF:<mark>\r\n<rdb><mark>. Empty lines a master sends to keep the link alive before it are skipped
+func DecodeRdbPayload(reader *bufio.Reader) ([]byte, error) {
+	header, err := reader.ReadBytes('\n')
+	for err == nil && len(bytes.TrimSpace(header)) == 0 {
+		header, err = reader.ReadBytes('\n')
+	}
+	if err != nil {
+		return nil, err
+	}
+	header = bytes.TrimSuffix(header, []byte("\r\n"))
+	if len(header) == 0 || header[0] != constants.BULK {
+		return nil, fmt.Errorf("expected an RDB payload, got %q", header)
+	}
+	if bytes.HasPrefix(header, []byte(constants.RDB_EOF_MARK_PREFIX)) {
+		eofMark := header[len(constants.RDB_EOF_MARK_PREFIX):]
+		if len(eofMark) != constants.RDB_EOF_MARK_LENGTH {
+			return nil, fmt.Errorf("invalid RDB EOF mark %q", eofMark)
+		}
+		payload := make([]byte, 0, 4096)
+		for !bytes.HasSuffix(payload, eofMark) {
+			dataByte, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			payload = append(payload, dataByte)
+		}
+		return payload[:len(payload)-len(eofMark)], nil
+	}
+	payloadLength, err := strconv.Atoi(string(header[1:]))
+	if err != nil || payloadLength < 0 {
+		return nil, fmt.Errorf("invalid RDB payload length %q", header[1:])
+	}
+	payload := make([]byte, payloadLength)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
 }
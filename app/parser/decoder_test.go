@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+)
+
+func TestMain(m *testing.M) {
+	InitBaseParser(&context.Context{Logger: log.New(io.Discard, "", 0)})
+	os.Exit(m.Run())
+}
+
+func TestDecode_InputLargerThanReadBuffer(t *testing.T) {
+	// An AOF holds many commands back to back, far more than a single bufio buffer
+	var input bytes.Buffer
+	commandCount := 1000
+	for i := 0; i < commandCount; i++ {
+		input.WriteString("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")
+	}
+
+	decodedDataList, err := Decode(input.Bytes())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(decodedDataList) != commandCount {
+		t.Errorf("Expected %d decoded commands, Got: %d", commandCount, len(decodedDataList))
+	}
+}
+
+func TestDecode_BulkStringLargerThanReadBuffer(t *testing.T) {
+	value := strings.Repeat("x", 10000)
+	decodedDataList, err := Decode([]byte("$10000\r\n" + value + "\r\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(decodedDataList) != 1 || decodedDataList[0].Type != constants.BULK || string(decodedDataList[0].Data) != value {
+		t.Errorf("Expected a single bulk string of %d bytes, Got: %+v", len(value), decodedDataList)
+	}
+}
+
+func TestDecode_TruncatedBulkString(t *testing.T) {
+	_, err := Decode([]byte("$10\r\nshort"))
+	if err == nil {
+		t.Errorf("Expected an error for a truncated bulk string")
+	}
+}
+
+func TestDecodeRdbPayload(t *testing.T) {
+	eofMark := strings.Repeat("ab", 20)
+	payloads := map[string]string{
+		"$7\r\nREDIS01*1\r\n$4\r\nPING\r\n":                                      "REDIS01",
+		"\n\n$EOF:" + eofMark + "\r\nREDIS01" + eofMark + "*1\r\n$4\r\nPING\r\n": "REDIS01",
+	}
+	for input, expectedPayload := range payloads {
+		reader := bufio.NewReader(strings.NewReader(input))
+		payload, err := DecodeRdbPayload(reader)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %q: %v", input, err)
+		}
+		if string(payload) != expectedPayload {
+			t.Errorf("Expected payload %q, Got: %q", expectedPayload, payload)
+		}
+		rest, _ := io.ReadAll(reader)
+		if string(rest) != "*1\r\n$4\r\nPING\r\n" {
+			t.Errorf("Expected the stream after the payload to be left unread, Got: %q", rest)
+		}
+	}
+	if _, err := DecodeRdbPayload(bufio.NewReader(strings.NewReader("$EOF:" + eofMark + "\r\nREDIS01"))); err == nil {
+		t.Errorf("Expected an error for a payload missing its EOF mark")
+	}
+}
+
+func TestDecode_Resp3Types(t *testing.T) {
+	input := "%2\r\n+first\r\n,3.14\r\n$6\r\nsecond\r\n~2\r\n#t\r\n_\r\n" +
+		">2\r\n(12345678901234567890\r\n=8\r\ntxt:text\r\n" +
+		"|1\r\n+ttl\r\n:10\r\n!5\r\nERR x\r\n"
+	decodedDataList, err := Decode([]byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(decodedDataList) != 3 {
+		t.Fatalf("Expected 3 decoded values, Got: %+v", decodedDataList)
+	}
+	decodedMap := decodedDataList[0]
+	if decodedMap.Type != constants.MAP || len(decodedMap.Array) != 4 || decodedMap.Array[1].Type != constants.DOUBLE ||
+		decodedMap.Array[3].Type != constants.SET || decodedMap.Array[3].Array[1].Type != constants.NULL {
+		t.Errorf("Unexpected decoded map: %+v", decodedMap)
+	}
+	decodedPush := decodedDataList[1]
+	if decodedPush.Type != constants.PUSH || decodedPush.Array[0].Type != constants.BIG_NUMBER ||
+		string(decodedPush.Array[1].Data) != "txt:text" {
+		t.Errorf("Unexpected decoded push: %+v", decodedPush)
+	}
+	blobError := decodedDataList[2]
+	if blobError.Type != constants.BLOB_ERROR || string(blobError.Data) != "ERR x" || len(blobError.Attributes) != 2 {
+		t.Errorf("Expected a blob error with its attribute, Got: %+v", blobError)
+	}
+	// Decoding and encoding for RESP3 gives back the input
+	var encoded bytes.Buffer
+	for _, decodedData := range decodedDataList {
+		encoded.Write(EncodeForProtocol(decodedData, constants.RESP3_PROTOCOL))
+	}
+	if encoded.String() != input {
+		t.Errorf("Expected %q once encoded, Got: %q", input, encoded.String())
+	}
+}
@@ -3,31 +3,87 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
 )
 
+// Encode encodes data for a RESP2 peer, such as a replica or a server this one sends commands to
 func Encode(data constants.DataRepr) []byte {
+	return EncodeForProtocol(data, constants.RESP2_PROTOCOL)
+}
+
+// EncodeForProtocol encodes data for a client using the given RESP version. RESP3 types are downgraded for
+// RESP2 clients: maps become arrays of their keys and values, sets and pushes arrays, nulls null bulk
+// strings, doubles, big numbers and verbatim strings bulk strings, and booleans 1 or 0. Attributes are dropped
+func EncodeForProtocol(data constants.DataRepr, protocol int) []byte {
 	ctx.Logger.Printf("Encoding data: %q", data)
-	encodedResponse := encode(data)
+	encodedResponse := encode(data, protocol)
 	return []byte(encodedResponse)
 }
 
-func encode(data constants.DataRepr) string {
+func encode(data constants.DataRepr, protocol int) string {
+	resp3 := protocol >= constants.RESP3_PROTOCOL
+	encodedAttributes := ""
+	if resp3 && len(data.Attributes) > 0 {
+		encodedAttributes = encodeAggregate(constants.ATTRIBUTE, data.Attributes, 2, protocol)
+	}
 	switch data.Type {
 	case constants.STRING:
-		return encodeString(data.Data)
+		return encodedAttributes + encodeString(data.Data)
 	case constants.BULK:
-		return encodeBulkString(data.Data)
+		if data.Data == nil && resp3 {
+			return encodedAttributes + encodeNull()
+		}
+		return encodedAttributes + encodeBulkString(data.Data)
 	case constants.INTEGER:
-		return encodeInteger(data.Data)
+		return encodedAttributes + encodeInteger(data.Data)
 	case constants.ERROR:
-		return encodeError(data.Data)
+		return encodedAttributes + encodeError(data.Data)
 	case constants.ARRAY:
-		return encodeArray(data.Array)
+		return encodedAttributes + encodeArray(data.Array, protocol)
 	case constants.RDB_FILE:
 		bulkStringEncoding := encodeBulkString(data.Data)
 		return bulkStringEncoding[:len(bulkStringEncoding)-2]
+	case constants.NULL:
+		if !resp3 {
+			return encodeBulkString(nil)
+		}
+		return encodedAttributes + encodeNull()
+	case constants.DOUBLE, constants.BIG_NUMBER:
+		if !resp3 {
+			return encodeBulkString(data.Data)
+		}
+		return encodedAttributes + string(data.Type) + string(data.Data) + constants.CRLF
+	case constants.BOOLEAN:
+		if !resp3 {
+			if string(data.Data) == constants.BOOLEAN_TRUE {
+				return encodeInteger([]byte("1"))
+			}
+			return encodeInteger([]byte("0"))
+		}
+		return encodedAttributes + string(data.Type) + string(data.Data) + constants.CRLF
+	case constants.BLOB_ERROR:
+		if !resp3 {
+			// Simple errors can't span lines
+			return encodeError([]byte(strings.NewReplacer("\r", " ", "\n", " ").Replace(string(data.Data))))
+		}
+		return encodedAttributes + encodeBlob(data.Type, data.Data)
+	case constants.VERBATIM:
+		if !resp3 {
+			return encodeBulkString(data.Data[min(constants.VERBATIM_FORMAT_LENGTH+1, len(data.Data)):])
+		}
+		return encodedAttributes + encodeBlob(data.Type, data.Data)
+	case constants.MAP:
+		if !resp3 {
+			return encodeArray(data.Array, protocol)
+		}
+		return encodedAttributes + encodeAggregate(data.Type, data.Array, 2, protocol)
+	case constants.SET, constants.PUSH:
+		if !resp3 {
+			return encodeArray(data.Array, protocol)
+		}
+		return encodedAttributes + encodeAggregate(data.Type, data.Array, 1, protocol)
 	default:
 		errMessage := fmt.Sprintf("Unsupported data type: %q", data.Type)
 		ctx.Logger.Println(errMessage)
@@ -55,6 +111,15 @@ func encodeBulkString(data []byte) string {
 	return string(constants.BULK) + encodedBulkString + constants.CRLF
 }
 
+// encodeBlob encodes the length prefixed RESP3 types, blob errors and verbatim strings
+func encodeBlob(dataType constants.DataType, data []byte) string {
+	return string(dataType) + strconv.Itoa(len(data)) + constants.CRLF + string(data) + constants.CRLF
+}
+
+func encodeNull() string {
+	return string(constants.NULL) + constants.CRLF
+}
+
 func encodeError(data []byte) string {
 	encodedErrorString := string(data)
 	ctx.Logger.Printf("Encoded error string: %s", encodedErrorString)
@@ -69,15 +134,20 @@ func encodeInteger(data []byte) string {
 	return string(constants.INTEGER) + strconv.Itoa(integerVal) + constants.CRLF
 }
 
-func encodeArray(dataArray []constants.DataRepr) string {
-	arrayLength := len(dataArray)
-	encodedArrayString := string(constants.ARRAY) + strconv.Itoa(arrayLength) + constants.CRLF
-
-	for _, data := range dataArray {
-		encodedDataString := encode(data)
-		encodedArrayString += encodedDataString
-	}
+func encodeArray(dataArray []constants.DataRepr, protocol int) string {
+	encodedArrayString := encodeAggregate(constants.ARRAY, dataArray, 1, protocol)
 	ctx.Logger.Printf("Encoded Array value as: %s", encodedArrayString)
 
 	return encodedArrayString
 }
+
+// encodeAggregate encodes the elements of an array, set, push, map or attribute, whose length counts entries
+// of elementsPerEntry elements, 2 for the keys and values of maps and attributes
+func encodeAggregate(dataType constants.DataType, dataArray []constants.DataRepr, elementsPerEntry int, protocol int) string {
+	var encodedAggregate strings.Builder
+	encodedAggregate.WriteString(string(dataType) + strconv.Itoa(len(dataArray)/elementsPerEntry) + constants.CRLF)
+	for _, data := range dataArray {
+		encodedAggregate.WriteString(encode(data, protocol))
+	}
+	return encodedAggregate.String()
+}
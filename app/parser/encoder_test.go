@@ -101,3 +101,25 @@ func TestEncode_UnsupportedType(t *testing.T) {
 		t.Errorf("Expected encoded error for unsupported type: %q, Got: %q", expectedOutput, string(encodedResponse))
 	}
 }
+
+func TestEncode_DowngradeForResp2(t *testing.T) {
+	data := constants.DataRepr{Type: constants.MAP, Array: []constants.DataRepr{
+		{Type: constants.BULK, Data: []byte("proto")}, {Type: constants.INTEGER, Data: []byte("2")},
+		{Type: constants.BULK, Data: []byte("flags")}, {Type: constants.SET, Array: []constants.DataRepr{
+			{Type: constants.BOOLEAN, Data: []byte(constants.BOOLEAN_TRUE)},
+			{Type: constants.DOUBLE, Data: []byte("1.5")},
+			{Type: constants.NULL},
+			{Type: constants.VERBATIM, Data: []byte("txt:a")},
+		}},
+	}}
+	expectedOutput := "*4\r\n$5\r\nproto\r\n:2\r\n$5\r\nflags\r\n*4\r\n:1\r\n$3\r\n1.5\r\n$-1\r\n$1\r\na\r\n"
+
+	encodedResponse := Encode(data)
+	if !bytes.Equal([]byte(expectedOutput), encodedResponse) {
+		t.Errorf("Expected RESP2 encoding: %q, Got: %q", expectedOutput, string(encodedResponse))
+	}
+	nilBulkString := constants.DataRepr{Type: constants.BULK}
+	if encoded := EncodeForProtocol(nilBulkString, constants.RESP3_PROTOCOL); string(encoded) != "_\r\n" {
+		t.Errorf("Expected the null bulk string to be a RESP3 null, Got: %q", encoded)
+	}
+}
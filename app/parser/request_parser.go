@@ -0,0 +1,276 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// ErrNeedMoreData is returned by RequestParser.Next while the data fed ends in the middle of a request
+var ErrNeedMoreData = errors.New("need more data")
+
+// RequestParser parses the requests a client sends as its data arrives. Requests starting with * are RESP
+// arrays of bulk strings, anything else is an inline command, a line of arguments as typed into telnet or
+// netcat. The multibulk request being parsed is kept across calls, so its arguments are only parsed once
+type RequestParser struct {
+	buffer []byte
+	// Arguments the multibulk request being parsed still expects, 0 between requests
+	multibulkLength int
+	// Length of the next bulk string, -1 until its header is read
+	bulkLength    int
+	args          []constants.DataRepr
+	maxBulkLength int
+	// Buffer reused for reads while no large request is pending, so reading doesn't allocate
+	ioBuffer []byte
+}
+
+func NewRequestParser(maxBulkLength int) *RequestParser {
+	return &RequestParser{bulkLength: -1, maxBulkLength: maxBulkLength}
+}
+
+// Feed appends data read from the connection to the buffer
+func (p *RequestParser) Feed(data []byte) {
+	p.buffer = append(p.buffer, data...)
+}
+
+// ReadFromConn reads the next data of a connection into the spare capacity of the buffer. Room for the rest of
+// the bulk string being parsed is reserved once, after which it is read in chunks of PROTO_MAX_READ_LEN at most
+func (p *RequestParser) ReadFromConn(reader io.Reader) (int, error) {
+	readSize := max(constants.PROTO_IOBUF_LEN, min(p.Missing(), constants.PROTO_MAX_READ_LEN))
+	p.reserve(readSize)
+	bytesRead, err := reader.Read(p.buffer[len(p.buffer) : len(p.buffer)+readSize])
+	p.buffer = p.buffer[:len(p.buffer)+bytesRead]
+	return bytesRead, err
+}
+
+// reserve makes room for at least size more bytes after the buffered data, and for the whole bulk string
+// being parsed. The data is moved to the start of the buffer when it fits, or else to a new one
+func (p *RequestParser) reserve(size int) {
+	if cap(p.buffer)-len(p.buffer) >= size {
+		return
+	}
+	capacity := len(p.buffer) + max(size, p.Missing())
+	var buffer []byte
+	if capacity <= 2*constants.PROTO_IOBUF_LEN {
+		if p.ioBuffer == nil {
+			p.ioBuffer = make([]byte, 2*constants.PROTO_IOBUF_LEN)
+		}
+		buffer = p.ioBuffer
+	} else {
+		buffer = make([]byte, capacity)
+	}
+	p.buffer = buffer[:copy(buffer, p.buffer)]
+}
+
+// Missing returns how many more bytes the bulk string being parsed needs, so a large value can be read at once
+func (p *RequestParser) Missing() int {
+	if p.bulkLength < 0 {
+		return 0
+	}
+	return max(p.bulkLength+len(constants.CRLF)-len(p.buffer), 0)
+}
+
+// Next returns the next complete request, or ErrNeedMoreData when there is none yet. Any other error is a
+// protocol error, after which the rest of the data can't be parsed
+func (p *RequestParser) Next() (constants.DataRepr, error) {
+	for p.multibulkLength == 0 {
+		if len(p.buffer) == 0 {
+			return constants.DataRepr{}, ErrNeedMoreData
+		}
+		if p.buffer[0] != constants.ARRAY {
+			request, err := p.parseInline()
+			// Empty lines are skipped
+			if err != nil || len(request.Array) > 0 {
+				return request, err
+			}
+			continue
+		}
+		length, err := p.readLength(constants.TOO_BIG_MULTIBULK_COUNT_ERROR, constants.INVALID_MULTIBULK_LENGTH_ERROR)
+		if err != nil {
+			return constants.DataRepr{}, err
+		}
+		if length > constants.PROTO_MAX_MULTIBULK_LEN {
+			return constants.DataRepr{}, errors.New(constants.INVALID_MULTIBULK_LENGTH_ERROR)
+		}
+		// Empty and null arrays are skipped
+		if length > 0 {
+			p.multibulkLength = length
+			p.args = make([]constants.DataRepr, 0, min(length, constants.PROTO_MULTIBULK_PREALLOC))
+		}
+	}
+	for p.multibulkLength > 0 {
+		if p.bulkLength < 0 {
+			if len(p.buffer) == 0 {
+				return constants.DataRepr{}, ErrNeedMoreData
+			}
+			if p.buffer[0] != constants.BULK {
+				return constants.DataRepr{}, fmt.Errorf(constants.EXPECTED_BULK_ERROR_FORMAT, p.buffer[0])
+			}
+			length, err := p.readLength(constants.TOO_BIG_BULK_COUNT_ERROR, constants.INVALID_BULK_LENGTH_ERROR)
+			if err != nil {
+				return constants.DataRepr{}, err
+			}
+			if length < 0 || length > p.maxBulkLength {
+				return constants.DataRepr{}, errors.New(constants.INVALID_BULK_LENGTH_ERROR)
+			}
+			p.bulkLength = length
+		}
+		if len(p.buffer) < p.bulkLength+len(constants.CRLF) {
+			return constants.DataRepr{}, ErrNeedMoreData
+		}
+		p.args = append(p.args, utils.CreateBulkResponse(string(p.buffer[:p.bulkLength])))
+		p.consume(p.bulkLength + len(constants.CRLF))
+		p.bulkLength = -1
+		p.multibulkLength--
+	}
+	request := utils.CreateArrayDataRepr(p.args)
+	p.args = nil
+	return request, nil
+}
+
+// readLength reads the length following the type of a multibulk request or bulk string, up to its CRLF
+func (p *RequestParser) readLength(tooBigError string, invalidError string) (int, error) {
+	crIndex := bytes.IndexByte(p.buffer, '\r')
+	if crIndex < 0 || crIndex+1 == len(p.buffer) {
+		if len(p.buffer) > constants.PROTO_INLINE_MAX_SIZE {
+			return 0, errors.New(tooBigError)
+		}
+		return 0, ErrNeedMoreData
+	}
+	length, err := strconv.Atoi(string(p.buffer[1:crIndex]))
+	if err != nil {
+		return 0, errors.New(invalidError)
+	}
+	p.consume(crIndex + len(constants.CRLF))
+	return length, nil
+}
+
+// parseInline reads an inline command up to its newline, giving an empty request for a line without arguments
+func (p *RequestParser) parseInline() (constants.DataRepr, error) {
+	newlineIndex := bytes.IndexByte(p.buffer, '\n')
+	if newlineIndex < 0 {
+		if len(p.buffer) > constants.PROTO_INLINE_MAX_SIZE {
+			return constants.DataRepr{}, errors.New(constants.TOO_BIG_INLINE_REQUEST_ERROR)
+		}
+		return constants.DataRepr{}, ErrNeedMoreData
+	}
+	line := string(bytes.TrimSuffix(p.buffer[:newlineIndex], []byte("\r")))
+	p.consume(newlineIndex + 1)
+	args, err := SplitArgs(line)
+	if err != nil {
+		ctx.Logger.Printf("Error trying to split inline command %q: %s", line, err)
+		return constants.DataRepr{}, err
+	}
+	if len(args) == 0 {
+		return utils.CreateArrayDataRepr(nil), nil
+	}
+	return utils.CreateRequestForCommand(args[0], args[1:]...), nil
+}
+
+func (p *RequestParser) consume(length int) {
+	p.buffer = p.buffer[length:]
+	if len(p.buffer) == 0 {
+		// Lets the buffer of a large request be released
+		p.buffer = nil
+	}
+}
+
+// SplitArgs splits a line into arguments like redis-cli. Arguments are separated by spaces, and may be
+// quoted: within double quotes \n, \r, \t, \b, \a and \xHH are escapes and a backslash keeps the next
+// character as is, within single quotes only \' is an escape. A closing quote must end the argument
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		inDoubleQuotes, inSingleQuotes, done := false, false, false
+		var current []byte
+		for !done {
+			switch {
+			case inDoubleQuotes:
+				if i == len(line) {
+					return nil, errors.New(constants.UNBALANCED_QUOTES_ERROR)
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					value, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(value))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					current = append(current, unescape(line[i]))
+				} else if line[i] == '"' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New(constants.UNBALANCED_QUOTES_ERROR)
+					}
+					done = true
+				} else {
+					current = append(current, line[i])
+				}
+			case inSingleQuotes:
+				if i == len(line) {
+					return nil, errors.New(constants.UNBALANCED_QUOTES_ERROR)
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if line[i] == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New(constants.UNBALANCED_QUOTES_ERROR)
+					}
+					done = true
+				} else {
+					current = append(current, line[i])
+				}
+			default:
+				if i == len(line) || isSpace(line[i]) || line[i] == 0 {
+					done = true
+				} else if line[i] == '"' {
+					inDoubleQuotes = true
+				} else if line[i] == '\'' {
+					inSingleQuotes = true
+				} else {
+					current = append(current, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(current))
+	}
+}
+
+func unescape(char byte) byte {
+	switch char {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return char
+	}
+}
+
+func isSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r' || char == '\v' || char == '\f'
+}
+
+func isHexDigit(char byte) bool {
+	return (char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')
+}
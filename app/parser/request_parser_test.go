@@ -0,0 +1,125 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+// parseAll feeds the input to a parser a chunk at a time, returning the arguments of the requests it completed
+func parseAll(t *testing.T, input string, chunkSize int) [][]string {
+	requestParser := NewRequestParser(constants.MIN_PROTO_MAX_BULK_LEN)
+	requests := [][]string{}
+	for start := 0; start < len(input); start += chunkSize {
+		requestParser.Feed([]byte(input[start:min(start+chunkSize, len(input))]))
+		for {
+			request, err := requestParser.Next()
+			if errors.Is(err, ErrNeedMoreData) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			args := []string{}
+			for _, arg := range request.Array {
+				args = append(args, string(arg.Data))
+			}
+			requests = append(requests, args)
+		}
+	}
+	return requests
+}
+
+func TestRequestParser_SplitAcrossReads(t *testing.T) {
+	value := strings.Repeat("x", 20000)
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$20000\r\n" + value + "\r\n*0\r\n*1\r\n$4\r\nPING\r\n"
+	for _, chunkSize := range []int{1, 7, 1024, len(input)} {
+		requests := parseAll(t, input, chunkSize)
+		if len(requests) != 2 || len(requests[0]) != 3 || requests[0][2] != value || requests[1][0] != "PING" {
+			t.Errorf("Unexpected requests parsed with chunks of %d bytes: %d requests", chunkSize, len(requests))
+		}
+	}
+}
+
+func TestRequestParser_Inline(t *testing.T) {
+	input := "SET \"a b\" 'it\\'s'\r\n\n  PING\n*1\r\n$4\r\nPING\r\nECHO \"\\x41\\n\"\n"
+	expected := [][]string{{"SET", "a b", "it's"}, {"PING"}, {"PING"}, {"ECHO", "A\n"}}
+	for _, chunkSize := range []int{1, len(input)} {
+		requests := parseAll(t, input, chunkSize)
+		if len(requests) != len(expected) {
+			t.Fatalf("Expected %d requests, Got: %q", len(expected), requests)
+		}
+		for i, args := range requests {
+			if strings.Join(args, "|") != strings.Join(expected[i], "|") {
+				t.Errorf("Expected request %q, Got: %q", expected[i], args)
+			}
+		}
+	}
+}
+
+func TestRequestParser_ProtocolErrors(t *testing.T) {
+	inputs := map[string]string{
+		"*1\r\n$2000000\r\n":                 constants.INVALID_BULK_LENGTH_ERROR,
+		"*3000000000\r\n":                    constants.INVALID_MULTIBULK_LENGTH_ERROR,
+		"*1\r\n+PING\r\n":                    "Protocol error: expected '$', got '+'",
+		"*" + strings.Repeat("1", 70000):     constants.TOO_BIG_MULTIBULK_COUNT_ERROR,
+		"PING " + strings.Repeat("x", 70000): constants.TOO_BIG_INLINE_REQUEST_ERROR,
+		"SET \"a\n":                          constants.UNBALANCED_QUOTES_ERROR,
+	}
+	for input, expectedError := range inputs {
+		requestParser := NewRequestParser(constants.MIN_PROTO_MAX_BULK_LEN)
+		requestParser.Feed([]byte(input))
+		_, err := requestParser.Next()
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("Expected error %q for %.20q, Got: %v", expectedError, input, err)
+		}
+	}
+}
+
+func TestSplitArgs_UnbalancedQuotes(t *testing.T) {
+	for _, line := range []string{`SET "a`, `SET 'a`, `SET "a"b`} {
+		if _, err := SplitArgs(line); err == nil {
+			t.Errorf("Expected an error for unbalanced quotes in %q", line)
+		}
+	}
+}
+
+func TestRequestParser_ReadFromConn(t *testing.T) {
+	requestParser := NewRequestParser(constants.MIN_PROTO_MAX_BULK_LEN)
+	value := strings.Repeat("x", constants.MIN_PROTO_MAX_BULK_LEN)
+	reader := strings.NewReader("*2\r\n$4\r\nECHO\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+
+	// Room for the whole value is reserved once its length is read
+	var request constants.DataRepr
+	err := ErrNeedMoreData
+	for reads := 0; errors.Is(err, ErrNeedMoreData); reads++ {
+		if _, readErr := requestParser.ReadFromConn(reader); readErr != nil {
+			t.Fatalf("Unexpected error reading after %d reads: %v", reads, readErr)
+		}
+		if requestParser.bulkLength == len(value) && cap(requestParser.buffer) < len(value) {
+			t.Fatalf("Expected room for the value to be reserved, Got: %d bytes", cap(requestParser.buffer))
+		}
+		request, err = requestParser.Next()
+	}
+	if err != nil || len(request.Array) != 2 || string(request.Array[1].Data) != value {
+		t.Fatalf("Unexpected request %d arguments (%v)", len(request.Array), err)
+	}
+
+	// Requests which fit in the read buffer don't allocate for reads
+	ping := []byte("*1\r\n$4\r\nPING\r\n")
+	pingReader := bytes.NewReader(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		pingReader.Reset(ping[:5])
+		requestParser.ReadFromConn(pingReader)
+		pingReader.Reset(ping[5:])
+		requestParser.ReadFromConn(pingReader)
+		requestParser.consume(len(ping))
+	})
+	if allocs > 0 {
+		t.Errorf("Expected reads not to allocate, Got: %v allocations per request", allocs)
+	}
+}
@@ -0,0 +1,434 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+)
+
+type AofFileType string
+
+// AOF file types as written in the manifest
+const (
+	AOF_BASE_TYPE    AofFileType = "b"
+	AOF_HISTORY_TYPE AofFileType = "h"
+	AOF_INCR_TYPE    AofFileType = "i"
+)
+
+const (
+	AOF_MANIFEST_SUFFIX = ".manifest"
+	AOF_BASE_SUFFIX     = ".base"
+	AOF_INCR_SUFFIX     = ".incr"
+	AOF_RDB_FORMAT      = ".rdb"
+	AOF_RESP_FORMAT     = ".aof"
+	AOF_TEMP_PREFIX     = "temp-"
+)
+
+type AofInfo struct {
+	FileName string
+	FileSeq  int64
+	FileType AofFileType
+}
+
+// AofManifest tracks the files making up a multi part AOF: one base file holding a snapshot,
+// the incremental files holding every write since, and history files waiting to be deleted
+type AofManifest struct {
+	BaseAof         *AofInfo
+	IncrAofList     []*AofInfo
+	HistoryAofList  []*AofInfo
+	CurrBaseFileSeq int64
+	CurrIncrFileSeq int64
+}
+
+func NewAofManifest() *AofManifest {
+	return &AofManifest{
+		IncrAofList:    make([]*AofInfo, 0),
+		HistoryAofList: make([]*AofInfo, 0),
+	}
+}
+
+func GetAofManifestFileName(appendFileName string) string {
+	return appendFileName + AOF_MANIFEST_SUFFIX
+}
+
+// LoadAofManifest parses manifest lines of the form 'file <name> seq <n> type <b|h|i>'
+func LoadAofManifest(manifestPath string) (*AofManifest, error) {
+	manifestFile, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer manifestFile.Close()
+
+	manifest := NewAofManifest()
+	scanner := bufio.NewScanner(manifestFile)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %q", lineNumber, line)
+		}
+		aofInfo := AofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				aofInfo.FileName = fields[i+1]
+			case "seq":
+				aofInfo.FileSeq, err = strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid AOF file sequence on manifest line %d: %q", lineNumber, fields[i+1])
+				}
+			case "type":
+				aofInfo.FileType = AofFileType(fields[i+1])
+			}
+		}
+		if len(aofInfo.FileName) == 0 || strings.ContainsAny(aofInfo.FileName, "/\\") {
+			return nil, fmt.Errorf("invalid AOF file name on manifest line %d: %q", lineNumber, aofInfo.FileName)
+		}
+		switch aofInfo.FileType {
+		case AOF_BASE_TYPE:
+			if manifest.BaseAof != nil {
+				return nil, fmt.Errorf("AOF manifest has more than one base file (line %d)", lineNumber)
+			}
+			manifest.BaseAof = &aofInfo
+			manifest.CurrBaseFileSeq = aofInfo.FileSeq
+		case AOF_INCR_TYPE:
+			if aofInfo.FileSeq <= manifest.CurrIncrFileSeq {
+				return nil, fmt.Errorf("AOF manifest incr files are out of order (line %d)", lineNumber)
+			}
+			manifest.IncrAofList = append(manifest.IncrAofList, &aofInfo)
+			manifest.CurrIncrFileSeq = aofInfo.FileSeq
+		case AOF_HISTORY_TYPE:
+			manifest.HistoryAofList = append(manifest.HistoryAofList, &aofInfo)
+		default:
+			return nil, fmt.Errorf("invalid AOF file type on manifest line %d: %q", lineNumber, aofInfo.FileType)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if manifest.BaseAof == nil && len(manifest.IncrAofList) == 0 {
+		return nil, fmt.Errorf("AOF manifest '%s' lists no files", manifestPath)
+	}
+	return manifest, nil
+}
+
+func (m *AofManifest) Encode() string {
+	var builder strings.Builder
+	writeInfo := func(aofInfo *AofInfo) {
+		fmt.Fprintf(&builder, "file %s seq %d type %s\n", aofInfo.FileName, aofInfo.FileSeq, aofInfo.FileType)
+	}
+	if m.BaseAof != nil {
+		writeInfo(m.BaseAof)
+	}
+	for _, aofInfo := range m.HistoryAofList {
+		writeInfo(aofInfo)
+	}
+	for _, aofInfo := range m.IncrAofList {
+		writeInfo(aofInfo)
+	}
+	return builder.String()
+}
+
+// Copy returns a manifest that can be changed without affecting the one in use
+func (m *AofManifest) Copy() *AofManifest {
+	copyInfo := func(aofInfo *AofInfo) *AofInfo {
+		aofInfoCopy := *aofInfo
+		return &aofInfoCopy
+	}
+	manifestCopy := *m
+	if m.BaseAof != nil {
+		manifestCopy.BaseAof = copyInfo(m.BaseAof)
+	}
+	manifestCopy.IncrAofList = make([]*AofInfo, len(m.IncrAofList))
+	for i, aofInfo := range m.IncrAofList {
+		manifestCopy.IncrAofList[i] = copyInfo(aofInfo)
+	}
+	manifestCopy.HistoryAofList = make([]*AofInfo, len(m.HistoryAofList))
+	for i, aofInfo := range m.HistoryAofList {
+		manifestCopy.HistoryAofList[i] = copyInfo(aofInfo)
+	}
+	return &manifestCopy
+}
+
+func (m *AofManifest) NewBaseAof(appendFileName string) *AofInfo {
+	m.CurrBaseFileSeq++
+	baseAof := &AofInfo{
+		FileName: fmt.Sprintf("%s.%d%s%s", appendFileName, m.CurrBaseFileSeq, AOF_BASE_SUFFIX, AOF_RDB_FORMAT),
+		FileSeq:  m.CurrBaseFileSeq,
+		FileType: AOF_BASE_TYPE,
+	}
+	if m.BaseAof != nil {
+		m.BaseAof.FileType = AOF_HISTORY_TYPE
+		m.HistoryAofList = append(m.HistoryAofList, m.BaseAof)
+	}
+	m.BaseAof = baseAof
+	return baseAof
+}
+
+func (m *AofManifest) NewIncrAof(appendFileName string) *AofInfo {
+	m.CurrIncrFileSeq++
+	incrAof := &AofInfo{
+		FileName: fmt.Sprintf("%s.%d%s%s", appendFileName, m.CurrIncrFileSeq, AOF_INCR_SUFFIX, AOF_RESP_FORMAT),
+		FileSeq:  m.CurrIncrFileSeq,
+		FileType: AOF_INCR_TYPE,
+	}
+	m.IncrAofList = append(m.IncrAofList, incrAof)
+	return incrAof
+}
+
+// MoveIncrAofsToHistory marks every incr file except the last one as history
+func (m *AofManifest) MoveIncrAofsToHistory() {
+	if len(m.IncrAofList) < 2 {
+		return
+	}
+	for _, aofInfo := range m.IncrAofList[:len(m.IncrAofList)-1] {
+		aofInfo.FileType = AOF_HISTORY_TYPE
+		m.HistoryAofList = append(m.HistoryAofList, aofInfo)
+	}
+	m.IncrAofList = m.IncrAofList[len(m.IncrAofList)-1:]
+}
+
+func (m *AofManifest) LastIncrAof() *AofInfo {
+	if len(m.IncrAofList) == 0 {
+		return nil
+	}
+	return m.IncrAofList[len(m.IncrAofList)-1]
+}
+
+// PersistAofManifest atomically replaces the manifest, so a crash leaves either the old or the new one
+func PersistAofManifest(dirPath string, appendFileName string, manifest *AofManifest) error {
+	manifestFileName := GetAofManifestFileName(appendFileName)
+	tempManifestPath := filepath.Join(dirPath, AOF_TEMP_PREFIX+manifestFileName)
+	err := writeFileAndSync(tempManifestPath, []byte(manifest.Encode()))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempManifestPath, filepath.Join(dirPath, manifestFileName))
+	if err != nil {
+		return err
+	}
+	return syncDir(dirPath)
+}
+
+func writeFileAndSync(filePath string, data []byte) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// WriteFileAtomically replaces a file through a synced temporary file, and syncs the directory once it is
+// renamed into place, so a crash leaves either version
+func WriteFileAtomically(filePath string, tempFilePath string, data []byte) error {
+	err := writeFileAndSync(tempFilePath, data)
+	if err == nil {
+		err = os.Rename(tempFilePath, filePath)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(filePath))
+	}
+	return err
+}
+
+// WriteRDBFile writes values as an RDB to a temporary file and renames it into place once synced, then syncs
+// the directory so the rename survives a crash
+func WriteRDBFile(filePath string, values map[string]Value, auxFields map[string]string) error {
+	tempFilePath := filepath.Join(filepath.Dir(filePath), AOF_TEMP_PREFIX+filepath.Base(filePath))
+	file, err := os.OpenFile(tempFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = WriteRDB(file, values, auxFields)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+	if err = os.Rename(tempFilePath, filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+// AofFormatError points at the first command of an AOF file which couldn't be decoded
+type AofFormatError struct {
+	Offset int
+	Err    error
+}
+
+func (e *AofFormatError) Error() string {
+	return fmt.Sprintf("bad command at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *AofFormatError) Unwrap() error {
+	return e.Err
+}
+
+// IsAofTruncated reports whether the AOF only ends in the middle of a command, as left behind by a crash
+func IsAofTruncated(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// DecodeAofCommands decodes the commands of a RESP AOF file. Each command has to be an array of bulk
+// strings encoded exactly as the server writes it. Along with an *AofFormatError, the commands before
+// the bad one are returned
+func DecodeAofCommands(data []byte) ([]constants.DataRepr, error) {
+	decodedDataList, endOffsets, err := parser.DecodePrefix(data)
+	startOffset := 0
+	for i, decodedData := range decodedDataList {
+		rawCommand := data[startOffset:endOffsets[i]]
+		expectedCommand := parser.Encode(decodedData)
+		if !isAofCommand(decodedData) {
+			return decodedDataList[:i], &AofFormatError{Offset: startOffset, Err: fmt.Errorf("%q is not a command", rawCommand)}
+		}
+		if !bytes.Equal(rawCommand, expectedCommand) {
+			if endOffsets[i] == len(data) && bytes.HasPrefix(expectedCommand, rawCommand) {
+				// Only the final CRLF is missing
+				return decodedDataList[:i], &AofFormatError{Offset: startOffset, Err: io.ErrUnexpectedEOF}
+			}
+			return decodedDataList[:i], &AofFormatError{Offset: startOffset, Err: fmt.Errorf("malformed command %q", rawCommand)}
+		}
+		startOffset = endOffsets[i]
+	}
+	if err != nil {
+		return decodedDataList, &AofFormatError{Offset: startOffset, Err: err}
+	}
+	return decodedDataList, nil
+}
+
+func isAofCommand(decodedData constants.DataRepr) bool {
+	if decodedData.Type != constants.ARRAY || len(decodedData.Array) == 0 {
+		return false
+	}
+	for _, element := range decodedData.Array {
+		if element.Type != constants.BULK || element.Data == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// AppendOnlyFile appends commands to an incr file, syncing to disk according to the appendfsync policy
+type AppendOnlyFile struct {
+	file        *os.File
+	fsyncPolicy string
+	dirty       bool
+	closed      bool
+	lock        sync.Mutex
+}
+
+func OpenAppendOnlyFile(filePath string, fsyncPolicy string) (*AppendOnlyFile, error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AppendOnlyFile{
+		file:        file,
+		fsyncPolicy: fsyncPolicy,
+	}, nil
+}
+
+func (aof *AppendOnlyFile) Write(data []byte) error {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	if aof.closed {
+		return os.ErrClosed
+	}
+	_, err := aof.file.Write(data)
+	if err != nil {
+		return err
+	}
+	if aof.fsyncPolicy == constants.APPENDFSYNC_ALWAYS {
+		return aof.file.Sync()
+	}
+	aof.dirty = true
+	return nil
+}
+
+func (aof *AppendOnlyFile) Sync() error {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	if aof.closed || !aof.dirty {
+		return nil
+	}
+	aof.dirty = false
+	return aof.file.Sync()
+}
+
+func (aof *AppendOnlyFile) isClosed() bool {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	return aof.closed
+}
+
+func (aof *AppendOnlyFile) Close() error {
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	if aof.closed {
+		return nil
+	}
+	aof.closed = true
+	syncErr := aof.file.Sync()
+	closeErr := aof.file.Close()
+	if syncErr != nil {
+		return syncErr
+	}
+	return closeErr
+}
+
+// StartEverySecFsync syncs the file once a second until it is closed
+func (aof *AppendOnlyFile) StartEverySecFsync(logger *log.Logger) {
+	if aof.fsyncPolicy != constants.APPENDFSYNC_EVERYSEC {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if aof.isClosed() {
+				return
+			}
+			err := aof.Sync()
+			if err != nil {
+				logger.Printf("Error while trying to fsync the append only file: %v", err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,65 @@
+package persistence
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+)
+
+const (
+	firstAofCommand  = "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	secondAofCommand = "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$2\r\n22\r\n"
+)
+
+func init() {
+	parser.InitBaseParser(&context.Context{Logger: log.New(io.Discard, "", 0)})
+}
+
+func TestDecodeAofCommands(t *testing.T) {
+	testCases := []struct {
+		name             string
+		data             string
+		expectedCommands int
+		expectedOffset   int
+		expectTruncated  bool
+		expectError      bool
+	}{
+		{name: "valid", data: firstAofCommand + secondAofCommand, expectedCommands: 2},
+		{name: "cut inside a bulk string", data: firstAofCommand + secondAofCommand[:20], expectedCommands: 1,
+			expectedOffset: len(firstAofCommand), expectTruncated: true, expectError: true},
+		{name: "cut before the final CRLF", data: firstAofCommand + secondAofCommand[:len(secondAofCommand)-2], expectedCommands: 1,
+			expectedOffset: len(firstAofCommand), expectTruncated: true, expectError: true},
+		{name: "garbage in the middle", data: firstAofCommand + "garbage\r\n" + secondAofCommand, expectedCommands: 1,
+			expectedOffset: len(firstAofCommand), expectError: true},
+		{name: "not a command", data: firstAofCommand + "+OK\r\n", expectedCommands: 1,
+			expectedOffset: len(firstAofCommand), expectError: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			commands, err := DecodeAofCommands([]byte(testCase.data))
+			if len(commands) != testCase.expectedCommands {
+				t.Errorf("Expected %d commands, Got: %d", testCase.expectedCommands, len(commands))
+			}
+			if !testCase.expectError {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			var formatErr *AofFormatError
+			if !errors.As(err, &formatErr) {
+				t.Fatalf("Expected an AofFormatError, Got: %v", err)
+			}
+			if formatErr.Offset != testCase.expectedOffset {
+				t.Errorf("Expected bad command at offset %d, Got: %d", testCase.expectedOffset, formatErr.Offset)
+			}
+			if IsAofTruncated(err) != testCase.expectTruncated {
+				t.Errorf("Expected truncated to be %v for error: %v", testCase.expectTruncated, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package persistence
+
+// CRC-64 with the Jones polynomial (0xad93d23594c935a9) as used by Redis for RDB checksums:
+// reflected input and output, zero initial value and no final xor. hash/crc64 can't be used as it
+// always inverts the crc before and after
+const CRC64_JONES_REFLECTED_POLY = 0x95ac9329ac4bc9b5
+
+var crc64JonesTable = makeCrc64Table(CRC64_JONES_REFLECTED_POLY)
+
+func makeCrc64Table(reflectedPoly uint64) *[256]uint64 {
+	table := new([256]uint64)
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ reflectedPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc64Jones(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64JonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
@@ -0,0 +1,58 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"strconv"
+)
+
+// DUMP payloads hold a single value as <RDB type><RDB encoded value><RDB version><CRC64>, the version being
+// 2 bytes and the checksum 8 bytes, both little endian. The checksum covers everything before it
+const DUMP_FOOTER_LENGTH = 10
+
+// EncodeDumpPayload serializes a value as sent by DUMP and MIGRATE. Its expiration time isn't part of it
+func EncodeDumpPayload(value Value) ([]byte, error) {
+	valueType, err := rdbValueType(value)
+	if err != nil {
+		return nil, err
+	}
+	var payload bytes.Buffer
+	rdb := rdbWriter{writer: bufio.NewWriter(&payload)}
+	rdb.write([]byte{byte(valueType)})
+	rdb.writeValue(value)
+	rdbVersion, _ := strconv.Atoi(RDB_WRITE_VERSION)
+	rdb.write(binary.LittleEndian.AppendUint16(nil, uint16(rdbVersion)))
+	rdb.write(binary.LittleEndian.AppendUint64(nil, rdb.checksum))
+	if err := rdb.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
+
+// DecodeDumpPayload reads a value serialized by EncodeDumpPayload, or by DUMP on a Redis server using an
+// RDB version gedis loads
+func DecodeDumpPayload(payload []byte, logger *log.Logger) (*Value, error) {
+	LOG = logger
+	invalidPayloadErr := errors.New("DUMP payload version or checksum are wrong")
+	if len(payload) < DUMP_FOOTER_LENGTH+1 {
+		return nil, invalidPayloadErr
+	}
+	footer := payload[len(payload)-DUMP_FOOTER_LENGTH:]
+	rdbVersion := int(binary.LittleEndian.Uint16(footer[:2]))
+	checksum := binary.LittleEndian.Uint64(footer[2:])
+	if rdbVersion > RDB_MAX_VERSION || checksum != crc64Jones(0, payload[:len(payload)-8]) {
+		return nil, invalidPayloadErr
+	}
+	reader := bytes.NewReader(payload[1 : len(payload)-DUMP_FOOTER_LENGTH])
+	value, err := readValue(reader, ValueType(payload[0]))
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() != 0 || value.Type == MODULE_2.String() {
+		return nil, errors.New("Bad data format")
+	}
+	return value, nil
+}
@@ -0,0 +1,38 @@
+package persistence
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+func TestDumpPayload_RoundTrip(t *testing.T) {
+	values := []Value{
+		{Type: constants.STRING_DATA_TYPE, Data: []byte("bar")},
+		{Type: constants.LIST_DATA_TYPE, List: [][]byte{[]byte("b"), []byte("a")}},
+		{Type: constants.HASH_DATA_TYPE, Hash: map[string][]byte{"field": []byte("value")}},
+	}
+	for _, value := range values {
+		payload, err := EncodeDumpPayload(value)
+		if err != nil {
+			t.Fatalf("Failed to encode %s value: %v", value.Type, err)
+		}
+		decoded, err := DecodeDumpPayload(payload, LOG)
+		if err != nil {
+			t.Fatalf("Failed to decode %s payload %q: %v", value.Type, payload, err)
+		}
+		if !reflect.DeepEqual(*decoded, value) {
+			t.Errorf("Expected %+v after a round trip, Got: %+v", value, *decoded)
+		}
+	}
+
+	payload, _ := EncodeDumpPayload(values[0])
+	if payload[0] != byte(STRING) || payload[len(payload)-10] != 11 {
+		t.Errorf("Expected a string payload of RDB version 11, Got: %q", payload)
+	}
+	payload[2] ^= 0xff
+	if _, err := DecodeDumpPayload(payload, LOG); err == nil {
+		t.Errorf("Expected an error for a payload with a wrong checksum")
+	}
+}
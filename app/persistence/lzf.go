@@ -0,0 +1,52 @@
+package persistence
+
+import "fmt"
+
+// Every back reference emits at most 264 bytes from 3 input bytes
+const LZF_MAX_EXPANSION = 88
+
+// lzfDecompress expands data compressed with the LZF algorithm Redis uses for long strings.
+// The stream is a series of chunks, each starting with a control byte: values below 32 announce
+// a literal run of control+1 bytes, anything else is a back reference into the output so far
+func lzfDecompress(compressed []byte, expectedLength int) ([]byte, error) {
+	output := make([]byte, 0, expectedLength)
+	position := 0
+	for position < len(compressed) {
+		control := int(compressed[position])
+		position++
+		if control < 32 {
+			literalLength := control + 1
+			if position+literalLength > len(compressed) {
+				return nil, fmt.Errorf("lzf literal run of %d bytes overflows the compressed input", literalLength)
+			}
+			output = append(output, compressed[position:position+literalLength]...)
+			position += literalLength
+			continue
+		}
+
+		referenceLength := control >> 5
+		if referenceLength == 7 {
+			if position >= len(compressed) {
+				return nil, fmt.Errorf("lzf back reference is missing its length byte")
+			}
+			referenceLength += int(compressed[position])
+			position++
+		}
+		if position >= len(compressed) {
+			return nil, fmt.Errorf("lzf back reference is missing its offset byte")
+		}
+		referenceStart := len(output) - ((control & 0x1F) << 8) - 1 - int(compressed[position])
+		position++
+		if referenceStart < 0 {
+			return nil, fmt.Errorf("lzf back reference points %d bytes before the start of the output", -referenceStart)
+		}
+		// Copied byte by byte as the reference may overlap the bytes being written
+		for i := 0; i < referenceLength+2; i++ {
+			output = append(output, output[referenceStart+i])
+		}
+	}
+	if len(output) != expectedLength {
+		return nil, fmt.Errorf("lzf data expanded to %d bytes but %d were expected", len(output), expectedLength)
+	}
+	return output, nil
+}
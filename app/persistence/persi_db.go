@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,41 +16,68 @@ type ValueType byte
 
 // Value Types
 const (
-	STRING ValueType = 0x00
-	LIST   ValueType = 0x01
-	SET    ValueType = 0x02
-	ZSET   ValueType = 0x03
-	HASH   ValueType = 0x04
-	ZIPMAP ValueType = 0x09
+	STRING             ValueType = 0x00
+	LIST               ValueType = 0x01
+	SET                ValueType = 0x02
+	ZSET               ValueType = 0x03
+	HASH               ValueType = 0x04
+	ZSET_2             ValueType = 0x05
+	MODULE             ValueType = 0x06
+	MODULE_2           ValueType = 0x07
+	ZIPMAP             ValueType = 0x09
+	LIST_ZIPLIST       ValueType = 0x0A
+	SET_INTSET         ValueType = 0x0B
+	ZSET_ZIPLIST       ValueType = 0x0C
+	HASH_ZIPLIST       ValueType = 0x0D
+	LIST_QUICKLIST     ValueType = 0x0E
+	STREAM_LISTPACKS   ValueType = 0x0F
+	HASH_LISTPACK      ValueType = 0x10
+	ZSET_LISTPACK      ValueType = 0x11
+	LIST_QUICKLIST_2   ValueType = 0x12
+	STREAM_LISTPACKS_2 ValueType = 0x13
+	SET_LISTPACK       ValueType = 0x14
+	STREAM_LISTPACKS_3 ValueType = 0x15
 )
 
+// String returns the logical data type (as reported by TYPE) for an RDB value type,
+// regardless of the encoding it was serialized with
 func (vt ValueType) String() string {
 	switch vt {
 	case STRING:
-		return "string"
-	case LIST:
-		return "list"
-	case SET:
-		return "set"
-	case ZSET:
-		return "zset"
-	case HASH:
-		return "hash"
-	case ZIPMAP:
-		return "zipmap"
+		return constants.STRING_DATA_TYPE
+	case LIST, LIST_ZIPLIST, LIST_QUICKLIST, LIST_QUICKLIST_2:
+		return constants.LIST_DATA_TYPE
+	case SET, SET_INTSET, SET_LISTPACK:
+		return constants.SET_DATA_TYPE
+	case ZSET, ZSET_2, ZSET_ZIPLIST, ZSET_LISTPACK:
+		return constants.ZSET_DATA_TYPE
+	case HASH, ZIPMAP, HASH_ZIPLIST, HASH_LISTPACK:
+		return constants.HASH_DATA_TYPE
+	case STREAM_LISTPACKS, STREAM_LISTPACKS_2, STREAM_LISTPACKS_3:
+		return constants.STREAM
+	case MODULE, MODULE_2:
+		return constants.MODULE_DATA_TYPE
 	default:
 		return constants.NONE
 	}
 }
 
+// Value holds a single keyspace entry. Strings use Data, every other type
+// uses the field matching its Type
 type Value struct {
 	Data           []byte
 	Type           string
 	ExpirationTime *time.Time
+	List           [][]byte
+	Set            map[string]struct{}
+	SortedSet      map[string]float64
+	Hash           map[string][]byte
+	Stream         *Stream
 }
 
 type SetOptions struct {
-	ExpiryDuration time.Duration
+	// Zero for keys which don't expire
+	ExpirationTime time.Time
 	ValueType      string
 }
 
@@ -58,6 +86,8 @@ type Memory struct {
 	expirableMemoryMap  map[string]Value
 	lock                *sync.RWMutex
 	expirableMemoryLock *sync.RWMutex
+	// Keys by cluster slot, streams included. It is updated along with the maps, its lock taken last
+	slotIndex *slotIndex
 }
 
 func initMemory() *Memory {
@@ -90,14 +120,18 @@ func (mem *Memory) Get(key string) (Value, bool) {
 }
 
 func (mem *Memory) Set(key string, val Value) error {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	mem.expirableMemoryLock.Lock()
+	defer mem.expirableMemoryLock.Unlock()
+	// A key lives in one of the maps only, otherwise a stale copy could expire and take the new value with it
+	mem.slotIndex.add(key)
 	if val.ExpirationTime != nil {
-		mem.expirableMemoryLock.Lock()
-		defer mem.expirableMemoryLock.Unlock()
+		delete(mem.memoryMap, key)
 		mem.expirableMemoryMap[key] = val
 		return nil
 	}
-	mem.lock.Lock()
-	defer mem.lock.Unlock()
+	delete(mem.expirableMemoryMap, key)
 	mem.memoryMap[key] = val
 
 	return nil
@@ -107,7 +141,10 @@ func (mem *Memory) Delete(key string) (Value, bool) {
 	mem.lock.Lock()
 	defer mem.lock.Unlock()
 	value, valueExists := mem.memoryMap[key]
-	delete(mem.memoryMap, key)
+	if valueExists {
+		delete(mem.memoryMap, key)
+		mem.slotIndex.remove(key)
+	}
 
 	return value, valueExists
 }
@@ -116,11 +153,27 @@ func (mem *Memory) DeleteExpired(key string) (Value, bool) {
 	mem.expirableMemoryLock.Lock()
 	defer mem.expirableMemoryLock.Unlock()
 	value, valueExists := mem.expirableMemoryMap[key]
-	delete(mem.expirableMemoryMap, key)
+	if valueExists {
+		delete(mem.expirableMemoryMap, key)
+		mem.slotIndex.remove(key)
+	}
 
 	return value, valueExists
 }
 
+// DeleteIfExpired removes key only if it has an expiration time which has passed
+func (mem *Memory) DeleteIfExpired(key string, now time.Time) bool {
+	mem.expirableMemoryLock.Lock()
+	defer mem.expirableMemoryLock.Unlock()
+	value, valueExists := mem.expirableMemoryMap[key]
+	if !valueExists || value.ExpirationTime == nil || now.Before(*value.ExpirationTime) {
+		return false
+	}
+	delete(mem.expirableMemoryMap, key)
+	mem.slotIndex.remove(key)
+	return true
+}
+
 func (mem *Memory) GetAllKeys() []string {
 	keys := make([]string, 0)
 	mem.lock.RLock()
@@ -150,9 +203,17 @@ type PersiDb struct {
 	dbFileName string
 	Memory     *Memory
 	streamMap  map[string]*Stream
+	// Guards streamMap. When held along with the memory locks, it is taken first
+	streamLock sync.RWMutex
+	// expiryHandler removes the expired keys the garbage collector finds, keys are deleted directly if unset
+	expiryHandler KeyExpiryFunc
 }
 
-func (db *PersiDb) load() {
+// KeyExpiryFunc is given a key which has expired
+type KeyExpiryFunc func(key string)
+
+// Load reads the configured RDB file into memory, if there is one
+func (db *PersiDb) Load() {
 	if len(db.dbDir) == 0 || len(db.dbFileName) == 0 {
 		return
 	}
@@ -168,17 +229,88 @@ func (db *PersiDb) load() {
 		return
 	}
 	db.logger.Printf("Successfully loaded RDB file from path: %s", rdbFilePath)
+	db.loadRdbResponse(loadedRdb)
+}
+
+// LoadRdbData parses an in-memory RDB and adds its keys to the dataset
+func (db *PersiDb) LoadRdbData(data []byte) error {
+	LOG = db.logger
+	loadedRdb, err := parseRdb(data)
+	if err != nil {
+		return err
+	}
+	db.loadRdbResponse(loadedRdb)
+	return nil
+}
+
+func (db *PersiDb) loadRdbResponse(loadedRdb *LoadRDBResponse) {
 	for dbIndex, database := range loadedRdb.dbs {
 		fmt.Printf("Loading database: %d\n", dbIndex)
 		for key, value := range database.nonExpirableData {
-			db.Memory.Set(key, value)
+			db.loadValue(key, value)
 		}
 		for key, value := range database.expirableData {
-			db.Memory.Set(key, value)
+			db.loadValue(key, value)
 		}
 	}
 }
 
+func (db *PersiDb) loadValue(key string, value Value) {
+	db.streamLock.Lock()
+	defer db.streamLock.Unlock()
+	loadValueInto(db.Memory, db.streamMap, key, value)
+}
+
+func loadValueInto(memory *Memory, streamMap map[string]*Stream, key string, value Value) {
+	if value.Stream != nil {
+		// Streams live outside of memory, gedis doesn't support expiring them
+		streamMap[key] = value.Stream
+		memory.slotIndex.add(key)
+		return
+	}
+	memory.Set(key, value)
+}
+
+// ReplaceWithRdbData parses an in-memory RDB and swaps it in for the whole dataset at once.
+// The dataset is left untouched if the RDB can't be parsed
+func (db *PersiDb) ReplaceWithRdbData(data []byte) error {
+	LOG = db.logger
+	loadedRdb, err := parseRdb(data)
+	if err != nil {
+		return err
+	}
+	memory := initMemory()
+	db.Memory.lock.RLock()
+	if db.Memory.slotIndex != nil {
+		memory.slotIndex = newSlotIndex()
+	}
+	db.Memory.lock.RUnlock()
+	streamMap := make(map[string]*Stream)
+	keyCount := 0
+	for _, database := range loadedRdb.dbs {
+		for key, value := range database.nonExpirableData {
+			loadValueInto(memory, streamMap, key, value)
+		}
+		for key, value := range database.expirableData {
+			loadValueInto(memory, streamMap, key, value)
+		}
+		keyCount += len(database.nonExpirableData) + len(database.expirableData)
+	}
+
+	db.streamLock.Lock()
+	db.Memory.lock.Lock()
+	db.Memory.expirableMemoryLock.Lock()
+	db.Memory.memoryMap = memory.memoryMap
+	db.Memory.expirableMemoryMap = memory.expirableMemoryMap
+	db.Memory.slotIndex = memory.slotIndex
+	db.streamMap = streamMap
+	db.Memory.expirableMemoryLock.Unlock()
+	db.Memory.lock.Unlock()
+	db.streamLock.Unlock()
+	db.logger.Printf("Replaced dataset with %d keys from RDB", keyCount)
+	return nil
+}
+
 func Init(ctx *context.Context) *PersiDb {
 	db := PersiDb{
 		ctx:        ctx,
@@ -188,7 +320,13 @@ func Init(ctx *context.Context) *PersiDb {
 		Memory:     initMemory(),
 		streamMap:  make(map[string]*Stream),
 	}
-	go db.load()
+	if ctx.ServerInstance.IsClusterEnabled() {
+		db.Memory.slotIndex = newSlotIndex()
+	}
+	if !ctx.ServerInstance.IsAppendOnlyEnabled() {
+		// With AOF enabled the AOF handler decides what gets loaded at startup
+		go db.Load()
+	}
 	go db.garbageCollector()
 	return &db
 }
@@ -199,8 +337,8 @@ func (db *PersiDb) Persist(key string, value []byte, options SetOptions) error {
 		Type: options.ValueType,
 	}
 
-	if options.ExpiryDuration > 0 {
-		expirationTime := time.Now().Add(options.ExpiryDuration)
+	if !options.ExpirationTime.IsZero() {
+		expirationTime := options.ExpirationTime
 		valueToPersist.ExpirationTime = &expirationTime
 	}
 	db.logger.Printf("For key: %s persisting value: %s", key, value)
@@ -222,30 +360,77 @@ func (db *PersiDb) Fetch(key string) (*Value, bool) {
 		db.logger.Printf("Value fetched for key '%s' is: %q", key, value.Data)
 		return &value, true
 	}
+	// Expired keys are hidden but left in place, deleting them is up to the expiry handler
 	db.logger.Printf("Value '%q' against  key '%s' has expired", value.Data, key)
-	db.Memory.DeleteExpired(key)
 	return nil, false
 }
 
+// GetValue returns the value of a live key whatever its type, streams included
+func (db *PersiDb) GetValue(key string) (Value, bool) {
+	if stream, streamExists := db.getStream(key); streamExists {
+		return Value{Type: constants.STREAM, Stream: stream}, true
+	}
+	value, valueExists := db.Fetch(key)
+	if !valueExists {
+		return Value{}, false
+	}
+	return *value, true
+}
+
+// RestoreKey sets key to a value of any type, replacing whatever the key held
+func (db *PersiDb) RestoreKey(key string, value Value) {
+	db.DeleteKey(key)
+	db.loadValue(key, value)
+}
+
+// DeleteKey removes key whatever its type, returning whether it existed
+func (db *PersiDb) DeleteKey(key string) bool {
+	_, deleted := db.Memory.Delete(key)
+	_, expirableDeleted := db.Memory.DeleteExpired(key)
+	db.streamLock.Lock()
+	_, streamExists := db.streamMap[key]
+	if streamExists {
+		delete(db.streamMap, key)
+		db.Memory.slotIndex.remove(key)
+	}
+	db.streamLock.Unlock()
+	return deleted || expirableDeleted || streamExists
+}
+
+// DeleteIfExpired removes key if its expiration time has passed
+func (db *PersiDb) DeleteIfExpired(key string) bool {
+	return db.Memory.DeleteIfExpired(key, time.Now())
+}
+
+func (db *PersiDb) SetExpiryHandler(expiryHandler KeyExpiryFunc) {
+	db.expiryHandler = expiryHandler
+}
+
 func (db *PersiDb) createStream(streamKey string) (*Stream, error) {
+	db.streamLock.Lock()
+	defer db.streamLock.Unlock()
 	stream, streamExists := db.streamMap[streamKey]
 	if streamExists {
 		return stream, nil
 	}
 	stream = NewStream(streamKey)
 	db.streamMap[streamKey] = stream
+	db.Memory.slotIndex.add(streamKey)
+	db.logger.Printf("Created new stream: %s", streamKey)
 	return stream, nil
 
 }
 
 func (db *PersiDb) getStream(streamKey string) (*Stream, bool) {
+	db.streamLock.RLock()
+	defer db.streamLock.RUnlock()
 	stream, streamExists := db.streamMap[streamKey]
 	return stream, streamExists
 }
 
 func (db *PersiDb) AddToStream(streamKey string, persistId string, fieldValuePairs [][]byte) (string, error) {
 	var err error
-	stream, streamExists := db.streamMap[streamKey]
+	stream, streamExists := db.getStream(streamKey)
 	if !streamExists {
 		stream, err = db.createStream(streamKey)
 		if err != nil {
@@ -267,6 +452,8 @@ func (db *PersiDb) GetKeysWithPattern(pattern string) []string {
 			matchedKeys = append(matchedKeys, key)
 		}
 	}
+	db.streamLock.RLock()
+	defer db.streamLock.RUnlock()
 	for streamKey := range db.streamMap {
 		if match, _ := match(pattern, streamKey); match {
 			matchedKeys = append(matchedKeys, streamKey)
@@ -275,6 +462,21 @@ func (db *PersiDb) GetKeysWithPattern(pattern string) []string {
 	return matchedKeys
 }
 
+// GetKeysInSlot returns the live keys which hash to the cluster slot, sorted. It is only supported in cluster mode
+func (db *PersiDb) GetKeysInSlot(slot int) []string {
+	db.Memory.lock.RLock()
+	index := db.Memory.slotIndex
+	db.Memory.lock.RUnlock()
+	keys := make([]string, 0)
+	for _, key := range index.keys(slot) {
+		if db.GetKeyType(key) != constants.NONE {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (db *PersiDb) GetKeyType(key string) string {
 	value, valueExists := db.Memory.Get(key)
 	if !valueExists {
@@ -284,20 +486,60 @@ func (db *PersiDb) GetKeyType(key string) string {
 		}
 		return constants.STREAM
 	}
+	if value.ExpirationTime != nil && time.Now().After(*value.ExpirationTime) {
+		return constants.NONE
+	}
 	return value.Type
 }
 
+// Snapshot returns a point-in-time copy of every live key, streams included
+func (db *PersiDb) Snapshot() map[string]Value {
+	snapshot := make(map[string]Value)
+	db.Memory.lock.RLock()
+	for key, value := range db.Memory.memoryMap {
+		snapshot[key] = value
+	}
+	db.Memory.lock.RUnlock()
+	now := time.Now()
+	db.Memory.expirableMemoryLock.RLock()
+	for key, value := range db.Memory.expirableMemoryMap {
+		if value.ExpirationTime == nil || now.Before(*value.ExpirationTime) {
+			snapshot[key] = value
+		}
+	}
+	db.Memory.expirableMemoryLock.RUnlock()
+	db.streamLock.RLock()
+	for streamKey, stream := range db.streamMap {
+		snapshot[streamKey] = Value{
+			Type:   constants.STREAM,
+			Stream: stream.clone(),
+		}
+	}
+	db.streamLock.RUnlock()
+	return snapshot
+}
+
 func (db *PersiDb) garbageCollector() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		now := time.Now()
-		for key, val := range db.Memory.GetAllExpirableKeyValuePair() {
+		expiredKeys := []string{}
+		db.Memory.expirableMemoryLock.RLock()
+		for key, val := range db.Memory.expirableMemoryMap {
 			if val.ExpirationTime != nil && now.After(*val.ExpirationTime) {
-				db.Memory.DeleteExpired(key)
-				db.logger.Printf("Deleted expired key: %s", key)
+				expiredKeys = append(expiredKeys, key)
+			}
+		}
+		db.Memory.expirableMemoryLock.RUnlock()
+		for _, key := range expiredKeys {
+			if db.expiryHandler != nil {
+				db.expiryHandler(key)
+				continue
 			}
+			db.DeleteIfExpired(key)
+			db.logger.Printf("Deleted expired key: %s", key)
 		}
 	}
 }
@@ -0,0 +1,47 @@
+package persistence
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+func TestGetKeysInSlot(t *testing.T) {
+	db := &PersiDb{logger: LOG, Memory: initMemory(), streamMap: make(map[string]*Stream)}
+	db.Memory.slotIndex = newSlotIndex()
+	slot := utils.KeyHashSlot("user1000")
+	db.Persist("{user1000}.following", []byte("a"), SetOptions{ValueType: constants.STRING_DATA_TYPE})
+	db.Persist("{user1000}.followers", []byte("b"), SetOptions{ValueType: constants.STRING_DATA_TYPE, ExpirationTime: time.Now().Add(time.Hour)})
+	db.AddToStream("{user1000}.stream", "1-1", [][]byte{[]byte("f"), []byte("v")})
+	db.Persist("{user1000}.expired", []byte("c"), SetOptions{ValueType: constants.STRING_DATA_TYPE, ExpirationTime: time.Now().Add(-time.Second)})
+	db.Persist("foo", []byte("d"), SetOptions{ValueType: constants.STRING_DATA_TYPE})
+
+	expected := []string{"{user1000}.followers", "{user1000}.following", "{user1000}.stream"}
+	if keys := db.GetKeysInSlot(slot); !slices.Equal(keys, expected) {
+		t.Fatalf("Expected the live keys of slot %d %v, Got: %v", slot, expected, keys)
+	}
+	db.DeleteKey("{user1000}.following")
+	db.DeleteKey("{user1000}.stream")
+	if keys := db.GetKeysInSlot(slot); !slices.Equal(keys, []string{"{user1000}.followers"}) {
+		t.Errorf("Expected deleted keys to leave the slot, Got: %v", keys)
+	}
+
+	var rdbData bytes.Buffer
+	values := map[string]Value{"{user1000}.fresh": {Type: constants.STRING_DATA_TYPE, Data: []byte("new")}}
+	if err := WriteRDB(&rdbData, values, nil); err != nil {
+		t.Fatalf("Failed to write RDB: %v", err)
+	}
+	if err := db.ReplaceWithRdbData(rdbData.Bytes()); err != nil {
+		t.Fatalf("Failed to replace dataset: %v", err)
+	}
+	if keys := db.GetKeysInSlot(slot); !slices.Equal(keys, []string{"{user1000}.fresh"}) {
+		t.Errorf("Expected the slot to hold the keys of the new dataset, Got: %v", keys)
+	}
+	if keys := db.GetKeysInSlot(utils.KeyHashSlot("foo")); len(keys) != 0 {
+		t.Errorf("Expected the keys replaced with the dataset to leave their slot, Got: %v", keys)
+	}
+}
@@ -0,0 +1,353 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Ziplist constants
+const (
+	ZIPLIST_HEADER_SIZE   = 10
+	ZIPLIST_END           = 0xFF
+	ZIPLIST_BIG_PREVLEN   = 0xFE
+	ZIPLIST_STR_06B       = 0x00
+	ZIPLIST_STR_14B       = 0x01
+	ZIPLIST_STR_32B       = 0x02
+	ZIPLIST_INT_16B       = 0xC0
+	ZIPLIST_INT_32B       = 0xD0
+	ZIPLIST_INT_64B       = 0xE0
+	ZIPLIST_INT_24B       = 0xF0
+	ZIPLIST_INT_8B        = 0xFE
+	ZIPLIST_INT_IMM_MIN   = 0xF1
+	ZIPLIST_INT_IMM_MAX   = 0xFD
+	ZIPLIST_INT_IMM_MASK  = 0x0F
+	ZIPLIST_STR_TYPE_MASK = 0xC0
+)
+
+// Listpack constants
+const (
+	LISTPACK_HEADER_SIZE = 6
+	LISTPACK_EOF         = 0xFF
+	LISTPACK_7BIT_UINT   = 0x00
+	LISTPACK_6BIT_STR    = 0x80
+	LISTPACK_13BIT_INT   = 0xC0
+	LISTPACK_12BIT_STR   = 0xE0
+	LISTPACK_32BIT_STR   = 0xF0
+	LISTPACK_16BIT_INT   = 0xF1
+	LISTPACK_24BIT_INT   = 0xF2
+	LISTPACK_32BIT_INT   = 0xF3
+	LISTPACK_64BIT_INT   = 0xF4
+)
+
+// Zipmap constants
+const (
+	ZIPMAP_BIGLEN = 0xFE
+	ZIPMAP_END    = 0xFF
+)
+
+// Intset encodings
+const (
+	INTSET_ENC_INT16 = 2
+	INTSET_ENC_INT32 = 4
+	INTSET_ENC_INT64 = 8
+)
+
+func checkBounds(data []byte, position int, n int, encoding string) error {
+	if n < 0 || position+n > len(data) {
+		return fmt.Errorf("%s is truncated: need %d bytes at position %d but only %d available", encoding, n, position, len(data)-position)
+	}
+	return nil
+}
+
+func readSignedLittleEndian(data []byte) int64 {
+	unsignedValue := getLittleEndian(data)
+	shift := uint(64 - 8*len(data))
+	return int64(unsignedValue<<shift) >> shift
+}
+
+// decodeZiplist returns every entry of a ziplist blob, with integer entries formatted in base 10
+func decodeZiplist(data []byte) ([][]byte, error) {
+	if err := checkBounds(data, 0, ZIPLIST_HEADER_SIZE, "ziplist"); err != nil {
+		return nil, err
+	}
+	totalBytes := binary.LittleEndian.Uint32(data[0:4])
+	if int(totalBytes) != len(data) {
+		return nil, fmt.Errorf("ziplist header claims %d bytes but blob has %d", totalBytes, len(data))
+	}
+	entryCount := binary.LittleEndian.Uint16(data[8:10])
+	entries := make([][]byte, 0, entryCount)
+	position := ZIPLIST_HEADER_SIZE
+	for {
+		if err := checkBounds(data, position, 1, "ziplist"); err != nil {
+			return nil, err
+		}
+		if data[position] == ZIPLIST_END {
+			break
+		}
+		// Skip the length of the previous entry, we only walk forward
+		if data[position] == ZIPLIST_BIG_PREVLEN {
+			position += 5
+		} else {
+			position += 1
+		}
+		if err := checkBounds(data, position, 1, "ziplist"); err != nil {
+			return nil, err
+		}
+		entry, entrySize, err := decodeZiplistEntry(data, position)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		position += entrySize
+	}
+	// A 0xFFFF count means the list was too long to keep count of, so it can't be checked
+	if entryCount != 0xFFFF && int(entryCount) != len(entries) {
+		return nil, fmt.Errorf("ziplist header claims %d entries but %d were found", entryCount, len(entries))
+	}
+	return entries, nil
+}
+
+func decodeZiplistEntry(data []byte, position int) ([]byte, int, error) {
+	encoding := data[position]
+	switch encoding >> 6 {
+	case ZIPLIST_STR_06B:
+		length := int(encoding & SIX_BIT_MASK)
+		if err := checkBounds(data, position+1, length, "ziplist"); err != nil {
+			return nil, 0, err
+		}
+		return data[position+1 : position+1+length], 1 + length, nil
+	case ZIPLIST_STR_14B:
+		if err := checkBounds(data, position, 2, "ziplist"); err != nil {
+			return nil, 0, err
+		}
+		length := int(encoding&SIX_BIT_MASK)<<8 | int(data[position+1])
+		if err := checkBounds(data, position+2, length, "ziplist"); err != nil {
+			return nil, 0, err
+		}
+		return data[position+2 : position+2+length], 2 + length, nil
+	case ZIPLIST_STR_32B:
+		if err := checkBounds(data, position, 5, "ziplist"); err != nil {
+			return nil, 0, err
+		}
+		length := int(binary.BigEndian.Uint32(data[position+1 : position+5]))
+		if err := checkBounds(data, position+5, length, "ziplist"); err != nil {
+			return nil, 0, err
+		}
+		return data[position+5 : position+5+length], 5 + length, nil
+	}
+
+	var intSize int
+	switch {
+	case encoding == ZIPLIST_INT_16B:
+		intSize = 2
+	case encoding == ZIPLIST_INT_32B:
+		intSize = 4
+	case encoding == ZIPLIST_INT_64B:
+		intSize = 8
+	case encoding == ZIPLIST_INT_24B:
+		intSize = 3
+	case encoding == ZIPLIST_INT_8B:
+		intSize = 1
+	case encoding >= ZIPLIST_INT_IMM_MIN && encoding <= ZIPLIST_INT_IMM_MAX:
+		immediateValue := int64(encoding&ZIPLIST_INT_IMM_MASK) - 1
+		return []byte(strconv.FormatInt(immediateValue, 10)), 1, nil
+	default:
+		return nil, 0, fmt.Errorf("invalid ziplist entry encoding: %X", encoding)
+	}
+	if err := checkBounds(data, position+1, intSize, "ziplist"); err != nil {
+		return nil, 0, err
+	}
+	intValue := readSignedLittleEndian(data[position+1 : position+1+intSize])
+	return []byte(strconv.FormatInt(intValue, 10)), 1 + intSize, nil
+}
+
+// decodeListpack returns every entry of a listpack blob, with integer entries formatted in base 10
+func decodeListpack(data []byte) ([][]byte, error) {
+	if err := checkBounds(data, 0, LISTPACK_HEADER_SIZE, "listpack"); err != nil {
+		return nil, err
+	}
+	totalBytes := binary.LittleEndian.Uint32(data[0:4])
+	if int(totalBytes) != len(data) {
+		return nil, fmt.Errorf("listpack header claims %d bytes but blob has %d", totalBytes, len(data))
+	}
+	entryCount := binary.LittleEndian.Uint16(data[4:6])
+	entries := make([][]byte, 0, entryCount)
+	position := LISTPACK_HEADER_SIZE
+	for {
+		if err := checkBounds(data, position, 1, "listpack"); err != nil {
+			return nil, err
+		}
+		if data[position] == LISTPACK_EOF {
+			break
+		}
+		entry, entrySize, err := decodeListpackEntry(data, position)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		// Every entry is followed by its own length, used for walking backwards
+		position += entrySize + listpackBacklenSize(entrySize)
+	}
+	// A 0xFFFF count means the listpack was too long to keep count of, so it can't be checked
+	if entryCount != 0xFFFF && int(entryCount) != len(entries) {
+		return nil, fmt.Errorf("listpack header claims %d entries but %d were found", entryCount, len(entries))
+	}
+	return entries, nil
+}
+
+func listpackBacklenSize(entrySize int) int {
+	switch {
+	case entrySize <= 127:
+		return 1
+	case entrySize < 16383:
+		return 2
+	case entrySize < 2097151:
+		return 3
+	case entrySize < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+func decodeListpackEntry(data []byte, position int) ([]byte, int, error) {
+	encoding := data[position]
+	switch {
+	case encoding&0x80 == LISTPACK_7BIT_UINT:
+		return []byte(strconv.FormatInt(int64(encoding&0x7F), 10)), 1, nil
+	case encoding&0xC0 == LISTPACK_6BIT_STR:
+		length := int(encoding & SIX_BIT_MASK)
+		if err := checkBounds(data, position+1, length, "listpack"); err != nil {
+			return nil, 0, err
+		}
+		return data[position+1 : position+1+length], 1 + length, nil
+	case encoding&0xE0 == LISTPACK_13BIT_INT:
+		if err := checkBounds(data, position, 2, "listpack"); err != nil {
+			return nil, 0, err
+		}
+		unsignedValue := int64(encoding&0x1F)<<8 | int64(data[position+1])
+		if unsignedValue >= 1<<12 {
+			unsignedValue -= 1 << 13
+		}
+		return []byte(strconv.FormatInt(unsignedValue, 10)), 2, nil
+	case encoding&0xF0 == LISTPACK_12BIT_STR:
+		if err := checkBounds(data, position, 2, "listpack"); err != nil {
+			return nil, 0, err
+		}
+		length := int(encoding&0x0F)<<8 | int(data[position+1])
+		if err := checkBounds(data, position+2, length, "listpack"); err != nil {
+			return nil, 0, err
+		}
+		return data[position+2 : position+2+length], 2 + length, nil
+	case encoding == LISTPACK_32BIT_STR:
+		if err := checkBounds(data, position, 5, "listpack"); err != nil {
+			return nil, 0, err
+		}
+		length := int(binary.LittleEndian.Uint32(data[position+1 : position+5]))
+		if err := checkBounds(data, position+5, length, "listpack"); err != nil {
+			return nil, 0, err
+		}
+		return data[position+5 : position+5+length], 5 + length, nil
+	}
+
+	var intSize int
+	switch encoding {
+	case LISTPACK_16BIT_INT:
+		intSize = 2
+	case LISTPACK_24BIT_INT:
+		intSize = 3
+	case LISTPACK_32BIT_INT:
+		intSize = 4
+	case LISTPACK_64BIT_INT:
+		intSize = 8
+	default:
+		return nil, 0, fmt.Errorf("invalid listpack entry encoding: %X", encoding)
+	}
+	if err := checkBounds(data, position+1, intSize, "listpack"); err != nil {
+		return nil, 0, err
+	}
+	intValue := readSignedLittleEndian(data[position+1 : position+1+intSize])
+	return []byte(strconv.FormatInt(intValue, 10)), 1 + intSize, nil
+}
+
+// decodeIntset returns the members of an intset blob formatted in base 10
+func decodeIntset(data []byte) ([][]byte, error) {
+	if err := checkBounds(data, 0, 8, "intset"); err != nil {
+		return nil, err
+	}
+	encoding := int(binary.LittleEndian.Uint32(data[0:4]))
+	if encoding != INTSET_ENC_INT16 && encoding != INTSET_ENC_INT32 && encoding != INTSET_ENC_INT64 {
+		return nil, fmt.Errorf("invalid intset encoding: %d", encoding)
+	}
+	length := int(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) != 8+length*encoding {
+		return nil, fmt.Errorf("intset header claims %d members of %d bytes but blob has %d bytes", length, encoding, len(data))
+	}
+	members := make([][]byte, length)
+	for i := 0; i < length; i++ {
+		start := 8 + i*encoding
+		member := readSignedLittleEndian(data[start : start+encoding])
+		members[i] = []byte(strconv.FormatInt(member, 10))
+	}
+	return members, nil
+}
+
+// decodeZipmap returns the field-value pairs of a zipmap blob flattened into a single list
+func decodeZipmap(data []byte) ([][]byte, error) {
+	if err := checkBounds(data, 0, 1, "zipmap"); err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, 0)
+	position := 1
+	for {
+		if err := checkBounds(data, position, 1, "zipmap"); err != nil {
+			return nil, err
+		}
+		if data[position] == ZIPMAP_END {
+			break
+		}
+		field, fieldSize, err := readZipmapString(data, position, false)
+		if err != nil {
+			return nil, err
+		}
+		position += fieldSize
+		value, valueSize, err := readZipmapString(data, position, true)
+		if err != nil {
+			return nil, err
+		}
+		position += valueSize
+		entries = append(entries, field, value)
+	}
+	return entries, nil
+}
+
+func readZipmapString(data []byte, position int, hasFreeSpace bool) ([]byte, int, error) {
+	if err := checkBounds(data, position, 1, "zipmap"); err != nil {
+		return nil, 0, err
+	}
+	length := int(data[position])
+	headerSize := 1
+	if data[position] == ZIPMAP_BIGLEN {
+		if err := checkBounds(data, position, 5, "zipmap"); err != nil {
+			return nil, 0, err
+		}
+		length = int(binary.LittleEndian.Uint32(data[position+1 : position+5]))
+		headerSize = 5
+	} else if data[position] == ZIPMAP_END {
+		return nil, 0, fmt.Errorf("unexpected end of zipmap at position %d", position)
+	}
+	freeSpace := 0
+	if hasFreeSpace {
+		if err := checkBounds(data, position+headerSize, 1, "zipmap"); err != nil {
+			return nil, 0, err
+		}
+		freeSpace = int(data[position+headerSize])
+		headerSize++
+	}
+	start := position + headerSize
+	if err := checkBounds(data, start, length+freeSpace, "zipmap"); err != nil {
+		return nil, 0, err
+	}
+	return data[start : start+length], headerSize + length + freeSpace, nil
+}
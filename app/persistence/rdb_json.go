@@ -0,0 +1,527 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+// Export format: one JSON object per line, holding either an aux field, a function or a key.
+//
+//	{"aux":"redis-ver","value":"7.2.0"}
+//	{"function":"#!lua name=lib ..."}
+//	{"db":0,"key":"greeting","type":"string","expire_at_ms":1700000000000,"value":"hello"}
+//
+// Lists and sets hold arrays, sorted sets arrays of {"member","score"}, hashes arrays of {"field","value"}
+// and streams an object with their entries, ids and consumer groups. Strings which aren't valid UTF-8
+// are written as {"base64":"..."} so an export can be imported back without losing bytes
+type rdbJsonRecord struct {
+	Aux        *string         `json:"aux,omitempty"`
+	Function   *string         `json:"function,omitempty"`
+	Db         *int            `json:"db,omitempty"`
+	Key        *jsonBytes      `json:"key,omitempty"`
+	Type       string          `json:"type,omitempty"`
+	ExpireAtMs *int64          `json:"expire_at_ms,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+
+type jsonBytes []byte
+
+type jsonBase64 struct {
+	Base64 string `json:"base64"`
+}
+
+func (b jsonBytes) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(jsonBase64{Base64: base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *jsonBytes) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = []byte(text)
+		return nil
+	}
+	var encoded jsonBase64
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return fmt.Errorf("expected a string or {\"base64\": ...}, got %s", data)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded.Base64)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// jsonScore writes infinite and NaN scores as strings, as JSON numbers can't hold them
+type jsonScore float64
+
+func (score jsonScore) MarshalJSON() ([]byte, error) {
+	value := float64(score)
+	switch {
+	case math.IsInf(value, 1):
+		return json.Marshal("inf")
+	case math.IsInf(value, -1):
+		return json.Marshal("-inf")
+	case math.IsNaN(value):
+		return json.Marshal("nan")
+	}
+	return json.Marshal(value)
+}
+
+func (score *jsonScore) UnmarshalJSON(data []byte) error {
+	var value float64
+	if err := json.Unmarshal(data, &value); err == nil {
+		*score = jsonScore(value)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("invalid score %s", data)
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("invalid score %q", text)
+	}
+	*score = jsonScore(value)
+	return nil
+}
+
+type jsonSortedSetMember struct {
+	Member jsonBytes `json:"member"`
+	Score  jsonScore `json:"score"`
+}
+
+type jsonHashField struct {
+	Field jsonBytes `json:"field"`
+	Value jsonBytes `json:"value"`
+}
+
+type jsonStream struct {
+	Entries        []jsonStreamEntry         `json:"entries"`
+	LastId         string                    `json:"last_id"`
+	FirstId        string                    `json:"first_id"`
+	MaxDeletedId   string                    `json:"max_deleted_id"`
+	EntriesAdded   uint64                    `json:"entries_added"`
+	ConsumerGroups []jsonStreamConsumerGroup `json:"groups"`
+}
+
+type jsonStreamEntry struct {
+	Id string `json:"id"`
+	// Field names and values, alternating
+	Fields []jsonBytes `json:"fields"`
+}
+
+type jsonStreamConsumerGroup struct {
+	Name            string                   `json:"name"`
+	LastDeliveredId string                   `json:"last_delivered_id"`
+	EntriesRead     int64                    `json:"entries_read"`
+	Pending         []jsonStreamPendingEntry `json:"pending"`
+	Consumers       []jsonStreamConsumer     `json:"consumers"`
+}
+
+type jsonStreamPendingEntry struct {
+	Id             string `json:"id"`
+	Consumer       string `json:"consumer"`
+	DeliveryTimeMs int64  `json:"delivery_time_ms"`
+	DeliveryCount  uint64 `json:"delivery_count"`
+}
+
+type jsonStreamConsumer struct {
+	Name         string   `json:"name"`
+	SeenTimeMs   int64    `json:"seen_time_ms"`
+	ActiveTimeMs int64    `json:"active_time_ms"`
+	Pending      []string `json:"pending"`
+}
+
+// ExportRDBJSONLines writes dump as JSON Lines: aux fields and functions first, then every key
+// sorted by database and name, so two exports can be diffed
+func ExportRDBJSONLines(writer io.Writer, dump *RdbDump) error {
+	bufferedWriter := bufio.NewWriter(writer)
+	encoder := json.NewEncoder(bufferedWriter)
+	encoder.SetEscapeHTML(false)
+	for _, auxKey := range sortedKeys(dump.AuxFields) {
+		auxValue, _ := json.Marshal(jsonBytes(dump.AuxFields[auxKey]))
+		if err := encoder.Encode(rdbJsonRecord{Aux: &auxKey, Value: auxValue}); err != nil {
+			return err
+		}
+	}
+	for _, function := range dump.Functions {
+		if err := encoder.Encode(rdbJsonRecord{Function: &function}); err != nil {
+			return err
+		}
+	}
+	dbIndexes := make([]int, 0, len(dump.Databases))
+	for dbIndex := range dump.Databases {
+		dbIndexes = append(dbIndexes, dbIndex)
+	}
+	sort.Ints(dbIndexes)
+	for _, dbIndex := range dbIndexes {
+		values := dump.Databases[dbIndex]
+		for _, key := range sortedKeys(values) {
+			record, err := newRdbJsonKeyRecord(dbIndex, key, values[key])
+			if err != nil {
+				return err
+			}
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+	}
+	return bufferedWriter.Flush()
+}
+
+func newRdbJsonKeyRecord(dbIndex int, key string, value Value) (*rdbJsonRecord, error) {
+	keyBytes := jsonBytes(key)
+	record := rdbJsonRecord{
+		Db:   &dbIndex,
+		Key:  &keyBytes,
+		Type: value.Type,
+	}
+	if value.ExpirationTime != nil {
+		expireAtMs := value.ExpirationTime.UnixMilli()
+		record.ExpireAtMs = &expireAtMs
+	}
+	var jsonValue interface{}
+	switch value.Type {
+	case constants.STRING_DATA_TYPE:
+		jsonValue = jsonBytes(value.Data)
+	case constants.LIST_DATA_TYPE:
+		list := make([]jsonBytes, len(value.List))
+		for i, element := range value.List {
+			list[i] = element
+		}
+		jsonValue = list
+	case constants.SET_DATA_TYPE:
+		set := make([]jsonBytes, 0, len(value.Set))
+		for _, member := range sortedKeys(value.Set) {
+			set = append(set, jsonBytes(member))
+		}
+		jsonValue = set
+	case constants.ZSET_DATA_TYPE:
+		members := make([]jsonSortedSetMember, 0, len(value.SortedSet))
+		for _, member := range sortedKeys(value.SortedSet) {
+			members = append(members, jsonSortedSetMember{Member: jsonBytes(member), Score: jsonScore(value.SortedSet[member])})
+		}
+		sort.SliceStable(members, func(i, j int) bool { return members[i].Score < members[j].Score })
+		jsonValue = members
+	case constants.HASH_DATA_TYPE:
+		fields := make([]jsonHashField, 0, len(value.Hash))
+		for _, field := range sortedKeys(value.Hash) {
+			fields = append(fields, jsonHashField{Field: jsonBytes(field), Value: value.Hash[field]})
+		}
+		jsonValue = fields
+	case constants.STREAM:
+		if value.Stream == nil {
+			return nil, fmt.Errorf("stream value for key '%s' has no stream", key)
+		}
+		jsonValue = newJsonStream(value.Stream)
+	default:
+		return nil, fmt.Errorf("can't export value of type '%s' for key '%s'", value.Type, key)
+	}
+	encodedValue, err := json.Marshal(jsonValue)
+	if err != nil {
+		return nil, err
+	}
+	record.Value = encodedValue
+	return &record, nil
+}
+
+func newJsonStream(stream *Stream) jsonStream {
+	exported := jsonStream{
+		Entries:        make([]jsonStreamEntry, 0, stream.Length),
+		LastId:         stream.LastId().String(),
+		FirstId:        stream.FirstId.String(),
+		MaxDeletedId:   stream.MaxDeletedId.String(),
+		EntriesAdded:   stream.EntriesAdded,
+		ConsumerGroups: make([]jsonStreamConsumerGroup, 0, len(stream.ConsumerGroups)),
+	}
+	for _, entry := range stream.Entries() {
+		fields := make([]jsonBytes, len(entry.FieldValuePairs))
+		for i, field := range entry.FieldValuePairs {
+			fields[i] = field
+		}
+		exported.Entries = append(exported.Entries, jsonStreamEntry{Id: entry.Id.String(), Fields: fields})
+	}
+	for _, groupName := range sortedKeys(stream.ConsumerGroups) {
+		group := stream.ConsumerGroups[groupName]
+		exportedGroup := jsonStreamConsumerGroup{
+			Name:            group.Name,
+			LastDeliveredId: group.LastDeliveredId.String(),
+			EntriesRead:     group.EntriesRead,
+			Pending:         make([]jsonStreamPendingEntry, 0, len(group.PendingEntries)),
+			Consumers:       make([]jsonStreamConsumer, 0, len(group.Consumers)),
+		}
+		for _, id := range sortedRecordIds(group.PendingEntries) {
+			pendingEntry := group.PendingEntries[id]
+			exportedGroup.Pending = append(exportedGroup.Pending, jsonStreamPendingEntry{
+				Id:             id.String(),
+				Consumer:       pendingEntry.Consumer,
+				DeliveryTimeMs: pendingEntry.DeliveryTime.UnixMilli(),
+				DeliveryCount:  pendingEntry.DeliveryCount,
+			})
+		}
+		for _, consumerName := range sortedKeys(group.Consumers) {
+			consumer := group.Consumers[consumerName]
+			pendingIds := make([]string, len(consumer.PendingIds))
+			for i, id := range consumer.PendingIds {
+				pendingIds[i] = id.String()
+			}
+			exportedGroup.Consumers = append(exportedGroup.Consumers, jsonStreamConsumer{
+				Name:         consumer.Name,
+				SeenTimeMs:   consumer.SeenTime.UnixMilli(),
+				ActiveTimeMs: consumer.ActiveTime.UnixMilli(),
+				Pending:      pendingIds,
+			})
+		}
+		exported.ConsumerGroups = append(exported.ConsumerGroups, exportedGroup)
+	}
+	return exported
+}
+
+// ImportRDBJSONLines reads an export written by ExportRDBJSONLines back into a dump
+func ImportRDBJSONLines(reader io.Reader) (*RdbDump, error) {
+	dump := RdbDump{
+		AuxFields: make(map[string]string),
+		Functions: make([]string, 0),
+		Databases: make(map[int]map[string]Value),
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), math.MaxInt32)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record rdbJsonRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		if err := dump.addJsonRecord(&record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &dump, nil
+}
+
+func (dump *RdbDump) addJsonRecord(record *rdbJsonRecord) error {
+	switch {
+	case record.Aux != nil:
+		var auxValue jsonBytes
+		if err := json.Unmarshal(record.Value, &auxValue); err != nil {
+			return fmt.Errorf("invalid value for aux field '%s': %v", *record.Aux, err)
+		}
+		dump.AuxFields[*record.Aux] = string(auxValue)
+		return nil
+	case record.Function != nil:
+		dump.Functions = append(dump.Functions, *record.Function)
+		return nil
+	case record.Key == nil:
+		return fmt.Errorf("record is neither an aux field, a function nor a key")
+	}
+	dbIndex := 0
+	if record.Db != nil {
+		dbIndex = *record.Db
+	}
+	if dbIndex < 0 {
+		return fmt.Errorf("invalid database index %d", dbIndex)
+	}
+	key := string(*record.Key)
+	value, err := parseJsonValue(key, record.Type, record.Value)
+	if err != nil {
+		return fmt.Errorf("key '%s': %v", key, err)
+	}
+	if record.ExpireAtMs != nil {
+		expirationTime := time.UnixMilli(*record.ExpireAtMs)
+		value.ExpirationTime = &expirationTime
+	}
+	if _, dbExists := dump.Databases[dbIndex]; !dbExists {
+		dump.Databases[dbIndex] = make(map[string]Value)
+	}
+	if _, keyExists := dump.Databases[dbIndex][key]; keyExists {
+		return fmt.Errorf("key '%s' appears more than once in database %d", key, dbIndex)
+	}
+	dump.Databases[dbIndex][key] = *value
+	return nil
+}
+
+func parseJsonValue(key string, valueType string, encodedValue json.RawMessage) (*Value, error) {
+	value := Value{Type: valueType}
+	switch valueType {
+	case constants.STRING_DATA_TYPE:
+		var data jsonBytes
+		if err := json.Unmarshal(encodedValue, &data); err != nil {
+			return nil, err
+		}
+		value.Data = data
+	case constants.LIST_DATA_TYPE:
+		var list []jsonBytes
+		if err := json.Unmarshal(encodedValue, &list); err != nil {
+			return nil, err
+		}
+		value.List = make([][]byte, len(list))
+		for i, element := range list {
+			value.List[i] = element
+		}
+	case constants.SET_DATA_TYPE:
+		var set []jsonBytes
+		if err := json.Unmarshal(encodedValue, &set); err != nil {
+			return nil, err
+		}
+		value.Set = make(map[string]struct{}, len(set))
+		for _, member := range set {
+			value.Set[string(member)] = struct{}{}
+		}
+	case constants.ZSET_DATA_TYPE:
+		var members []jsonSortedSetMember
+		if err := json.Unmarshal(encodedValue, &members); err != nil {
+			return nil, err
+		}
+		value.SortedSet = make(map[string]float64, len(members))
+		for _, member := range members {
+			value.SortedSet[string(member.Member)] = float64(member.Score)
+		}
+	case constants.HASH_DATA_TYPE:
+		var fields []jsonHashField
+		if err := json.Unmarshal(encodedValue, &fields); err != nil {
+			return nil, err
+		}
+		value.Hash = make(map[string][]byte, len(fields))
+		for _, field := range fields {
+			value.Hash[string(field.Field)] = field.Value
+		}
+	case constants.STREAM:
+		var exported jsonStream
+		if err := json.Unmarshal(encodedValue, &exported); err != nil {
+			return nil, err
+		}
+		stream, err := exported.toStream(key)
+		if err != nil {
+			return nil, err
+		}
+		value.Stream = stream
+	default:
+		return nil, fmt.Errorf("unsupported type '%s'", valueType)
+	}
+	return &value, nil
+}
+
+func (exported *jsonStream) toStream(streamName string) (*Stream, error) {
+	stream := NewStream(streamName)
+	previousId := RecordId{}
+	for i, entry := range exported.Entries {
+		id, err := parseRecordId(entry.Id)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && !isRecordIdGreater(id, previousId) {
+			return nil, fmt.Errorf("stream entry %s isn't greater than %s", entry.Id, previousId)
+		}
+		if len(entry.Fields) == 0 || len(entry.Fields)%2 != 0 {
+			return nil, fmt.Errorf("stream entry %s needs field and value pairs", entry.Id)
+		}
+		fieldValuePairs := make([][]byte, len(entry.Fields))
+		for j, field := range entry.Fields {
+			fieldValuePairs[j] = field
+		}
+		stream.insertEntry(id, fieldValuePairs)
+		previousId = id
+	}
+	firstId, err := parseRecordId(exported.FirstId)
+	if err != nil {
+		return nil, err
+	}
+	maxDeletedId, err := parseRecordId(exported.MaxDeletedId)
+	if err != nil {
+		return nil, err
+	}
+	stream.FirstId = firstId
+	stream.MaxDeletedId = maxDeletedId
+	lastId, err := parseRecordId(exported.LastId)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Length > 0 && isRecordIdGreater(previousId, lastId) {
+		return nil, fmt.Errorf("stream last id %s is smaller than its last entry %s", exported.LastId, previousId)
+	}
+	stream.setLastId(lastId)
+	stream.EntriesAdded = exported.EntriesAdded
+
+	for _, exportedGroup := range exported.ConsumerGroups {
+		group, err := exportedGroup.toConsumerGroup()
+		if err != nil {
+			return nil, fmt.Errorf("consumer group '%s': %v", exportedGroup.Name, err)
+		}
+		stream.ConsumerGroups[group.Name] = group
+	}
+	return stream, nil
+}
+
+func (exportedGroup *jsonStreamConsumerGroup) toConsumerGroup() (*StreamConsumerGroup, error) {
+	lastDeliveredId, err := parseRecordId(exportedGroup.LastDeliveredId)
+	if err != nil {
+		return nil, err
+	}
+	group := StreamConsumerGroup{
+		Name:            exportedGroup.Name,
+		LastDeliveredId: lastDeliveredId,
+		EntriesRead:     exportedGroup.EntriesRead,
+		PendingEntries:  make(map[RecordId]*StreamPendingEntry, len(exportedGroup.Pending)),
+		Consumers:       make(map[string]*StreamConsumer, len(exportedGroup.Consumers)),
+	}
+	for _, pending := range exportedGroup.Pending {
+		id, err := parseRecordId(pending.Id)
+		if err != nil {
+			return nil, err
+		}
+		group.PendingEntries[id] = &StreamPendingEntry{
+			DeliveryTime:  time.UnixMilli(pending.DeliveryTimeMs),
+			DeliveryCount: pending.DeliveryCount,
+			Consumer:      pending.Consumer,
+		}
+	}
+	for _, exportedConsumer := range exportedGroup.Consumers {
+		consumer := StreamConsumer{
+			Name:       exportedConsumer.Name,
+			SeenTime:   time.UnixMilli(exportedConsumer.SeenTimeMs),
+			ActiveTime: time.UnixMilli(exportedConsumer.ActiveTimeMs),
+			PendingIds: make([]RecordId, 0, len(exportedConsumer.Pending)),
+		}
+		for _, pendingId := range exportedConsumer.Pending {
+			id, err := parseRecordId(pendingId)
+			if err != nil {
+				return nil, err
+			}
+			if _, isPending := group.PendingEntries[id]; !isPending {
+				return nil, fmt.Errorf("consumer '%s' owns %s which isn't pending in the group", consumer.Name, pendingId)
+			}
+			consumer.PendingIds = append(consumer.PendingIds, id)
+		}
+		group.Consumers[consumer.Name] = &consumer
+	}
+	return &group, nil
+}
+
+func isRecordIdGreater(id RecordId, other RecordId) bool {
+	if id.Epoch != other.Epoch {
+		return id.Epoch > other.Epoch
+	}
+	return id.Count > other.Count
+}
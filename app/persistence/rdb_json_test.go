@@ -0,0 +1,93 @@
+package persistence
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+func TestRdbJsonLines_RoundTripThroughRdb(t *testing.T) {
+	expirationTime := time.UnixMilli(1700000000123)
+	stream := NewStream("events")
+	stream.Add("5-1", [][]byte{[]byte("f"), []byte("v")})
+	stream.Add("5-2", [][]byte{[]byte("f"), []byte("w")})
+	stream.ConsumerGroups["group"] = &StreamConsumerGroup{
+		Name:            "group",
+		LastDeliveredId: RecordId{Epoch: 5, Count: 2},
+		EntriesRead:     2,
+		PendingEntries: map[RecordId]*StreamPendingEntry{
+			{Epoch: 5, Count: 2}: {DeliveryTime: time.UnixMilli(1700000000000), DeliveryCount: 3, Consumer: "alice"},
+		},
+		Consumers: map[string]*StreamConsumer{
+			"alice": {Name: "alice", SeenTime: time.UnixMilli(1700000000001), ActiveTime: time.UnixMilli(1700000000002),
+				PendingIds: []RecordId{{Epoch: 5, Count: 2}}},
+		},
+	}
+	dump := &RdbDump{
+		AuxFields: map[string]string{"redis-ver": "7.2.0", "redis-bits": "64", "ctime": "1700000000"},
+		Functions: []string{"#!lua name=lib\nredis.register_function('f', function() return 1 end)"},
+		Databases: map[int]map[string]Value{
+			0: {
+				"binary":  {Type: constants.STRING_DATA_TYPE, Data: []byte{0xff, 0x00, 0xfe}, ExpirationTime: &expirationTime},
+				"list":    {Type: constants.LIST_DATA_TYPE, List: [][]byte{[]byte("b"), []byte("a")}},
+				"set":     {Type: constants.SET_DATA_TYPE, Set: map[string]struct{}{"x": {}, "\xc3\x28": {}}},
+				"zset":    {Type: constants.ZSET_DATA_TYPE, SortedSet: map[string]float64{"low": math.Inf(-1), "mid": 1.5, "high": math.Inf(1)}},
+				"hash":    {Type: constants.HASH_DATA_TYPE, Hash: map[string][]byte{"field": []byte("value")}},
+				"events":  {Type: constants.STREAM, Stream: stream},
+				"unicode": {Type: constants.STRING_DATA_TYPE, Data: []byte("héllo <&>")},
+			},
+			3: {"other": {Type: constants.STRING_DATA_TYPE, Data: []byte("db3")}},
+		},
+	}
+
+	var exported bytes.Buffer
+	if err := ExportRDBJSONLines(&exported, dump); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if !strings.Contains(exported.String(), `"value":{"base64":"/wD+"}`) || !strings.Contains(exported.String(), `"score":"-inf"`) {
+		t.Errorf("Expected binary values as base64 and infinite scores as strings, Got:\n%s", exported.String())
+	}
+	imported, err := ImportRDBJSONLines(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+
+	var rdbData bytes.Buffer
+	if err := WriteRDBDump(&rdbData, imported); err != nil {
+		t.Fatalf("Failed to write RDB: %v", err)
+	}
+	reloaded, err := ReadRDBDump(rdbData.Bytes(), LOG)
+	if err != nil {
+		t.Fatalf("Failed to read written RDB: %v", err)
+	}
+	var reexported bytes.Buffer
+	if err := ExportRDBJSONLines(&reexported, reloaded); err != nil {
+		t.Fatalf("Failed to export reloaded RDB: %v", err)
+	}
+	if exported.String() != reexported.String() {
+		t.Errorf("Export changed after a round trip through RDB.\nBefore:\n%s\nAfter:\n%s", exported.String(), reexported.String())
+	}
+	if !reflect.DeepEqual(reloaded.Functions, dump.Functions) {
+		t.Errorf("Expected functions %q, Got: %q", dump.Functions, reloaded.Functions)
+	}
+}
+
+func TestImportRDBJSONLines_RejectsInvalidRecords(t *testing.T) {
+	invalidExports := []string{
+		`{"db":0,"key":"k","type":"list","value":"not a list"}`,
+		`{"db":0,"key":"k","type":"unknown","value":"v"}`,
+		`{"type":"string","value":"no key"}`,
+		`{"db":0,"key":"k","type":"string","value":"a"}` + "\n" + `{"db":0,"key":"k","type":"string","value":"b"}`,
+		`{"db":0,"key":"s","type":"stream","value":{"entries":[{"id":"2-0","fields":["f","v"]},{"id":"1-0","fields":["f","v"]}],"last_id":"2-0","first_id":"1-0","max_deleted_id":"0-0"}}`,
+	}
+	for _, invalidExport := range invalidExports {
+		if _, err := ImportRDBJSONLines(strings.NewReader(invalidExport)); err == nil {
+			t.Errorf("Expected an error importing %s", invalidExport)
+		}
+	}
+}
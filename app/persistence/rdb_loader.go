@@ -2,23 +2,43 @@ package persistence
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"strconv"
 	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
 )
 
 var LOG *log.Logger
 
+// Every RDB file starts with this, followed by a 4 digit version
+const RDB_MAGIC_STRING = "REDIS"
+
 // OpCodes
 const (
-	AUX           = 0xFA
-	RESIZEDB      = 0xFB
-	EXPIRETIME_MS = 0xFC
-	EXPIRETIME    = 0xFD
-	SELECTDB      = 0xFE
-	EOF           = 0xFF
+	FUNCTION2       = 0xF5
+	FUNCTION_PRE_GA = 0xF6
+	MODULE_AUX      = 0xF7
+	IDLE            = 0xF8
+	FREQ            = 0xF9
+	AUX             = 0xFA
+	RESIZEDB        = 0xFB
+	EXPIRETIME_MS   = 0xFC
+	EXPIRETIME      = 0xFD
+	SELECTDB        = 0xFE
+	EOF             = 0xFF
+)
+
+const (
+	// Newest RDB format version this loader understands (Redis 7.x)
+	RDB_MAX_VERSION = 11
+	// Checksums were introduced in RDB version 5
+	RDB_CHECKSUM_MIN_VERSION = 5
 )
 
 type LengthEncodingType byte
@@ -31,6 +51,33 @@ const (
 	LENGTH_SPECIAL LengthEncodingType = 0x03
 
 	SIX_BIT_MASK = 0x3F
+
+	// Exact first bytes selecting a 32 or 64 bit big-endian length
+	LENGTH_32BIT_MARKER = 0x80
+	LENGTH_64BIT_MARKER = 0x81
+)
+
+// Quicklist 2 node containers
+const (
+	QUICKLIST_NODE_PLAIN  = 1
+	QUICKLIST_NODE_PACKED = 2
+)
+
+// Module value opcodes
+const (
+	MODULE_OPCODE_EOF    = 0
+	MODULE_OPCODE_SINT   = 1
+	MODULE_OPCODE_UINT   = 2
+	MODULE_OPCODE_FLOAT  = 3
+	MODULE_OPCODE_DOUBLE = 4
+	MODULE_OPCODE_STRING = 5
+)
+
+// Special lengths used by the legacy ZSET score encoding
+const (
+	DOUBLE_NAN     = 253
+	DOUBLE_POS_INF = 254
+	DOUBLE_NEG_INF = 255
 )
 
 // Size encoding types
@@ -38,6 +85,7 @@ const (
 	INT_8BIT  = 0
 	INT_16BIT = 1
 	INT_32BIT = 2
+	LZF       = 3
 )
 
 type LengthEncodingResponse struct {
@@ -54,6 +102,15 @@ type IndexedDb struct {
 type LoadRDBResponse struct {
 	arbitraryMetaData map[string]string
 	dbs               map[int]*IndexedDb
+	functions         []string
+	rdbVersion        int
+}
+
+func newIndexedDb() *IndexedDb {
+	return &IndexedDb{
+		expirableData:    make(map[string]Value, 0),
+		nonExpirableData: make(map[string]Value, 0),
+	}
 }
 
 func (rdb *LoadRDBResponse) AddDb(databaseIndex int, db *IndexedDb) {
@@ -61,9 +118,22 @@ func (rdb *LoadRDBResponse) AddDb(databaseIndex int, db *IndexedDb) {
 	rdb.dbs[databaseIndex] = db
 }
 
+func (rdb *LoadRDBResponse) getOrCreateDb(databaseIndex int) *IndexedDb {
+	if db, dbExists := rdb.dbs[databaseIndex]; dbExists {
+		return db
+	}
+	db := newIndexedDb()
+	rdb.AddDb(databaseIndex, db)
+	return db
+}
+
 func readNextNBytes(reader *bytes.Reader, n int) ([]byte, error) {
+	if n < 0 || n > reader.Len() {
+		LOG.Printf("Error while trying to read next %d bytes: only %d bytes left", n, reader.Len())
+		return nil, io.ErrUnexpectedEOF
+	}
 	nextBytes := make([]byte, n)
-	_, err := reader.Read(nextBytes)
+	_, err := io.ReadFull(reader, nextBytes)
 	if err != nil {
 		LOG.Printf("Error while trying to read next %d bytes: %v", n, err.Error())
 		return nil, err
@@ -118,15 +188,30 @@ func readLengthEncoding(reader *bytes.Reader) (*LengthEncodingResponse, error) {
 		LOG.Printf("Read 14 bit length encoding. Length: %d", length)
 		return &lengthEncodingResponse, nil
 	case LENGTH_32BIT:
-		LOG.Printf("Length encoding type: LENGTH_32BIT")
-		lengthBytes, err := readNextNBytes(reader, 4)
-		if err != nil {
-			return nil, err
+		switch lengthEncodingByte {
+		case LENGTH_32BIT_MARKER:
+			LOG.Printf("Length encoding type: LENGTH_32BIT")
+			lengthBytes, err := readNextNBytes(reader, 4)
+			if err != nil {
+				return nil, err
+			}
+			length := uint64(binary.BigEndian.Uint32(lengthBytes))
+			lengthEncodingResponse.ReturnValue = length
+			LOG.Printf("Read 32 bit length encoding. Length: %d", length)
+			return &lengthEncodingResponse, nil
+		case LENGTH_64BIT_MARKER:
+			LOG.Printf("Length encoding type: LENGTH_64BIT")
+			lengthBytes, err := readNextNBytes(reader, 8)
+			if err != nil {
+				return nil, err
+			}
+			length := binary.BigEndian.Uint64(lengthBytes)
+			lengthEncodingResponse.ReturnValue = length
+			LOG.Printf("Read 64 bit length encoding. Length: %d", length)
+			return &lengthEncodingResponse, nil
+		default:
+			return nil, fmt.Errorf("invalid length encoding byte: %X", lengthEncodingByte)
 		}
-		length := (uint64(lengthBytes[0]) << 24) | (uint64(lengthBytes[1]) << 16) | (uint64(lengthBytes[2]) << 8) | uint64(lengthBytes[3])
-		lengthEncodingResponse.ReturnValue = length
-		LOG.Printf("Read 32 bit length encoding. Length: %d", length)
-		return &lengthEncodingResponse, nil
 	case LENGTH_SPECIAL:
 		LOG.Printf("Length encoding type: LENGTH_SPECIAL")
 		length := uint64(lengthEncodingByte & SIX_BIT_MASK)
@@ -153,14 +238,14 @@ func readStringEncoding(reader *bytes.Reader) (string, error) {
 				LOG.Printf("error while trying to read 8 bit int encoded as string: %v", err.Error())
 				return "", err
 			}
-			return strconv.FormatInt(int64(intByte), 10), nil
+			return strconv.FormatInt(int64(int8(intByte)), 10), nil
 		case INT_16BIT:
 			lengthBytes, err := readNextNBytes(reader, 2)
 			if err != nil {
 				LOG.Printf("Error while trying to read 16 bit int encoded as string: %v", err.Error())
 				return "", err
 			}
-			val := getLittleEndian(lengthBytes)
+			val := int16(getLittleEndian(lengthBytes))
 			return strconv.FormatInt(int64(val), 10), nil
 		case INT_32BIT:
 			lengthBytes, err := readNextNBytes(reader, 4)
@@ -168,12 +253,17 @@ func readStringEncoding(reader *bytes.Reader) (string, error) {
 				LOG.Printf("Error while trying to read 32 bit int encoded as string: %v", err.Error())
 				return "", err
 			}
-			val := getLittleEndian(lengthBytes)
+			val := int32(getLittleEndian(lengthBytes))
 			return strconv.FormatInt(int64(val), 10), nil
+		case LZF:
+			return readLzfString(reader)
 		default:
-			return "", fmt.Errorf("unsupported string encoding type")
+			return "", fmt.Errorf("unsupported string encoding type: %d", lengthEncodingResponseValue)
 		}
 	}
+	if lengthEncodingResponseValue > uint64(reader.Len()) {
+		return "", fmt.Errorf("string length %d exceeds the %d bytes left in the RDB", lengthEncodingResponseValue, reader.Len())
+	}
 	stringBytes, err := readNextNBytes(reader, int(lengthEncodingResponseValue))
 	if err != nil {
 		LOG.Printf("Error while trying to read encoded string: %v", err.Error())
@@ -182,6 +272,35 @@ func readStringEncoding(reader *bytes.Reader) (string, error) {
 	return string(stringBytes), nil
 }
 
+func readLzfString(reader *bytes.Reader) (string, error) {
+	compressedLength, err := readLength(reader)
+	if err != nil {
+		return "", err
+	}
+	uncompressedLength, err := readLength(reader)
+	if err != nil {
+		return "", err
+	}
+	if compressedLength > uint64(reader.Len()) {
+		return "", fmt.Errorf("compressed string length %d exceeds the %d bytes left in the RDB", compressedLength, reader.Len())
+	}
+	// LZF expands data at most LZF_MAX_EXPANSION times, anything beyond is a corrupt length
+	if uncompressedLength > compressedLength*LZF_MAX_EXPANSION {
+		return "", fmt.Errorf("compressed string of %d bytes can't expand to %d bytes", compressedLength, uncompressedLength)
+	}
+	compressedBytes, err := readNextNBytes(reader, int(compressedLength))
+	if err != nil {
+		LOG.Printf("Error while trying to read LZF compressed string: %v", err.Error())
+		return "", err
+	}
+	decompressedBytes, err := lzfDecompress(compressedBytes, int(uncompressedLength))
+	if err != nil {
+		LOG.Printf("Error while trying to decompress LZF string: %v", err.Error())
+		return "", err
+	}
+	return string(decompressedBytes), nil
+}
+
 func readStringEncodingKeyValuePair(reader *bytes.Reader) ([]byte, error) {
 	value, err := readStringEncoding(reader)
 	if err != nil {
@@ -191,18 +310,348 @@ func readStringEncodingKeyValuePair(reader *bytes.Reader) ([]byte, error) {
 	return []byte(value), nil
 }
 
-func readKeyValuePair(reader *bytes.Reader, valueType ValueType) (string, []byte, error) {
+func readKeyValuePair(reader *bytes.Reader, valueType ValueType) (string, *Value, error) {
 	key, err := readStringEncoding(reader)
 	if err != nil {
 		LOG.Printf("Error while trying to read string-encoded key: %v", err.Error())
 		return "", nil, err
 	}
+	value, err := readValue(reader, valueType)
+	if err != nil {
+		LOG.Printf("Error while trying to read value of type %X for key '%s': %v", valueType, key, err.Error())
+		return "", nil, err
+	}
+	return key, value, nil
+}
+
+func readValue(reader *bytes.Reader, valueType ValueType) (*Value, error) {
+	value := Value{
+		Type: valueType.String(),
+	}
+	var err error
 	switch valueType {
 	case STRING:
-		value, err := readStringEncodingKeyValuePair(reader)
-		return key, value, err
+		value.Data, err = readStringEncodingKeyValuePair(reader)
+	case LIST, LIST_ZIPLIST, LIST_QUICKLIST, LIST_QUICKLIST_2:
+		value.List, err = readListValue(reader, valueType)
+	case SET, SET_INTSET, SET_LISTPACK:
+		value.Set, err = readSetValue(reader, valueType)
+	case ZSET, ZSET_2, ZSET_ZIPLIST, ZSET_LISTPACK:
+		value.SortedSet, err = readSortedSetValue(reader, valueType)
+	case HASH, ZIPMAP, HASH_ZIPLIST, HASH_LISTPACK:
+		value.Hash, err = readHashValue(reader, valueType)
+	case STREAM_LISTPACKS, STREAM_LISTPACKS_2, STREAM_LISTPACKS_3:
+		value.Stream, err = readStreamValue(reader, valueType)
+	case MODULE_2:
+		err = skipModuleValue(reader)
+	default:
+		err = fmt.Errorf("unsupported value type: %d", valueType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func readLength(reader *bytes.Reader) (uint64, error) {
+	lengthEncodingResponse, err := readLengthEncoding(reader)
+	if err != nil {
+		return 0, err
+	}
+	if lengthEncodingResponse.LengthEncodingType == LENGTH_SPECIAL {
+		return 0, fmt.Errorf("expected a length but found special encoding %d", lengthEncodingResponse.ReturnValue)
+	}
+	return lengthEncodingResponse.ReturnValue, nil
+}
+
+// readElementCount reads a collection length, refusing counts that can't possibly fit in
+// what is left of the file so a corrupt length doesn't turn into a huge allocation
+func readElementCount(reader *bytes.Reader) (int, error) {
+	count, err := readLength(reader)
+	if err != nil {
+		return 0, err
+	}
+	if count > uint64(reader.Len()) {
+		return 0, fmt.Errorf("element count %d exceeds the %d bytes left in the RDB", count, reader.Len())
+	}
+	return int(count), nil
+}
+
+func readStringList(reader *bytes.Reader, count int) ([][]byte, error) {
+	elements := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		element, err := readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = element
+	}
+	return elements, nil
+}
+
+func readListValue(reader *bytes.Reader, valueType ValueType) ([][]byte, error) {
+	switch valueType {
+	case LIST:
+		count, err := readElementCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		return readStringList(reader, count)
+	case LIST_ZIPLIST:
+		ziplist, err := readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decodeZiplist(ziplist)
+	case LIST_QUICKLIST:
+		nodeCount, err := readElementCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		elements := make([][]byte, 0)
+		for i := 0; i < nodeCount; i++ {
+			ziplist, err := readStringEncodingKeyValuePair(reader)
+			if err != nil {
+				return nil, err
+			}
+			nodeElements, err := decodeZiplist(ziplist)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, nodeElements...)
+		}
+		return elements, nil
+	case LIST_QUICKLIST_2:
+		nodeCount, err := readElementCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		elements := make([][]byte, 0)
+		for i := 0; i < nodeCount; i++ {
+			container, err := readLength(reader)
+			if err != nil {
+				return nil, err
+			}
+			nodeData, err := readStringEncodingKeyValuePair(reader)
+			if err != nil {
+				return nil, err
+			}
+			switch container {
+			case QUICKLIST_NODE_PLAIN:
+				elements = append(elements, nodeData)
+			case QUICKLIST_NODE_PACKED:
+				nodeElements, err := decodeListpack(nodeData)
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, nodeElements...)
+			default:
+				return nil, fmt.Errorf("invalid quicklist node container: %d", container)
+			}
+		}
+		return elements, nil
+	default:
+		return nil, fmt.Errorf("value type %X is not a list", valueType)
+	}
+}
+
+func readSetValue(reader *bytes.Reader, valueType ValueType) (map[string]struct{}, error) {
+	var members [][]byte
+	var err error
+	switch valueType {
+	case SET:
+		var count int
+		count, err = readElementCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		members, err = readStringList(reader, count)
+	case SET_INTSET:
+		var intset []byte
+		intset, err = readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		members, err = decodeIntset(intset)
+	case SET_LISTPACK:
+		var listpack []byte
+		listpack, err = readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		members, err = decodeListpack(listpack)
+	default:
+		return nil, fmt.Errorf("value type %X is not a set", valueType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		set[string(member)] = struct{}{}
+	}
+	return set, nil
+}
+
+func readSortedSetValue(reader *bytes.Reader, valueType ValueType) (map[string]float64, error) {
+	switch valueType {
+	case ZSET, ZSET_2:
+		count, err := readElementCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		sortedSet := make(map[string]float64, count)
+		for i := 0; i < count; i++ {
+			member, err := readStringEncoding(reader)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if valueType == ZSET_2 {
+				score, err = readBinaryDouble(reader)
+			} else {
+				score, err = readLegacyDouble(reader)
+			}
+			if err != nil {
+				return nil, err
+			}
+			sortedSet[member] = score
+		}
+		return sortedSet, nil
+	case ZSET_ZIPLIST, ZSET_LISTPACK:
+		blob, err := readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		var entries [][]byte
+		if valueType == ZSET_ZIPLIST {
+			entries, err = decodeZiplist(blob)
+		} else {
+			entries, err = decodeListpack(blob)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(entries)%2 != 0 {
+			return nil, fmt.Errorf("sorted set blob has an odd number of entries: %d", len(entries))
+		}
+		sortedSet := make(map[string]float64, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			score, err := strconv.ParseFloat(string(entries[i+1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sorted set score %q: %v", entries[i+1], err)
+			}
+			sortedSet[string(entries[i])] = score
+		}
+		return sortedSet, nil
 	default:
-		return "", nil, fmt.Errorf("unsupported value type: %d", valueType)
+		return nil, fmt.Errorf("value type %X is not a sorted set", valueType)
+	}
+}
+
+func readBinaryDouble(reader *bytes.Reader) (float64, error) {
+	doubleBytes, err := readNextNBytes(reader, 8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(doubleBytes)), nil
+}
+
+func readLegacyDouble(reader *bytes.Reader) (float64, error) {
+	length, err := readNextByte(reader)
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case DOUBLE_NAN:
+		return math.NaN(), nil
+	case DOUBLE_POS_INF:
+		return math.Inf(1), nil
+	case DOUBLE_NEG_INF:
+		return math.Inf(-1), nil
+	}
+	doubleBytes, err := readNextNBytes(reader, int(length))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(doubleBytes), 64)
+}
+
+func readHashValue(reader *bytes.Reader, valueType ValueType) (map[string][]byte, error) {
+	var entries [][]byte
+	var err error
+	switch valueType {
+	case HASH:
+		var count int
+		count, err = readElementCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		entries, err = readStringList(reader, 2*count)
+	case ZIPMAP, HASH_ZIPLIST, HASH_LISTPACK:
+		var blob []byte
+		blob, err = readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case ZIPMAP:
+			entries, err = decodeZipmap(blob)
+		case HASH_ZIPLIST:
+			entries, err = decodeZiplist(blob)
+		default:
+			entries, err = decodeListpack(blob)
+		}
+	default:
+		return nil, fmt.Errorf("value type %X is not a hash", valueType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entries)%2 != 0 {
+		return nil, fmt.Errorf("hash has an odd number of entries: %d", len(entries))
+	}
+	hash := make(map[string][]byte, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		hash[string(entries[i])] = entries[i+1]
+	}
+	return hash, nil
+}
+
+// skipModuleValue consumes a module value serialized with the self-describing MODULE_2 format.
+// Gedis has no modules to hand the value to, so the data is dropped
+func skipModuleValue(reader *bytes.Reader) error {
+	moduleId, err := readLength(reader)
+	if err != nil {
+		return err
+	}
+	LOG.Printf("Skipping value of module with id: %d", moduleId)
+	return skipModuleOpcodes(reader)
+}
+
+func skipModuleOpcodes(reader *bytes.Reader) error {
+	for {
+		opcode, err := readLength(reader)
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case MODULE_OPCODE_EOF:
+			return nil
+		case MODULE_OPCODE_SINT, MODULE_OPCODE_UINT:
+			_, err = readLength(reader)
+		case MODULE_OPCODE_FLOAT:
+			_, err = readNextNBytes(reader, 4)
+		case MODULE_OPCODE_DOUBLE:
+			_, err = readNextNBytes(reader, 8)
+		case MODULE_OPCODE_STRING:
+			_, err = readStringEncoding(reader)
+		default:
+			return fmt.Errorf("unknown module opcode: %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
@@ -214,14 +663,26 @@ func readTableSize(reader *bytes.Reader) (int, error) {
 	return int(tableSize.ReturnValue), nil
 }
 
-func validateChecksum(reader *bytes.Reader) bool {
+// validateChecksum compares the CRC64 stored after the EOF opcode with one computed over
+// everything before it. A zero checksum means the file was saved with rdbchecksum disabled
+func validateChecksum(reader *bytes.Reader, data []byte) error {
+	checksummedLength := len(data) - reader.Len()
 	checksumBytes, err := readNextNBytes(reader, 8)
 	if err != nil {
 		LOG.Printf("Error while trying to read checksum: %v", err.Error())
-		return false
+		return fmt.Errorf("RDB is missing its checksum: %v", err)
+	}
+	storedChecksum := binary.LittleEndian.Uint64(checksumBytes)
+	LOG.Printf("Checksum: %X", storedChecksum)
+	if storedChecksum == 0 {
+		LOG.Printf("RDB was saved without a checksum, skipping verification")
+		return nil
+	}
+	computedChecksum := crc64Jones(0, data[:checksummedLength])
+	if computedChecksum != storedChecksum {
+		return fmt.Errorf("RDB checksum mismatch: file has %016X but contents hash to %016X, the file is corrupted", storedChecksum, computedChecksum)
 	}
-	LOG.Printf("Checksum: %v", checksumBytes)
-	return true
+	return nil
 }
 
 func readDatabaseIndex(reader *bytes.Reader) (int, error) {
@@ -233,153 +694,194 @@ func readDatabaseIndex(reader *bytes.Reader) (int, error) {
 }
 
 func validateMetaData(reader *bytes.Reader) (string, string, bool) {
-	metaDataKey, metaDataValueBytes, err := readKeyValuePair(reader, STRING)
+	metaDataKey, err := readStringEncoding(reader)
 	if err != nil {
-		LOG.Printf("Error while trying to read metadata key-value pair: %v", err.Error())
+		LOG.Printf("Error while trying to read metadata key: %v", err.Error())
+		return "", "", false
+	}
+	metaDataValue, err := readStringEncoding(reader)
+	if err != nil {
+		LOG.Printf("Error while trying to read metadata value: %v", err.Error())
 		return "", "", false
 	}
-	metaDataValue := string(metaDataValueBytes)
 	LOG.Printf("Metadata key: %s, Metadata value: %s", metaDataKey, metaDataValue)
 	// TODO: Validate metadata
 	return metaDataKey, metaDataValue, true
 }
 
-func validateHeaderSection(reader *bytes.Reader) bool {
+func skipModuleAux(reader *bytes.Reader) error {
+	moduleId, err := readLength(reader)
+	if err != nil {
+		return err
+	}
+	whenOpcode, err := readLength(reader)
+	if err != nil {
+		return err
+	}
+	if whenOpcode != MODULE_OPCODE_UINT {
+		return fmt.Errorf("invalid module aux 'when' opcode: %d", whenOpcode)
+	}
+	if _, err := readLength(reader); err != nil {
+		return err
+	}
+	LOG.Printf("Skipping aux data of module with id: %d", moduleId)
+	return skipModuleOpcodes(reader)
+}
+
+func readFunction(reader *bytes.Reader, opcode byte) (string, error) {
+	if opcode == FUNCTION2 {
+		return readStringEncoding(reader)
+	}
+	// Functions saved by Redis 7.0 release candidates: name, engine, optional description, code
+	if _, err := readStringEncoding(reader); err != nil {
+		return "", err
+	}
+	if _, err := readStringEncoding(reader); err != nil {
+		return "", err
+	}
+	hasDescription, err := readLength(reader)
+	if err != nil {
+		return "", err
+	}
+	if hasDescription != 0 {
+		if _, err := readStringEncoding(reader); err != nil {
+			return "", err
+		}
+	}
+	return readStringEncoding(reader)
+}
+
+func validateHeaderSection(reader *bytes.Reader) (int, bool) {
 	magicStringBytes, err := readNextNBytes(reader, 5)
 	if err != nil {
 		LOG.Printf("Error while trying to read magic string: %v", err.Error())
-		return false
+		return 0, false
 	}
 	magicString := string(magicStringBytes)
-	if magicString != "REDIS" {
+	if magicString != RDB_MAGIC_STRING {
 		LOG.Printf("Invalid magic string: %s", magicString)
-		return false
+		return 0, false
 	}
 	LOG.Printf("Magic string: %s", magicString)
 	rdbVersionNumber, err := readNextNBytes(reader, 4)
 	if err != nil {
 		LOG.Printf("Error while trying to read RDB version number: %v", err.Error())
-		return false
+		return 0, false
 	}
-	rdbVersion := string(rdbVersionNumber)
-	LOG.Printf("RDB version: %s", rdbVersion)
-	return true
+	rdbVersion, err := strconv.Atoi(string(rdbVersionNumber))
+	if err != nil {
+		LOG.Printf("Invalid RDB version number %q: %v", rdbVersionNumber, err.Error())
+		return 0, false
+	}
+	if rdbVersion < 1 || rdbVersion > RDB_MAX_VERSION {
+		LOG.Printf("Unsupported RDB version: %d (supported up to %d)", rdbVersion, RDB_MAX_VERSION)
+		return 0, false
+	}
+	LOG.Printf("RDB version: %d", rdbVersion)
+	return rdbVersion, true
 }
 
-func loadDatabase(reader *bytes.Reader) (*IndexedDb, error) {
-	indexedDb := IndexedDb{
-		expirableData:    make(map[string]Value, 0),
-		nonExpirableData: make(map[string]Value, 0),
-	}
-	continueLoading := true
-	for continueLoading {
+func loadDatabase(reader *bytes.Reader, indexedDb *IndexedDb, keepExpiredKeys bool) error {
+	var pendingExpiryTime *time.Time
+	for {
 		opcode, err := readNextByte(reader)
 		LOG.Printf("Load Database Opcode: %X", opcode)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		switch opcode {
 		case RESIZEDB:
 			// Database size information
 			hashTableSize, err := readTableSize(reader)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			LOG.Printf("Hash table size: %d", hashTableSize)
-			indexedDb.expirableData = make(map[string]Value, hashTableSize)
 			expireHashTableSize, err := readTableSize(reader)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			LOG.Printf("Expire hash table size: %d", expireHashTableSize)
-			indexedDb.nonExpirableData = make(map[string]Value, expireHashTableSize)
+			if hashTableSize <= reader.Len() {
+				indexedDb.nonExpirableData = make(map[string]Value, hashTableSize)
+			}
+			if expireHashTableSize <= reader.Len() {
+				indexedDb.expirableData = make(map[string]Value, expireHashTableSize)
+			}
 		case EXPIRETIME_MS:
 			encodedExpiryTimeInMs, err := readNextNBytes(reader, 8)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			expiryTimeInMs := getLittleEndian(encodedExpiryTimeInMs)
 			LOG.Printf("Expiry time in milliseconds: %d", expiryTimeInMs)
-			nextByte, err := readNextByte(reader)
-			if err != nil {
-				return nil, err
-			}
-
-			valueType := ValueType(nextByte)
-			LOG.Printf("[EXPIRABLE] Value type: %X", valueType)
-			key, val, err := readKeyValuePair(reader, valueType)
-			if err != nil {
-				LOG.Printf("Error while trying to read key-value pair: %v", err.Error())
-				return nil, err
-			}
-			LOG.Printf("[EXPIRABLE] Key: %s, Value: %q", key, val)
 			// expiration time is the epoch timestamp in milliseconds
 			// Convert epoch timestamp to time.Time object
 			expiryTime := time.Unix(0, int64(expiryTimeInMs)*int64(time.Millisecond))
-			if time.Now().After(expiryTime) {
-				LOG.Printf("Key: %s has expired, not adding to database", key)
-				continue
-			}
-			indexedDb.expirableData[key] = Value{
-				Data:           val,
-				Type:           valueType.String(),
-				ExpirationTime: &expiryTime,
-			}
-
+			pendingExpiryTime = &expiryTime
 		case EXPIRETIME:
 			encodedExpiryTimeInSeconds, err := readNextNBytes(reader, 4)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			expiryTimeInSeconds := getLittleEndian(encodedExpiryTimeInSeconds)
 			LOG.Printf("Expiry time in seconds: %d", expiryTimeInSeconds)
-			nextByte, err := readNextByte(reader)
-			if err != nil {
-				return nil, err
-			}
-			valueType := ValueType(nextByte)
-			LOG.Printf("[EXPIRABLE] Value type: %X", valueType)
-			key, val, err := readKeyValuePair(reader, valueType)
-			if err != nil {
-				return nil, err
-			}
-			LOG.Printf("[EXPIRABLE] Key: %s, Value: %q", key, val)
-			// expiration time is the epoch timestamp in milliseconds
-			// Convert epoch timestamp to time.Time object
 			expiryTime := time.Unix(int64(expiryTimeInSeconds), 0)
-			if time.Now().After(expiryTime) {
-				LOG.Printf("Key: %s has expired, not adding to database", key)
-				continue
+			pendingExpiryTime = &expiryTime
+		case IDLE:
+			// LRU idle time of the next key, gedis doesn't evict so it is dropped
+			if _, err := readLength(reader); err != nil {
+				return err
 			}
-			indexedDb.expirableData[key] = Value{
-				Data:           val,
-				Type:           valueType.String(),
-				ExpirationTime: &expiryTime,
+		case FREQ:
+			// LFU access frequency of the next key, gedis doesn't evict so it is dropped
+			if _, err := readNextByte(reader); err != nil {
+				return err
 			}
-		case EOF, SELECTDB:
-			continueLoading = false
+		case EOF, SELECTDB, AUX, MODULE_AUX, FUNCTION2, FUNCTION_PRE_GA:
+			// Not part of this database, leave it for the caller
+			return reader.UnreadByte()
 		default:
 			// Read key value pair
 			valueType := ValueType(opcode)
 			key, val, err := readKeyValuePair(reader, valueType)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			LOG.Printf("Key: %s, Value: %q", key, val)
-			indexedDb.nonExpirableData[key] = Value{
-				Data:           val,
-				Type:           valueType.String(),
-				ExpirationTime: nil,
+			expiryTime := pendingExpiryTime
+			pendingExpiryTime = nil
+			if val.Type == constants.MODULE_DATA_TYPE {
+				LOG.Printf("Key: %s holds a module value, not adding to database", key)
+				continue
+			}
+			if val.Stream != nil {
+				val.Stream.StreamName = key
+			}
+			if expiryTime == nil {
+				LOG.Printf("Key: %s, Type: %s", key, val.Type)
+				indexedDb.nonExpirableData[key] = *val
+				continue
+			}
+			LOG.Printf("[EXPIRABLE] Key: %s, Type: %s", key, val.Type)
+			if !keepExpiredKeys && time.Now().After(*expiryTime) {
+				LOG.Printf("Key: %s has expired, not adding to database", key)
+				continue
 			}
+			val.ExpirationTime = expiryTime
+			indexedDb.expirableData[key] = *val
 		}
 	}
-	return &indexedDb, nil
 }
 
 func parseRdb(data []byte) (*LoadRDBResponse, error) {
+	return parseRdbData(data, false)
+}
+
+// parseRdbData reads a complete RDB. Keys which already expired are dropped unless keepExpiredKeys is set
+func parseRdbData(data []byte, keepExpiredKeys bool) (*LoadRDBResponse, error) {
 	// Parse data and load into memory
 	reader := bytes.NewReader(data)
-	hasValidHeader := validateHeaderSection(reader)
+	rdbVersion, hasValidHeader := validateHeaderSection(reader)
 
 	if !hasValidHeader {
 		return nil, fmt.Errorf("invalid RDB file header")
@@ -388,13 +890,14 @@ func parseRdb(data []byte) (*LoadRDBResponse, error) {
 	loadedRDB := LoadRDBResponse{
 		arbitraryMetaData: make(map[string]string),
 		dbs:               make(map[int]*IndexedDb),
+		functions:         make([]string, 0),
+		rdbVersion:        rdbVersion,
 	}
-	continueParsing := true
-	for continueParsing {
+	for {
 		opcode, err := readNextByte(reader)
 		LOG.Printf("Parse RDB Opcode: %X", opcode)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("RDB ended before the EOF opcode: %v", err)
 		}
 		switch opcode {
 		case AUX:
@@ -404,6 +907,17 @@ func parseRdb(data []byte) (*LoadRDBResponse, error) {
 				return nil, fmt.Errorf("invalid metadata")
 			}
 			loadedRDB.arbitraryMetaData[metaDataKey] = metaDataVal
+		case MODULE_AUX:
+			err := skipModuleAux(reader)
+			if err != nil {
+				return nil, err
+			}
+		case FUNCTION2, FUNCTION_PRE_GA:
+			function, err := readFunction(reader, opcode)
+			if err != nil {
+				return nil, err
+			}
+			loadedRDB.functions = append(loadedRDB.functions, function)
 		case SELECTDB:
 			// Database index section
 			databaseIndex, err := readDatabaseIndex(reader)
@@ -411,22 +925,28 @@ func parseRdb(data []byte) (*LoadRDBResponse, error) {
 				return nil, err
 			}
 			LOG.Printf("Reading database index: %d", databaseIndex)
-			loadedDatabase, err := loadDatabase(reader)
+			err = loadDatabase(reader, loadedRDB.getOrCreateDb(databaseIndex), keepExpiredKeys)
 			if err != nil {
 				return nil, err
 			}
-			loadedRDB.AddDb(databaseIndex, loadedDatabase)
-			// Move reader 2 places back so that the next opcode can be read
-			reader.Seek(-2, 1)
 		case EOF:
-			validChecksum := validateChecksum(reader)
-			if !validChecksum {
-				return nil, fmt.Errorf("invalid checksum")
+			if rdbVersion < RDB_CHECKSUM_MIN_VERSION {
+				return &loadedRDB, nil
+			}
+			err := validateChecksum(reader, data)
+			if err != nil {
+				return nil, err
+			}
+			return &loadedRDB, nil
+		default:
+			// Keys that aren't preceded by a SELECTDB belong to database 0
+			reader.UnreadByte()
+			err := loadDatabase(reader, loadedRDB.getOrCreateDb(0), keepExpiredKeys)
+			if err != nil {
+				return nil, err
 			}
-			continueParsing = false
 		}
 	}
-	return &loadedRDB, nil
 }
 
 func LoadRDB(filePath string, logger *log.Logger) (*LoadRDBResponse, error) {
@@ -449,3 +969,44 @@ func LoadRDB(filePath string, logger *log.Logger) (*LoadRDBResponse, error) {
 
 	return parseRdb(data)
 }
+
+// ValidateRDBData checks that data is a complete RDB which loads without errors
+func ValidateRDBData(data []byte, logger *log.Logger) error {
+	LOG = logger
+	_, err := parseRdb(data)
+	return err
+}
+
+// RdbDump is everything an RDB file holds, including the keys which have already expired
+type RdbDump struct {
+	Version   int
+	AuxFields map[string]string
+	Functions []string
+	Databases map[int]map[string]Value
+}
+
+// ReadRDBDump parses an RDB for inspection rather than loading it into the server
+func ReadRDBDump(data []byte, logger *log.Logger) (*RdbDump, error) {
+	LOG = logger
+	loadedRdb, err := parseRdbData(data, true)
+	if err != nil {
+		return nil, err
+	}
+	dump := RdbDump{
+		Version:   loadedRdb.rdbVersion,
+		AuxFields: loadedRdb.arbitraryMetaData,
+		Functions: loadedRdb.functions,
+		Databases: make(map[int]map[string]Value),
+	}
+	for dbIndex, indexedDb := range loadedRdb.dbs {
+		values := make(map[string]Value, len(indexedDb.nonExpirableData)+len(indexedDb.expirableData))
+		for key, value := range indexedDb.nonExpirableData {
+			values[key] = value
+		}
+		for key, value := range indexedDb.expirableData {
+			values[key] = value
+		}
+		dump.Databases[dbIndex] = values
+	}
+	return &dump, nil
+}
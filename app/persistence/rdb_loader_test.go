@@ -0,0 +1,297 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	LOG = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// Fixture builders, written straight from the RDB format description
+
+func rdbLength(n int) []byte {
+	switch {
+	case n < 1<<6:
+		return []byte{byte(n)}
+	case n < 1<<14:
+		return []byte{byte(n>>8) | 0x40, byte(n)}
+	default:
+		lengthBytes := []byte{LENGTH_32BIT_MARKER, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(lengthBytes[1:], uint32(n))
+		return lengthBytes
+	}
+}
+
+func rdbString(s []byte) []byte {
+	return append(rdbLength(len(s)), s...)
+}
+
+func listpackBlob(entries ...[]byte) []byte {
+	body := []byte{}
+	for _, entry := range entries {
+		var encoded []byte
+		if n, err := strconv.ParseInt(string(entry), 10, 64); err == nil && n >= 0 && n < 128 {
+			encoded = []byte{byte(n)}
+		} else if err == nil && n >= -32768 && n < 32768 {
+			encoded = []byte{LISTPACK_16BIT_INT, byte(n), byte(n >> 8)}
+		} else {
+			encoded = append([]byte{LISTPACK_6BIT_STR | byte(len(entry))}, entry...)
+		}
+		body = append(body, encoded...)
+		body = append(body, byte(len(encoded)))
+	}
+	blob := make([]byte, LISTPACK_HEADER_SIZE)
+	blob = append(blob, body...)
+	blob = append(blob, LISTPACK_EOF)
+	binary.LittleEndian.PutUint32(blob[0:4], uint32(len(blob)))
+	binary.LittleEndian.PutUint16(blob[4:6], uint16(len(entries)))
+	return blob
+}
+
+func ziplistBlob(entries ...[]byte) []byte {
+	body := []byte{}
+	previousLength := 0
+	for _, entry := range entries {
+		encoded := []byte{byte(previousLength)}
+		if n, err := strconv.ParseInt(string(entry), 10, 64); err == nil && n >= 0 && n <= 12 {
+			encoded = append(encoded, ZIPLIST_INT_IMM_MIN+byte(n))
+		} else if err == nil && n >= -32768 && n < 32768 {
+			encoded = append(encoded, ZIPLIST_INT_16B, byte(n), byte(n>>8))
+		} else {
+			encoded = append(encoded, byte(len(entry)))
+			encoded = append(encoded, entry...)
+		}
+		body = append(body, encoded...)
+		previousLength = len(encoded)
+	}
+	blob := make([]byte, ZIPLIST_HEADER_SIZE)
+	blob = append(blob, body...)
+	blob = append(blob, ZIPLIST_END)
+	binary.LittleEndian.PutUint32(blob[0:4], uint32(len(blob)))
+	binary.LittleEndian.PutUint16(blob[8:10], uint16(len(entries)))
+	return blob
+}
+
+func rdbFile(version string, body ...[]byte) []byte {
+	data := []byte("REDIS" + version)
+	for _, section := range body {
+		data = append(data, section...)
+	}
+	data = append(data, EOF)
+	return append(data, make([]byte, 8)...)
+}
+
+func b(s ...string) [][]byte {
+	result := make([][]byte, len(s))
+	for i := range s {
+		result[i] = []byte(s[i])
+	}
+	return result
+}
+
+func keyValue(valueType ValueType, key string, payload ...[]byte) []byte {
+	data := append([]byte{byte(valueType)}, rdbString([]byte(key))...)
+	for _, section := range payload {
+		data = append(data, section...)
+	}
+	return data
+}
+
+func loadFixture(t *testing.T, data []byte) map[string]Value {
+	t.Helper()
+	loadedRdb, err := parseRdb(data)
+	if err != nil {
+		t.Fatalf("Failed to parse RDB fixture: %v", err)
+	}
+	values := make(map[string]Value)
+	for _, db := range loadedRdb.dbs {
+		for key, value := range db.nonExpirableData {
+			values[key] = value
+		}
+		for key, value := range db.expirableData {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func TestParseRdb_CompactEncodings(t *testing.T) {
+	zsetScore := make([]byte, 8)
+	binary.LittleEndian.PutUint64(zsetScore, math.Float64bits(2.5))
+	data := rdbFile("0011",
+		[]byte{AUX}, rdbString([]byte("redis-ver")), rdbString([]byte("7.2.0")),
+		[]byte{SELECTDB, 0, RESIZEDB, 9, 0},
+		keyValue(STRING, "int8", []byte{0xC0, 0xFE}),
+		keyValue(LIST_QUICKLIST_2, "list", rdbLength(2),
+			rdbLength(QUICKLIST_NODE_PACKED), rdbString(listpackBlob(b("a", "-7", "1000")...)),
+			rdbLength(QUICKLIST_NODE_PLAIN), rdbString([]byte("plain"))),
+		keyValue(LIST_ZIPLIST, "oldlist", rdbString(ziplistBlob(b("x", "12", "-300")...))),
+		keyValue(SET_INTSET, "intset", rdbString([]byte{2, 0, 0, 0, 2, 0, 0, 0, 0xFF, 0xFF, 5, 0})),
+		keyValue(SET_LISTPACK, "set", rdbString(listpackBlob(b("m1", "m2")...))),
+		keyValue(ZSET_LISTPACK, "zset", rdbString(listpackBlob(b("one", "1", "half", "0.5")...))),
+		keyValue(ZSET_2, "zset2", rdbLength(1), rdbString([]byte("m")), zsetScore),
+		keyValue(HASH_ZIPLIST, "hash", rdbString(ziplistBlob(b("f1", "v1", "f2", "2")...))),
+		keyValue(ZIPMAP, "zipmap", rdbString([]byte{1, 3, 'f', 'o', 'o', 3, 1, 'b', 'a', 'r', 'x', ZIPMAP_END})),
+	)
+	values := loadFixture(t, data)
+
+	if got := string(values["int8"].Data); got != "-2" {
+		t.Errorf("Expected signed 8 bit integer string '-2', Got: %q", got)
+	}
+	assertElements(t, "list", values["list"].List, b("a", "-7", "1000", "plain"))
+	assertElements(t, "oldlist", values["oldlist"].List, b("x", "12", "-300"))
+	assertMembers(t, "intset", values["intset"].Set, "-1", "5")
+	assertMembers(t, "set", values["set"].Set, "m1", "m2")
+	if zset := values["zset"].SortedSet; zset["one"] != 1 || zset["half"] != 0.5 || len(zset) != 2 {
+		t.Errorf("Unexpected sorted set: %v", zset)
+	}
+	if zset := values["zset2"].SortedSet; zset["m"] != 2.5 {
+		t.Errorf("Unexpected binary-scored sorted set: %v", zset)
+	}
+	if hash := values["hash"].Hash; string(hash["f1"]) != "v1" || string(hash["f2"]) != "2" {
+		t.Errorf("Unexpected hash: %q", hash)
+	}
+	if hash := values["zipmap"].Hash; string(hash["foo"]) != "bar" || len(hash) != 1 {
+		t.Errorf("Unexpected zipmap hash: %q", hash)
+	}
+	for key, expectedType := range map[string]string{"list": "list", "intset": "set", "zset": "zset", "zipmap": "hash", "int8": "string"} {
+		if values[key].Type != expectedType {
+			t.Errorf("Expected key '%s' to have type '%s', Got: '%s'", key, expectedType, values[key].Type)
+		}
+	}
+}
+
+func TestParseRdb_StreamWithConsumerGroup(t *testing.T) {
+	masterId := RecordId{Epoch: 1700000000000, Count: 0}
+	node := listpackBlob(b(
+		// master entry: 2 live, 1 deleted, fields [temp]
+		"2", "1", "1", "temp", "0",
+		// same fields entry 1700000000000-0
+		"2", "0", "0", "20", "4",
+		// deleted entry 1700000000000-1
+		"3", "0", "1", "21", "4",
+		// entry with its own fields 1700000000005-0
+		"0", "5", "0", "2", "temp", "22", "hum", "40", "7",
+	)...)
+	pendingId := RecordId{Epoch: 1700000000005, Count: 0}
+	deliveryTime := make([]byte, 8)
+	binary.LittleEndian.PutUint64(deliveryTime, 1700000001000)
+	data := rdbFile("0011",
+		[]byte{SELECTDB, 0},
+		keyValue(STREAM_LISTPACKS_3, "sensor",
+			rdbLength(1), rdbString(masterId.Bytes()), rdbString(node),
+			// length, last id, first id, max deleted id, entries added
+			rdbLength(2),
+			rdbLength64(1700000000005), rdbLength(0),
+			rdbLength64(1700000000000), rdbLength(0),
+			rdbLength64(1700000000000), rdbLength(1),
+			rdbLength(3),
+			// one group with one pending entry owned by one consumer
+			rdbLength(1), rdbString([]byte("g1")), rdbLength64(1700000000005), rdbLength(0), rdbLength(2),
+			rdbLength(1), pendingId.Bytes(), deliveryTime, rdbLength(1),
+			rdbLength(1), rdbString([]byte("alice")), deliveryTime, deliveryTime, rdbLength(1), pendingId.Bytes(),
+		),
+	)
+	values := loadFixture(t, data)
+	stream := values["sensor"].Stream
+	if stream == nil {
+		t.Fatalf("Expected stream to be loaded")
+	}
+	entries := stream.Entries()
+	if len(entries) != 2 || stream.Length != 2 {
+		t.Fatalf("Expected 2 live stream entries, Got: %d", len(entries))
+	}
+	if entries[0].Id.String() != "1700000000000-0" || entries[1].Id.String() != "1700000000005-0" {
+		t.Errorf("Unexpected stream entry ids: %s, %s", entries[0].Id, entries[1].Id)
+	}
+	assertElements(t, "first entry", entries[0].FieldValuePairs, b("temp", "20"))
+	assertElements(t, "second entry", entries[1].FieldValuePairs, b("temp", "22", "hum", "40"))
+	if stream.LastId().String() != "1700000000005-0" || stream.EntriesAdded != 3 {
+		t.Errorf("Unexpected stream metadata: last id %s, entries added %d", stream.LastId(), stream.EntriesAdded)
+	}
+	group := stream.ConsumerGroups["g1"]
+	if group == nil || group.EntriesRead != 2 {
+		t.Fatalf("Expected consumer group 'g1' with 2 entries read, Got: %+v", group)
+	}
+	if pending := group.PendingEntries[pendingId]; pending == nil || pending.Consumer != "alice" || pending.DeliveryCount != 1 {
+		t.Errorf("Unexpected pending entry: %+v", pending)
+	}
+}
+
+func TestParseRdb_RejectsUnknownVersionAndTruncation(t *testing.T) {
+	if _, err := parseRdb(rdbFile("0012")); err == nil {
+		t.Errorf("Expected RDB version 12 to be rejected")
+	}
+	data := rdbFile("0011", []byte{SELECTDB, 0}, keyValue(STRING, "key", rdbString([]byte("value"))))
+	if _, err := parseRdb(data[:len(data)-12]); err == nil {
+		t.Errorf("Expected truncated RDB to be rejected")
+	}
+}
+
+func rdbLength64(n uint64) []byte {
+	lengthBytes := []byte{LENGTH_64BIT_MARKER, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(lengthBytes[1:], n)
+	return lengthBytes
+}
+
+func assertElements(t *testing.T, name string, actual [][]byte, expected [][]byte) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Errorf("Expected %s to be %q, Got: %q", name, expected, actual)
+		return
+	}
+	for i := range expected {
+		if !bytes.Equal(actual[i], expected[i]) {
+			t.Errorf("Expected %s to be %q, Got: %q", name, expected, actual)
+			return
+		}
+	}
+}
+
+func assertMembers(t *testing.T, name string, actual map[string]struct{}, expected ...string) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Errorf("Expected %s to have members %v, Got: %v", name, expected, actual)
+	}
+	for _, member := range expected {
+		if _, ok := actual[member]; !ok {
+			t.Errorf("Expected %s to contain member '%s'", name, member)
+		}
+	}
+}
+
+func TestCrc64Jones_CheckValue(t *testing.T) {
+	if crc := crc64Jones(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected CRC64 check value e9c6d914c4b8d9ca, Got: %x", crc)
+	}
+}
+
+func TestParseRdb_LzfStringAndChecksum(t *testing.T) {
+	// literal "a" followed by a 19 byte back reference to it
+	compressed := []byte{0x00, 'a', 0xE0, 0x0A, 0x00}
+	data := rdbFile("0011",
+		[]byte{SELECTDB, 0},
+		keyValue(STRING, "lzf", []byte{0xC3}, rdbLength(len(compressed)), rdbLength(20), compressed),
+	)
+	binary.LittleEndian.PutUint64(data[len(data)-8:], crc64Jones(0, data[:len(data)-8]))
+
+	values := loadFixture(t, data)
+	if got := string(values["lzf"].Data); got != "aaaaaaaaaaaaaaaaaaaa" {
+		t.Errorf("Expected LZF string to expand to 20 'a's, Got: %q", got)
+	}
+
+	corrupted := bytes.Clone(data)
+	corrupted[len("REDIS0011")+3] ^= 0x01
+	if _, err := parseRdb(corrupted); err == nil {
+		t.Errorf("Expected RDB with a flipped bit to fail checksum verification")
+	}
+}
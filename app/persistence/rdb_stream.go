@@ -0,0 +1,316 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Flags stored with every entry of a stream listpack node
+const (
+	STREAM_ITEM_FLAG_DELETED    = 1
+	STREAM_ITEM_FLAG_SAMEFIELDS = 2
+)
+
+func readMillisecondTime(reader *bytes.Reader) (time.Time, error) {
+	timeBytes, err := readNextNBytes(reader, 8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(binary.LittleEndian.Uint64(timeBytes))), nil
+}
+
+func readStreamId(reader *bytes.Reader) (RecordId, error) {
+	epoch, err := readLength(reader)
+	if err != nil {
+		return RecordId{}, err
+	}
+	count, err := readLength(reader)
+	if err != nil {
+		return RecordId{}, err
+	}
+	return RecordId{Epoch: int64(epoch), Count: int64(count)}, nil
+}
+
+func readRawStreamId(reader *bytes.Reader) (RecordId, error) {
+	idBytes, err := readNextNBytes(reader, 16)
+	if err != nil {
+		return RecordId{}, err
+	}
+	return recordIdFromBytes(idBytes)
+}
+
+func readStreamValue(reader *bytes.Reader, valueType ValueType) (*Stream, error) {
+	stream := NewStream("")
+	nodeCount, err := readElementCount(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nodeCount; i++ {
+		nodeKey, err := readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		masterId, err := recordIdFromBytes(nodeKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream node key: %v", err)
+		}
+		listpack, err := readStringEncodingKeyValuePair(reader)
+		if err != nil {
+			return nil, err
+		}
+		err = loadStreamListpackNode(stream, masterId, listpack)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	length, err := readLength(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length != stream.Length {
+		return nil, fmt.Errorf("stream claims %d entries but %d were loaded", length, stream.Length)
+	}
+	lastId, err := readStreamId(reader)
+	if err != nil {
+		return nil, err
+	}
+	stream.setLastId(lastId)
+
+	if valueType >= STREAM_LISTPACKS_2 {
+		stream.FirstId, err = readStreamId(reader)
+		if err != nil {
+			return nil, err
+		}
+		stream.MaxDeletedId, err = readStreamId(reader)
+		if err != nil {
+			return nil, err
+		}
+		stream.EntriesAdded, err = readLength(reader)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Older formats don't track these, the best guess is every entry still being present
+		stream.EntriesAdded = stream.Length
+	}
+
+	groupCount, err := readElementCount(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < groupCount; i++ {
+		group, err := readStreamConsumerGroup(reader, valueType)
+		if err != nil {
+			return nil, err
+		}
+		stream.ConsumerGroups[group.Name] = group
+	}
+	return stream, nil
+}
+
+// loadStreamListpackNode adds the live entries of one listpack node to the stream. Entry ids are
+// stored as deltas against the node's master id, and entries flagged SAMEFIELDS reuse the master
+// entry's field names
+func loadStreamListpackNode(stream *Stream, masterId RecordId, listpack []byte) error {
+	elements, err := decodeListpack(listpack)
+	if err != nil {
+		return err
+	}
+	position := 0
+	nextInt := func() (int64, error) {
+		if position >= len(elements) {
+			return 0, fmt.Errorf("stream listpack node ended unexpectedly")
+		}
+		value, err := strconv.ParseInt(string(elements[position]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected an integer in stream listpack node, got %q", elements[position])
+		}
+		position++
+		return value, nil
+	}
+	nextBytes := func() ([]byte, error) {
+		if position >= len(elements) {
+			return nil, fmt.Errorf("stream listpack node ended unexpectedly")
+		}
+		element := elements[position]
+		position++
+		return element, nil
+	}
+
+	// Master entry: count, deleted, num-fields, field_1 ... field_N, 0
+	validCount, err := nextInt()
+	if err != nil {
+		return err
+	}
+	deletedCount, err := nextInt()
+	if err != nil {
+		return err
+	}
+	masterFieldCount, err := nextInt()
+	if err != nil {
+		return err
+	}
+	masterFields := make([][]byte, masterFieldCount)
+	for i := range masterFields {
+		masterFields[i], err = nextBytes()
+		if err != nil {
+			return err
+		}
+	}
+	if terminator, err := nextInt(); err != nil || terminator != 0 {
+		return fmt.Errorf("stream listpack node has an invalid master entry terminator")
+	}
+
+	loadedValid, loadedDeleted := int64(0), int64(0)
+	for position < len(elements) {
+		flags, err := nextInt()
+		if err != nil {
+			return err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		var fieldValuePairs [][]byte
+		if flags&STREAM_ITEM_FLAG_SAMEFIELDS != 0 {
+			fieldValuePairs = make([][]byte, 0, 2*len(masterFields))
+			for _, field := range masterFields {
+				value, err := nextBytes()
+				if err != nil {
+					return err
+				}
+				fieldValuePairs = append(fieldValuePairs, field, value)
+			}
+		} else {
+			fieldCount, err := nextInt()
+			if err != nil {
+				return err
+			}
+			fieldValuePairs = make([][]byte, 2*fieldCount)
+			for i := range fieldValuePairs {
+				fieldValuePairs[i], err = nextBytes()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		// lp-count, only needed when walking the node backwards
+		if _, err := nextInt(); err != nil {
+			return err
+		}
+		if flags&STREAM_ITEM_FLAG_DELETED != 0 {
+			loadedDeleted++
+			continue
+		}
+		loadedValid++
+		stream.insertEntry(RecordId{
+			Epoch: masterId.Epoch + msDiff,
+			Count: masterId.Count + seqDiff,
+		}, fieldValuePairs)
+	}
+	if loadedValid != validCount || loadedDeleted != deletedCount {
+		return fmt.Errorf("stream listpack node claims %d live and %d deleted entries but has %d and %d", validCount, deletedCount, loadedValid, loadedDeleted)
+	}
+	return nil
+}
+
+func readStreamConsumerGroup(reader *bytes.Reader, valueType ValueType) (*StreamConsumerGroup, error) {
+	groupName, err := readStringEncoding(reader)
+	if err != nil {
+		return nil, err
+	}
+	lastDeliveredId, err := readStreamId(reader)
+	if err != nil {
+		return nil, err
+	}
+	group := StreamConsumerGroup{
+		Name:            groupName,
+		LastDeliveredId: lastDeliveredId,
+		EntriesRead:     -1,
+		PendingEntries:  make(map[RecordId]*StreamPendingEntry),
+		Consumers:       make(map[string]*StreamConsumer),
+	}
+	if valueType >= STREAM_LISTPACKS_2 {
+		entriesRead, err := readLength(reader)
+		if err != nil {
+			return nil, err
+		}
+		group.EntriesRead = int64(entriesRead)
+	}
+
+	pendingCount, err := readElementCount(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < pendingCount; i++ {
+		id, err := readRawStreamId(reader)
+		if err != nil {
+			return nil, err
+		}
+		deliveryTime, err := readMillisecondTime(reader)
+		if err != nil {
+			return nil, err
+		}
+		deliveryCount, err := readLength(reader)
+		if err != nil {
+			return nil, err
+		}
+		group.PendingEntries[id] = &StreamPendingEntry{
+			DeliveryTime:  deliveryTime,
+			DeliveryCount: deliveryCount,
+		}
+	}
+
+	consumerCount, err := readElementCount(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < consumerCount; i++ {
+		consumerName, err := readStringEncoding(reader)
+		if err != nil {
+			return nil, err
+		}
+		seenTime, err := readMillisecondTime(reader)
+		if err != nil {
+			return nil, err
+		}
+		activeTime := seenTime
+		if valueType >= STREAM_LISTPACKS_3 {
+			activeTime, err = readMillisecondTime(reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		consumer := StreamConsumer{
+			Name:       consumerName,
+			SeenTime:   seenTime,
+			ActiveTime: activeTime,
+		}
+		consumerPendingCount, err := readElementCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < consumerPendingCount; j++ {
+			id, err := readRawStreamId(reader)
+			if err != nil {
+				return nil, err
+			}
+			pendingEntry, pendingEntryExists := group.PendingEntries[id]
+			if !pendingEntryExists {
+				return nil, fmt.Errorf("consumer '%s' of group '%s' owns id %s which is not pending in the group", consumerName, groupName, id)
+			}
+			pendingEntry.Consumer = consumerName
+			consumer.PendingIds = append(consumer.PendingIds, id)
+		}
+		group.Consumers[consumerName] = &consumer
+	}
+	return &group, nil
+}
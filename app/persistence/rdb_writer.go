@@ -0,0 +1,425 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+const (
+	RDB_WRITE_VERSION = "0011"
+	// Version of the Redis RDB format the written files are compatible with
+	RDB_WRITE_REDIS_VERSION = "7.2.0"
+	// Same default as Redis' stream-node-max-entries
+	STREAM_NODE_MAX_ENTRIES = 100
+)
+
+// rdbWriter serializes values with the plain (non compact) encodings, which every Redis
+// version from 7.0 onwards loads, and keeps a running CRC64 of everything written
+type rdbWriter struct {
+	writer   *bufio.Writer
+	checksum uint64
+}
+
+// WriteRDB writes a complete RDB file holding values as database 0
+func WriteRDB(writer io.Writer, values map[string]Value, auxFields map[string]string) error {
+	return WriteRDBDump(writer, &RdbDump{
+		AuxFields: auxFields,
+		Databases: map[int]map[string]Value{0: values},
+	})
+}
+
+// WriteRDBDump writes a complete RDB file holding the aux fields, functions and every database of dump.
+// The dump's version is ignored, files are always written as RDB_WRITE_VERSION
+func WriteRDBDump(writer io.Writer, dump *RdbDump) error {
+	rdb := rdbWriter{writer: bufio.NewWriter(writer)}
+	rdb.write([]byte(RDB_MAGIC_STRING + RDB_WRITE_VERSION))
+
+	defaultAuxFields := map[string]string{
+		"redis-ver":  RDB_WRITE_REDIS_VERSION,
+		"redis-bits": "64",
+		"ctime":      strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	for auxKey, auxValue := range dump.AuxFields {
+		defaultAuxFields[auxKey] = auxValue
+	}
+	for _, auxKey := range sortedKeys(defaultAuxFields) {
+		rdb.write([]byte{AUX})
+		rdb.writeString([]byte(auxKey))
+		rdb.writeString([]byte(defaultAuxFields[auxKey]))
+	}
+	for _, function := range dump.Functions {
+		rdb.write([]byte{FUNCTION2})
+		rdb.writeString([]byte(function))
+	}
+
+	databases := dump.Databases
+	dbIndexes := make([]int, 0, len(databases))
+	for dbIndex := range databases {
+		dbIndexes = append(dbIndexes, dbIndex)
+	}
+	sort.Ints(dbIndexes)
+	for _, dbIndex := range dbIndexes {
+		err := rdb.writeDatabase(dbIndex, databases[dbIndex])
+		if err != nil {
+			return err
+		}
+	}
+
+	rdb.write([]byte{EOF})
+	checksumBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksumBytes, rdb.checksum)
+	rdb.write(checksumBytes)
+	return rdb.writer.Flush()
+}
+
+func (rdb *rdbWriter) writeDatabase(dbIndex int, values map[string]Value) error {
+	if dbIndex < 0 {
+		return fmt.Errorf("invalid database index %d", dbIndex)
+	}
+	expirableCount := 0
+	for _, value := range values {
+		if value.ExpirationTime != nil {
+			expirableCount++
+		}
+	}
+	rdb.write([]byte{SELECTDB})
+	rdb.writeLength(uint64(dbIndex))
+	rdb.write([]byte{RESIZEDB})
+	rdb.writeLength(uint64(len(values)))
+	rdb.writeLength(uint64(expirableCount))
+
+	for _, key := range sortedKeys(values) {
+		err := rdb.writeKeyValuePair(key, values[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (rdb *rdbWriter) write(data []byte) {
+	rdb.checksum = crc64Jones(rdb.checksum, data)
+	// bufio.Writer keeps the first error and reports it on Flush
+	rdb.writer.Write(data)
+}
+
+func (rdb *rdbWriter) writeLength(length uint64) {
+	switch {
+	case length < 1<<6:
+		rdb.write([]byte{byte(length)})
+	case length < 1<<14:
+		rdb.write([]byte{byte(length>>8) | byte(LENGTH_14BIT)<<6, byte(length)})
+	case length <= math.MaxUint32:
+		lengthBytes := []byte{LENGTH_32BIT_MARKER, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(lengthBytes[1:], uint32(length))
+		rdb.write(lengthBytes)
+	default:
+		lengthBytes := []byte{LENGTH_64BIT_MARKER, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(lengthBytes[1:], length)
+		rdb.write(lengthBytes)
+	}
+}
+
+func (rdb *rdbWriter) writeString(data []byte) {
+	rdb.writeLength(uint64(len(data)))
+	rdb.write(data)
+}
+
+func (rdb *rdbWriter) writeMillisecondTime(t time.Time) {
+	timeBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timeBytes, uint64(t.UnixMilli()))
+	rdb.write(timeBytes)
+}
+
+func (rdb *rdbWriter) writeKeyValuePair(key string, value Value) error {
+	valueType, err := rdbValueType(value)
+	if err != nil {
+		return fmt.Errorf("%v for key '%s'", err.Error(), key)
+	}
+	if value.ExpirationTime != nil {
+		rdb.write([]byte{EXPIRETIME_MS})
+		rdb.writeMillisecondTime(*value.ExpirationTime)
+	}
+	rdb.write([]byte{byte(valueType)})
+	rdb.writeString([]byte(key))
+	rdb.writeValue(value)
+	return nil
+}
+
+// rdbValueType returns the RDB type a value is written as
+func rdbValueType(value Value) (ValueType, error) {
+	switch value.Type {
+	case constants.STRING_DATA_TYPE:
+		return STRING, nil
+	case constants.LIST_DATA_TYPE:
+		return LIST, nil
+	case constants.SET_DATA_TYPE:
+		return SET, nil
+	case constants.ZSET_DATA_TYPE:
+		return ZSET_2, nil
+	case constants.HASH_DATA_TYPE:
+		return HASH, nil
+	case constants.STREAM:
+		if value.Stream == nil {
+			return 0, errors.New("stream value has no stream")
+		}
+		return STREAM_LISTPACKS_3, nil
+	default:
+		return 0, fmt.Errorf("can't write value of type '%s' to RDB", value.Type)
+	}
+}
+
+// writeValue writes a value in the encoding of its rdbValueType
+func (rdb *rdbWriter) writeValue(value Value) {
+	switch value.Type {
+	case constants.STRING_DATA_TYPE:
+		rdb.writeString(value.Data)
+	case constants.LIST_DATA_TYPE:
+		rdb.writeLength(uint64(len(value.List)))
+		for _, element := range value.List {
+			rdb.writeString(element)
+		}
+	case constants.SET_DATA_TYPE:
+		rdb.writeLength(uint64(len(value.Set)))
+		for _, member := range sortedKeys(value.Set) {
+			rdb.writeString([]byte(member))
+		}
+	case constants.ZSET_DATA_TYPE:
+		rdb.writeLength(uint64(len(value.SortedSet)))
+		scoreBytes := make([]byte, 8)
+		for _, member := range sortedKeys(value.SortedSet) {
+			rdb.writeString([]byte(member))
+			binary.LittleEndian.PutUint64(scoreBytes, math.Float64bits(value.SortedSet[member]))
+			rdb.write(scoreBytes)
+		}
+	case constants.HASH_DATA_TYPE:
+		rdb.writeLength(uint64(len(value.Hash)))
+		for _, field := range sortedKeys(value.Hash) {
+			rdb.writeString([]byte(field))
+			rdb.writeString(value.Hash[field])
+		}
+	case constants.STREAM:
+		rdb.writeStream(value.Stream)
+	}
+}
+
+func (rdb *rdbWriter) writeStreamId(id RecordId) {
+	rdb.writeLength(uint64(id.Epoch))
+	rdb.writeLength(uint64(id.Count))
+}
+
+func (rdb *rdbWriter) writeStream(stream *Stream) {
+	entries := stream.Entries()
+	nodeCount := (len(entries) + STREAM_NODE_MAX_ENTRIES - 1) / STREAM_NODE_MAX_ENTRIES
+	rdb.writeLength(uint64(nodeCount))
+	for start := 0; start < len(entries); start += STREAM_NODE_MAX_ENTRIES {
+		end := min(start+STREAM_NODE_MAX_ENTRIES, len(entries))
+		nodeEntries := entries[start:end]
+		rdb.writeString(nodeEntries[0].Id.Bytes())
+		rdb.writeString(encodeStreamListpackNode(nodeEntries))
+	}
+
+	rdb.writeLength(uint64(len(entries)))
+	rdb.writeStreamId(stream.LastId())
+	rdb.writeStreamId(stream.FirstId)
+	rdb.writeStreamId(stream.MaxDeletedId)
+	rdb.writeLength(stream.EntriesAdded)
+
+	rdb.writeLength(uint64(len(stream.ConsumerGroups)))
+	for _, groupName := range sortedKeys(stream.ConsumerGroups) {
+		group := stream.ConsumerGroups[groupName]
+		rdb.writeString([]byte(group.Name))
+		rdb.writeStreamId(group.LastDeliveredId)
+		// Redis stores an unknown entries-read counter as -1 cast to unsigned
+		rdb.writeLength(uint64(group.EntriesRead))
+
+		pendingIds := sortedRecordIds(group.PendingEntries)
+		rdb.writeLength(uint64(len(pendingIds)))
+		for _, id := range pendingIds {
+			pendingEntry := group.PendingEntries[id]
+			rdb.write(id.Bytes())
+			rdb.writeMillisecondTime(pendingEntry.DeliveryTime)
+			rdb.writeLength(pendingEntry.DeliveryCount)
+		}
+
+		rdb.writeLength(uint64(len(group.Consumers)))
+		for _, consumerName := range sortedKeys(group.Consumers) {
+			consumer := group.Consumers[consumerName]
+			rdb.writeString([]byte(consumer.Name))
+			rdb.writeMillisecondTime(consumer.SeenTime)
+			rdb.writeMillisecondTime(consumer.ActiveTime)
+			rdb.writeLength(uint64(len(consumer.PendingIds)))
+			for _, id := range consumer.PendingIds {
+				rdb.write(id.Bytes())
+			}
+		}
+	}
+}
+
+func sortedRecordIds[V any](m map[RecordId]V) []RecordId {
+	ids := make([]RecordId, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Epoch != ids[j].Epoch {
+			return ids[i].Epoch < ids[j].Epoch
+		}
+		return ids[i].Count < ids[j].Count
+	})
+	return ids
+}
+
+// encodeStreamListpackNode lays entries out the way Redis does: a master entry holding the field
+// names of the first entry, followed by every entry with its id stored as a delta from the first
+func encodeStreamListpackNode(entries []StreamEntry) []byte {
+	masterId := entries[0].Id
+	masterFields := make([][]byte, 0)
+	for i := 0; i < len(entries[0].FieldValuePairs); i += 2 {
+		masterFields = append(masterFields, entries[0].FieldValuePairs[i])
+	}
+
+	listpack := newListpackBuilder()
+	listpack.appendInteger(int64(len(entries)))
+	listpack.appendInteger(0)
+	listpack.appendInteger(int64(len(masterFields)))
+	for _, field := range masterFields {
+		listpack.appendString(field)
+	}
+	listpack.appendInteger(0)
+
+	for _, entry := range entries {
+		sameFields := hasSameFields(entry.FieldValuePairs, masterFields)
+		flags := int64(0)
+		if sameFields {
+			flags |= STREAM_ITEM_FLAG_SAMEFIELDS
+		}
+		fieldCount := int64(len(entry.FieldValuePairs) / 2)
+		listpack.appendInteger(flags)
+		listpack.appendInteger(entry.Id.Epoch - masterId.Epoch)
+		listpack.appendInteger(entry.Id.Count - masterId.Count)
+		if sameFields {
+			for i := 1; i < len(entry.FieldValuePairs); i += 2 {
+				listpack.appendString(entry.FieldValuePairs[i])
+			}
+			listpack.appendInteger(fieldCount + 3)
+			continue
+		}
+		listpack.appendInteger(fieldCount)
+		for _, fieldOrValue := range entry.FieldValuePairs {
+			listpack.appendString(fieldOrValue)
+		}
+		listpack.appendInteger(2*fieldCount + 4)
+	}
+	return listpack.bytes()
+}
+
+func hasSameFields(fieldValuePairs [][]byte, masterFields [][]byte) bool {
+	if len(fieldValuePairs) != 2*len(masterFields) {
+		return false
+	}
+	for i, field := range masterFields {
+		if string(fieldValuePairs[2*i]) != string(field) {
+			return false
+		}
+	}
+	return true
+}
+
+type listpackBuilder struct {
+	body       []byte
+	entryCount int
+}
+
+func newListpackBuilder() *listpackBuilder {
+	return &listpackBuilder{body: make([]byte, 0)}
+}
+
+func (lp *listpackBuilder) appendEntry(encodedEntry []byte) {
+	lp.body = append(lp.body, encodedEntry...)
+	lp.body = append(lp.body, encodeListpackBacklen(len(encodedEntry))...)
+	lp.entryCount++
+}
+
+func (lp *listpackBuilder) appendInteger(value int64) {
+	switch {
+	case value >= 0 && value <= 127:
+		lp.appendEntry([]byte{byte(value)})
+	case value >= -4096 && value <= 4095:
+		unsignedValue := uint64(value) & 0x1FFF
+		lp.appendEntry([]byte{LISTPACK_13BIT_INT | byte(unsignedValue>>8), byte(unsignedValue)})
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		lp.appendEntry([]byte{LISTPACK_16BIT_INT, byte(value), byte(value >> 8)})
+	case value >= -(1<<23) && value < 1<<23:
+		lp.appendEntry([]byte{LISTPACK_24BIT_INT, byte(value), byte(value >> 8), byte(value >> 16)})
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		encodedEntry := []byte{LISTPACK_32BIT_INT, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(encodedEntry[1:], uint32(value))
+		lp.appendEntry(encodedEntry)
+	default:
+		encodedEntry := []byte{LISTPACK_64BIT_INT, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(encodedEntry[1:], uint64(value))
+		lp.appendEntry(encodedEntry)
+	}
+}
+
+func (lp *listpackBuilder) appendString(data []byte) {
+	var header []byte
+	switch {
+	case len(data) < 64:
+		header = []byte{LISTPACK_6BIT_STR | byte(len(data))}
+	case len(data) < 4096:
+		header = []byte{LISTPACK_12BIT_STR | byte(len(data)>>8), byte(len(data))}
+	default:
+		header = []byte{LISTPACK_32BIT_STR, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(header[1:], uint32(len(data)))
+	}
+	lp.appendEntry(append(header, data...))
+}
+
+func (lp *listpackBuilder) bytes() []byte {
+	listpack := make([]byte, LISTPACK_HEADER_SIZE, LISTPACK_HEADER_SIZE+len(lp.body)+1)
+	listpack = append(listpack, lp.body...)
+	listpack = append(listpack, LISTPACK_EOF)
+	binary.LittleEndian.PutUint32(listpack[0:4], uint32(len(listpack)))
+	entryCount := lp.entryCount
+	if entryCount > math.MaxUint16-1 {
+		// Too many entries to count in the header, readers have to walk the listpack
+		entryCount = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(listpack[4:6], uint16(entryCount))
+	return listpack
+}
+
+// encodeListpackBacklen stores an entry length in 7 bit groups, most significant group first,
+// with the high bit set on every byte but the first so it can be read from the right
+func encodeListpackBacklen(length int) []byte {
+	backlenSize := listpackBacklenSize(length)
+	backlen := make([]byte, backlenSize)
+	for i := backlenSize - 1; i >= 0; i-- {
+		backlen[i] = byte(length & 0x7F)
+		if i != 0 {
+			backlen[i] |= 0x80
+		}
+		length >>= 7
+	}
+	return backlen
+}
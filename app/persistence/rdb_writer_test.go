@@ -0,0 +1,90 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+func TestWriteRDB_RoundTrip(t *testing.T) {
+	expirationTime := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	stream := NewStream("events")
+	for i := 1; i <= 150; i++ {
+		fields := [][]byte{[]byte("temperature"), []byte(fmt.Sprint(i))}
+		if i%50 == 0 {
+			fields = append(fields, []byte("note"), []byte("different fields"))
+		}
+		if _, err := stream.Add(fmt.Sprintf("1000-%d", i), fields); err != nil {
+			t.Fatalf("Failed to add stream entry: %v", err)
+		}
+	}
+	values := map[string]Value{
+		"plain":   {Type: constants.STRING_DATA_TYPE, Data: []byte("value")},
+		"expires": {Type: constants.STRING_DATA_TYPE, Data: []byte("soon"), ExpirationTime: &expirationTime},
+		"events":  {Type: constants.STREAM, Stream: stream},
+	}
+
+	var rdbData bytes.Buffer
+	if err := WriteRDB(&rdbData, values, map[string]string{"aof-base": "1"}); err != nil {
+		t.Fatalf("Failed to write RDB: %v", err)
+	}
+	loadedRdb, err := parseRdb(rdbData.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse written RDB: %v", err)
+	}
+
+	if loadedRdb.arbitraryMetaData["aof-base"] != "1" {
+		t.Errorf("Expected aof-base aux field to be written, Got: %v", loadedRdb.arbitraryMetaData)
+	}
+	db := loadedRdb.dbs[0]
+	if value, ok := db.nonExpirableData["plain"]; !ok || string(value.Data) != "value" {
+		t.Errorf("Expected key 'plain' with value 'value', Got: %+v", value)
+	}
+	expiringValue, ok := db.expirableData["expires"]
+	if !ok || expiringValue.ExpirationTime == nil || !expiringValue.ExpirationTime.Equal(expirationTime) {
+		t.Errorf("Expected key 'expires' to expire at %v, Got: %+v", expirationTime, expiringValue)
+	}
+	streamValue, ok := db.nonExpirableData["events"]
+	if !ok || streamValue.Stream == nil {
+		t.Fatalf("Expected stream 'events' to be loaded")
+	}
+	loadedStream := streamValue.Stream
+	entries := loadedStream.Entries()
+	if len(entries) != 150 || loadedStream.LastId() != stream.LastId() {
+		t.Fatalf("Expected 150 entries up to %s, Got: %d up to %s", stream.LastId(), len(entries), loadedStream.LastId())
+	}
+	if len(entries[49].FieldValuePairs) != 4 || string(entries[149].FieldValuePairs[1]) != "150" {
+		t.Errorf("Stream entries were not preserved: %q, %q", entries[49].FieldValuePairs, entries[149].FieldValuePairs)
+	}
+}
+
+func TestReplaceWithRdbData(t *testing.T) {
+	db := &PersiDb{logger: LOG, Memory: initMemory(), streamMap: make(map[string]*Stream)}
+	db.Persist("stale", []byte("old"), SetOptions{ValueType: constants.STRING_DATA_TYPE})
+	db.AddToStream("stale-stream", "1-1", [][]byte{[]byte("f"), []byte("v")})
+
+	var rdbData bytes.Buffer
+	values := map[string]Value{"fresh": {Type: constants.STRING_DATA_TYPE, Data: []byte("new")}}
+	if err := WriteRDB(&rdbData, values, nil); err != nil {
+		t.Fatalf("Failed to write RDB: %v", err)
+	}
+	if err := db.ReplaceWithRdbData([]byte("REDIS0011 not an rdb")); err == nil {
+		t.Fatalf("Expected an error for invalid RDB data")
+	}
+	if _, exists := db.Fetch("stale"); !exists {
+		t.Fatalf("Expected the dataset to be kept when the RDB is invalid")
+	}
+
+	if err := db.ReplaceWithRdbData(rdbData.Bytes()); err != nil {
+		t.Fatalf("Failed to replace dataset: %v", err)
+	}
+	if value, exists := db.Fetch("fresh"); !exists || string(value.Data) != "new" {
+		t.Errorf("Expected 'fresh' to be loaded from the RDB")
+	}
+	if db.GetKeyType("stale") != constants.NONE || db.GetKeyType("stale-stream") != constants.NONE {
+		t.Errorf("Expected keys missing from the RDB to be dropped")
+	}
+}
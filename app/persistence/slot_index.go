@@ -0,0 +1,57 @@
+package persistence
+
+import (
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// slotIndex keeps the keys of the dataset by cluster slot, so the keys of a slot are found without going
+// through the whole dataset. It is only kept in cluster mode, a nil index ignores updates
+type slotIndex struct {
+	lock  sync.RWMutex
+	slots map[int]map[string]bool
+}
+
+func newSlotIndex() *slotIndex {
+	return &slotIndex{slots: make(map[int]map[string]bool)}
+}
+
+func (i *slotIndex) add(key string) {
+	if i == nil {
+		return
+	}
+	slot := utils.KeyHashSlot(key)
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.slots[slot] == nil {
+		i.slots[slot] = make(map[string]bool)
+	}
+	i.slots[slot][key] = true
+}
+
+func (i *slotIndex) remove(key string) {
+	if i == nil {
+		return
+	}
+	slot := utils.KeyHashSlot(key)
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	delete(i.slots[slot], key)
+	if len(i.slots[slot]) == 0 {
+		delete(i.slots, slot)
+	}
+}
+
+func (i *slotIndex) keys(slot int) []string {
+	if i == nil {
+		return nil
+	}
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	keys := make([]string, 0, len(i.slots[slot]))
+	for key := range i.slots[slot] {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"encoding/binary"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -27,11 +28,80 @@ type RecordId struct {
 	Count int64
 }
 
+// Bytes returns the 128 bit big-endian form of the id, which sorts the same way the ids do
+func (id RecordId) Bytes() []byte {
+	idBytes := make([]byte, 16)
+	binary.BigEndian.PutUint64(idBytes[:8], uint64(id.Epoch))
+	binary.BigEndian.PutUint64(idBytes[8:], uint64(id.Count))
+	return idBytes
+}
+
+func (id RecordId) String() string {
+	return fmt.Sprintf(DEFAULT_ID_FORMAT, id.Epoch, id.Count)
+}
+
+func recordIdFromBytes(idBytes []byte) (RecordId, error) {
+	if len(idBytes) != 16 {
+		return RecordId{}, fmt.Errorf("invalid stream id length: %d", len(idBytes))
+	}
+	return RecordId{
+		Epoch: int64(binary.BigEndian.Uint64(idBytes[:8])),
+		Count: int64(binary.BigEndian.Uint64(idBytes[8:])),
+	}, nil
+}
+
+func parseRecordId(id string) (RecordId, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 2 {
+		return RecordId{}, fmt.Errorf("invalid stream id: %s", id)
+	}
+	epoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return RecordId{}, fmt.Errorf("invalid stream id: %s", id)
+	}
+	count, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return RecordId{}, fmt.Errorf("invalid stream id: %s", id)
+	}
+	return RecordId{Epoch: epoch, Count: count}, nil
+}
+
+type StreamEntry struct {
+	Id              RecordId
+	FieldValuePairs [][]byte
+}
+
+type StreamPendingEntry struct {
+	DeliveryTime  time.Time
+	DeliveryCount uint64
+	Consumer      string
+}
+
+type StreamConsumer struct {
+	Name       string
+	SeenTime   time.Time
+	ActiveTime time.Time
+	PendingIds []RecordId
+}
+
+type StreamConsumerGroup struct {
+	Name            string
+	LastDeliveredId RecordId
+	EntriesRead     int64
+	PendingEntries  map[RecordId]*StreamPendingEntry
+	Consumers       map[string]*StreamConsumer
+}
+
 type Stream struct {
 	StreamName     string
 	storage        *iradix.Tree
 	lastRecordedId *RecordId
 	uidLock        *sync.RWMutex
+	Length         uint64
+	FirstId        RecordId
+	MaxDeletedId   RecordId
+	EntriesAdded   uint64
+	ConsumerGroups map[string]*StreamConsumerGroup
 }
 
 func NewStream(streamName string) *Stream {
@@ -42,9 +112,9 @@ func NewStream(streamName string) *Stream {
 			Epoch: 0,
 			Count: 0,
 		},
-		uidLock: &sync.RWMutex{},
+		uidLock:        &sync.RWMutex{},
+		ConsumerGroups: make(map[string]*StreamConsumerGroup),
 	}
-	fmt.Printf("Created new stream: %s\n", streamName)
 	return &stream
 }
 
@@ -122,7 +192,61 @@ func (s *Stream) Add(id string, fieldValuePairs [][]byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	treeRef, _, _ := s.storage.Insert([]byte(persistedId), fieldValuePairs)
-	s.storage = treeRef
+	recordId, err := parseRecordId(persistedId)
+	if err != nil {
+		return "", err
+	}
+	s.insertEntry(recordId, fieldValuePairs)
+	s.EntriesAdded++
 	return persistedId, nil
 }
+
+func (s *Stream) insertEntry(id RecordId, fieldValuePairs [][]byte) {
+	treeRef, _, updated := s.storage.Insert(id.Bytes(), fieldValuePairs)
+	s.storage = treeRef
+	if updated {
+		return
+	}
+	if s.Length == 0 {
+		s.FirstId = id
+	}
+	s.Length++
+}
+
+// clone returns a copy sharing the immutable entry tree, so later writes to s don't show up in it
+func (s *Stream) clone() *Stream {
+	streamCopy := *s
+	lastRecordedId := s.LastId()
+	streamCopy.lastRecordedId = &lastRecordedId
+	streamCopy.uidLock = &sync.RWMutex{}
+	return &streamCopy
+}
+
+func (s *Stream) LastId() RecordId {
+	s.uidLock.RLock()
+	defer s.uidLock.RUnlock()
+	return *s.lastRecordedId
+}
+
+func (s *Stream) setLastId(id RecordId) {
+	s.uidLock.Lock()
+	defer s.uidLock.Unlock()
+	s.lastRecordedId = &id
+}
+
+// Entries returns all the entries of the stream in id order
+func (s *Stream) Entries() []StreamEntry {
+	entries := make([]StreamEntry, 0, s.Length)
+	iterator := s.storage.Root().Iterator()
+	for key, value, ok := iterator.Next(); ok; key, value, ok = iterator.Next() {
+		id, err := recordIdFromBytes(key)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, StreamEntry{
+			Id:              id,
+			FieldValuePairs: value.([][]byte),
+		})
+	}
+	return entries
+}
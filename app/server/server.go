@@ -1,39 +1,83 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
 )
 
 type ServerReplicationConfig struct {
-	Role                       string
-	ConnectedSlaves            int
-	MasterReplId               string
-	MasterReplOffset           int
+	Role             string
+	ConnectedSlaves  int
+	MasterReplId     string
+	MasterReplOffset int
+	// Replication ID this server had before its last promotion, along with the offset up to which it is valid
+	MasterReplId2              string
 	SecondReplOffeset          int
 	ReplBacklogActive          int
 	ReplBacklogSize            int
 	ReplBacklogFirstByteOffset int
 	ReplBacklogHistlen         int
 	MasterServerAddress        string
+	// State of a replica's link to its master and the last time anything was read from it
+	MasterLinkState  string
+	MasterLastIoTime time.Time
 }
 
 type ServerConfig struct {
-	RdbDir     string
-	DbFileName string
+	RdbDir         string
+	DbFileName     string
+	AppendOnly     bool
+	AppendFsync    string
+	AppendFileName string
+	AppendDirName  string
+	// AofLoadTruncated allows startup to drop an incomplete command at the end of the AOF
+	AofLoadTruncated bool
+	ReplBacklogSize  int
+	// ReplDisklessSync streams full resync snapshots to replicas instead of writing them to disk first
+	ReplDisklessSync      bool
+	ReplDisklessSyncDelay int
+	ReplicaReadOnly       bool
+	ReplicaServeStaleData bool
+	// 0 disables the check
+	MinReplicasToWrite int
+	MinReplicasMaxLag  int
+	// Sentinel runs the server as a sentinel monitoring SentinelMonitor, given as <name> <host> <port> <quorum>
+	Sentinel                bool
+	SentinelMonitor         string
+	SentinelDownAfter       int
+	SentinelFailoverTimeout int
+	// ClusterEnabled shards the keyspace over the nodes listed in ClusterConfigFile, kept in the RDB directory
+	ClusterEnabled    bool
+	ClusterConfigFile string
+	// Milliseconds a cluster node may be unreachable before it is flagged as failing
+	ClusterNodeTimeout int
+	ProtoMaxBulkLen    int
+	// A replica is disconnected once its pending output reaches the hard limit, or stays at or above
+	// the soft limit for the soft seconds. Limits of 0 are disabled
+	ReplicaOutputBufferHardLimit   int
+	ReplicaOutputBufferSoftLimit   int
+	ReplicaOutputBufferSoftSeconds int
 }
 
 type Server struct {
-	ListeningPort     string
-	Listener          net.Listener
-	ReplicaOf         string
+	ListeningPort string
+	Listener      net.Listener
+	ReplicaOf     string
+	// Changed by the master link, the replication stream and role changes while clients read it, so once
+	// the server is running it is only accessed through the methods below
 	ReplicationConfig ServerReplicationConfig
+	replicationLock   sync.RWMutex
 	ServerAddress     string
 	ServerConfig      ServerConfig
 }
@@ -51,6 +95,46 @@ func GetServerInstance() *Server {
 
 }
 
+// GetReplicationConfig returns a copy of the replication state
+func (s *Server) GetReplicationConfig() ServerReplicationConfig {
+	s.replicationLock.RLock()
+	defer s.replicationLock.RUnlock()
+	return s.ReplicationConfig
+}
+
+// UpdateReplicationConfig changes the replication state, readers see the fields changed together at once
+func (s *Server) UpdateReplicationConfig(update func(*ServerReplicationConfig)) {
+	s.replicationLock.Lock()
+	defer s.replicationLock.Unlock()
+	update(&s.ReplicationConfig)
+}
+
+func (s *Server) GetReplicationRole() string {
+	s.replicationLock.RLock()
+	defer s.replicationLock.RUnlock()
+	return s.ReplicationConfig.Role
+}
+
+func (s *Server) GetMasterReplOffset() int {
+	s.replicationLock.RLock()
+	defer s.replicationLock.RUnlock()
+	return s.ReplicationConfig.MasterReplOffset
+}
+
+// AddMasterReplOffset moves the replication offset along by length bytes, returning the new offset
+func (s *Server) AddMasterReplOffset(length int) int {
+	s.replicationLock.Lock()
+	defer s.replicationLock.Unlock()
+	s.ReplicationConfig.MasterReplOffset += length
+	return s.ReplicationConfig.MasterReplOffset
+}
+
+func (s *Server) GetMasterServerAddress() string {
+	s.replicationLock.RLock()
+	defer s.replicationLock.RUnlock()
+	return s.ReplicationConfig.MasterServerAddress
+}
+
 func (s *Server) GetRdbDir() string {
 	return s.ServerConfig.RdbDir
 }
@@ -59,15 +143,128 @@ func (s *Server) GetRdbFileName() string {
 	return s.ServerConfig.DbFileName
 }
 
+func (s *Server) IsAppendOnlyEnabled() bool {
+	return s.ServerConfig.AppendOnly
+}
+
+func (s *Server) GetAppendFsync() string {
+	return s.ServerConfig.AppendFsync
+}
+
+func (s *Server) IsAofLoadTruncatedEnabled() bool {
+	return s.ServerConfig.AofLoadTruncated
+}
+
+func (s *Server) GetReplBacklogSize() int {
+	return s.ServerConfig.ReplBacklogSize
+}
+
+func (s *Server) IsReplDisklessSyncEnabled() bool {
+	return s.ServerConfig.ReplDisklessSync
+}
+
+func (s *Server) GetReplDisklessSyncDelay() time.Duration {
+	return time.Duration(s.ServerConfig.ReplDisklessSyncDelay) * time.Second
+}
+
+func (s *Server) IsReplicaReadOnly() bool {
+	return s.ServerConfig.ReplicaReadOnly
+}
+
+func (s *Server) IsReplicaServeStaleDataEnabled() bool {
+	return s.ServerConfig.ReplicaServeStaleData
+}
+
+func (s *Server) GetMinReplicasToWrite() int {
+	return s.ServerConfig.MinReplicasToWrite
+}
+
+func (s *Server) GetMinReplicasMaxLag() time.Duration {
+	return time.Duration(s.ServerConfig.MinReplicasMaxLag) * time.Second
+}
+
+func (s *Server) IsSentinelEnabled() bool {
+	return s.ServerConfig.Sentinel
+}
+
+func (s *Server) GetSentinelDownAfter() time.Duration {
+	return time.Duration(s.ServerConfig.SentinelDownAfter) * time.Millisecond
+}
+
+func (s *Server) GetSentinelFailoverTimeout() time.Duration {
+	return time.Duration(s.ServerConfig.SentinelFailoverTimeout) * time.Millisecond
+}
+
+func (s *Server) IsClusterEnabled() bool {
+	return s.ServerConfig.ClusterEnabled
+}
+
+func (s *Server) GetClusterConfigPath() string {
+	return filepath.Join(s.ServerConfig.RdbDir, s.ServerConfig.ClusterConfigFile)
+}
+
+func (s *Server) GetClusterNodeTimeout() time.Duration {
+	return time.Duration(s.ServerConfig.ClusterNodeTimeout) * time.Millisecond
+}
+
+func (s *Server) GetProtoMaxBulkLen() int {
+	return s.ServerConfig.ProtoMaxBulkLen
+}
+
+// GetReplicaOutputBufferLimits returns the hard and soft limits of the output pending for a replica, and how
+// long it may stay at or above the soft limit
+func (s *Server) GetReplicaOutputBufferLimits() (int, int, time.Duration) {
+	return s.ServerConfig.ReplicaOutputBufferHardLimit, s.ServerConfig.ReplicaOutputBufferSoftLimit,
+		time.Duration(s.ServerConfig.ReplicaOutputBufferSoftSeconds) * time.Second
+}
+
+func (s *Server) GetAppendFileName() string {
+	return s.ServerConfig.AppendFileName
+}
+
+// GetAppendDirPath returns the directory holding the AOF files, which lives inside the RDB directory
+func (s *Server) GetAppendDirPath() string {
+	rdbDir := s.ServerConfig.RdbDir
+	if len(rdbDir) == 0 {
+		rdbDir = "."
+	}
+	return filepath.Join(rdbDir, s.ServerConfig.AppendDirName)
+}
+
 func initializeServer() *Server {
 	serverObj := Server{}
 	port := flag.String("port", constants.DEFAULT_SERVER_PORT, "Gedis listening port")
 	replicaof := flag.String("replicaof", "", "Master server address")
 	dir := flag.String("dir", "", "RDB File directory")
 	dbFileName := flag.String("dbfilename", "", "RDB file name")
+	appendOnly := flag.String("appendonly", constants.CONFIG_NO, "Enable append only file persistence (yes|no)")
+	appendFsync := flag.String("appendfsync", constants.APPENDFSYNC_EVERYSEC, "When to fsync the append only file (always|everysec|no)")
+	appendFileName := flag.String("appendfilename", constants.DEFAULT_APPEND_FILE_NAME, "Base name of the append only files")
+	appendDirName := flag.String("appenddirname", constants.DEFAULT_APPEND_DIR_NAME, "Directory holding the append only files, relative to dir")
+	replBacklogSize := flag.String("repl-backlog-size", constants.DEFAULT_REPL_BACKLOG_SIZE, "Size of the replication backlog used for partial resyncs, e.g. 1mb")
+	replDisklessSync := flag.String("repl-diskless-sync", constants.CONFIG_NO, "Stream full resync snapshots straight to replica sockets (yes|no)")
+	replDisklessSyncDelay := flag.Int("repl-diskless-sync-delay", constants.DEFAULT_REPL_DISKLESS_SYNC_DELAY, "Seconds to wait for more replicas before a diskless transfer starts")
+	replicaReadOnly := flag.String("replica-read-only", constants.CONFIG_YES, "Reject writes on a replica from clients other than its master (yes|no)")
+	replicaServeStaleData := flag.String("replica-serve-stale-data", constants.CONFIG_YES, "Keep serving data on a replica while its link to the master is down (yes|no)")
+	minReplicasToWrite := flag.Int("min-replicas-to-write", 0, "Refuse writes unless this many replicas are connected with a small enough lag, 0 to disable")
+	minReplicasMaxLag := flag.Int("min-replicas-max-lag", constants.DEFAULT_MIN_REPLICAS_MAX_LAG, "Seconds since its last ACK for a replica to count towards min-replicas-to-write")
+	aofLoadTruncated := flag.String("aof-load-truncated", constants.CONFIG_YES, "Load an AOF cut off mid command by dropping the incomplete command (yes|no)")
+	sentinel := flag.Bool("sentinel", false, "Run as a sentinel, monitoring a master and failing it over")
+	sentinelMonitor := flag.String("sentinel-monitor", "", "Master monitored by a sentinel, as '<name> <host> <port> <quorum>'")
+	sentinelDownAfter := flag.Int("sentinel-down-after-milliseconds", constants.DEFAULT_SENTINEL_DOWN_AFTER, "Milliseconds without a valid reply before a sentinel considers an instance down")
+	sentinelFailoverTimeout := flag.Int("sentinel-failover-timeout", constants.DEFAULT_SENTINEL_FAILOVER_TIMEOUT, "Milliseconds a sentinel failover may take, twice that passes before it is retried")
+	clusterEnabled := flag.String("cluster-enabled", constants.CONFIG_NO, "Run as a cluster node serving the hash slots assigned to it (yes|no)")
+	clusterConfigFile := flag.String("cluster-config-file", constants.DEFAULT_CLUSTER_CONFIG_FILE, "File describing the cluster nodes and their slots, relative to dir")
+	clusterNodeTimeout := flag.Int("cluster-node-timeout", constants.DEFAULT_CLUSTER_NODE_TIMEOUT, "Milliseconds a cluster node may be unreachable before it is considered failing")
+	protoMaxBulkLen := flag.String("proto-max-bulk-len", constants.DEFAULT_PROTO_MAX_BULK_LEN, "Longest bulk string a client may send, e.g. 512mb")
+	clientOutputBufferLimit := flag.String("client-output-buffer-limit", constants.DEFAULT_REPLICA_OUTPUT_BUFFER_LIMIT,
+		"Output pending for a replica before it is disconnected, as 'replica <hard limit> <soft limit> <soft seconds>'")
 	flag.Parse()
 
 	serverObj.ListeningPort = *port
+	if *sentinel && !isFlagSet("port") {
+		serverObj.ListeningPort = constants.DEFAULT_SENTINEL_PORT
+	}
 	serverObj.ReplicaOf = *replicaof
 
 	serverRole := constants.MASTER_ROLE
@@ -83,20 +280,132 @@ func initializeServer() *Server {
 	}
 
 	serverObj.ServerConfig = ServerConfig{
-		RdbDir:     *dir,
-		DbFileName: *dbFileName,
+		RdbDir:                  *dir,
+		DbFileName:              *dbFileName,
+		AppendOnly:              parseYesNo("appendonly", *appendOnly),
+		AppendFsync:             *appendFsync,
+		AppendFileName:          *appendFileName,
+		AppendDirName:           *appendDirName,
+		AofLoadTruncated:        parseYesNo("aof-load-truncated", *aofLoadTruncated),
+		ReplBacklogSize:         parseMemorySize("repl-backlog-size", *replBacklogSize, constants.MIN_REPL_BACKLOG_SIZE),
+		ReplDisklessSync:        parseYesNo("repl-diskless-sync", *replDisklessSync),
+		ReplDisklessSyncDelay:   *replDisklessSyncDelay,
+		ReplicaReadOnly:         parseYesNo("replica-read-only", *replicaReadOnly),
+		ReplicaServeStaleData:   parseYesNo("replica-serve-stale-data", *replicaServeStaleData),
+		MinReplicasToWrite:      *minReplicasToWrite,
+		MinReplicasMaxLag:       *minReplicasMaxLag,
+		Sentinel:                *sentinel,
+		SentinelMonitor:         *sentinelMonitor,
+		SentinelDownAfter:       *sentinelDownAfter,
+		SentinelFailoverTimeout: *sentinelFailoverTimeout,
+		ClusterEnabled:          parseYesNo("cluster-enabled", *clusterEnabled),
+		ClusterConfigFile:       *clusterConfigFile,
+		ClusterNodeTimeout:      *clusterNodeTimeout,
+		ProtoMaxBulkLen:         parseMemorySize("proto-max-bulk-len", *protoMaxBulkLen, constants.MIN_PROTO_MAX_BULK_LEN),
+	}
+	serverObj.ServerConfig.ReplicaOutputBufferHardLimit, serverObj.ServerConfig.ReplicaOutputBufferSoftLimit,
+		serverObj.ServerConfig.ReplicaOutputBufferSoftSeconds = parseReplicaOutputBufferLimit(*clientOutputBufferLimit)
+	if serverObj.ServerConfig.ClusterEnabled && (serverObj.ServerConfig.Sentinel || len(serverObj.ReplicaOf) != 0) {
+		log.Fatalf("cluster-enabled can't be combined with sentinel or replicaof, replicas are set in the cluster config file")
+	}
+	if serverObj.ServerConfig.ClusterNodeTimeout <= 0 {
+		log.Fatalf("Invalid cluster-node-timeout %d, expected a positive number", serverObj.ServerConfig.ClusterNodeTimeout)
+	}
+	if serverObj.ServerConfig.SentinelDownAfter <= 0 || serverObj.ServerConfig.SentinelFailoverTimeout <= 0 {
+		log.Fatalf("Invalid sentinel-down-after-milliseconds %d or sentinel-failover-timeout %d, expected positive numbers",
+			serverObj.ServerConfig.SentinelDownAfter, serverObj.ServerConfig.SentinelFailoverTimeout)
+	}
+	if serverObj.ServerConfig.MinReplicasToWrite < 0 || serverObj.ServerConfig.MinReplicasMaxLag < 0 {
+		log.Fatalf("Invalid min-replicas-to-write %d or min-replicas-max-lag %d, expected non negative numbers",
+			serverObj.ServerConfig.MinReplicasToWrite, serverObj.ServerConfig.MinReplicasMaxLag)
+	}
+	if serverObj.ServerConfig.ReplDisklessSyncDelay < 0 {
+		log.Fatalf("Invalid repl-diskless-sync-delay value %d, expected a number of seconds", serverObj.ServerConfig.ReplDisklessSyncDelay)
+	}
+	switch serverObj.ServerConfig.AppendFsync {
+	case constants.APPENDFSYNC_ALWAYS, constants.APPENDFSYNC_EVERYSEC, constants.APPENDFSYNC_NO:
+	default:
+		log.Fatalf("Invalid appendfsync value '%s', expected always, everysec or no", serverObj.ServerConfig.AppendFsync)
 	}
 
 	serverObj.ServerAddress = fmt.Sprintf("%s:%s", constants.DEFAULT_SERVER_ADDRESS, serverObj.ListeningPort)
 	serverObj.Listener = getListener(serverObj.ServerAddress)
-	// TODO: Update following configurations once communication with master is established
-	serverObj.ReplicationConfig.MasterReplId = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
+	serverObj.ReplicationConfig.MasterReplId = NewReplicationId()
 	serverObj.ReplicationConfig.MasterReplOffset = 0
+	serverObj.ReplicationConfig.MasterReplId2 = constants.EMPTY_REPLICATION_ID
+	serverObj.ReplicationConfig.SecondReplOffeset = -1
 
-	log.Printf("[%s] Server state: %+v", serverObj.ServerAddress, serverObj)
+	log.Printf("[%s] Server state: %+v", serverObj.ServerAddress, &serverObj)
 	return &serverObj
 }
 
+func isFlagSet(name string) bool {
+	flagSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			flagSet = true
+		}
+	})
+	return flagSet
+}
+
+func parseYesNo(configName string, value string) bool {
+	switch strings.ToLower(value) {
+	case constants.CONFIG_YES:
+		return true
+	case constants.CONFIG_NO:
+		return false
+	default:
+		log.Fatalf("Invalid %s value '%s', expected yes or no", configName, value)
+		return false
+	}
+}
+
+// parseMemorySize reads sizes such as 1048576, 16kb or 1mb
+func parseMemorySize(configName string, value string, minimum int) int {
+	units := []struct {
+		suffix     string
+		multiplier int
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+	lowerValue := strings.ToLower(value)
+	multiplier := 1
+	for _, unit := range units {
+		if strings.HasSuffix(lowerValue, unit.suffix) {
+			lowerValue = strings.TrimSuffix(lowerValue, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.Atoi(lowerValue)
+	if err != nil || size*multiplier < minimum {
+		log.Fatalf("Invalid %s value '%s', expected a size of at least %d bytes", configName, value, minimum)
+	}
+	return size * multiplier
+}
+
+// parseReplicaOutputBufferLimit reads 'replica <hard limit> <soft limit> <soft seconds>', where the class may
+// also be called slave. The limits of other client classes aren't enforced
+func parseReplicaOutputBufferLimit(value string) (int, int, int) {
+	fields := strings.Fields(value)
+	if len(fields) != 4 || (!strings.EqualFold(fields[0], constants.CLIENT_CLASS_REPLICA) && !strings.EqualFold(fields[0], constants.CLIENT_CLASS_SLAVE)) {
+		log.Fatalf("Invalid client-output-buffer-limit value '%s', expected 'replica <hard limit> <soft limit> <soft seconds>'", value)
+	}
+	softSeconds, err := strconv.Atoi(fields[3])
+	if err != nil || softSeconds < 0 {
+		log.Fatalf("Invalid client-output-buffer-limit soft seconds '%s', expected a non negative number", fields[3])
+	}
+	return parseMemorySize("client-output-buffer-limit", fields[1], 0), parseMemorySize("client-output-buffer-limit", fields[2], 0), softSeconds
+}
+
+// NewReplicationId returns a random 40 character hex replication ID
+func NewReplicationId() string {
+	idBytes := make([]byte, constants.REPLICATION_ID_LENGTH/2)
+	if _, err := rand.Read(idBytes); err != nil {
+		log.Fatalf("Failed to generate replication ID: %v", err)
+	}
+	return hex.EncodeToString(idBytes)
+}
+
 func getListener(address string) net.Listener {
 	l, err := net.Listen("tcp", address)
 	if err != nil {
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/constants"
+)
+
+// CRC-16/XMODEM (polynomial 0x1021, zero initial value), which Redis cluster uses to map keys to slots
+const CRC16_XMODEM_POLY = 0x1021
+
+var crc16XmodemTable = makeCrc16Table(CRC16_XMODEM_POLY)
+
+func makeCrc16Table(poly uint16) *[256]uint16 {
+	table := new([256]uint16)
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc16Xmodem(data string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(data); i++ {
+		crc = crc16XmodemTable[byte(crc>>8)^data[i]] ^ (crc << 8)
+	}
+	return crc
+}
+
+// KeyHashSlot returns the cluster slot of a key. When the key holds a non empty {hashtag}, only the tag is
+// hashed, so related keys can be kept in the same slot
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16Xmodem(key)) % constants.CLUSTER_SLOTS
+}
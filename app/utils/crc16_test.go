@@ -0,0 +1,29 @@
+package utils
+
+import "testing"
+
+func TestKeyHashSlot(t *testing.T) {
+	if crc := crc16Xmodem("123456789"); crc != 0x31c3 {
+		t.Fatalf("Expected CRC16 check value 0x31c3, Got: %#x", crc)
+	}
+	testCases := []struct {
+		key  string
+		slot int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", 3443},
+		{"{user1000}.followers", 3443},
+		{"user1000", 3443},
+		// The tag runs from the first { to the next }
+		{"foo{{bar}}zap", 4015},
+		// Empty or unterminated tags hash the whole key
+		{"foo{}{bar}", 8363},
+		{"foo{bar", 15278},
+	}
+	for _, testCase := range testCases {
+		if slot := KeyHashSlot(testCase.key); slot != testCase.slot {
+			t.Errorf("Expected slot %d for key %q, Got: %d", testCase.slot, testCase.key, slot)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"math"
 	"strconv"
 
 	"github.com/codecrafters-io/redis-starter-go/app/constants"
@@ -37,6 +38,48 @@ func CreateErrorResponse(data string) constants.DataRepr {
 	return CreateAtomicDataReprFromString(data, constants.ERROR)
 }
 
+func CreateBlobErrorResponse(data string) constants.DataRepr {
+	return CreateAtomicDataReprFromString(data, constants.BLOB_ERROR)
+}
+
+// CreateDoubleResponse formats the value like Redis, with inf, -inf and nan for the special values
+func CreateDoubleResponse(value float64) constants.DataRepr {
+	var formatted string
+	switch {
+	case math.IsInf(value, 1):
+		formatted = "inf"
+	case math.IsInf(value, -1):
+		formatted = "-inf"
+	case math.IsNaN(value):
+		formatted = "nan"
+	default:
+		formatted = strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	return CreateAtomicDataReprFromString(formatted, constants.DOUBLE)
+}
+
+func CreateBooleanResponse(value bool) constants.DataRepr {
+	if value {
+		return CreateAtomicDataReprFromString(constants.BOOLEAN_TRUE, constants.BOOLEAN)
+	}
+	return CreateAtomicDataReprFromString(constants.BOOLEAN_FALSE, constants.BOOLEAN)
+}
+
+func CreateBigNumberResponse(number string) constants.DataRepr {
+	return CreateAtomicDataReprFromString(number, constants.BIG_NUMBER)
+}
+
+// CreateVerbatimResponse creates a verbatim string, the format being 3 characters such as txt or mkd
+func CreateVerbatimResponse(format string, text string) constants.DataRepr {
+	return CreateAtomicDataReprFromString(format+":"+text, constants.VERBATIM)
+}
+
+func NullResponse() constants.DataRepr {
+	return constants.DataRepr{
+		Type: constants.NULL,
+	}
+}
+
 func CreateRdbFileResponse(data []byte) constants.DataRepr {
 	return CreateAtomicDataReprFromByte(data, constants.RDB_FILE)
 }
@@ -65,6 +108,29 @@ func CreateArrayDataRepr(dataArray []constants.DataRepr) constants.DataRepr {
 	}
 }
 
+// CreateMapDataRepr creates a map from its keys and values given alternately
+func CreateMapDataRepr(keyValues []constants.DataRepr) constants.DataRepr {
+	return constants.DataRepr{
+		Type:  constants.MAP,
+		Array: keyValues,
+	}
+}
+
+func CreateSetDataRepr(dataArray []constants.DataRepr) constants.DataRepr {
+	return constants.DataRepr{
+		Type:  constants.SET,
+		Array: dataArray,
+	}
+}
+
+// CreatePushDataRepr creates an out of band message, such as one published to a subscribed channel
+func CreatePushDataRepr(dataArray []constants.DataRepr) constants.DataRepr {
+	return constants.DataRepr{
+		Type:  constants.PUSH,
+		Array: dataArray,
+	}
+}
+
 func NilBulkStringResponse() constants.DataRepr {
 	return constants.DataRepr{
 		Type:  constants.BULK,
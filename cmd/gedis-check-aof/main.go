@@ -0,0 +1,161 @@
+// gedis-check-aof validates append only files and can truncate them to their last valid command.
+//
+// Usage:
+//
+//	gedis-check-aof [--fix] [--yes] <file.aof | file.manifest>
+//
+// Given a manifest every file it lists is checked, but only the last one can be fixed, as it is the
+// only one a crash can leave half written.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/context"
+	"github.com/codecrafters-io/redis-starter-go/app/parser"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+)
+
+type checkResult struct {
+	filePath     string
+	size         int
+	validUpTo    int
+	commandCount int
+	isRdb        bool
+	err          error
+}
+
+func main() {
+	fix := flag.Bool("fix", false, "Truncate the file to the last valid command")
+	yes := flag.Bool("yes", false, "Don't ask for confirmation before fixing")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--fix] [--yes] <file.aof | file.manifest>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	discardLogger := log.New(io.Discard, "", 0)
+	parser.InitBaseParser(&context.Context{Logger: discardLogger})
+
+	filePaths, err := aofFilePaths(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read '%s': %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	for i, filePath := range filePaths {
+		result, err := checkAofFile(filePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read '%s': %v\n", filePath, err)
+			os.Exit(1)
+		}
+		printResult(result)
+		if result.err == nil {
+			continue
+		}
+		isLastFile := i == len(filePaths)-1
+		if result.isRdb {
+			fmt.Printf("'%s' holds an RDB, which can't be fixed by truncating it\n", filePath)
+			os.Exit(1)
+		}
+		if !*fix {
+			fmt.Printf("Run with --fix to truncate '%s' to %d bytes\n", filePath, result.validUpTo)
+			os.Exit(1)
+		}
+		if !isLastFile {
+			fmt.Printf("Only the last AOF file can be fixed, '%s' needs to be repaired by hand\n", filePath)
+			os.Exit(1)
+		}
+		if !*yes && !confirm(fmt.Sprintf("This will shrink '%s' from %d bytes to %d bytes, discarding %d bytes. Continue? [y/N]: ",
+			filePath, result.size, result.validUpTo, result.size-result.validUpTo)) {
+			fmt.Println("AOF not fixed")
+			os.Exit(1)
+		}
+		err = os.Truncate(filePath, int64(result.validUpTo))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to truncate '%s': %v\n", filePath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Successfully truncated '%s' to %d bytes\n", filePath, result.validUpTo)
+	}
+}
+
+// aofFilePaths lists the files to check in load order
+func aofFilePaths(path string) ([]string, error) {
+	if !strings.HasSuffix(path, persistence.AOF_MANIFEST_SUFFIX) {
+		return []string{path}, nil
+	}
+	manifest, err := persistence.LoadAofManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	dirPath := filepath.Dir(path)
+	filePaths := []string{}
+	if manifest.BaseAof != nil {
+		filePaths = append(filePaths, filepath.Join(dirPath, manifest.BaseAof.FileName))
+	}
+	for _, incrAof := range manifest.IncrAofList {
+		filePaths = append(filePaths, filepath.Join(dirPath, incrAof.FileName))
+	}
+	return filePaths, nil
+}
+
+func checkAofFile(filePath string) (*checkResult, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	result := &checkResult{filePath: filePath, size: len(data)}
+	if bytes.HasPrefix(data, []byte(persistence.RDB_MAGIC_STRING)) {
+		// An RDB can't be truncated into a valid state, so it is either fully valid or not at all
+		result.isRdb = true
+		result.err = persistence.ValidateRDBData(data, log.New(io.Discard, "", 0))
+		if result.err == nil {
+			result.validUpTo = len(data)
+		}
+		return result, nil
+	}
+	commands, err := persistence.DecodeAofCommands(data)
+	result.commandCount = len(commands)
+	result.validUpTo = len(data)
+	if err != nil {
+		result.err = err
+		var formatErr *persistence.AofFormatError
+		if errors.As(err, &formatErr) {
+			result.validUpTo = formatErr.Offset
+		}
+	}
+	return result, nil
+}
+
+func printResult(result *checkResult) {
+	fmt.Printf("AOF analyzed: file=%s, size=%d, ok_up_to=%d, commands=%d, diff=%d\n",
+		result.filePath, result.size, result.validUpTo, result.commandCount, result.size-result.validUpTo)
+	switch {
+	case result.err == nil:
+		fmt.Printf("AOF '%s' is valid\n", result.filePath)
+	case persistence.IsAofTruncated(result.err):
+		fmt.Printf("AOF '%s' is truncated: the command at offset %d is incomplete\n", result.filePath, result.validUpTo)
+	default:
+		fmt.Printf("AOF '%s' format error: %v\n", result.filePath, result.err)
+	}
+}
+
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,245 @@
+// gedis-rdb inspects RDB files offline.
+//
+// Usage:
+//
+//	gedis-rdb check <file.rdb>                      validate the file and print its metadata and key statistics
+//	gedis-rdb export <file.rdb> [-o <file.jsonl>]   write every key and value as JSON Lines
+//	gedis-rdb import <file.jsonl> -o <file.rdb>     build an RDB from an export
+//
+// Unlike the server, check and export include keys which have already expired.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+)
+
+const (
+	CHECK_MODE  = "check"
+	EXPORT_MODE = "export"
+	IMPORT_MODE = "import"
+)
+
+type databaseStats struct {
+	keys        int
+	expirable   int
+	expired     int
+	typeCounts  map[string]int
+	minExpireAt *time.Time
+	maxExpireAt *time.Time
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	mode, args := os.Args[1], os.Args[2:]
+	flags := flag.NewFlagSet(mode, flag.ExitOnError)
+	outputPath := flags.String("o", "", "Output file, defaults to stdout for export")
+	// Allow flags both before and after the input file
+	inputPath := ""
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		inputPath, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	if len(inputPath) == 0 && flags.NArg() == 1 {
+		inputPath = flags.Arg(0)
+	}
+	if len(inputPath) == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch mode {
+	case CHECK_MODE:
+		err = checkRdb(inputPath)
+	case EXPORT_MODE:
+		err = exportRdb(inputPath, *outputPath)
+	case IMPORT_MODE:
+		if len(*outputPath) == 0 {
+			fmt.Fprintln(os.Stderr, "import needs an output file given with -o")
+			os.Exit(2)
+		}
+		err = importRdb(inputPath, *outputPath)
+	default:
+		printUsage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", mode, err)
+		os.Exit(1)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n"+
+		"  %[1]s check <file.rdb>\n"+
+		"  %[1]s export <file.rdb> [-o <file.jsonl>]\n"+
+		"  %[1]s import <file.jsonl> -o <file.rdb>\n", os.Args[0])
+}
+
+func readDump(inputPath string) ([]byte, *persistence.RdbDump, error) {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	dump, err := persistence.ReadRDBDump(data, log.New(io.Discard, "", 0))
+	if err != nil {
+		return data, nil, fmt.Errorf("'%s' is not a valid RDB: %v", inputPath, err)
+	}
+	return data, dump, nil
+}
+
+func checkRdb(inputPath string) error {
+	data, dump, err := readDump(inputPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("RDB file: %s (%d bytes)\n", inputPath, len(data))
+	fmt.Printf("Version: %d\n", dump.Version)
+	fmt.Printf("Checksum: %s\n", checksumStatus(data, dump.Version))
+
+	fmt.Println("Aux fields:")
+	auxKeys := make([]string, 0, len(dump.AuxFields))
+	for auxKey := range dump.AuxFields {
+		auxKeys = append(auxKeys, auxKey)
+	}
+	sort.Strings(auxKeys)
+	for _, auxKey := range auxKeys {
+		fmt.Printf("  %s: %s\n", auxKey, formatAuxValue(auxKey, dump.AuxFields[auxKey]))
+	}
+	if len(dump.Functions) > 0 {
+		fmt.Printf("Function libraries: %d\n", len(dump.Functions))
+	}
+
+	dbIndexes := make([]int, 0, len(dump.Databases))
+	for dbIndex := range dump.Databases {
+		dbIndexes = append(dbIndexes, dbIndex)
+	}
+	sort.Ints(dbIndexes)
+	now := time.Now()
+	for _, dbIndex := range dbIndexes {
+		stats := collectStats(dump.Databases[dbIndex], now)
+		fmt.Printf("db%d: keys=%d, expires=%d, already_expired=%d\n", dbIndex, stats.keys, stats.expirable, stats.expired)
+		valueTypes := make([]string, 0, len(stats.typeCounts))
+		for valueType := range stats.typeCounts {
+			valueTypes = append(valueTypes, valueType)
+		}
+		sort.Strings(valueTypes)
+		for _, valueType := range valueTypes {
+			fmt.Printf("  %s: %d\n", valueType, stats.typeCounts[valueType])
+		}
+		if stats.minExpireAt != nil {
+			fmt.Printf("  expiry range: %s .. %s\n", stats.minExpireAt.UTC().Format(time.RFC3339), stats.maxExpireAt.UTC().Format(time.RFC3339))
+		}
+	}
+	fmt.Printf("'%s' is a valid RDB\n", inputPath)
+	return nil
+}
+
+func collectStats(values map[string]persistence.Value, now time.Time) databaseStats {
+	stats := databaseStats{typeCounts: make(map[string]int)}
+	for _, value := range values {
+		stats.keys++
+		stats.typeCounts[value.Type]++
+		if value.ExpirationTime == nil {
+			continue
+		}
+		expireAt := *value.ExpirationTime
+		stats.expirable++
+		if now.After(expireAt) {
+			stats.expired++
+		}
+		if stats.minExpireAt == nil || expireAt.Before(*stats.minExpireAt) {
+			stats.minExpireAt = &expireAt
+		}
+		if stats.maxExpireAt == nil || expireAt.After(*stats.maxExpireAt) {
+			stats.maxExpireAt = &expireAt
+		}
+	}
+	return stats
+}
+
+// checksumStatus describes the trailing checksum, which ReadRDBDump has already verified
+func checksumStatus(data []byte, version int) string {
+	if version < persistence.RDB_CHECKSUM_MIN_VERSION {
+		return "not present before RDB version " + strconv.Itoa(persistence.RDB_CHECKSUM_MIN_VERSION)
+	}
+	checksum := binary.LittleEndian.Uint64(data[len(data)-8:])
+	if checksum == 0 {
+		return "disabled"
+	}
+	return fmt.Sprintf("%016x (ok)", checksum)
+}
+
+func formatAuxValue(auxKey string, auxValue string) string {
+	if auxKey != "ctime" {
+		return auxValue
+	}
+	seconds, err := strconv.ParseInt(auxValue, 10, 64)
+	if err != nil {
+		return auxValue
+	}
+	return fmt.Sprintf("%s (%s)", auxValue, time.Unix(seconds, 0).UTC().Format(time.RFC3339))
+}
+
+func exportRdb(inputPath string, outputPath string) error {
+	_, dump, err := readDump(inputPath)
+	if err != nil {
+		return err
+	}
+	if len(outputPath) == 0 {
+		return persistence.ExportRDBJSONLines(os.Stdout, dump)
+	}
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	err = persistence.ExportRDBJSONLines(outputFile, dump)
+	closeErr := outputFile.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func importRdb(inputPath string, outputPath string) error {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+	dump, err := persistence.ImportRDBJSONLines(inputFile)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a valid export: %v", inputPath, err)
+	}
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	err = persistence.WriteRDBDump(outputFile, dump)
+	closeErr := outputFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	keyCount := 0
+	for _, values := range dump.Databases {
+		keyCount += len(values)
+	}
+	fmt.Printf("Wrote %d keys in %d databases to '%s'\n", keyCount, len(dump.Databases), outputPath)
+	return nil
+}
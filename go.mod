@@ -11,7 +11,8 @@ module github.com/codecrafters-io/redis-starter-go
 go 1.22
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/hashicorp/go-immutable-radix v1.3.1 // indirect
-	github.com/hashicorp/golang-lru v0.5.0 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/hashicorp/go-immutable-radix v1.3.1
 )
+
+require github.com/hashicorp/golang-lru v0.5.0 // indirect